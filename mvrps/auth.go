@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp/backendutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialsFile lists the users allowed to log in to the SMTP and POP3
+// servers, one "address:hash" line per user, where hash is a bcrypt hash of
+// the password, e.g. as created by "htpasswd -nB". The file is reloaded when
+// it changes.
+const credentialsFile = "passwd"
+
+// Certificate and key of the SMTP and POP3 servers. Without them, the servers
+// don't support TLS and refuse to authenticate users.
+const (
+	certFile = "cert.pem"
+	keyFile  = "key.pem"
+)
+
+var errInvalidCredentials = errors.New("Invalid username or password")
+
+var credentials backendutil.ReloadableFile
+
+func loadCredentials(path string) (interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ':')
+		if i < 0 {
+			return nil, errors.New("invalid credentials line: missing colon")
+		}
+		m[strings.ToLower(line[:i])] = []byte(line[i+1:])
+	}
+	return m, scanner.Err()
+}
+
+// authenticate checks the credentials of SMTP and POP3 clients. POP3 users
+// log in with the address of their mailbox.
+func authenticate(username, password string) error {
+	v, err := credentials.Get(credentialsFile, loadCredentials)
+	if err != nil {
+		log.Printf("Error loading credentials: %v", err)
+	}
+	m, _ := v.(map[string][]byte)
+	hash, ok := m[strings.ToLower(username)]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration of the SMTP and POP3 servers, or
+// nil if there's no certificate.
+func tlsConfig() *tls.Config {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Printf("TLS disabled, authentication won't be available: %v", err)
+		return nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
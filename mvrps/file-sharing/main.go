@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"flag"
+	"strings"
 
+	"github.com/emersion/go-smtp/clamav"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -17,6 +19,9 @@ const DiscoveryServiceTag = "gossipsub-file-transceiver"
 func main() {
 	// networkFlag for setting name of creating/joining network group
 	networkFlag := flag.String("network", "test-network", "name of network group")
+	// clamdFlag for scanning received files with clamd, e.g. localhost:3310
+	// or /run/clamav/clamd.ctl
+	clamdFlag := flag.String("clamd", "", "address of clamd to scan received files")
 	flag.Parse()
 
 	ctx := context.Background()
@@ -50,6 +55,14 @@ func main() {
 		panic(err)
 	}
 
+	if *clamdFlag != "" {
+		scanner := &clamav.Client{Addr: *clamdFlag}
+		if strings.HasPrefix(*clamdFlag, "/") {
+			scanner.Network = "unix"
+		}
+		network.Scanner = scanner
+	}
+
 	err = network.Run()
 	if err != nil {
 		panic(err)
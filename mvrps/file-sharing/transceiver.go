@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 
+	"github.com/emersion/go-smtp/clamav"
 	"github.com/libp2p/go-libp2p-core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
@@ -24,6 +26,10 @@ type File struct {
 
 type FileTransceiver struct {
 	ReceivedFile chan *File
+	// Scanner checks received files for viruses before they are stored,
+	// it's the same scanner interface used for SMTP messages. Nil disables
+	// scanning.
+	Scanner clamav.Scanner
 
 	ctx   context.Context
 	ps    *pubsub.PubSub
@@ -151,6 +157,13 @@ func (ft *FileTransceiver) handleEvents() {
 // and store it into the directory that you run this example
 func (ft *FileTransceiver) handleReceivedFile(receivedFile *File) {
 	fmt.Println(receivedFile.SenderPeer, "sent a file:", receivedFile.FileName)
+	if ft.Scanner != nil {
+		// infected files and files that couldn't be scanned are dropped
+		if err := ft.Scanner.Scan(bytes.NewReader(receivedFile.Data)); err != nil {
+			fmt.Println("Discarding", receivedFile.FileName+":", err)
+			return
+		}
+	}
 	file, err := os.Create(receivedFile.FileName)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp/maildir"
+	"github.com/emersion/go-smtp/pop3"
+)
+
+// mailRoot is the local mail store. Each address has a Maildir in it, named
+// after the lower-case address: it's written by the SMTP server and by the
+// publishers, and served by the POP3 server.
+const mailRoot = "mail"
+
+// mailDir returns the Maildir of an address.
+func mailDir(addr string) maildir.Dir {
+	return maildir.Dir(filepath.Join(mailRoot, strings.ToLower(addr)))
+}
+
+// message formats an email as a RFC 5322 message.
+func (e *Email) message() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", (&mail.Address{Address: e.From}).String())
+	fmt.Fprintf(&b, "To: %v\r\n", (&mail.Address{Address: e.To}).String())
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(e.Subject), " ")))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	body := strings.Replace(e.Body, "\r\n", "\n", -1)
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+// deliverEmail stores an email in the Maildir of a subscriber, so that it
+// can be fetched over POP3.
+func deliverEmail(subscriber *Subscriber, email Email) error {
+	d := mailDir(subscriber.Email)
+	if err := d.Init(); err != nil {
+		return err
+	}
+	_, err := d.Deliver(bytes.NewReader(email.message()), nil)
+	return err
+}
+
+// createPOP3Server creates a POP3 server serving the Maildirs of the mail
+// store. Users log in with their address, over TLS.
+func createPOP3Server() *pop3.Server {
+	s := pop3.NewServer(&pop3.MaildirBackend{
+		Root:         mailRoot,
+		Authenticate: authenticate,
+	})
+
+	s.Addr = "localhost:1110"
+	s.WriteTimeout = 10 * time.Second
+	s.ReadTimeout = 10 * time.Minute
+	s.TLSConfig = tlsConfig()
+
+	return s
+}
+
+func pop3Server(publisher *Publisher) {
+	log.Println("Starting POP3 server at", publisher.POP3.Addr)
+	log.Fatal(publisher.POP3.ListenAndServe())
+}
@@ -7,13 +7,14 @@ import (
 	"net/http"
 	"strings"
 	"sync"
-	"errors"
 	"io"
 	"io/ioutil"
 	"time"
 	"os/exec"
 
 	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/maildir"
+	"github.com/emersion/go-smtp/pop3"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -39,6 +40,7 @@ type Email struct {
 type Publisher struct {
 	ID       string
 	SMTP     *smtp.Server
+	POP3     *pop3.Server
 	Pubsub   *Pubsub
 	Emails   chan Email
 	MvrpURLs chan string
@@ -103,10 +105,7 @@ func (ps *Pubsub) getSubscriber(email string) (*Subscriber, bool) {
 
 // AuthPlain implements authentication using SASL PLAIN.
 func (s *Session) AuthPlain(username, password string) error {
-	if username != "username" || password != "password" {
-		return errors.New("Invalid username or password")
-	}
-	return nil
+	return authenticate(username, password)
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
@@ -136,19 +135,21 @@ func (s *Session) Logout() error {
 
 // ExampleServer runs an example SMTP server.
 //
-// It can be tested manually with e.g. telnet:
+// It can be tested manually with e.g. openssl, users are listed in
+// credentialsFile:
 //
-//	> telnet localhost 1025
+//	> openssl s_client -starttls smtp -connect localhost:1025
 //	EHLO localhost
 //	AUTH PLAIN
-//	AHVzZXJuYW1lAHBhc3N3b3Jk
+//	<base64 of "\x00username\x00password">
 //	MAIL FROM:<root@nsa.gov>
 //	RCPT TO:<root@gchq.gov.uk>
 //	DATA
 //	Hey <3
 //	.
 func createSMTPServer() *smtp.Server {
-	be := &Backend{}
+	// Messages are delivered to the mail store, served over POP3
+	be := &maildir.Backend{Root: mailRoot, AuthPlain: authenticate}
 
 	s := smtp.NewServer(be)
 
@@ -158,7 +159,7 @@ func createSMTPServer() *smtp.Server {
 	s.ReadTimeout = 10 * time.Second
 	s.MaxMessageBytes = 1024 * 1024
 	s.MaxRecipients = 50
-	s.AllowInsecureAuth = true
+	s.TLSConfig = tlsConfig()
 
 	log.Println("Starting server at", s.Addr)
 	if err := s.ListenAndServe(); err != nil {
@@ -184,6 +185,7 @@ func createPublisher() *Publisher {
 	publisher := &Publisher{
 		ID:       id,
 		SMTP:     createSMTPServer(),
+		POP3:     createPOP3Server(),
 		Pubsub:   pubsub,
 		Emails:   make(chan Email),
 		MvrpURLs: make(chan string),
@@ -198,6 +200,9 @@ func createPublisher() *Publisher {
 	// Run SMTP server concurrently
 	go smtpServer(publisher)
 
+	// Run POP3 server concurrently
+	go pop3Server(publisher)
+
 	// Process emails concurrently
 	go func() {
 		for {
@@ -205,6 +210,9 @@ func createPublisher() *Publisher {
 			case email := <-publisher.Emails:
 				// Process incoming emails, e.g., forward to subscribers
 				for _, subscriber := range pubsub.Subscribers {
+					if err := deliverEmail(subscriber, email); err != nil {
+						log.Printf("Error delivering email to %s: %v", subscriber.Email, err)
+					}
 					subscriber.Messages <- email
 				}
 			case mvrpURL := <-publisher.MvrpURLs:
@@ -236,6 +244,9 @@ func createSubscriber(id int) *Subscriber {
 	log.Printf("Command output:\n%s", output)
 
 	email := fmt.Sprintf("abc_%d@x.com", id)
+	if err := mailDir(email).Init(); err != nil {
+		log.Fatal(err)
+	}
 	return &Subscriber{
 		ID:       fmt.Sprintf("subscriber%d", id),
 		Email:    email,
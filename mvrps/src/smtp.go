@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// SMTPProtocol is the protocol ID used to exchange mail between nodes.
+const SMTPProtocol = protocol.ID("/muvor/smtp/1.0.0")
+
+// StreamAddr is the address of one end of a libp2p stream. Streams are
+// authenticated by the libp2p security transport, so Peer can be trusted,
+// e.g. by a smtp.Backend checking c.Conn().RemoteAddr().
+type StreamAddr struct {
+	Peer peer.ID
+	Addr multiaddr.Multiaddr
+}
+
+func (a *StreamAddr) Network() string {
+	return "libp2p"
+}
+
+func (a *StreamAddr) String() string {
+	return a.Peer.Pretty()
+}
+
+// streamConn turns a libp2p stream into a net.Conn.
+type streamConn struct {
+	network.Stream
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	conn := c.Stream.Conn()
+	return &StreamAddr{Peer: conn.LocalPeer(), Addr: conn.LocalMultiaddr()}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	conn := c.Stream.Conn()
+	return &StreamAddr{Peer: conn.RemotePeer(), Addr: conn.RemoteMultiaddr()}
+}
+
+// StreamListener is a net.Listener accepting libp2p streams for a protocol.
+// It can be passed to smtp.Server.Serve to run a SMTP server over a libp2p
+// host.
+type StreamListener struct {
+	host     host.Host
+	protocol protocol.ID
+	streams  chan network.Stream
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// ListenStreams registers a stream handler for the protocol on the host and
+// returns a listener accepting the incoming streams.
+func ListenStreams(h host.Host, proto protocol.ID) *StreamListener {
+	l := &StreamListener{
+		host:     h,
+		protocol: proto,
+		streams:  make(chan network.Stream),
+		closed:   make(chan struct{}),
+	}
+	h.SetStreamHandler(proto, func(s network.Stream) {
+		select {
+		case l.streams <- s:
+		case <-l.closed:
+			s.Reset()
+		}
+	})
+	return l
+}
+
+// Accept waits for the next incoming stream.
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.streams:
+		return &streamConn{s}, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close removes the stream handler. Pending streams are reset.
+func (l *StreamListener) Close() error {
+	l.once.Do(func() {
+		l.host.RemoveStreamHandler(l.protocol)
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the address of the local peer.
+func (l *StreamListener) Addr() net.Addr {
+	return &StreamAddr{Peer: l.host.ID()}
+}
+
+// DialStream opens a stream for the protocol to a peer, and returns it as a
+// net.Conn. The host must know the addresses of the peer, or be able to
+// discover them (e.g. with the DHT).
+func DialStream(ctx context.Context, h host.Host, id peer.ID, proto protocol.ID) (net.Conn, error) {
+	s, err := h.NewStream(ctx, id, proto)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{s}, nil
+}
+
+// DialSMTP connects a SMTP client to a peer. Streams are already encrypted
+// and authenticated, so the client doesn't need STARTTLS.
+func DialSMTP(ctx context.Context, h host.Host, id peer.ID) (*smtp.Client, error) {
+	conn, err := DialStream(ctx, h, id, SMTPProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return smtp.NewClient(conn)
+}
+
+// ServeSMTP runs a SMTP server over the host's streams, until the server is
+// closed. Since connections aren't using TLS, the server must allow insecure
+// authentication if it requires authentication at all.
+func ServeSMTP(h host.Host, s *smtp.Server) error {
+	return s.Serve(ListenStreams(h, SMTPProtocol))
+}
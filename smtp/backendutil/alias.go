@@ -0,0 +1,328 @@
+package backendutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Maximum depth of nested aliases.
+const maxAliasDepth = 20
+
+// Separator between the user and the detail parts of a subaddress, as in
+// user+detail@example.org.
+const subaddressSeparator = "+"
+
+var errAliasUnknownRcpt = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user here",
+}
+
+var errAliasLoop = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Alias loop detected",
+}
+
+// AliasMap maps virtual addresses to mailboxes.
+//
+// An alias map is read from a text file. Each line contains an address,
+// optionally followed by a list of targets separated by commas or spaces. An
+// address without targets is a mailbox, an address with targets is an alias.
+// An address of the form "@domain" is a catch-all for the domain. Targets can
+// be mailboxes, other aliases or addresses in external domains. Empty lines
+// and lines starting with "#" are ignored.
+//
+//	alice@example.org
+//	bob@example.org
+//	postmaster@example.org  alice@example.org
+//	team@example.org        alice@example.org, bob@example.org
+//	@example.org            alice@example.org
+//
+// Lookups are case-insensitive. An address of the form user+detail@domain
+// matches user@domain if it isn't listed itself.
+type AliasMap struct {
+	mailboxes map[string]bool
+	aliases   map[string][]string
+	domains   map[string]bool
+}
+
+func splitAliasAddress(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// ParseAliasMap parses an alias map.
+func ParseAliasMap(r io.Reader) (*AliasMap, error) {
+	m := &AliasMap{
+		mailboxes: make(map[string]bool),
+		aliases:   make(map[string][]string),
+		domains:   make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		key := strings.ToLower(fields[0])
+		_, domain, ok := splitAliasAddress(key)
+		if !ok {
+			return nil, fmt.Errorf("backendutil: alias map line %v: invalid address %q", lineno, fields[0])
+		}
+		if m.mailboxes[key] || m.aliases[key] != nil {
+			return nil, fmt.Errorf("backendutil: alias map line %v: duplicate address %q", lineno, fields[0])
+		}
+		m.domains[domain] = true
+
+		if len(fields) == 1 {
+			if strings.HasPrefix(key, "@") {
+				return nil, fmt.Errorf("backendutil: alias map line %v: catch-all %q has no target", lineno, fields[0])
+			}
+			m.mailboxes[key] = true
+			continue
+		}
+
+		targets := make([]string, 0, len(fields)-1)
+		for _, target := range fields[1:] {
+			if local, _, ok := splitAliasAddress(target); !ok || local == "" {
+				return nil, fmt.Errorf("backendutil: alias map line %v: invalid target %q", lineno, target)
+			}
+			targets = append(targets, strings.ToLower(target))
+		}
+		m.aliases[key] = targets
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// LoadAliasMap reads an alias map from a file.
+func LoadAliasMap(path string) (*AliasMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseAliasMap(f)
+}
+
+// lookup returns the key matching an address, or an empty string.
+func (m *AliasMap) lookup(addr string) string {
+	local, domain, _ := splitAliasAddress(addr)
+
+	keys := []string{addr}
+	if i := strings.Index(local, subaddressSeparator); i > 0 {
+		keys = append(keys, local[:i]+"@"+domain)
+	}
+	keys = append(keys, "@"+domain)
+
+	for _, key := range keys {
+		if m.mailboxes[key] || m.aliases[key] != nil {
+			return key
+		}
+	}
+	return ""
+}
+
+func (m *AliasMap) resolve(addr string, path []string, out []string) ([]string, error) {
+	if _, domain, ok := splitAliasAddress(addr); !ok {
+		return nil, errAliasUnknownRcpt
+	} else if !m.domains[domain] {
+		// Address in an external domain
+		return append(out, addr), nil
+	}
+
+	key := m.lookup(addr)
+	if key == "" {
+		return nil, errAliasUnknownRcpt
+	}
+	if m.mailboxes[key] {
+		return append(out, key), nil
+	}
+
+	for _, k := range path {
+		if k == key {
+			return nil, errAliasLoop
+		}
+	}
+	if len(path) >= maxAliasDepth {
+		return nil, errAliasLoop
+	}
+	path = append(path, key)
+
+	for _, target := range m.aliases[key] {
+		if target == key {
+			// An alias listing itself delivers to the address as-is
+			out = append(out, key)
+			continue
+		}
+
+		var err error
+		if out, err = m.resolve(target, path, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Resolve expands an address to the list of its final destinations:
+// mailboxes and addresses in external domains.
+//
+// An error is returned if the address is unknown, or if aliases form a loop.
+// Addresses in domains not listed in the map are unknown.
+func (m *AliasMap) Resolve(addr string) ([]string, error) {
+	addr = strings.ToLower(addr)
+	if _, domain, ok := splitAliasAddress(addr); !ok || !m.domains[domain] {
+		return nil, errAliasUnknownRcpt
+	}
+
+	l, err := m.resolve(addr, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(l))
+	out := l[:0]
+	for _, addr := range l {
+		if !seen[addr] {
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	return out, nil
+}
+
+// AliasBackend is a backend that resolves recipients with an alias map.
+//
+// Unknown recipients are rejected at RCPT time. Known recipients are replaced
+// with their final destinations before being passed to the underlying
+// backend.
+type AliasBackend struct {
+	Backend smtp.Backend
+
+	// Path of the alias map file. The file is reloaded when it changes. If
+	// the new file can't be loaded, the previous alias map is kept.
+	Path string
+	// Logger used to report errors while reloading the alias map. If nil,
+	// errors are not reported.
+	ErrorLog smtp.Logger
+
+	file ReloadableFile
+}
+
+func loadAliasMap(path string) (interface{}, error) {
+	return LoadAliasMap(path)
+}
+
+// Load loads the alias map file, replacing the current alias map.
+func (be *AliasBackend) Load() error {
+	_, err := be.file.Load(be.Path, loadAliasMap)
+	return err
+}
+
+// aliasMap returns the current alias map, reloading the file if it has
+// changed.
+func (be *AliasBackend) aliasMap() (*AliasMap, error) {
+	v, err := be.file.Get(be.Path, loadAliasMap)
+	if v == nil {
+		return nil, err
+	} else if err != nil && be.ErrorLog != nil {
+		be.ErrorLog.Printf("failed to reload alias map: %v", err)
+	}
+	return v.(*AliasMap), nil
+}
+
+func (be *AliasBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	m, err := be.aliasMap()
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &aliasSession{Session: sess, m: m}, nil
+}
+
+type aliasSession struct {
+	Session smtp.Session
+
+	m     *AliasMap
+	rcpts map[string]bool
+}
+
+func (s *aliasSession) Reset() {
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *aliasSession) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *aliasSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.rcpts = nil
+	return s.Session.Mail(from, opts)
+}
+
+// Rcpt passes the final destinations of a recipient to the underlying
+// session. Destinations already added to the transaction are skipped. The
+// recipient is accepted if at least one destination is accepted.
+func (s *aliasSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	l, err := s.m.Resolve(to)
+	if err != nil {
+		return err
+	}
+
+	if s.rcpts == nil {
+		s.rcpts = make(map[string]bool)
+	}
+
+	var rcptErr error
+	accepted := false
+	for _, addr := range l {
+		if s.rcpts[addr] {
+			accepted = true
+			continue
+		}
+		if err := s.Session.Rcpt(addr, opts); err != nil {
+			if rcptErr == nil {
+				rcptErr = err
+			}
+			continue
+		}
+		s.rcpts[addr] = true
+		accepted = true
+	}
+	if !accepted {
+		return rcptErr
+	}
+	return nil
+}
+
+func (s *aliasSession) Data(r io.Reader) error {
+	return s.Session.Data(r)
+}
+
+func (s *aliasSession) Logout() error {
+	return s.Session.Logout()
+}
@@ -0,0 +1,155 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.AliasBackend{}
+
+const testAliasMap = `# Mailboxes
+alice@example.org
+bob@example.org
+
+postmaster@example.org  alice@example.org
+team@example.org        alice@example.org, bob@example.org
+all@example.org         team@example.org bob@example.org
+archive@example.org     archive@example.org, carol@example.net
+loop1@example.org       loop2@example.org
+loop2@example.org       loop1@example.org
+@example.com            Bob@example.org
+`
+
+func TestAliasMap_Resolve(t *testing.T) {
+	m, err := backendutil.ParseAliasMap(strings.NewReader(testAliasMap))
+	if err != nil {
+		t.Fatalf("ParseAliasMap() = %v", err)
+	}
+
+	tests := []struct {
+		addr string
+		want []string
+		code int
+	}{
+		{addr: "alice@example.org", want: []string{"alice@example.org"}},
+		{addr: "Alice@Example.ORG", want: []string{"alice@example.org"}},
+		{addr: "alice+lists@example.org", want: []string{"alice@example.org"}},
+		{addr: "postmaster@example.org", want: []string{"alice@example.org"}},
+		{addr: "all@example.org", want: []string{"alice@example.org", "bob@example.org"}},
+		{addr: "archive@example.org", want: []string{"archive@example.org", "carol@example.net"}},
+		{addr: "anyone@example.com", want: []string{"bob@example.org"}},
+		{addr: "nobody@example.org", code: 550},
+		{addr: "alice@example.net", code: 550},
+		{addr: "loop1@example.org", code: 554},
+	}
+	for _, tc := range tests {
+		got, err := m.Resolve(tc.addr)
+		if tc.code != 0 {
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != tc.code {
+				t.Errorf("Resolve(%q) = %v, want a %v error", tc.addr, err, tc.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q) = %v", tc.addr, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Resolve(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestParseAliasMap_invalid(t *testing.T) {
+	tests := []string{
+		"not-an-address\n",
+		"alice@example.org\nALICE@example.org\n",
+		"@example.org\n",
+		"alice@example.org @example.net\n",
+	}
+	for _, s := range tests {
+		if _, err := backendutil.ParseAliasMap(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseAliasMap(%q) = nil, want an error", s)
+		}
+	}
+}
+
+func TestAliasBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-alias-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "virtual")
+	if err := ioutil.WriteFile(path, []byte(testAliasMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	be := new(backend)
+	abe := &backendutil.AliasBackend{Backend: be, Path: path}
+	if err := abe.Load(); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(abe)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	sendMail := func(to ...string) error {
+		c, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.SendMail("root@nsa.gov", to, strings.NewReader("Hey <3\r\n"))
+	}
+
+	if err := sendMail("team@example.org", "alice+foo@example.org"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	if want := []string{"alice@example.org", "bob@example.org"}; !reflect.DeepEqual(be.anonmsgs[0].To, want) {
+		t.Errorf("Invalid recipients: %v, want %v", be.anonmsgs[0].To, want)
+	}
+
+	err = sendMail("nobody@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+		t.Fatalf("SendMail(unknown) = %v, want 550 5.1.1", err)
+	}
+
+	// Hot reload
+	newMap := testAliasMap + "nobody@example.org alice@example.org\n"
+	if err := ioutil.WriteFile(path, []byte(newMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMail("nobody@example.org"); err != nil {
+		t.Fatalf("SendMail() after reload = %v", err)
+	}
+
+	// Invalid files don't replace the current map
+	if err := ioutil.WriteFile(path, []byte("invalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMail("nobody@example.org"); err != nil {
+		t.Fatalf("SendMail() after invalid reload = %v", err)
+	}
+}
@@ -0,0 +1,536 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Default minimum interval between two replies to the same sender, as
+// recommended in RFC 3834 section 2.
+const defaultAutoReplyInterval = 7 * 24 * time.Hour
+
+// Maximum size of the header read to decide whether to reply.
+const maxAutoReplyHeaderSize = 64 * 1024
+
+// AutoReply is the auto-reply configuration of a recipient.
+type AutoReply struct {
+	// Subject of replies. Defaults to "Auto: " followed by the subject of
+	// the original message.
+	Subject string `json:"subject,omitempty"`
+	// Plain text body of replies.
+	Body string `json:"body"`
+	// From header field of replies. Defaults to the recipient address.
+	From string `json:"from,omitempty"`
+	// Minimum interval between two replies to the same sender. Defaults to
+	// 7 days.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Period during which replies are sent, e.g. for a vacation. Zero values
+	// mean no bound.
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+func (ar *AutoReply) active(now time.Time) bool {
+	if !ar.Start.IsZero() && now.Before(ar.Start) {
+		return false
+	}
+	if !ar.End.IsZero() && !now.Before(ar.End) {
+		return false
+	}
+	return true
+}
+
+func (ar *AutoReply) interval() time.Duration {
+	if ar.Interval <= 0 {
+		return defaultAutoReplyInterval
+	}
+	return ar.Interval
+}
+
+// AutoReplyBackend is a backend which sends auto-replies, e.g. vacation
+// notices, on behalf of recipients, following RFC 3834.
+//
+// Once a message has been accepted by the underlying backend, a reply is
+// sent to the envelope sender for each recipient with an active
+// configuration, unless:
+//
+//   - the reverse-path is null or looks like a list or system address,
+//   - the message has an Auto-Submitted header field other than "no",
+//   - the message comes from a mailing list (List-* header fields) or has
+//     a bulk, list or junk Precedence,
+//   - the recipient isn't in the To, Cc or Bcc header fields,
+//   - a reply has already been sent from the recipient to the sender
+//     during the configured interval. Replies which fail to be sent aren't
+//     taken into account.
+//
+// Replies are sent in the background, so that the client doesn't wait for
+// them. Wait can be used to wait for pending replies, e.g. before exiting.
+//
+// Replies have an Auto-Submitted: auto-replied header field and a null
+// reverse-path, so that they don't trigger other auto-replies or bounces.
+//
+// Configurations can be changed at runtime with SetAutoReply, or with the
+// HTTP API served by ServeHTTP:
+//
+//	GET    /            List configurations
+//	GET    /<address>   Get the configuration of a recipient
+//	PUT    /<address>   Set the configuration of a recipient (JSON AutoReply)
+//	DELETE /<address>   Remove the configuration of a recipient
+type AutoReplyBackend struct {
+	Backend smtp.Backend
+
+	// Opens a connection to the server used to send replies.
+	Dial func() (*smtp.Client, error)
+	// Logger used to report errors while sending replies. If nil, errors
+	// are not reported.
+	ErrorLog smtp.Logger
+	// Used to get the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mutex   sync.Mutex
+	replies map[string]*AutoReply
+	sent    map[string]time.Time // reply key -> time after which to reply again
+	pending sync.WaitGroup
+}
+
+// Wait waits for the replies being sent to complete.
+func (be *AutoReplyBackend) Wait() {
+	be.pending.Wait()
+}
+
+func (be *AutoReplyBackend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+// SetAutoReply sets the configuration of a recipient.
+func (be *AutoReplyBackend) SetAutoReply(rcpt string, ar *AutoReply) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	if be.replies == nil {
+		be.replies = make(map[string]*AutoReply)
+	}
+	v := *ar
+	be.replies[strings.ToLower(rcpt)] = &v
+}
+
+// RemoveAutoReply removes the configuration of a recipient.
+func (be *AutoReplyBackend) RemoveAutoReply(rcpt string) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	delete(be.replies, strings.ToLower(rcpt))
+}
+
+// AutoReply returns the configuration of a recipient.
+func (be *AutoReplyBackend) AutoReply(rcpt string) (*AutoReply, bool) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	ar, ok := be.replies[strings.ToLower(rcpt)]
+	if !ok {
+		return nil, false
+	}
+	v := *ar
+	return &v, true
+}
+
+// AutoReplies returns all configurations, indexed by recipient.
+func (be *AutoReplyBackend) AutoReplies() map[string]*AutoReply {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	m := make(map[string]*AutoReply, len(be.replies))
+	for rcpt, ar := range be.replies {
+		v := *ar
+		m[rcpt] = &v
+	}
+	return m
+}
+
+// shouldReply checks whether a reply should be sent from rcpt to sender, and
+// records the reply if so. The reply must be forgotten if it can't be sent.
+func (be *AutoReplyBackend) shouldReply(rcpt, sender string) (*AutoReply, bool) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+
+	now := be.now()
+	ar, ok := be.replies[strings.ToLower(rcpt)]
+	if !ok || !ar.active(now) {
+		return nil, false
+	}
+
+	for k, t := range be.sent {
+		if !now.Before(t) {
+			delete(be.sent, k)
+		}
+	}
+	key := autoReplyKey(rcpt, sender)
+	if _, ok := be.sent[key]; ok {
+		return nil, false
+	}
+	if be.sent == nil {
+		be.sent = make(map[string]time.Time)
+	}
+	be.sent[key] = now.Add(ar.interval())
+
+	v := *ar
+	return &v, true
+}
+
+// forgetReply removes a reply recorded by shouldReply.
+func (be *AutoReplyBackend) forgetReply(rcpt, sender string) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	delete(be.sent, autoReplyKey(rcpt, sender))
+}
+
+func autoReplyKey(rcpt, sender string) string {
+	return strings.ToLower(rcpt) + "\x00" + strings.ToLower(sender)
+}
+
+// ServeHTTP serves the configuration API.
+func (be *AutoReplyBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcpt := strings.Trim(r.URL.Path, "/")
+	if rcpt == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAutoReplyJSON(w, be.AutoReplies())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ar, ok := be.AutoReply(rcpt)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeAutoReplyJSON(w, ar)
+	case http.MethodPut:
+		var ar AutoReply
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		be.SetAutoReply(rcpt, &ar)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		be.RemoveAutoReply(rcpt)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeAutoReplyJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (be *AutoReplyBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &autoReplySession{Session: s, be: be}, nil
+}
+
+// CanAutoReply reports whether an automatic reply can be sent to a message
+// with the specified reverse-path and header, as described in RFC 3834
+// section 2: the reverse-path must not be null nor look like a list or
+// system address, and the message must not have been sent automatically or
+// by a mailing list.
+func CanAutoReply(sender string, h textproto.MIMEHeader) bool {
+	local := sender
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		local = sender[:i]
+	}
+	local = strings.ToLower(local)
+	switch {
+	case local == "":
+		return false
+	case local == "mailer-daemon", local == "postmaster", local == "listserv", local == "majordomo":
+		return false
+	case strings.HasPrefix(local, "owner-"), strings.HasSuffix(local, "-request"), strings.HasSuffix(local, "-owner"):
+		return false
+	}
+
+	if v := strings.TrimSpace(h.Get("Auto-Submitted")); v != "" && !strings.EqualFold(v, "no") {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for k := range h {
+		if strings.HasPrefix(k, "List-") {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAddressedTo reports whether one of the addresses appears in the To, Cc,
+// Bcc, Resent-To or Resent-Cc header fields. RFC 3834 section 2 recommends
+// not replying to other messages, e.g. the ones received via a list or an
+// alias.
+func IsAddressedTo(h textproto.MIMEHeader, addrs []string) bool {
+	for _, k := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		for _, v := range h[k] {
+			l, err := mail.ParseAddressList(v)
+			if err != nil {
+				continue
+			}
+			for _, a := range l {
+				for _, addr := range addrs {
+					if strings.EqualFold(a.Address, addr) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// AutoReplyMessage is an automatic reply, as described in RFC 3834
+// section 3.
+type AutoReplyMessage struct {
+	// From header field, e.g. "Alice <alice@example.org>".
+	From string
+	// Address the reply is sent to, the reverse-path of the original
+	// message.
+	To string
+	// Subject of the reply. Defaults to "Auto: " followed by the subject of
+	// the original message.
+	Subject string
+	Date    time.Time
+	// Plain text body of the reply. If MIME is set, it's a MIME entity
+	// instead, starting with its header fields.
+	Body string
+	MIME bool
+}
+
+// Format formats a reply to a message with the header h. Plain text bodies
+// are quoted-printable encoded, so that replies can be sent to servers
+// which don't support 8BITMIME.
+func (m *AutoReplyMessage) Format(h textproto.MIMEHeader) ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("backendutil: invalid auto-reply From address: %v", err)
+	}
+	subject := m.Subject
+	if subject == "" {
+		var dec mime.WordDecoder
+		orig, err := dec.DecodeHeader(h.Get("Subject"))
+		if err != nil {
+			orig = h.Get("Subject")
+		}
+		subject = "Auto: " + orig
+	}
+	// Line breaks aren't encoded by QEncoding
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(from.Address, "@"); i >= 0 {
+		domain = from.Address[i+1:]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", from.String())
+	fmt.Fprintf(&b, "To: %v\r\n", (&mail.Address{Address: m.To}).String())
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", m.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%v@%v>\r\n", hex.EncodeToString(id[:]), domain)
+	if msgID := strings.TrimSpace(h.Get("Message-Id")); msgID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %v\r\n", msgID)
+		refs := strings.TrimSpace(h.Get("References"))
+		if refs != "" {
+			refs += " "
+		}
+		fmt.Fprintf(&b, "References: %v\r\n", refs+msgID)
+	}
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	body := strings.Replace(m.Body, "\r\n", "\n", -1)
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	body = strings.Replace(body, "\n", "\r\n", -1)
+	if m.MIME {
+		b.WriteString(body)
+		return b.Bytes(), nil
+	}
+
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	b.WriteString("\r\n")
+	qw := quotedprintable.NewWriter(&b)
+	if _, err := io.WriteString(qw, body); err != nil {
+		return nil, err
+	}
+	if err := qw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Send sends the reply with a null reverse-path, which prevents bounces and
+// loops. 8-bit MIME entities are downgraded if the server doesn't support
+// 8BITMIME.
+func (m *AutoReplyMessage) Send(c *smtp.Client, msg []byte) error {
+	c.Downgrade8BitMIME = true
+	if err := c.SendMail("", []string{m.To}, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+type autoReplySession struct {
+	Session smtp.Session
+	be      *AutoReplyBackend
+
+	from  string
+	rcpts []string
+}
+
+func (s *autoReplySession) Reset() {
+	s.from = ""
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *autoReplySession) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *autoReplySession) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.from = from
+	s.rcpts = nil
+	return nil
+}
+
+func (s *autoReplySession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+// headerBuffer keeps the beginning of a message.
+type headerBuffer struct {
+	bytes.Buffer
+}
+
+func (b *headerBuffer) Write(p []byte) (int, error) {
+	if n := maxAutoReplyHeaderSize - b.Len(); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.Buffer.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+func (s *autoReplySession) Data(r io.Reader) error {
+	var buf headerBuffer
+	if err := s.Session.Data(io.TeeReader(r, &buf)); err != nil {
+		return err
+	}
+
+	h, err := textproto.NewReader(bufio.NewReader(&buf)).ReadMIMEHeader()
+	if err != nil || !CanAutoReply(s.from, h) {
+		return nil
+	}
+
+	for _, rcpt := range s.rcpts {
+		if !IsAddressedTo(h, []string{rcpt}) {
+			continue
+		}
+		ar, ok := s.be.shouldReply(rcpt, s.from)
+		if !ok {
+			continue
+		}
+		if err := s.reply(rcpt, ar, h); err != nil {
+			s.be.replyFailed(rcpt, s.from, err)
+		}
+	}
+	return nil
+}
+
+// replyFailed forgets a reply which couldn't be sent, so that the next
+// message triggers another attempt.
+func (be *AutoReplyBackend) replyFailed(rcpt, sender string, err error) {
+	be.forgetReply(rcpt, sender)
+	if be.ErrorLog != nil {
+		be.ErrorLog.Printf("failed to send auto-reply from <%v> to <%v>: %v", rcpt, sender, err)
+	}
+}
+
+func (s *autoReplySession) Logout() error {
+	return s.Session.Logout()
+}
+
+// reply formats a reply and sends it in the background.
+func (s *autoReplySession) reply(rcpt string, ar *AutoReply, h textproto.MIMEHeader) error {
+	// AutoReply.From is a header field value, it may contain a display name
+	from := ar.From
+	if from == "" {
+		from = (&mail.Address{Address: rcpt}).String()
+	}
+	m := &AutoReplyMessage{
+		From:    from,
+		To:      s.from,
+		Subject: ar.Subject,
+		Date:    s.be.now(),
+		Body:    ar.Body,
+	}
+	msg, err := m.Format(h)
+	if err != nil {
+		return err
+	}
+
+	be := s.be
+	be.pending.Add(1)
+	go func() {
+		defer be.pending.Done()
+
+		c, err := be.Dial()
+		if err == nil {
+			defer c.Close()
+			err = m.Send(c, msg)
+		}
+		if err != nil {
+			be.replyFailed(rcpt, m.To, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,134 @@
+package backendutil_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestAutoReplyBackend(t *testing.T) {
+	outbox := &backend{}
+	obs := smtp.NewServer(outbox)
+	obs.Domain = "outbox"
+	outboxAddr := serve(t, obs)
+	defer obs.Close()
+
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	outboxDown := false
+	be := &backend{}
+	arbe := &backendutil.AutoReplyBackend{
+		Backend: be,
+		Dial: func() (*smtp.Client, error) {
+			if outboxDown {
+				return nil, errors.New("outbox down")
+			}
+			return smtp.Dial(outboxAddr)
+		},
+		Now: func() time.Time { return now },
+	}
+	s := smtp.NewServer(arbe)
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	ts := httptest.NewServer(arbe)
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/root@gchq.gov.uk", strings.NewReader(`{"body":"I'm on vacation. \u00c0 bient\u00f4t !"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT = %v", resp.StatusCode)
+	}
+	if ar, ok := arbe.AutoReply("ROOT@gchq.gov.uk"); !ok || ar.Body != "I'm on vacation. À bientôt !" {
+		t.Fatalf("AutoReply() = %v, %v", ar, ok)
+	}
+
+	send := func(from, header string) {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		msg := "Message-Id: <42@nsa.gov>\r\nSubject: Hey\r\n" + header + "\r\nHey <3\r\n"
+		if !strings.Contains(header, "To:") {
+			msg = "To: Root <root@gchq.gov.uk>\r\n" + msg
+		}
+		if err := c.SendMail(from, []string{"root@gchq.gov.uk", "other@gchq.gov.uk"}, strings.NewReader(msg)); err != nil {
+			t.Fatalf("SendMail() = %v", err)
+		}
+		arbe.Wait()
+	}
+
+	// Replies which can't be sent aren't recorded
+	outboxDown = true
+	send("root@nsa.gov", "")
+	outboxDown = false
+	send("root@nsa.gov", "")
+	if len(outbox.anonmsgs) != 1 {
+		t.Fatalf("Invalid number of replies: %v", len(outbox.anonmsgs))
+	}
+	reply := outbox.anonmsgs[0]
+	if reply.From != "" || len(reply.To) != 1 || reply.To[0] != "root@nsa.gov" {
+		t.Errorf("Invalid reply envelope: %v, %v", reply.From, reply.To)
+	}
+	data := string(reply.Data)
+	for _, s := range []string{
+		"From: <root@gchq.gov.uk>\r\n",
+		"Subject: Auto: Hey\r\n",
+		"In-Reply-To: <42@nsa.gov>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"Content-Transfer-Encoding: quoted-printable\r\n",
+		"\r\n\r\nI'm on vacation. =C3=80 bient=C3=B4t !\r\n",
+	} {
+		if !strings.Contains(data, s) {
+			t.Errorf("Reply doesn't contain %q:\n%v", s, data)
+		}
+	}
+
+	// Already replied during the interval
+	send("root@nsa.gov", "")
+	// Not eligible for auto-replies
+	send("root@nsa.gov", "Auto-Submitted: auto-generated\r\n")
+	send("list@nsa.gov", "List-Id: <list.nsa.gov>\r\n")
+	send("owner-list@nsa.gov", "")
+	send("", "")
+	// Not addressed to the recipient, e.g. received via an alias
+	send("other@nsa.gov", "To: <alias@gchq.gov.uk>\r\n")
+	if len(outbox.anonmsgs) != 1 {
+		t.Fatalf("Invalid number of replies: %v", len(outbox.anonmsgs))
+	}
+
+	now = now.Add(8 * 24 * time.Hour)
+	send("root@nsa.gov", "")
+	if len(outbox.anonmsgs) != 2 {
+		t.Fatalf("Invalid number of replies after the interval: %v", len(outbox.anonmsgs))
+	}
+	if len(be.anonmsgs) != 9 {
+		t.Errorf("Invalid number of delivered messages: %v", len(be.anonmsgs))
+	}
+
+	// From is a header field, it may contain a display name
+	arbe.SetAutoReply("root@gchq.gov.uk", &backendutil.AutoReply{
+		Body: "I'm on vacation.",
+		From: "Root Account <root@gchq.gov.uk>",
+	})
+	send("other@nsa.gov", "")
+	if len(outbox.anonmsgs) != 3 {
+		t.Fatalf("Invalid number of replies: %v", len(outbox.anonmsgs))
+	}
+	if data := string(outbox.anonmsgs[2].Data); !strings.Contains(data, "From: \"Root Account\" <root@gchq.gov.uk>\r\n") {
+		t.Errorf("Reply doesn't have the configured From header field:\n%v", data)
+	}
+}
@@ -0,0 +1,334 @@
+package backendutil
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultDNSBLCacheTTL = 5 * time.Minute
+	defaultDNSBLTimeout  = 10 * time.Second
+)
+
+// DNSBL is a DNS blocklist.
+type DNSBL struct {
+	// DNS zone of the list, e.g. "zen.spamhaus.org".
+	Zone string
+	// If true, the list contains domain names (e.g. "dbl.spamhaus.org") and
+	// is queried with the HELO and sender domains. Otherwise, the list
+	// contains IP addresses and is queried with the client IP address.
+	Domain bool
+	// Score added when the list matches. Defaults to 1.
+	Weight int
+	// Addresses returned by the list which are considered a match. If empty,
+	// any address in 127.0.0.0/8 matches.
+	Responses []string
+}
+
+func (l *DNSBL) weight() int {
+	if l.Weight == 0 {
+		return 1
+	}
+	return l.Weight
+}
+
+func (l *DNSBL) match(addrs []string) bool {
+	for _, addr := range addrs {
+		if len(l.Responses) == 0 {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil && ip.To4()[0] == 127 {
+				return true
+			}
+			continue
+		}
+		for _, resp := range l.Responses {
+			if addr == resp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DNSBLResult describes a DNSBL match.
+type DNSBLResult struct {
+	List *DNSBL
+	// The client IP address or the domain name which was listed.
+	Subject string
+	// Addresses returned by the list.
+	Addrs []string
+	// Reason published by the list in its TXT record, if any.
+	Reason string
+}
+
+// DNSBLResolver is a DNS resolver. *net.Resolver implements this interface.
+type DNSBLResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type dnsblCacheEntry struct {
+	addrs   []string
+	reason  string
+	expires time.Time
+}
+
+// DNSBLBackend is a backend that rejects clients listed in DNS blocklists.
+//
+// The client IP address is checked when a session is created, the HELO and
+// sender domains are checked when a mail transaction is started. When the
+// sum of the weights of the matching lists reaches the threshold, the client
+// is rejected with a 554 reply.
+//
+// Lookup failures are treated as if the client wasn't listed.
+type DNSBLBackend struct {
+	Backend smtp.Backend
+
+	Lists []DNSBL
+	// Minimum score required to reject a client. Defaults to 1.
+	Threshold int
+
+	// Resolver used to query the lists. If nil, net.DefaultResolver is used.
+	Resolver DNSBLResolver
+	// Maximum amount of time allowed to query the lists. Defaults to 10
+	// seconds.
+	Timeout time.Duration
+	// Amount of time lookup results are cached for. Defaults to 5 minutes.
+	CacheTTL time.Duration
+
+	// Builds the message of the rejection reply. If nil, a message
+	// including the list zone and its reason is used.
+	RejectMessage func(res *DNSBLResult) string
+
+	mutex sync.Mutex
+	cache map[string]*dnsblCacheEntry
+}
+
+func (be *DNSBLBackend) resolver() DNSBLResolver {
+	if be.Resolver != nil {
+		return be.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (be *DNSBLBackend) threshold() int {
+	if be.Threshold <= 0 {
+		return 1
+	}
+	return be.Threshold
+}
+
+func (be *DNSBLBackend) timeout() time.Duration {
+	if be.Timeout <= 0 {
+		return defaultDNSBLTimeout
+	}
+	return be.Timeout
+}
+
+func (be *DNSBLBackend) cacheTTL() time.Duration {
+	if be.CacheTTL <= 0 {
+		return defaultDNSBLCacheTTL
+	}
+	return be.CacheTTL
+}
+
+// reverseIP formats an IP address for a DNSBL query: reversed octets for
+// IPv4, reversed nibbles for IPv6, as described in RFC 5782 section 2.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	h := hex.EncodeToString(ip.To16())
+	var sb strings.Builder
+	for i := len(h) - 1; i >= 0; i-- {
+		sb.WriteByte(h[i])
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+	}
+	return sb.String()
+}
+
+// lookup queries a name, and its TXT record if it's listed.
+func (be *DNSBLBackend) lookup(ctx context.Context, name string) (addrs []string, reason string) {
+	be.mutex.Lock()
+	entry := be.cache[name]
+	be.mutex.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.addrs, entry.reason
+	}
+
+	r := be.resolver()
+	addrs, err := r.LookupHost(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		addrs, err = nil, nil
+	}
+	if err != nil {
+		return nil, ""
+	}
+	if len(addrs) > 0 {
+		if txts, err := r.LookupTXT(ctx, name); err == nil {
+			reason = strings.Join(txts, " ")
+		}
+	}
+
+	be.mutex.Lock()
+	if be.cache == nil {
+		be.cache = make(map[string]*dnsblCacheEntry)
+	}
+	now := time.Now()
+	for k, e := range be.cache {
+		if now.After(e.expires) {
+			delete(be.cache, k)
+		}
+	}
+	be.cache[name] = &dnsblCacheEntry{
+		addrs:   addrs,
+		reason:  reason,
+		expires: now.Add(be.cacheTTL()),
+	}
+	be.mutex.Unlock()
+
+	return addrs, reason
+}
+
+// check queries the lists and returns the total score and the result of the
+// matching list with the highest weight.
+func (be *DNSBLBackend) check(ip net.IP, domains []string) (score int, res *DNSBLResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), be.timeout())
+	defer cancel()
+
+	for i := range be.Lists {
+		l := &be.Lists[i]
+
+		var subjects, names []string
+		if l.Domain {
+			for _, domain := range domains {
+				subjects = append(subjects, domain)
+				names = append(names, domain+"."+l.Zone)
+			}
+		} else if ip != nil {
+			subjects = append(subjects, ip.String())
+			names = append(names, reverseIP(ip)+"."+l.Zone)
+		}
+
+		for j, name := range names {
+			addrs, reason := be.lookup(ctx, name)
+			if !l.match(addrs) {
+				continue
+			}
+			score += l.weight()
+			if res == nil || l.weight() > res.List.weight() {
+				res = &DNSBLResult{
+					List:    l,
+					Subject: subjects[j],
+					Addrs:   addrs,
+					Reason:  reason,
+				}
+			}
+			// Each list only counts once
+			break
+		}
+	}
+
+	return score, res
+}
+
+func (be *DNSBLBackend) rejectError(res *DNSBLResult) error {
+	var msg string
+	if be.RejectMessage != nil {
+		msg = be.RejectMessage(res)
+	} else {
+		msg = fmt.Sprintf("%v blocked using %v", res.Subject, res.List.Zone)
+		if res.Reason != "" {
+			msg += ": " + res.Reason
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      msg,
+	}
+}
+
+func (be *DNSBLBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	var ip net.IP
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	score, res := be.check(ip, nil)
+	if score >= be.threshold() {
+		return nil, be.rejectError(res)
+	}
+
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsblSession{Session: sess, be: be, conn: c, score: score, res: res}, nil
+}
+
+type dnsblSession struct {
+	Session smtp.Session
+
+	be   *DNSBLBackend
+	conn *smtp.Conn
+
+	// Score and result of the client IP address check
+	score int
+	res   *DNSBLResult
+}
+
+func (s *dnsblSession) Reset() {
+	s.Session.Reset()
+}
+
+func (s *dnsblSession) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *dnsblSession) Mail(from string, opts *smtp.MailOptions) error {
+	var domains []string
+	if helo := strings.ToLower(s.conn.Hostname()); helo != "" && !strings.HasPrefix(helo, "[") {
+		domains = append(domains, strings.TrimSuffix(helo, "."))
+	}
+	if i := strings.LastIndexByte(from, '@'); i >= 0 {
+		domain := strings.ToLower(from[i+1:])
+		if !strings.HasPrefix(domain, "[") && (len(domains) == 0 || domains[0] != domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	if len(domains) > 0 {
+		score, res := s.be.check(nil, domains)
+		if res == nil || (s.res != nil && s.res.List.weight() >= res.List.weight()) {
+			res = s.res
+		}
+		if s.score+score >= s.be.threshold() {
+			return s.be.rejectError(res)
+		}
+	}
+
+	return s.Session.Mail(from, opts)
+}
+
+func (s *dnsblSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.Session.Rcpt(to, opts)
+}
+
+func (s *dnsblSession) Data(r io.Reader) error {
+	return s.Session.Data(r)
+}
+
+func (s *dnsblSession) Logout() error {
+	return s.Session.Logout()
+}
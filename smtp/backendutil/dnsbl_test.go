@@ -0,0 +1,200 @@
+package backendutil_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.DNSBLBackend{}
+
+type fakeResolver struct {
+	mutex   sync.Mutex
+	hosts   map[string][]string
+	txts    map[string][]string
+	queries int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.queries++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	txts, ok := r.txts[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func testDNSBLServer(t *testing.T, dbe *backendutil.DNSBLBackend) (be *backend, s *smtp.Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = new(backend)
+	dbe.Backend = be
+	s = smtp.NewServer(dbe)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	return be, s, l.Addr().String()
+}
+
+func TestDNSBLBackend_ip(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{"1.0.0.127.bl.example": {"127.0.0.2"}},
+		txts:  map[string][]string{"1.0.0.127.bl.example": {"Listed, see https://bl.example"}},
+	}
+	_, s, addr := testDNSBLServer(t, &backendutil.DNSBLBackend{
+		Lists:    []backendutil.DNSBL{{Zone: "bl.example"}},
+		Resolver: r,
+	})
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Hello("localhost")
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 554 {
+		t.Fatalf("Hello() = %v, want a 554 error", err)
+	}
+	if want := "127.0.0.1 blocked using bl.example: Listed, see https://bl.example"; smtpErr.Message != want {
+		t.Errorf("Invalid error message: %q, want %q", smtpErr.Message, want)
+	}
+}
+
+func TestDNSBLBackend_score(t *testing.T) {
+	r := &fakeResolver{
+		hosts: map[string][]string{
+			"1.0.0.127.bl.example":       {"127.0.0.2"},
+			"1.0.0.127.ignored.example":  {"127.0.0.4"},
+			"spam.example.dbl.example":   {"127.0.1.2"},
+			"1.0.0.127.notlocal.example": {"10.0.0.1"},
+		},
+		txts: map[string][]string{"spam.example.dbl.example": {"Spam domain"}},
+	}
+	be, s, addr := testDNSBLServer(t, &backendutil.DNSBLBackend{
+		Lists: []backendutil.DNSBL{
+			{Zone: "bl.example"},
+			{Zone: "ignored.example", Responses: []string{"127.0.0.2"}},
+			{Zone: "notlocal.example"},
+			{Zone: "dbl.example", Domain: true, Weight: 2},
+		},
+		Threshold: 3,
+		Resolver:  r,
+		RejectMessage: func(res *backendutil.DNSBLResult) string {
+			return "Go away, " + res.Subject + " (" + res.Reason + ")"
+		},
+	})
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+
+	err = c.Mail("root@spam.example", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 554 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Fatalf("Mail() = %v, want a 554 5.7.1 error", err)
+	}
+	if want := "Go away, spam.example (Spam domain)"; smtpErr.Message != want {
+		t.Errorf("Invalid error message: %q, want %q", smtpErr.Message, want)
+	}
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	w.Write([]byte("Hey <3\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data().Close() = %v", err)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+}
+
+func TestDNSBLBackend_cache(t *testing.T) {
+	r := &fakeResolver{}
+	_, s, addr := testDNSBLServer(t, &backendutil.DNSBLBackend{
+		Lists:    []backendutil.DNSBL{{Zone: "bl.example"}},
+		Resolver: r,
+	})
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatalf("Hello() = %v", err)
+		}
+		c.Close()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.queries != 1 {
+		t.Errorf("Resolver queried %v times, want 1", r.queries)
+	}
+}
+
+func TestDNSBLBackend_ipv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+
+	name := "1." + strings.Repeat("0.", 31) + "bl.example"
+	r := &fakeResolver{hosts: map[string][]string{name: {"127.0.0.2"}}}
+	s := smtp.NewServer(&backendutil.DNSBLBackend{
+		Backend:  new(backend),
+		Lists:    []backendutil.DNSBL{{Zone: "bl.example"}},
+		Resolver: r,
+	})
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err, ok := c.Hello("localhost").(*smtp.SMTPError); !ok || err.Code != 554 {
+		t.Fatalf("Hello() = %v, want a 554 error", err)
+	}
+}
@@ -0,0 +1,509 @@
+package backendutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+var errUpstreamUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Upstream server unavailable, try again later",
+}
+
+var errUpstreamRequireTLS = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 30},
+	Message:      "REQUIRETLS not supported by upstream server",
+}
+
+var errUpstreamFutureRelease = &smtp.SMTPError{
+	Code:         555,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+	Message:      "FUTURERELEASE not supported by upstream server",
+}
+
+var errUpstreamSMTPUTF8 = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "SMTPUTF8 not supported by upstream server",
+}
+
+var errUpstreamInsecureAuth = errors.New("backendutil: refusing to authenticate with upstream server without TLS")
+
+// RelayBackend is a backend that synchronously relays messages to an upstream
+// server.
+//
+// Each session opens its own connection to the upstream server when the
+// first MAIL command is received. Commands are forwarded as they are
+// received, so upstream replies (including per-recipient errors) are reported
+// to the client.
+//
+// When an LMTP upstream server rejects some recipients of a message received
+// over SMTP, the message is accepted, since it has been delivered to the
+// other recipients, and a delivery status notification is sent to the sender
+// for the rejected ones. If all recipients are rejected, the error is
+// reported to the client.
+type RelayBackend struct {
+	// The type of network, "tcp" or "unix". Defaults to "tcp".
+	Network string
+	// Address of the upstream server.
+	Addr string
+	// Use LMTP to talk to the upstream server.
+	LMTP bool
+
+	// Connect to the upstream server with implicit TLS. If false, STARTTLS is
+	// used if the upstream server supports it.
+	ImplicitTLS bool
+	// TLS configuration used to connect to the upstream server. If its
+	// ServerName is empty, the host part of Addr is used.
+	TLSConfig *tls.Config
+
+	// Host name used in HELO/EHLO/LHLO. Defaults to "localhost".
+	LocalName string
+
+	// If set, called to authenticate with the upstream server. A new SASL
+	// client is needed for each connection. Credentials are only sent over
+	// TLS, unless AllowInsecureAuth is set.
+	Auth func() sasl.Client
+	// Allow authenticating with the upstream server without TLS, e.g. over a
+	// Unix socket.
+	AllowInsecureAuth bool
+
+	// If set, called to authenticate clients. If nil, authentication is not
+	// supported.
+	AuthPlain func(username, password string) error
+
+	// If set, used instead of the fields above to open connections to the
+	// upstream server.
+	Dial func() (*smtp.Client, error)
+
+	// Opens a connection to the server used to send delivery status
+	// notifications for recipients rejected by an LMTP upstream server. If
+	// nil, such failures are only logged.
+	BounceDial func() (*smtp.Client, error)
+	// Logger used to report delivery failures which can't be bounced. If
+	// nil, failures are not reported.
+	ErrorLog smtp.Logger
+}
+
+func (be *RelayBackend) logf(format string, v ...interface{}) {
+	if be.ErrorLog != nil {
+		be.ErrorLog.Printf(format, v...)
+	}
+}
+
+func (be *RelayBackend) localName() string {
+	if be.LocalName != "" {
+		return be.LocalName
+	}
+	return "localhost"
+}
+
+func (be *RelayBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &relaySession{be: be}, nil
+}
+
+func (be *RelayBackend) dial() (*smtp.Client, error) {
+	if be.Dial != nil {
+		return be.Dial()
+	}
+
+	network := be.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	tlsConfig := be.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" && network == "tcp" {
+		if host, _, err := net.SplitHostPort(be.Addr); err == nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if be.ImplicitTLS {
+		conn, err = tls.Dial(network, be.Addr, tlsConfig)
+	} else {
+		conn, err = net.Dial(network, be.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c *smtp.Client
+	if be.LMTP {
+		c, err = smtp.NewClientLMTP(conn)
+	} else {
+		c, err = smtp.NewClient(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if be.LocalName != "" {
+		if err := c.Hello(be.LocalName); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && !be.ImplicitTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if be.Auth != nil {
+		// STARTTLS is opportunistic, don't send credentials in cleartext if
+		// it isn't available, e.g. because it has been stripped
+		if _, isTLS := c.TLSConnectionState(); !isTLS && !be.AllowInsecureAuth {
+			c.Close()
+			return nil, errUpstreamInsecureAuth
+		}
+		if err := c.Auth(be.Auth()); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+type relaySession struct {
+	be *RelayBackend
+
+	upstream *smtp.Client
+	from     string
+}
+
+// relayError converts an upstream error to an error suitable for the client.
+func relayError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*smtp.SMTPError); ok {
+		return err
+	}
+	switch err {
+	case smtp.ErrSMTPUTF8Unsupported:
+		return errUpstreamSMTPUTF8
+	case smtp.ErrTLSRequired:
+		return errUpstreamRequireTLS
+	}
+	return errUpstreamUnavailable
+}
+
+// drop closes the upstream connection after an unrecoverable error.
+func (s *relaySession) drop() {
+	if s.upstream != nil {
+		s.upstream.Close()
+		s.upstream = nil
+	}
+}
+
+func (s *relaySession) Reset() {
+	if s.upstream != nil {
+		if err := s.upstream.Reset(); err != nil {
+			s.drop()
+		}
+	}
+}
+
+func (s *relaySession) Logout() error {
+	if s.upstream == nil {
+		return nil
+	}
+	err := s.upstream.Quit()
+	if err != nil {
+		s.upstream.Close()
+	}
+	s.upstream = nil
+	return err
+}
+
+func (s *relaySession) AuthPlain(username, password string) error {
+	if s.be.AuthPlain == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	return s.be.AuthPlain(username, password)
+}
+
+func (s *relaySession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.upstream == nil {
+		c, err := s.be.dial()
+		if err != nil {
+			return errUpstreamUnavailable
+		}
+		s.upstream = c
+	}
+
+	if opts != nil && opts.RequireTLS {
+		if ok, _ := s.upstream.Extension("REQUIRETLS"); !ok {
+			return errUpstreamRequireTLS
+		}
+	}
+	if opts != nil && (opts.HoldFor != 0 || !opts.HoldUntil.IsZero()) {
+		if ok, _ := s.upstream.Extension("FUTURERELEASE"); !ok {
+			return errUpstreamFutureRelease
+		}
+	}
+
+	s.from = from
+	err := relayError(s.upstream.Mail(from, opts))
+	if err == errUpstreamUnavailable {
+		s.drop()
+	}
+	return err
+}
+
+func (s *relaySession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.upstream == nil {
+		return errUpstreamUnavailable
+	}
+
+	err := relayError(s.upstream.Rcpt(to, opts))
+	if err == errUpstreamUnavailable {
+		s.drop()
+	}
+	return err
+}
+
+func (s *relaySession) data(r io.Reader, statusCb func(rcpt string, status *smtp.SMTPError)) error {
+	if s.upstream == nil {
+		return errUpstreamUnavailable
+	}
+
+	var w io.WriteCloser
+	var err error
+	if statusCb != nil {
+		w, err = s.upstream.LMTPData(statusCb)
+	} else {
+		w, err = s.upstream.Data()
+	}
+	if err != nil {
+		if _, ok := err.(*smtp.SMTPError); !ok {
+			s.drop()
+		}
+		return relayError(err)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		// There's no way to abort the upstream transaction, drop the
+		// connection to make sure the partial message isn't delivered.
+		s.drop()
+		if _, ok := err.(*smtp.SMTPError); ok {
+			return err
+		}
+		return errUpstreamUnavailable
+	}
+
+	err = w.Close()
+	if _, ok := err.(*smtp.SMTPError); err != nil && !ok {
+		s.drop()
+	}
+	return relayError(err)
+}
+
+func (s *relaySession) Data(r io.Reader) error {
+	if !s.be.LMTP {
+		return s.data(r, nil)
+	}
+
+	// Plain SMTP can't report per-recipient errors. Accept the message if
+	// it has been delivered to at least one recipient, otherwise the client
+	// would send it again to all recipients.
+	var failed []relayFailure
+	delivered := false
+	header := &headerCapture{}
+	err := s.data(io.TeeReader(r, header), func(rcpt string, status *smtp.SMTPError) {
+		if status != nil {
+			failed = append(failed, relayFailure{rcpt, status})
+		} else {
+			delivered = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		return nil
+	} else if !delivered {
+		return failed[0].status
+	}
+
+	s.bounce(failed, header.bytes())
+	return nil
+}
+
+func (s *relaySession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if !s.be.LMTP {
+		// The upstream server returns a single status for all recipients.
+		return s.Data(r)
+	}
+
+	return s.data(r, func(rcpt string, st *smtp.SMTPError) {
+		var err error
+		if st != nil {
+			err = st
+		}
+		status.SetStatus(rcpt, err)
+	})
+}
+
+type relayFailure struct {
+	rcpt   string
+	status *smtp.SMTPError
+}
+
+// Maximum size of the header of a message kept for delivery status
+// notifications.
+const maxBounceHeaderSize = 64 * 1024
+
+// headerCapture keeps the beginning of a message, to return its header.
+type headerCapture struct {
+	buf bytes.Buffer
+}
+
+func (hc *headerCapture) Write(b []byte) (int, error) {
+	if n := maxBounceHeaderSize - hc.buf.Len(); n > 0 {
+		if len(b) > n {
+			hc.buf.Write(b[:n])
+		} else {
+			hc.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
+
+// bytes returns the header of the message, without the blank line ending it.
+func (hc *headerCapture) bytes() []byte {
+	b := hc.buf.Bytes()
+	if bytes.HasPrefix(b, []byte("\r\n")) || bytes.HasPrefix(b, []byte("\n")) {
+		return nil
+	}
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(b, []byte(sep)); i >= 0 {
+			return b[:i+len(sep)/2]
+		}
+	}
+	return b
+}
+
+// bounce sends a delivery status notification, as defined in RFC 3464, for
+// recipients rejected by the upstream server.
+func (s *relaySession) bounce(failed []relayFailure, header []byte) {
+	var rcpts []string
+	for _, f := range failed {
+		rcpts = append(rcpts, f.rcpt)
+	}
+
+	if s.from == "" {
+		// Never bounce a bounce
+		s.be.logf("backendutil: failed to relay message with null sender to %v: %v", rcpts, failed[0].status)
+		return
+	} else if s.be.BounceDial == nil {
+		s.be.logf("backendutil: failed to relay message from <%v> to %v: %v", s.from, rcpts, failed[0].status)
+		return
+	}
+
+	msg, err := s.be.writeBounce(s.from, failed, header)
+	if err == nil {
+		err = s.be.sendBounce(s.from, msg)
+	}
+	if err != nil {
+		s.be.logf("backendutil: failed to send delivery status notification to <%v> for %v: %v", s.from, rcpts, err)
+	}
+}
+
+func (be *RelayBackend) writeBounce(to string, failed []relayFailure, header []byte) ([]byte, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	name := be.localName()
+	now := time.Now()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", name)
+	fmt.Fprintf(&b, "To: <%v>\r\n", to)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%v@%v>\r\n", hex.EncodeToString(id[:]), name)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%v\r\n", mw.Boundary())
+	b.WriteString("\r\n")
+
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(w, "Your message couldn't be delivered to the following recipients:\r\n\r\n")
+	for _, f := range failed {
+		fmt.Fprintf(w, "<%v>: %v\r\n", f.rcpt, f.status.Error())
+	}
+
+	w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Reporting-MTA: dns; %v\r\n", name)
+	fmt.Fprintf(w, "Arrival-Date: %v\r\n", now.Format(time.RFC1123Z))
+	for _, f := range failed {
+		code := f.status.EnhancedCode
+		if code == smtp.NoEnhancedCode || code == smtp.EnhancedCodeNotSet {
+			code = smtp.EnhancedCode{f.status.Code / 100, 0, 0}
+		}
+		io.WriteString(w, "\r\n")
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %v\r\n", f.rcpt)
+		io.WriteString(w, "Action: failed\r\n")
+		fmt.Fprintf(w, "Status: %v.%v.%v\r\n", code[0], code[1], code[2])
+		fmt.Fprintf(w, "Diagnostic-Code: smtp; %v %v\r\n", f.status.Code, strings.Join(strings.Fields(f.status.Message), " "))
+	}
+
+	if len(header) > 0 {
+		w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(header)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (be *RelayBackend) sendBounce(to string, msg []byte) error {
+	c, err := be.BounceDial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// A null reverse-path prevents bounce loops
+	if err := c.SendMail("", []string{to}, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,374 @@
+package backendutil_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+var _ smtp.Backend = &backendutil.RelayBackend{}
+
+var errUnknownRcpt = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user",
+}
+
+type upstreamMessage struct {
+	From string
+	Opts *smtp.MailOptions
+	To   []string
+	Data []byte
+}
+
+type upstreamBackend struct {
+	messages []*upstreamMessage
+	// Recipients rejected in LMTPData
+	failRcpts map[string]bool
+}
+
+func (be *upstreamBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &upstreamSession{be: be}, nil
+}
+
+type upstreamSession struct {
+	be  *upstreamBackend
+	msg *upstreamMessage
+}
+
+func (s *upstreamSession) Reset()        { s.msg = nil }
+func (s *upstreamSession) Logout() error { return nil }
+
+func (s *upstreamSession) AuthPlain(username, password string) error {
+	if username != "relay" || password != "secret" {
+		return errors.New("Invalid username or password")
+	}
+	return nil
+}
+
+func (s *upstreamSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &upstreamMessage{From: from, Opts: opts}
+	return nil
+}
+
+func (s *upstreamSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if strings.HasPrefix(to, "unknown@") {
+		return errUnknownRcpt
+	}
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *upstreamSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = b
+	s.be.messages = append(s.be.messages, s.msg)
+	return nil
+}
+
+func (s *upstreamSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+	for _, rcpt := range s.msg.To {
+		if s.be.failRcpts[rcpt] {
+			status.SetStatus(rcpt, &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+				Message:      "Mailbox full",
+			})
+		} else {
+			status.SetStatus(rcpt, nil)
+		}
+	}
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func testRelay(t *testing.T, lmtp bool) (upstream *upstreamBackend, us, s *smtp.Server, addr string) {
+	upstream = &upstreamBackend{}
+	us = smtp.NewServer(upstream)
+	us.Domain = "upstream"
+	us.AllowInsecureAuth = true
+	us.EnableSMTPUTF8 = true
+	us.LMTP = lmtp
+	us.Network = "tcp"
+	upstreamAddr := serve(t, us)
+
+	s = smtp.NewServer(&backendutil.RelayBackend{
+		Addr: upstreamAddr,
+		LMTP: lmtp,
+		Auth: func() sasl.Client {
+			return sasl.NewPlainClient("", "relay", "secret")
+		},
+		AllowInsecureAuth: true,
+	})
+	s.Domain = "localhost"
+	s.EnableSMTPUTF8 = true
+	addr = serve(t, s)
+	return
+}
+
+func TestRelayBackend(t *testing.T) {
+	upstream, us, s, addr := testRelay(t, false)
+	defer us.Close()
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("root@nsa.gov", &smtp.MailOptions{Size: 8, UTF8: true}); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	err = c.Rcpt("unknown@gchq.gov.uk", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+		t.Fatalf("Rcpt() = %v, want upstream error", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data().Close() = %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() = %v", err)
+	}
+
+	if len(upstream.messages) != 1 {
+		t.Fatal("Invalid number of relayed messages:", upstream.messages)
+	}
+	msg := upstream.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Error("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Error("Invalid mail recipients:", msg.To)
+	}
+	if msg.Opts.Size != 8 || !msg.Opts.UTF8 {
+		t.Errorf("Invalid mail options: %+v", msg.Opts)
+	}
+	if string(msg.Data) != "Hey <3\r\n" {
+		t.Errorf("Invalid mail data: %q", msg.Data)
+	}
+}
+
+func TestRelayBackend_LMTP(t *testing.T) {
+	upstream, us, s, _ := testRelay(t, true)
+	defer us.Close()
+	s.Close()
+
+	upstream.failRcpts = map[string]bool{"full@gchq.gov.uk": true}
+
+	relay := s.Backend
+	s = smtp.NewServer(relay)
+	s.Domain = "localhost"
+	s.LMTP = true
+	s.Network = "tcp"
+	addr := serve(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClientLMTP(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	for _, rcpt := range []string{"root@gchq.gov.uk", "full@gchq.gov.uk"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt() = %v", err)
+		}
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatalf("LMTPData() = %v", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("LMTPData().Close() = %v", err)
+	}
+
+	if len(statuses) != 2 {
+		t.Fatal("Invalid number of statuses:", statuses)
+	}
+	if statuses["root@gchq.gov.uk"] != nil {
+		t.Error("Unexpected status:", statuses["root@gchq.gov.uk"])
+	}
+	if st := statuses["full@gchq.gov.uk"]; st == nil || st.Code != 552 {
+		t.Error("Invalid status:", st)
+	}
+}
+
+func TestRelayBackend_upstreamDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamAddr := l.Addr().String()
+	l.Close()
+
+	s := smtp.NewServer(&backendutil.RelayBackend{Addr: upstreamAddr})
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Mail("root@nsa.gov", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Mail() = %v, want a temporary error", err)
+	}
+}
+
+func TestRelayBackend_insecureAuth(t *testing.T) {
+	_, us, s, addr := testRelay(t, false)
+	defer us.Close()
+	defer s.Close()
+
+	// The upstream server doesn't support STARTTLS
+	s.Backend.(*backendutil.RelayBackend).AllowInsecureAuth = false
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Mail("root@nsa.gov", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Mail() = %v, want a temporary error", err)
+	}
+}
+
+func TestRelayBackend_futureRelease(t *testing.T) {
+	upstream, us, s, addr := testRelay(t, false)
+	defer us.Close()
+	defer s.Close()
+
+	// The upstream server doesn't support FUTURERELEASE
+	s.EnableFUTURERELEASE = true
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Mail("root@nsa.gov", &smtp.MailOptions{HoldFor: time.Hour})
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 555 {
+		t.Fatalf("Mail() = %v, want a permanent error", err)
+	}
+
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(upstream.messages) != 1 {
+		t.Fatalf("upstream received %v messages, want 1", len(upstream.messages))
+	}
+}
+
+func TestRelayBackend_LMTPPartialFailure(t *testing.T) {
+	upstream, us, s, addr := testRelay(t, true)
+	defer us.Close()
+	defer s.Close()
+
+	upstream.failRcpts = map[string]bool{"full@gchq.gov.uk": true}
+
+	bounces := &upstreamBackend{}
+	bs := smtp.NewServer(bounces)
+	bs.Domain = "bounces"
+	bounceAddr := serve(t, bs)
+	defer bs.Close()
+	s.Backend.(*backendutil.RelayBackend).BounceDial = func() (*smtp.Client, error) {
+		return smtp.Dial(bounceAddr)
+	}
+
+	sendMail := func(rcpts ...string) error {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.SendMail("root@nsa.gov", rcpts, strings.NewReader("Subject: Hey\r\n\r\nHey <3\r\n"))
+	}
+
+	// Delivered to one recipient: the message is accepted and bounced for
+	// the other one
+	if err := sendMail("root@gchq.gov.uk", "full@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(upstream.messages) != 1 {
+		t.Fatal("Invalid number of relayed messages:", upstream.messages)
+	}
+	if len(bounces.messages) != 1 {
+		t.Fatal("Invalid number of bounces:", bounces.messages)
+	}
+	bounce := bounces.messages[0]
+	if bounce.From != "" || len(bounce.To) != 1 || bounce.To[0] != "root@nsa.gov" {
+		t.Errorf("Invalid bounce envelope: from %q to %v", bounce.From, bounce.To)
+	}
+	for _, want := range []string{
+		"report-type=delivery-status",
+		"Final-Recipient: rfc822; full@gchq.gov.uk\r\n",
+		"Status: 5.2.2\r\n",
+		"Content-Type: text/rfc822-headers\r\n\r\nSubject: Hey\r\n",
+	} {
+		if !strings.Contains(string(bounce.Data), want) {
+			t.Errorf("Bounce doesn't contain %q:\n%s", want, bounce.Data)
+		}
+	}
+	if strings.Contains(string(bounce.Data), "root@gchq.gov.uk") {
+		t.Errorf("Bounce contains a delivered recipient:\n%s", bounce.Data)
+	}
+
+	// Rejected for all recipients: the error is reported to the client
+	err := sendMail("full@gchq.gov.uk")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 552 {
+		t.Errorf("SendMail() = %v, want upstream error", err)
+	}
+	if len(bounces.messages) != 1 {
+		t.Error("Invalid number of bounces:", bounces.messages)
+	}
+}
@@ -0,0 +1,62 @@
+package backendutil
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// ReloadableFile caches a value loaded from a file, e.g. a configuration
+// file, and loads it again when the file changes. Changes are detected with
+// the modification time and size of the file.
+//
+// The zero value is ready to use.
+type ReloadableFile struct {
+	mutex   sync.Mutex
+	value   interface{}
+	modTime time.Time
+	size    int64
+}
+
+// Load loads the file with the load function, replacing the current value.
+func (f *ReloadableFile) Load(path string, load func(path string) (interface{}, error)) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.load(path, load)
+}
+
+func (f *ReloadableFile) load(path string, load func(path string) (interface{}, error)) (interface{}, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	f.value = v
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return v, nil
+}
+
+// Get returns the current value, loading the file with the load function if
+// it has changed since the last call.
+//
+// If the file can't be loaded, the previous value is returned along with the
+// error, so that callers can report it and keep working. If there's no
+// previous value, nil is returned.
+func (f *ReloadableFile) Get(path string, load func(path string) (interface{}, error)) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := os.Stat(path)
+	if err == nil && f.value != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, nil
+	}
+
+	if err == nil {
+		_, err = f.load(path, load)
+	}
+	return f.value, err
+}
@@ -0,0 +1,67 @@
+package backendutil_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestReloadableFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-reload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+
+	loads := 0
+	load := func(path string) (interface{}, error) {
+		loads++
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		} else if string(b) == "invalid" {
+			return nil, errors.New("invalid file")
+		}
+		return string(b), nil
+	}
+
+	var f backendutil.ReloadableFile
+	if v, err := f.Get(path, load); v != nil || err == nil {
+		t.Fatalf("Get() = %v, %v for a missing file", v, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if v, err := f.Get(path, load); v != "a" || err != nil {
+			t.Fatalf("Get() = %v, %v", v, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("File loaded %v times, want 1", loads)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f.Get(path, load); v != "bb" || err != nil {
+		t.Fatalf("Get() = %v, %v after a change", v, err)
+	}
+
+	// The previous value is kept
+	if err := ioutil.WriteFile(path, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f.Get(path, load); v != "bb" || err == nil {
+		t.Fatalf("Get() = %v, %v for an invalid file", v, err)
+	}
+	if v, err := f.Load(path, load); v != nil || err == nil {
+		t.Fatalf("Load() = %v, %v for an invalid file", v, err)
+	}
+}
@@ -0,0 +1,196 @@
+package backendutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Default size above which messages are spooled to disk.
+const defaultSpoolThreshold = 1024 * 1024
+
+// Spool is a message kept in memory, or in a temporary file once it exceeds
+// a threshold. Unlike the reader passed to Session.Data, it can be read
+// several times, with Seek or ReadAt.
+type Spool struct {
+	*io.SectionReader
+
+	f      *os.File
+	remove bool // the file couldn't be unlinked while open
+}
+
+// File returns the temporary file holding the message, or nil if the
+// message is kept in memory.
+func (s *Spool) File() *os.File {
+	return s.f
+}
+
+// Close releases the resources of the spool, removing the temporary file if
+// any.
+func (s *Spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if s.remove {
+		os.Remove(s.f.Name())
+	}
+	s.f = nil
+	return err
+}
+
+// Spooler buffers messages.
+type Spooler struct {
+	// Size above which messages are written to a temporary file. Defaults to
+	// 1 MiB.
+	Threshold int64
+	// Directory of temporary files. Defaults to os.TempDir.
+	Dir string
+	// Maximum message size. If exceeded, smtp.ErrDataTooLarge is returned.
+	// Zero means no limit.
+	MaxBytes int64
+}
+
+func (sp *Spooler) threshold() int64 {
+	if sp.Threshold <= 0 {
+		return defaultSpoolThreshold
+	}
+	return sp.Threshold
+}
+
+// Spool reads r until EOF. The returned spool must be closed.
+func (sp *Spooler) Spool(r io.Reader) (*Spool, error) {
+	if sp.MaxBytes > 0 {
+		r = &spoolLimitReader{r: r, n: sp.MaxBytes}
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, sp.threshold()+1)
+	if err == io.EOF {
+		return &Spool{SectionReader: io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, n)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(sp.Dir, "go-smtp-spool-")
+	if err != nil {
+		return nil, err
+	}
+	// Unlink the file right away where the OS allows it, so that it doesn't
+	// leak if the process crashes
+	s := &Spool{f: f, remove: os.Remove(f.Name()) != nil}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	m, err := io.Copy(f, r)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.SectionReader = io.NewSectionReader(f, 0, n+m)
+	return s, nil
+}
+
+// spoolLimitReader fails with smtp.ErrDataTooLarge when more than n bytes
+// are read.
+type spoolLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *spoolLimitReader) Read(b []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, smtp.ErrDataTooLarge
+	}
+	// Read one more byte than allowed to detect messages which are too large
+	if int64(len(b)) > lr.n+1 {
+		b = b[:lr.n+1]
+	}
+	n, err := lr.r.Read(b)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return 0, smtp.ErrDataTooLarge
+	}
+	return n, err
+}
+
+// SpoolBackend is a backend which spools messages before passing them to
+// the underlying backend's Session.Data. The reader passed to Session.Data
+// is a *Spool, which can be used to read the message several times:
+//
+//	func (s *session) Data(r io.Reader) error {
+//		spool := r.(*backendutil.Spool)
+//		...
+//	}
+//
+// The spool is closed on Reset and Logout, i.e. once the transaction is
+// over: it must not be used once Session.Data has returned.
+//
+// If MaxBytes is zero, the server's MaxMessageBytes is used.
+type SpoolBackend struct {
+	Backend smtp.Backend
+	Spooler
+}
+
+func (be *SpoolBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	spooler := be.Spooler
+	if spooler.MaxBytes == 0 && c.Server() != nil {
+		spooler.MaxBytes = c.Server().MaxMessageBytes
+	}
+	return &spoolSession{Session: s, spooler: &spooler}, nil
+}
+
+type spoolSession struct {
+	Session smtp.Session
+	spooler *Spooler
+	spool   *Spool
+}
+
+func (s *spoolSession) closeSpool() {
+	if s.spool != nil {
+		s.spool.Close()
+		s.spool = nil
+	}
+}
+
+func (s *spoolSession) Reset() {
+	s.closeSpool()
+	s.Session.Reset()
+}
+
+func (s *spoolSession) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *spoolSession) Mail(from string, opts *smtp.MailOptions) error {
+	return s.Session.Mail(from, opts)
+}
+
+func (s *spoolSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.Session.Rcpt(to, opts)
+}
+
+func (s *spoolSession) Data(r io.Reader) error {
+	s.closeSpool()
+	spool, err := s.spooler.Spool(r)
+	if err != nil {
+		return err
+	}
+	s.spool = spool
+	return s.Session.Data(spool)
+}
+
+func (s *spoolSession) Logout() error {
+	s.closeSpool()
+	return s.Session.Logout()
+}
@@ -0,0 +1,129 @@
+package backendutil_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestSpooler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp := &backendutil.Spooler{Threshold: 16, Dir: dir, MaxBytes: 64}
+
+	spool, err := sp.Spool(strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Spool() = %v", err)
+	}
+	if spool.File() != nil || spool.Size() != 8 {
+		t.Errorf("Small message: File() = %v, Size() = %v", spool.File(), spool.Size())
+	}
+	spool.Close()
+
+	body := strings.Repeat("Hey <3\r\n", 4)
+	spool, err = sp.Spool(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Spool() = %v", err)
+	}
+	if spool.File() == nil || spool.Size() != int64(len(body)) {
+		t.Errorf("Large message: File() = %v, Size() = %v", spool.File(), spool.Size())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(spool); err != nil || string(b) != body {
+			t.Errorf("ReadAll() = %q, %v", b, err)
+		}
+	}
+	if err := spool.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Temporary files left: %v", files)
+	}
+
+	if _, err := sp.Spool(strings.NewReader(strings.Repeat("x", 65))); err != smtp.ErrDataTooLarge {
+		t.Errorf("Spool() = %v, want %v", err, smtp.ErrDataTooLarge)
+	}
+	if _, err := sp.Spool(strings.NewReader(strings.Repeat("x", 64))); err != nil {
+		t.Errorf("Spool() = %v", err)
+	}
+}
+
+type spoolCheckBackend struct {
+	spools []*backendutil.Spool
+	data   [][]byte
+}
+
+func (be *spoolCheckBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &spoolCheckSession{be: be}, nil
+}
+
+type spoolCheckSession struct {
+	be *spoolCheckBackend
+}
+
+func (s *spoolCheckSession) Reset()        {}
+func (s *spoolCheckSession) Logout() error { return nil }
+
+func (s *spoolCheckSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *spoolCheckSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *spoolCheckSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+
+func (s *spoolCheckSession) Data(r io.Reader) error {
+	spool := r.(*backendutil.Spool)
+	b := make([]byte, spool.Size())
+	if _, err := spool.ReadAt(b, 0); err != nil {
+		return err
+	}
+	s.be.spools = append(s.be.spools, spool)
+	s.be.data = append(s.be.data, b)
+	return nil
+}
+
+func TestSpoolBackend(t *testing.T) {
+	be := &spoolCheckBackend{}
+	s := smtp.NewServer(&backendutil.SpoolBackend{
+		Backend: be,
+		Spooler: backendutil.Spooler{Threshold: 16},
+	})
+	s.Domain = "localhost"
+	s.MaxMessageBytes = 1024
+	addr := serve(t, s)
+	defer s.Close()
+
+	body := strings.Repeat("Hey <3\r\n", 4)
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(body)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.data) != 1 || !bytes.Equal(be.data[0], []byte(body)) {
+		t.Fatalf("Invalid spooled data: %q", be.data)
+	}
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(strings.Repeat(body, 64)))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 552 {
+		t.Errorf("SendMail() = %v, want a 552 error", err)
+	}
+	// The first transaction is over once the next one has started
+	if be.spools[0].File() != nil {
+		t.Errorf("Spool hasn't been closed after the transaction")
+	}
+}
@@ -0,0 +1,281 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TraceBackend is a backend which prepends trace header fields to messages,
+// as described in RFC 5321 section 4.4.
+//
+// A Received header field is added to each message. It records the client
+// HELO name and IP address, the server host name, the protocol (as defined
+// in RFC 3848), the TLS version and cipher suite, the authenticated user,
+// and the recipient if there's only one.
+//
+// If AuthenticationResults is set, an Authentication-Results header field
+// (RFC 8601) records the outcome of SMTP authentication, and the fields
+// which claim to come from this server are removed from incoming messages.
+type TraceBackend struct {
+	Backend smtp.Backend
+
+	// Host name of the server. Defaults to the server's Domain.
+	Hostname string
+	// Add a Return-Path header field with the envelope sender. This must
+	// only be enabled when the server performs the final delivery.
+	ReturnPath bool
+	// Add an Authentication-Results header field with the result of SMTP
+	// authentication. Hostname is used as the authserv-id.
+	AuthenticationResults bool
+
+	// Used to get the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (be *TraceBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &traceSession{Session: s, be: be, c: c}, nil
+}
+
+type traceSession struct {
+	Session smtp.Session
+	be      *TraceBackend
+	c       *smtp.Conn
+
+	user  string
+	from  string
+	rcpts []string
+}
+
+func (s *traceSession) Reset() {
+	s.from = ""
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *traceSession) AuthPlain(username, password string) error {
+	if err := s.Session.AuthPlain(username, password); err != nil {
+		return err
+	}
+	s.user = username
+	return nil
+}
+
+func (s *traceSession) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.from = from
+	s.rcpts = nil
+	return nil
+}
+
+func (s *traceSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *traceSession) Data(r io.Reader) error {
+	var sb strings.Builder
+	if s.be.ReturnPath {
+		sb.WriteString("Return-Path: <" + sanitizeTrace(s.from) + ">\r\n")
+	}
+	sb.WriteString(s.received())
+	if s.be.AuthenticationResults {
+		sb.WriteString(s.authenticationResults())
+		r = stripAuthenticationResults(r, s.hostname())
+	}
+	return s.Session.Data(io.MultiReader(strings.NewReader(sb.String()), r))
+}
+
+func (s *traceSession) Logout() error {
+	return s.Session.Logout()
+}
+
+func (s *traceSession) hostname() string {
+	if s.be.Hostname == "" && s.c.Server() != nil {
+		return s.c.Server().Domain
+	}
+	return s.be.Hostname
+}
+
+// received formats a Received header field.
+func (s *traceSession) received() string {
+	hostname := s.hostname()
+	now := time.Now
+	if s.be.Now != nil {
+		now = s.be.Now
+	}
+
+	var ip string
+	if conn := s.c.Conn(); conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP.String()
+			if addr.IP.To4() == nil {
+				ip = "IPv6:" + ip
+			}
+		}
+	}
+
+	// RFC 3848 only defines the TLS and AUTH suffixes for ESMTP and LMTP,
+	// both of which are required by STARTTLS and AUTH anyway
+	protocol := "SMTP"
+	tlsState, isTLS := s.c.TLSConnectionState()
+	if s.c.Extended() {
+		protocol = "ESMTP"
+		if s.c.Server() != nil && s.c.Server().LMTP {
+			protocol = "LMTP"
+		}
+		if isTLS {
+			protocol += "S"
+		}
+		if s.user != "" {
+			protocol += "A"
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Received: from " + sanitizeTrace(s.c.Hostname()))
+	if ip != "" {
+		sb.WriteString(" ([" + ip + "])")
+	}
+	sb.WriteString("\r\n\tby " + sanitizeTrace(hostname) + " with " + protocol)
+	if isTLS {
+		fmt.Fprintf(&sb, "\r\n\t(%v with cipher %v)", tlsVersionName(tlsState.Version), tls.CipherSuiteName(tlsState.CipherSuite))
+	}
+	if s.user != "" {
+		sb.WriteString("\r\n\t(authenticated as " + quoteTraceComment(s.user) + ")")
+	}
+	// Only disclose the recipient if there's a single one, as recommended
+	// in RFC 5321 section 7.2
+	if len(s.rcpts) == 1 {
+		sb.WriteString("\r\n\tfor <" + sanitizeTrace(s.rcpts[0]) + ">")
+	}
+	sb.WriteString(";\r\n\t" + now().Format(time.RFC1123Z) + "\r\n")
+	return sb.String()
+}
+
+// authenticationResults formats an Authentication-Results header field, as
+// defined in RFC 8601 section 2.7.4.
+func (s *traceSession) authenticationResults() string {
+	result := "none"
+	if s.user != "" {
+		result = "auth=pass smtp.auth=" + quoteTraceValue(s.user)
+	}
+	return "Authentication-Results: " + sanitizeTrace(s.hostname()) + ";\r\n\t" + result + "\r\n"
+}
+
+// stripAuthenticationResults removes the Authentication-Results header fields
+// of a message which have the given authserv-id, as required by RFC 8601
+// section 5. These can only have been forged.
+func stripAuthenticationResults(r io.Reader, authservID string) io.Reader {
+	br := bufio.NewReader(r)
+
+	var header bytes.Buffer
+	var field []byte
+	flush := func() {
+		if !isAuthenticationResults(field, authservID) {
+			header.Write(field)
+		}
+		field = nil
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && field != nil && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line...)
+		} else if len(line) > 0 {
+			flush()
+			if bytes.IndexByte(line, ':') < 0 {
+				// End of the header
+				header.Write(line)
+				break
+			}
+			field = line
+		}
+		if err != nil {
+			flush()
+			break
+		}
+	}
+
+	return io.MultiReader(&header, br)
+}
+
+func isAuthenticationResults(field []byte, authservID string) bool {
+	i := bytes.IndexByte(field, ':')
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(string(field[:i])), "Authentication-Results") {
+		return false
+	}
+	value := string(field[i+1:])
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	// The authserv-id may be followed by a version
+	id := strings.Fields(value)
+	return len(id) > 0 && strings.EqualFold(id[0], authservID)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("TLS 0x%04x", version)
+	}
+}
+
+// sanitizeTrace removes the characters which could break a header field.
+func sanitizeTrace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// quoteTraceValue formats a string as a pvalue, as defined in RFC 8601
+// section 2.2. It's quoted unless it only contains atext, dots and at signs.
+func quoteTraceValue(s string) string {
+	s = sanitizeTrace(s)
+	bare := s != ""
+	for _, r := range s {
+		if r >= 0x7f || (!('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') && !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.@", r)) {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// quoteTraceComment escapes a string so that it can be used in a comment.
+func quoteTraceComment(s string) string {
+	s = sanitizeTrace(s)
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "(", `\(`, -1)
+	return strings.Replace(s, ")", `\)`, -1)
+}
@@ -0,0 +1,173 @@
+package backendutil_test
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestTraceBackend(t *testing.T) {
+	be := &backend{}
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	s := smtp.NewServer(&backendutil.TraceBackend{
+		Backend:    be,
+		Hostname:   "mx.example.org",
+		ReturnPath: true,
+		Now:        func() time.Time { return now },
+	})
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	addr := serve(t, s)
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "username", "password")); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk", "other@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	if len(be.anonmsgs) != 1 || len(be.messages) != 1 {
+		t.Fatalf("Invalid number of messages: %v, %v", len(be.anonmsgs), len(be.messages))
+	}
+
+	want := "Return-Path: <root@nsa.gov>\r\n" +
+		"Received: from client.example.org ([127.0.0.1])\r\n" +
+		"\tby mx.example.org with ESMTP\r\n" +
+		"\tfor <root@gchq.gov.uk>;\r\n" +
+		"\tMon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Hey <3\r\n"
+	if got := string(be.anonmsgs[0].Data); got != want {
+		t.Errorf("Invalid message:\n%v\nwant:\n%v", got, want)
+	}
+
+	want = "Return-Path: <root@nsa.gov>\r\n" +
+		"Received: from client.example.org ([127.0.0.1])\r\n" +
+		"\tby mx.example.org with ESMTPA\r\n" +
+		"\t(authenticated as username);\r\n" +
+		"\tMon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Hey <3\r\n"
+	if got := string(be.messages[0].Data); got != want {
+		t.Errorf("Invalid message:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestTraceBackend_authenticationResults(t *testing.T) {
+	be := &backend{}
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	s := smtp.NewServer(&backendutil.TraceBackend{
+		Backend:               be,
+		Hostname:              "mx.example.org",
+		AuthenticationResults: true,
+		Now:                   func() time.Time { return now },
+	})
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	addr := serve(t, s)
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "Authentication-Results: MX.example.org 1;\r\n" +
+		"\tauth=pass smtp.auth=admin\r\n" +
+		"Authentication-Results: other.example.org; none\r\n" +
+		"Subject: Hey\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.org; none\r\n"
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "username", "password")); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	if len(be.anonmsgs) != 1 || len(be.messages) != 1 {
+		t.Fatalf("Invalid number of messages: %v, %v", len(be.anonmsgs), len(be.messages))
+	}
+
+	want := "Authentication-Results: mx.example.org;\r\n" +
+		"\tnone\r\n" +
+		"Authentication-Results: other.example.org; none\r\n" +
+		"Subject: Hey\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.org; none\r\n"
+	if got := string(be.anonmsgs[0].Data); !strings.HasSuffix(got, want) {
+		t.Errorf("Invalid message:\n%v\nwant suffix:\n%v", got, want)
+	}
+
+	want = "Authentication-Results: mx.example.org;\r\n" +
+		"\tauth=pass smtp.auth=username\r\n" +
+		"Hey <3\r\n"
+	if got := string(be.messages[0].Data); !strings.HasSuffix(got, want) {
+		t.Errorf("Invalid message:\n%v\nwant suffix:\n%v", got, want)
+	}
+}
+
+func TestTraceBackend_helo(t *testing.T) {
+	be := &backend{}
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	s := smtp.NewServer(&backendutil.TraceBackend{
+		Backend:  be,
+		Hostname: "mx.example.org",
+		Now:      func() time.Time { return now },
+	})
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	expect := func(code int) {
+		t.Helper()
+		if _, _, err := text.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(220)
+	for _, cmd := range []string{"HELO client.example.org", "MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"} {
+		text.PrintfLine("%v", cmd)
+		expect(250)
+	}
+	text.PrintfLine("DATA")
+	expect(354)
+	text.PrintfLine("Hey <3\r\n.")
+	expect(250)
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Invalid number of messages: %v", len(be.anonmsgs))
+	}
+	if got := string(be.anonmsgs[0].Data); !strings.Contains(got, "\tby mx.example.org with SMTP\r\n") {
+		t.Errorf("Invalid protocol for HELO:\n%v", got)
+	}
+}
@@ -0,0 +1,319 @@
+package backendutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/message"
+)
+
+const (
+	defaultWebhookTimeout    = 30 * time.Second
+	defaultWebhookRetries    = 3
+	defaultWebhookRetryDelay = time.Second
+	defaultWebhookRetryTime  = time.Minute
+)
+
+var errWebhookRejected = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected",
+}
+
+var errWebhookTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message too large",
+}
+
+var errWebhookUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Delivery failed, try again later",
+}
+
+// WebhookFormat is the format of webhook requests.
+type WebhookFormat int
+
+const (
+	// A JSON object with the "envelope" and either the parsed "message" or
+	// the "raw" message.
+	WebhookJSON WebhookFormat = iota
+	// A multipart/form-data body with an "envelope" JSON field and a
+	// "message" file field containing the raw message.
+	WebhookMultipart
+)
+
+// WebhookEnvelope is the envelope of a message sent to a webhook.
+type WebhookEnvelope struct {
+	From       string   `json:"from"`
+	To         []string `json:"to"`
+	Helo       string   `json:"helo,omitempty"`
+	RemoteAddr string   `json:"remoteAddr,omitempty"`
+}
+
+// WebhookPayload is the body of JSON webhook requests. The raw message is
+// base64-encoded, since it may not be valid UTF-8.
+type WebhookPayload struct {
+	Envelope WebhookEnvelope  `json:"envelope"`
+	Message  *message.Message `json:"message,omitempty"`
+	Raw      []byte           `json:"raw,omitempty"`
+}
+
+// WebhookBackend is a backend which delivers messages by sending HTTP POST
+// requests to an endpoint.
+//
+// Requests are retried with an exponential backoff if the endpoint can't be
+// reached, times out or replies with a 5xx, 408 or 429 status code, for at
+// most MaxRetryTime since the client is waiting for a reply to DATA. The
+// message is then rejected with a temporary error, so that the client tries
+// again later. Other 4xx status codes are mapped to permanent errors (552
+// for 413, 550 otherwise). If the response body is a short text, it's used
+// as the SMTP error message.
+//
+// If Secret is set, requests are signed: the X-Webhook-Timestamp header field
+// contains the Unix time of the request, and the X-Webhook-Signature header
+// field contains "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+// timestamp, a dot and the request body.
+type WebhookBackend struct {
+	// URL of the endpoint.
+	URL    string
+	Format WebhookFormat
+	// Send the raw message instead of the parsed message, in the JSON format.
+	Raw bool
+	// Secret used to sign requests.
+	Secret []byte
+	// Additional header fields of requests, e.g. for authentication.
+	Header http.Header
+
+	// HTTP client used to send requests. Defaults to a client with a
+	// 30 seconds timeout.
+	Client *http.Client
+	// Maximum number of retries. Defaults to 3, a negative value disables
+	// retries.
+	MaxRetries int
+	// Delay before the first retry, doubled for each subsequent retry.
+	// Defaults to 1 second.
+	RetryDelay time.Duration
+	// Maximum total time spent delivering a message, including retries.
+	// Defaults to 1 minute.
+	MaxRetryTime time.Duration
+
+	// If set, called to authenticate clients. If nil, authentication is not
+	// supported.
+	AuthPlain func(username, password string) error
+}
+
+func (be *WebhookBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	env := WebhookEnvelope{Helo: c.Hostname()}
+	if conn := c.Conn(); conn != nil {
+		env.RemoteAddr = conn.RemoteAddr().String()
+	}
+	return &webhookSession{be: be, env: env}, nil
+}
+
+func (be *WebhookBackend) client() *http.Client {
+	if be.Client != nil {
+		return be.Client
+	}
+	return &http.Client{Timeout: defaultWebhookTimeout}
+}
+
+func (be *WebhookBackend) maxRetries() int {
+	switch {
+	case be.MaxRetries < 0:
+		return 0
+	case be.MaxRetries == 0:
+		return defaultWebhookRetries
+	default:
+		return be.MaxRetries
+	}
+}
+
+func (be *WebhookBackend) retryDelay() time.Duration {
+	if be.RetryDelay <= 0 {
+		return defaultWebhookRetryDelay
+	}
+	return be.RetryDelay
+}
+
+func (be *WebhookBackend) maxRetryTime() time.Duration {
+	if be.MaxRetryTime <= 0 {
+		return defaultWebhookRetryTime
+	}
+	return be.MaxRetryTime
+}
+
+// body builds the request body and returns its content type.
+func (be *WebhookBackend) body(env *WebhookEnvelope, raw []byte) ([]byte, string, error) {
+	if be.Format == WebhookMultipart {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		envJSON, err := json.Marshal(env)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := mw.WriteField("envelope", string(envJSON)); err != nil {
+			return nil, "", err
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="message"; filename="message.eml"`)
+		h.Set("Content-Type", "message/rfc822")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, "", err
+		}
+		if err := mw.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), mw.FormDataContentType(), nil
+	}
+
+	payload := WebhookPayload{Envelope: *env}
+	if be.Raw {
+		payload.Raw = raw
+	} else {
+		msg, err := message.Read(bytes.NewReader(raw))
+		if err != nil {
+			// Malformed messages are still delivered
+			payload.Raw = raw
+		} else {
+			payload.Message = msg
+		}
+	}
+	b, err := json.Marshal(&payload)
+	return b, "application/json", err
+}
+
+// post sends a request. It returns whether the request can be retried.
+func (be *WebhookBackend) post(ctx context.Context, body []byte, contentType string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, be.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, values := range be.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if be.Secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", ts)
+		req.Header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(be.Secret, ts, body))
+	}
+
+	resp, err := be.client().Do(req)
+	if err != nil {
+		return true, errWebhookUnavailable
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return false, nil
+	case code >= 500, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true, webhookError(errWebhookUnavailable, msg)
+	case code == http.StatusRequestEntityTooLarge:
+		return false, webhookError(errWebhookTooLarge, msg)
+	case code >= 400:
+		return false, webhookError(errWebhookRejected, msg)
+	default:
+		return false, fmt.Errorf("backendutil: unexpected webhook response status: %v", resp.Status)
+	}
+}
+
+// webhookError returns an error with the response body as message, if it's
+// a single short line.
+func webhookError(err *smtp.SMTPError, msg []byte) error {
+	s := string(bytes.TrimSpace(msg))
+	if s == "" || len(s) >= 512 || strings.ContainsAny(s, "\r\n") {
+		return err
+	}
+	return &smtp.SMTPError{Code: err.Code, EnhancedCode: err.EnhancedCode, Message: s}
+}
+
+// WebhookSignature computes the signature of a webhook request, as
+// described in WebhookBackend. It's hex-encoded.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookSession struct {
+	be  *WebhookBackend
+	env WebhookEnvelope
+}
+
+func (s *webhookSession) Reset() {
+	s.env.From = ""
+	s.env.To = nil
+}
+
+func (s *webhookSession) Logout() error {
+	return nil
+}
+
+func (s *webhookSession) AuthPlain(username, password string) error {
+	if s.be.AuthPlain == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	return s.be.AuthPlain(username, password)
+}
+
+func (s *webhookSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.env.From = from
+	s.env.To = nil
+	return nil
+}
+
+func (s *webhookSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.env.To = append(s.env.To, to)
+	return nil
+}
+
+func (s *webhookSession) Data(r io.Reader) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	body, contentType, err := s.be.body(&s.env, raw)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.be.maxRetryTime())
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	delay := s.be.retryDelay()
+	for i := 0; ; i++ {
+		retry, err := s.be.post(ctx, body, contentType)
+		if !retry || i >= s.be.maxRetries() || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,192 @@
+package backendutil_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+type webhookRecorder struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+
+	wr.mutex.Lock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, b)
+	status := http.StatusOK
+	if len(wr.statuses) > 0 {
+		status = wr.statuses[0]
+		wr.statuses = wr.statuses[1:]
+	}
+	wr.mutex.Unlock()
+
+	w.WriteHeader(status)
+	if status == http.StatusBadRequest {
+		w.Write([]byte("Unknown mailbox\n"))
+	}
+}
+
+func testWebhook(t *testing.T, be *backendutil.WebhookBackend, statuses ...int) (*webhookRecorder, error) {
+	wr := &webhookRecorder{statuses: statuses}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	be.URL = ts.URL
+	be.RetryDelay = time.Millisecond
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk", "other@gchq.gov.uk"}, strings.NewReader("Subject: Hey\r\n\r\nHey <3\r\n"))
+	return wr, err
+}
+
+func TestWebhookBackend(t *testing.T) {
+	secret := []byte("secret")
+	wr, err := testWebhook(t, &backendutil.WebhookBackend{Secret: secret})
+	if err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(wr.requests) != 1 {
+		t.Fatalf("Invalid number of requests: %v", len(wr.requests))
+	}
+
+	req, body := wr.requests[0], wr.bodies[0]
+	if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Invalid Content-Type: %v", ct)
+	}
+	sig := backendutil.WebhookSignature(secret, req.Header.Get("X-Webhook-Timestamp"), body)
+	if got := req.Header.Get("X-Webhook-Signature"); got != "sha256="+sig {
+		t.Errorf("Invalid signature: %v, want sha256=%v", got, sig)
+	}
+
+	var payload backendutil.WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Invalid payload: %v", err)
+	}
+	if env := payload.Envelope; env.From != "root@nsa.gov" || len(env.To) != 2 || env.To[1] != "other@gchq.gov.uk" || env.Helo != "localhost" {
+		t.Errorf("Invalid envelope: %+v", env)
+	}
+	if payload.Message == nil || payload.Message.Subject != "Hey" || payload.Message.Text != "Hey <3\r\n" {
+		t.Errorf("Invalid message: %+v", payload.Message)
+	}
+}
+
+func TestWebhookBackend_multipart(t *testing.T) {
+	wr, err := testWebhook(t, &backendutil.WebhookBackend{Format: backendutil.WebhookMultipart})
+	if err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	req := wr.requests[0]
+	req.Body = ioutil.NopCloser(strings.NewReader(string(wr.bodies[0])))
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatalf("ParseMultipartForm() = %v", err)
+	}
+	var env backendutil.WebhookEnvelope
+	if err := json.Unmarshal([]byte(req.FormValue("envelope")), &env); err != nil || env.From != "root@nsa.gov" {
+		t.Errorf("Invalid envelope: %+v, %v", env, err)
+	}
+	f, _, err := req.FormFile("message")
+	if err != nil {
+		t.Fatalf("FormFile() = %v", err)
+	}
+	if b, _ := ioutil.ReadAll(f); string(b) != "Subject: Hey\r\n\r\nHey <3\r\n" {
+		t.Errorf("Invalid raw message: %q", b)
+	}
+}
+
+func TestWebhookBackend_status(t *testing.T) {
+	tests := []struct {
+		statuses []int
+		requests int
+		code     int
+		message  string
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusOK}, 2, 0, ""},
+		{[]int{http.StatusBadRequest}, 1, 550, "Unknown mailbox"},
+		{[]int{http.StatusRequestEntityTooLarge}, 1, 552, ""},
+		{[]int{500, 500, 500, 500, 500}, 4, 451, ""},
+	}
+	for _, test := range tests {
+		wr, err := testWebhook(t, &backendutil.WebhookBackend{}, test.statuses...)
+		if len(wr.requests) != test.requests {
+			t.Errorf("%v: invalid number of requests: %v, want %v", test.statuses, len(wr.requests), test.requests)
+		}
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%v: SendMail() = %v", test.statuses, err)
+			}
+			continue
+		}
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok || smtpErr.Code != test.code || (test.message != "" && smtpErr.Message != test.message) {
+			t.Errorf("%v: SendMail() = %v, want a %v error", test.statuses, err, test.code)
+		}
+	}
+}
+
+func TestWebhookBackend_raw(t *testing.T) {
+	wr := &webhookRecorder{}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	s := smtp.NewServer(&backendutil.WebhookBackend{URL: ts.URL, Raw: true})
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	// Latin-1 isn't valid UTF-8
+	raw := "Subject: Caf\xe9\r\n\r\nHey <3\r\n"
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(raw)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	var payload backendutil.WebhookPayload
+	if err := json.Unmarshal(wr.bodies[0], &payload); err != nil {
+		t.Fatalf("Invalid payload: %v", err)
+	}
+	if string(payload.Raw) != raw {
+		t.Errorf("Invalid raw message: %q, want %q", payload.Raw, raw)
+	}
+}
+
+func TestWebhookBackend_maxRetryTime(t *testing.T) {
+	be := &backendutil.WebhookBackend{
+		MaxRetries:   100,
+		MaxRetryTime: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err := testWebhook(t, be, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("SendMail() = %v, want a 451 error", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Delivery took %v, want less than MaxRetryTime", d)
+	}
+}
@@ -0,0 +1,91 @@
+package clamav
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/quarantine"
+)
+
+var errScannerUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Virus scanner unavailable, try again later",
+}
+
+// Backend is a backend that scans messages before passing them to the
+// underlying backend.
+//
+// The message is streamed to the scanner while it's received. Infected
+// messages are rejected with a 554 error containing the name of the virus.
+// If the scanner fails, messages are rejected with a temporary error, unless
+// FailOpen is set.
+type Backend struct {
+	Backend smtp.Backend
+	Scanner Scanner
+
+	// If true, scanner failures are ignored and messages are accepted.
+	FailOpen bool
+	// If true, infected messages are quarantined instead of being rejected.
+	// The backend must be wrapped in a quarantine.Backend.
+	Quarantine bool
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &session{Session: sess, be: be}, nil
+}
+
+type session struct {
+	Session smtp.Session
+	be      *Backend
+}
+
+func (s *session) Reset() {
+	s.Session.Reset()
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return s.Session.Mail(from, opts)
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return s.Session.Rcpt(to, opts)
+}
+
+func (s *session) Data(r io.Reader) error {
+	var buf bytes.Buffer
+	err := s.be.Scanner.Scan(io.TeeReader(r, &buf))
+	if verr, ok := err.(*VirusError); ok {
+		if s.be.Quarantine {
+			return &quarantine.Error{Reason: "Virus found: " + verr.Name}
+		}
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected: virus found: " + verr.Name,
+		}
+	} else if err != nil {
+		if !s.be.FailOpen {
+			return errScannerUnavailable
+		}
+		// The scanner may have stopped reading in the middle of the message
+		if _, err := io.Copy(&buf, r); err != nil {
+			return err
+		}
+	}
+
+	return s.Session.Data(&buf)
+}
+
+func (s *session) Logout() error {
+	return s.Session.Logout()
+}
@@ -0,0 +1,184 @@
+// Package clamav implements a client for the clamd protocol, and a backend
+// scanning messages for viruses.
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	chunkSize      = 64 * 1024
+)
+
+// Scanner scans data for viruses.
+type Scanner interface {
+	// Scan reads r until EOF and scans its contents. It returns a
+	// *VirusError if a virus is found.
+	Scan(r io.Reader) error
+}
+
+// VirusError is returned by scanners when a virus is found.
+type VirusError struct {
+	Name string
+}
+
+func (err *VirusError) Error() string {
+	return "clamav: virus found: " + err.Name
+}
+
+// Client is a client for clamd. It implements Scanner by sending data with
+// the INSTREAM command.
+//
+// A new connection is opened for each command.
+type Client struct {
+	// The type of network, "tcp" or "unix". Defaults to "tcp".
+	Network string
+	// Address of the daemon, e.g. "localhost:3310" or
+	// "/run/clamav/clamd.ctl".
+	Addr string
+	// Maximum duration of a network operation: connecting, or reading or
+	// writing data. Slow uploads don't time out as long as each chunk makes
+	// progress. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// timeoutConn resets the deadline of the connection before each read and
+// write.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	conn, err := net.DialTimeout(network, c.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: conn, timeout: timeout}, nil
+}
+
+// command sends a command and calls fn, if not nil, to send its payload. It
+// returns the reply of the daemon.
+func (c *Client) command(cmd string, fn func(w io.Writer) error) (string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// The "z" prefix means that commands and replies are terminated by a
+	// NUL character
+	if _, err := io.WriteString(conn, "z"+cmd+"\x00"); err != nil {
+		return "", err
+	}
+	if fn != nil {
+		if err := fn(conn); err != nil {
+			return "", err
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// Ping checks that the daemon is available.
+func (c *Client) Ping() error {
+	reply, err := c.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamav: unexpected reply to PING: %q", reply)
+	}
+	return nil
+}
+
+// Scan implements Scanner.
+func (c *Client) Scan(r io.Reader) error {
+	reply, err := c.command("INSTREAM", func(w io.Writer) error {
+		return writeChunks(w, r)
+	})
+	if err != nil {
+		return err
+	}
+	return parseScanReply(reply)
+}
+
+// writeChunks writes data in the INSTREAM format: chunks prefixed with their
+// length as a 32-bit big-endian integer, followed by an empty chunk.
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseScanReply parses a reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseScanReply(reply string) error {
+	if strings.HasSuffix(reply, " ERROR") {
+		return errors.New("clamav: " + strings.TrimSuffix(reply, " ERROR"))
+	}
+
+	i := strings.IndexByte(reply, ':')
+	if i < 0 {
+		return fmt.Errorf("clamav: malformed reply: %q", reply)
+	}
+	result := strings.TrimSpace(reply[i+1:])
+
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &VirusError{Name: strings.TrimSuffix(result, " FOUND")}
+	default:
+		return fmt.Errorf("clamav: malformed reply: %q", reply)
+	}
+}
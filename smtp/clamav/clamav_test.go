@@ -0,0 +1,236 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd is a minimal clamd which detects the EICAR test file.
+type fakeClamd struct {
+	l net.Listener
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeClamd{l: l}
+	go d.serve()
+	return d
+}
+
+func (d *fakeClamd) client() *Client {
+	return &Client{Addr: d.l.Addr().String()}
+}
+
+func (d *fakeClamd) serve() {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	cmd, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var data []byte
+		for {
+			var size uint32
+			if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(br, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+		}
+		if bytes.Contains(data, []byte(eicar)) {
+			io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+func (d *fakeClamd) Close() error {
+	return d.l.Close()
+}
+
+func TestClient(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+	c := d.client()
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	if err := c.Scan(strings.NewReader("Hello")); err != nil {
+		t.Errorf("Scan(clean) = %v", err)
+	}
+
+	// Larger than a chunk
+	r := io.MultiReader(bytes.NewReader(make([]byte, chunkSize+42)), strings.NewReader(eicar))
+	err := c.Scan(r)
+	if verr, ok := err.(*VirusError); !ok || verr.Name != "Eicar-Signature" {
+		t.Errorf("Scan(infected) = %v", err)
+	}
+}
+
+// slowReader returns chunks of data, waiting before each one.
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.chunks--
+	return copy(b, make([]byte, chunkSize)), nil
+}
+
+func TestClient_slowUpload(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+	c := d.client()
+	c.Timeout = 100 * time.Millisecond
+
+	// The whole upload takes longer than the timeout
+	if err := c.Scan(&slowReader{chunks: 4, delay: 50 * time.Millisecond}); err != nil {
+		t.Errorf("Scan(slow) = %v", err)
+	}
+}
+
+func TestParseScanReply(t *testing.T) {
+	if err := parseScanReply("INSTREAM size limit exceeded. ERROR"); err == nil || err.Error() != "clamav: INSTREAM size limit exceeded." {
+		t.Errorf("parseScanReply(ERROR) = %v", err)
+	}
+	if err := parseScanReply("stream: lol"); err == nil {
+		t.Error("parseScanReply(malformed) = nil")
+	}
+}
+
+type backend struct {
+	messages []string
+}
+
+func (be *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &backendSession{be: be}, nil
+}
+
+type backendSession struct {
+	be *backend
+}
+
+func (s *backendSession) Reset()        {}
+func (s *backendSession) Logout() error { return nil }
+
+func (s *backendSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *backendSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *backendSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+
+func (s *backendSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.messages = append(s.be.messages, string(b))
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func sendMail(t *testing.T, addr, msg string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg))
+}
+
+func TestBackend(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+
+	be := &backend{}
+	cbe := &Backend{Backend: be, Scanner: d.client()}
+	s := smtp.NewServer(cbe)
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	if err := sendMail(t, addr, "Subject: Hi\r\n\r\nHello\r\n"); err != nil {
+		t.Fatalf("SendMail(clean) = %v", err)
+	}
+	if len(be.messages) != 1 || be.messages[0] != "Subject: Hi\r\n\r\nHello\r\n" {
+		t.Errorf("Invalid delivered messages: %q", be.messages)
+	}
+
+	err := sendMail(t, addr, "Subject: Hi\r\n\r\n"+eicar+"\r\n")
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 554 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) || !strings.Contains(smtpErr.Message, "Eicar-Signature") {
+		t.Errorf("SendMail(infected) = %v", err)
+	}
+	if len(be.messages) != 1 {
+		t.Errorf("Infected message has been delivered")
+	}
+
+	// Scanner unavailable
+	d.Close()
+	err = sendMail(t, addr, "Subject: Hi\r\n\r\nHello\r\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("SendMail(unavailable) = %v, want a 451 error", err)
+	}
+
+	cbe.FailOpen = true
+	if err := sendMail(t, addr, "Subject: Hi\r\n\r\nHello\r\n"); err != nil {
+		t.Errorf("SendMail(unavailable, fail open) = %v", err)
+	}
+	if len(be.messages) != 2 {
+		t.Errorf("Message hasn't been delivered with FailOpen")
+	}
+}
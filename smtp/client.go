@@ -5,15 +5,18 @@
 package smtp
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -38,6 +41,10 @@ type Client struct {
 	helloError error    // the error from the hello
 	rcpts      []string // recipients accumulated for the current session
 
+	// Protects conn deadlines, which may be set by a context watcher
+	deadlineMutex sync.Mutex
+	cancelled     bool // the context of the in-flight operation is done
+
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
 	// Time to wait for responses after final dot.
@@ -45,8 +52,36 @@ type Client struct {
 
 	// Logger for all network activity.
 	DebugWriter io.Writer
+
+	// If set, messages sent to a server which doesn't advertise 8BITMIME are
+	// converted to 7-bit MIME: 8-bit textual parts are re-encoded with
+	// quoted-printable, other 8-bit parts with base64 and 8-bit header fields
+	// with RFC 2047 encoded-words. Messages which can't be converted, e.g.
+	// because an address contains non-ASCII characters, are rejected with
+	// ErrSMTPUTF8Unsupported, and so are non-ASCII addresses passed to Mail
+	// and Rcpt if the server doesn't advertise SMTPUTF8.
+	Downgrade8BitMIME bool
+
+	// If set, checked by Mail before a transaction is started. Mail fails if
+	// the connection doesn't satisfy the policy.
+	TLSPolicy TLSPolicy
 }
 
+// TLSPolicy decides whether a message can be transmitted over a connection,
+// e.g. according to an MTA-STS (RFC 8461) policy.
+type TLSPolicy interface {
+	// CheckTLS returns an error if the connection to the server doesn't
+	// satisfy the policy. state is nil if the connection doesn't use TLS.
+	// serverName is the host name the client connected to, it may be empty
+	// if it is unknown.
+	CheckTLS(state *tls.ConnectionState, serverName string) error
+}
+
+// ErrTLSRequired is returned by Client.Mail when the message requires TLS
+// (see MailOptions.RequireTLS) but the connection doesn't use TLS with a
+// verified certificate.
+var ErrTLSRequired = errors.New("smtp: REQUIRETLS message needs a verified TLS connection")
+
 // 30 seconds was chosen as it's the same duration as http.DefaultTransport's
 // timeout.
 const defaultTimeout = 30 * time.Second
@@ -94,6 +129,14 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn) (*Client, error) {
+	c := newClient(conn)
+	if err := c.greet(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(conn net.Conn) *Client {
 	c := &Client{
 		localName: "localhost",
 		// As recommended by RFC 5321. For DATA command reply (3xx one) RFC
@@ -106,21 +149,24 @@ func NewClient(conn net.Conn) (*Client, error) {
 	}
 
 	c.setConn(conn)
+	return c
+}
 
+// greet reads the server greeting.
+func (c *Client) greet() error {
 	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
-	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(time.Now().Add(5 * time.Minute))
+	defer c.setDeadline(time.Time{})
 
 	_, _, err := c.text.ReadResponse(220)
 	if err != nil {
 		c.text.Close()
 		if protoErr, ok := err.(*textproto.Error); ok {
-			return nil, toSMTPErr(protoErr)
+			return toSMTPErr(protoErr)
 		}
-		return nil, err
+		return err
 	}
-
-	return c, nil
+	return nil
 }
 
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
@@ -134,9 +180,21 @@ func NewClientLMTP(conn net.Conn) (*Client, error) {
 	return c, nil
 }
 
+// setDeadline sets the deadline of the connection, unless the context of
+// the in-flight operation is done.
+func (c *Client) setDeadline(t time.Time) {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	if !c.cancelled {
+		c.conn.SetDeadline(t)
+	}
+}
+
 // setConn sets the underlying network connection for the client.
 func (c *Client) setConn(conn net.Conn) {
+	c.deadlineMutex.Lock()
 	c.conn = conn
+	c.deadlineMutex.Unlock()
 
 	var r io.Reader = conn
 	var w io.Writer = conn
@@ -203,8 +261,8 @@ func (c *Client) Hello(localName string) error {
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(time.Now().Add(c.CommandTimeout))
+	defer c.setDeadline(time.Time{})
 
 	id, err := c.text.Cmd(format, args...)
 	if err != nil {
@@ -396,6 +454,9 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
 		fmt.Fprintf(&sb, " SIZE=%v", opts.Size)
 	}
+	if err := c.checkTLSPolicy(opts); err != nil {
+		return err
+	}
 	if opts != nil && opts.RequireTLS {
 		if _, ok := c.ext["REQUIRETLS"]; ok {
 			sb.WriteString(" REQUIRETLS")
@@ -403,11 +464,12 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 			return errors.New("smtp: server does not support REQUIRETLS")
 		}
 	}
-	if opts != nil && opts.UTF8 {
-		if _, ok := c.ext["SMTPUTF8"]; ok {
+	_, smtputf8 := c.ext["SMTPUTF8"]
+	if (opts != nil && opts.UTF8) || (!isPrintableASCII(from) && (smtputf8 || c.Downgrade8BitMIME)) {
+		if smtputf8 {
 			sb.WriteString(" SMTPUTF8")
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return ErrSMTPUTF8Unsupported
 		}
 	}
 	if _, ok := c.ext["DSN"]; ok && opts != nil {
@@ -432,10 +494,58 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
+	if opts != nil && (opts.HoldFor != 0 || !opts.HoldUntil.IsZero()) {
+		if _, ok := c.ext["FUTURERELEASE"]; !ok {
+			return errors.New("smtp: server does not support FUTURERELEASE")
+		}
+		switch {
+		case opts.HoldFor != 0 && !opts.HoldUntil.IsZero():
+			return errors.New("smtp: HOLDFOR and HOLDUNTIL are mutually exclusive")
+		case opts.HoldFor < 0:
+			return errors.New("smtp: Malformed HOLDFOR parameter value")
+		case opts.HoldFor != 0:
+			// Round up, so that short intervals don't disable the hold
+			fmt.Fprintf(&sb, " HOLDFOR=%v", int64((opts.HoldFor+time.Second-1)/time.Second))
+		default:
+			fmt.Fprintf(&sb, " HOLDUNTIL=%s", opts.HoldUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	if opts != nil && opts.MTPriority != nil {
+		if *opts.MTPriority < MinMTPriority || *opts.MTPriority > MaxMTPriority {
+			return errors.New("smtp: Malformed MT-PRIORITY parameter value")
+		}
+		if _, ok := c.ext["MT-PRIORITY"]; ok {
+			fmt.Fprintf(&sb, " MT-PRIORITY=%d", *opts.MTPriority)
+		}
+		// Priority is advisory, it can be discarded if server does not
+		// support MT-PRIORITY.
+	}
 	_, _, err := c.cmd(250, "%s", sb.String())
 	return err
 }
 
+// checkTLSPolicy checks that the connection satisfies the REQUIRETLS option
+// and the TLS policy, if any.
+func (c *Client) checkTLSPolicy(opts *MailOptions) error {
+	var state *tls.ConnectionState
+	if cs, ok := c.TLSConnectionState(); ok {
+		state = &cs
+	}
+
+	if opts != nil && opts.RequireTLS {
+		// RFC 8689 section 4.2.1: the certificate must be valid and match
+		// the server name.
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return ErrTLSRequired
+		}
+	}
+
+	if c.TLSPolicy != nil {
+		return c.TLSPolicy.CheckTLS(state, c.serverName)
+	}
+	return nil
+}
+
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
@@ -448,6 +558,9 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
+	if _, ok := c.ext["SMTPUTF8"]; !ok && c.Downgrade8BitMIME && !isPrintableASCII(to) {
+		return ErrSMTPUTF8Unsupported
+	}
 
 	var sb strings.Builder
 	// A high enough power of 2 than 510+29+501
@@ -509,8 +622,8 @@ func (d *dataCloser) Close() error {
 		return err
 	}
 
-	d.c.conn.SetDeadline(time.Now().Add(d.c.SubmissionTimeout))
-	defer d.c.conn.SetDeadline(time.Time{})
+	d.c.setDeadline(time.Now().Add(d.c.SubmissionTimeout))
+	defer d.c.setDeadline(time.Time{})
 
 	expectedResponses := len(d.c.rcpts)
 	if d.c.lmtp {
@@ -548,13 +661,33 @@ func (d *dataCloser) Close() error {
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
 //
+// If the message needs to be converted to 7-bit MIME (see
+// Downgrade8BitMIME), it is buffered until the writer is closed. If the
+// conversion fails, the connection is closed since the transaction can't be
+// aborted anymore. Use SendMail to detect such failures before the
+// transaction is started.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Data() (io.WriteCloser, error) {
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c: c, WriteCloser: c.text.DotWriter()}, nil
+	var w io.WriteCloser = c.text.DotWriter()
+	if c.needsDowngrade() {
+		w = &downgradeWriter{c: c, w: w}
+	}
+	return &dataCloser{c: c, WriteCloser: w}, nil
+}
+
+// needsDowngrade reports whether messages need to be converted to 7-bit MIME
+// before being sent.
+func (c *Client) needsDowngrade() bool {
+	if !c.Downgrade8BitMIME {
+		return false
+	}
+	_, ok := c.ext["8BITMIME"]
+	return !ok
 }
 
 // LMTPData is the LMTP-specific version of the Data method. It accepts a callback
@@ -594,6 +727,22 @@ func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.Wri
 func (c *Client) SendMail(from string, to []string, r io.Reader) error {
 	var err error
 
+	if err = c.hello(); err != nil {
+		return err
+	}
+	if c.needsDowngrade() {
+		// Convert the message before starting the transaction, so that
+		// conversion failures don't leave the transaction half-done.
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if b, err = downgradeMessage(b); err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
 	if err = c.Mail(from, nil); err != nil {
 		return err
 	}
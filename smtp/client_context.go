@@ -0,0 +1,217 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// aLongTimeAgo is a deadline in the past, used to abort blocking I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch aborts the in-flight I/O when ctx is done, by setting a deadline in
+// the past on the connection. The returned function stops watching and
+// reports whether the I/O has been aborted. It must be called exactly once.
+func (c *Client) watch(ctx context.Context) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.deadlineMutex.Lock()
+			select {
+			case <-stopped:
+			default:
+				c.cancelled = true
+				c.conn.SetDeadline(aLongTimeAgo)
+			}
+			c.deadlineMutex.Unlock()
+		case <-stopped:
+		}
+	}()
+
+	return func() bool {
+		c.deadlineMutex.Lock()
+		defer c.deadlineMutex.Unlock()
+		close(stopped)
+		cancelled := c.cancelled
+		c.cancelled = false
+		return cancelled
+	}
+}
+
+// withContext runs fn, aborting it when ctx is done. If fn has been aborted,
+// the context error is returned.
+func (c *Client) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := c.watch(ctx)
+	err := fn()
+	if stop() && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// DialContext is like Dial, but aborts connecting and reading the greeting
+// when ctx is done.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	conn, err := defaultDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(conn)
+	if err := c.withContext(ctx, c.greet); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.serverName, _, _ = net.SplitHostPort(addr)
+	return c, nil
+}
+
+// HelloContext is like Hello, but aborts the command when ctx is done.
+//
+// Once a command has been aborted, the state of the connection is unknown
+// and the client should be closed. This applies to all context-taking
+// methods.
+func (c *Client) HelloContext(ctx context.Context, localName string) error {
+	return c.withContext(ctx, func() error {
+		return c.Hello(localName)
+	})
+}
+
+// StartTLSContext is like StartTLS, but aborts the command and the TLS
+// handshake when ctx is done.
+func (c *Client) StartTLSContext(ctx context.Context, config *tls.Config) error {
+	return c.withContext(ctx, func() error {
+		return c.StartTLS(config)
+	})
+}
+
+// AuthContext is like Auth, but aborts the authentication exchange when ctx
+// is done.
+func (c *Client) AuthContext(ctx context.Context, a sasl.Client) error {
+	return c.withContext(ctx, func() error {
+		return c.Auth(a)
+	})
+}
+
+// MailContext is like Mail, but aborts the command when ctx is done.
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Mail(from, opts)
+	})
+}
+
+// RcptContext is like Rcpt, but aborts the command when ctx is done.
+func (c *Client) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Rcpt(to, opts)
+	})
+}
+
+// DataContext is like Data, but aborts the command when ctx is done. The
+// returned writer keeps watching ctx until it's closed: writing the message
+// and waiting for the final reply are aborted as well.
+func (c *Client) DataContext(ctx context.Context) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := c.watch(ctx)
+	w, err := c.Data()
+	if err != nil {
+		if stop() {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &contextWriter{WriteCloser: w, ctx: ctx, stop: stop}, nil
+}
+
+// contextWriter stops watching a context when closed.
+type contextWriter struct {
+	io.WriteCloser
+	ctx    context.Context
+	stop   func() bool
+	closed bool
+}
+
+func (w *contextWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	if err != nil && w.ctx.Err() != nil {
+		return n, w.ctx.Err()
+	}
+	return n, err
+}
+
+func (w *contextWriter) Close() error {
+	if w.closed {
+		return errors.New("smtp: data writer closed twice")
+	}
+	w.closed = true
+	err := w.WriteCloser.Close()
+	if w.stop() && err != nil {
+		return w.ctx.Err()
+	}
+	return err
+}
+
+// SendMailContext is like SendMail, but aborts the transaction when ctx is
+// done.
+func (c *Client) SendMailContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	return c.withContext(ctx, func() error {
+		return c.SendMail(from, to, r)
+	})
+}
+
+// SendMailContext is like the SendMail function, but aborts connecting and
+// sending the message when ctx is done.
+func SendMailContext(ctx context.Context, addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return err
+		}
+	}
+
+	c, err := DialContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(nil); err != nil {
+			return err
+		}
+		if a != nil {
+			if ok, _ := c.Extension("AUTH"); !ok {
+				return errors.New("smtp: server doesn't support AUTH")
+			}
+			if err := c.Auth(a); err != nil {
+				return err
+			}
+		}
+		if err := c.SendMail(from, to, r); err != nil {
+			return err
+		}
+		return c.Quit()
+	})
+}
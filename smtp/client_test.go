@@ -7,8 +7,10 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io"
 	"net"
 	"net/textproto"
@@ -1031,3 +1033,192 @@ func TestClientDSN(t *testing.T) {
 		t.Errorf("wrote %q; want %q", actualcmds, client)
 	}
 }
+
+var futureReleaseClient = `MAIL FROM:<root@nsa.gov> HOLDFOR=3600 MT-PRIORITY=4
+MAIL FROM:<root@nsa.gov> HOLDFOR=1
+MAIL FROM:<root@nsa.gov> HOLDUNTIL=2030-01-02T03:04:05Z
+`
+
+func TestClientFutureReleaseAndPriority(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 ok\r\n" +
+		"250 ok\r\n" +
+		"250 ok\r\n"
+	client := strings.Join(strings.Split(futureReleaseClient, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.didHello = true
+	c.ext = map[string]string{}
+
+	var priority int
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldFor: time.Hour}); err == nil {
+		t.Fatalf("MAIL should fail when FUTURERELEASE is not supported")
+	}
+
+	c.ext["FUTURERELEASE"] = "604800 2030-01-01T00:00:00Z"
+	c.ext["MT-PRIORITY"] = ""
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldFor: time.Hour, HoldUntil: time.Now()}); err == nil {
+		t.Fatalf("MAIL should fail when both HOLDFOR and HOLDUNTIL are set")
+	}
+	priority = 10
+	if err := c.Mail("root@nsa.gov", &MailOptions{MTPriority: &priority}); err == nil {
+		t.Fatalf("MAIL should fail when MT-PRIORITY is out of range")
+	}
+	priority = 4
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldFor: time.Hour, MTPriority: &priority}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldFor: 500 * time.Millisecond}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	holdUntil := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldUntil: holdUntil}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	c.Close()
+	if actualcmds := wrote.String(); client != actualcmds {
+		t.Errorf("wrote %q; want %q", actualcmds, client)
+	}
+}
+
+type testTLSPolicy struct {
+	called     bool
+	state      *tls.ConnectionState
+	serverName string
+	err        error
+}
+
+func (p *testTLSPolicy) CheckTLS(state *tls.ConnectionState, serverName string) error {
+	p.called = true
+	p.state = state
+	p.serverName = serverName
+	return p.err
+}
+
+func TestClientTLSPolicy(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 ok\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.didHello = true
+	c.serverName = "mx.example.org"
+	c.ext = map[string]string{"REQUIRETLS": ""}
+
+	if err := c.Mail("root@nsa.gov", &MailOptions{RequireTLS: true}); err != ErrTLSRequired {
+		t.Fatalf("Mail() = %v, want %v", err, ErrTLSRequired)
+	}
+
+	policyErr := errors.New("policy violation")
+	policy := &testTLSPolicy{err: policyErr}
+	c.TLSPolicy = policy
+	if err := c.Mail("root@nsa.gov", nil); err != policyErr {
+		t.Fatalf("Mail() = %v, want %v", err, policyErr)
+	}
+	if !policy.called || policy.state != nil || policy.serverName != "mx.example.org" {
+		t.Errorf("CheckTLS called with %v, %q", policy.state, policy.serverName)
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q; want nothing", wrote.String())
+	}
+
+	policy.err = nil
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+}
+
+// stallingServer accepts a single connection, replies to the greeting and to
+// EHLO, and then never replies.
+func stallingServer(t *testing.T, greet bool) (addr string, done func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if greet {
+			io.WriteString(conn, "220 localhost ESMTP\r\n")
+			br := bufio.NewReader(conn)
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			io.WriteString(conn, "250-localhost\r\n250 8BITMIME\r\n")
+		}
+		<-closed
+	}()
+	return l.Addr().String(), func() {
+		close(closed)
+		l.Close()
+	}
+}
+
+func TestClient_MailContext(t *testing.T) {
+	addr, done := stallingServer(t, true)
+	defer done()
+
+	c, err := DialContext(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("DialContext() = %v", err)
+	}
+	defer c.Close()
+	if err := c.HelloContext(context.Background(), "localhost"); err != nil {
+		t.Fatalf("HelloContext() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err := c.MailContext(ctx, "root@nsa.gov", nil); err != context.Canceled {
+		t.Fatalf("MailContext() = %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("MailContext() took %v", d)
+	}
+
+	if err := c.RcptContext(ctx, "root@gchq.gov.uk", nil); err != context.Canceled {
+		t.Errorf("RcptContext() with a done context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDialContext_timeout(t *testing.T) {
+	addr, done := stallingServer(t, false)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, addr); err != context.DeadlineExceeded {
+		t.Fatalf("DialContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const defaultWaitTimeout = 30 * time.Second
+
+// parsedPart is a leaf part of a message.
+type parsedPart struct {
+	ContentType string              `json:"contentType"`
+	Filename    string              `json:"filename,omitempty"`
+	Header      map[string][]string `json:"header"`
+	Size        int                 `json:"size"`
+	// Decoded content, as text for textual parts, as base64 otherwise
+	Text string `json:"text,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+type parsedMessage struct {
+	*storedMessage
+	Header map[string][]string `json:"header"`
+	Parts  []parsedPart        `json:"parts"`
+}
+
+var wordDecoder mime.WordDecoder
+
+func decodeHeader(h map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(h))
+	for k, values := range h {
+		for _, v := range values {
+			if dec, err := wordDecoder.DecodeHeader(v); err == nil {
+				v = dec
+			}
+			out[k] = append(out[k], v)
+		}
+	}
+	return out
+}
+
+// parseParts flattens a MIME entity to its leaf parts.
+func parseParts(h textproto.MIMEHeader, body io.Reader) ([]parsedPart, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		var parts []parsedPart
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return parts, nil
+			} else if err != nil {
+				return parts, err
+			}
+			children, err := parseParts(p.Header, p)
+			parts = append(parts, children...)
+			if err != nil {
+				return parts, err
+			}
+		}
+	}
+
+	// multipart.Reader already decodes quoted-printable parts
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	part := parsedPart{
+		ContentType: mediaType,
+		Header:      decodeHeader(h),
+		Size:        len(b),
+	}
+	if _, dispParams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		part.Filename = dispParams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		part.Text = string(b)
+	} else {
+		part.Data = b
+	}
+	return []parsedPart{part}, nil
+}
+
+type httpHandler struct {
+	store *store
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "api/messages":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, h.store.List())
+		case http.MethodDelete:
+			h.store.DeleteAll()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(path, "api/messages/"):
+		h.serveMessage(w, r, strings.TrimPrefix(path, "api/messages/"))
+	case path == "api/wait" && r.Method == http.MethodGet:
+		h.serveWait(w, r)
+	case path == "api/events" && r.Method == http.MethodGet:
+		h.serveEvents(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *httpHandler) serveMessage(w http.ResponseWriter, r *http.Request, path string) {
+	id, sub := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		id, sub = path[:i], path[i+1:]
+	}
+
+	msg := h.store.Get(id)
+	if msg == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodDelete:
+		h.store.Delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "" && r.Method == http.MethodGet:
+		b, err := h.store.Raw(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse message: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		parts, err := parseParts(textproto.MIMEHeader(m.Header), m.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse message: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, &parsedMessage{
+			storedMessage: msg,
+			Header:        decodeHeader(m.Header),
+			Parts:         parts,
+		})
+	case sub == "raw" && r.Method == http.MethodGet:
+		b, err := h.store.Raw(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func matchMessage(msg *storedMessage, q map[string][]string) bool {
+	if from := q["from"]; len(from) > 0 && !strings.EqualFold(msg.From, from[0]) {
+		return false
+	}
+	if to := q["to"]; len(to) > 0 {
+		found := false
+		for _, rcpt := range msg.To {
+			if strings.EqualFold(rcpt, to[0]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if subject := q["subject"]; len(subject) > 0 && !strings.Contains(msg.Subject, subject[0]) {
+		return false
+	}
+	return true
+}
+
+// serveWait returns the first message matching the from, to and subject
+// query parameters, waiting for one to arrive if necessary.
+func (h *httpHandler) serveWait(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	timeout := defaultWaitTimeout
+	if s := q.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	// Subscribe before listing messages to avoid missing arrivals
+	ch, unsubscribe := h.store.Subscribe()
+	defer unsubscribe()
+
+	for _, msg := range h.store.List() {
+		if matchMessage(msg, q) {
+			writeJSON(w, msg)
+			return
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			if matchMessage(msg, q) {
+				writeJSON(w, msg)
+				return
+			}
+		case <-timer.C:
+			http.Error(w, "no matching message", http.StatusRequestTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveEvents streams new messages as server-sent events.
+func (h *httpHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, unsubscribe := h.store.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case msg := <-ch:
+			b, err := json.Marshal(msg)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: message\nid: %v\ndata: %s\n\n", msg.ID, b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "From: root@nsa.gov\r\n" +
+	"To: root@gchq.gov.uk\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=foo\r\n" +
+	"\r\n" +
+	"--foo\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hey =E2=9D=A4\r\n" +
+	"--foo\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=hello.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--foo--\r\n"
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func doDelete(t *testing.T, url string) int {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTP(t *testing.T) {
+	st := &store{}
+	ts := httptest.NewServer(&httpHandler{store: st})
+	defer ts.Close()
+
+	msg, err := st.Add("root@nsa.gov", []string{"root@gchq.gov.uk"}, []byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []storedMessage
+	if code := getJSON(t, ts.URL+"/api/messages", &list); code != http.StatusOK {
+		t.Fatalf("GET /api/messages = %v", code)
+	}
+	if len(list) != 1 || list[0].ID != msg.ID || list[0].Subject != "=?utf-8?q?Caf=C3=A9?=" {
+		t.Errorf("Invalid message list: %+v", list)
+	}
+
+	var parsed struct {
+		ID     string
+		Header map[string][]string
+		Parts  []parsedPart
+	}
+	if code := getJSON(t, ts.URL+"/api/messages/"+msg.ID, &parsed); code != http.StatusOK {
+		t.Fatalf("GET /api/messages/%v = %v", msg.ID, code)
+	}
+	if subject := parsed.Header["Subject"]; len(subject) != 1 || subject[0] != "Café" {
+		t.Errorf("Invalid Subject: %v", subject)
+	}
+	if len(parsed.Parts) != 2 {
+		t.Fatalf("Invalid parts: %+v", parsed.Parts)
+	}
+	if p := parsed.Parts[0]; p.ContentType != "text/plain" || p.Text != "Hey ❤" {
+		t.Errorf("Invalid text part: %+v", p)
+	}
+	if p := parsed.Parts[1]; p.Filename != "hello.bin" || string(p.Data) != "\x00\x01\x02" {
+		t.Errorf("Invalid attachment part: %+v", p)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/messages/" + msg.ID + "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(raw) != testMessage {
+		t.Errorf("Invalid raw message: %q", raw)
+	}
+
+	if code := doDelete(t, ts.URL+"/api/messages/"+msg.ID); code != http.StatusNoContent {
+		t.Errorf("DELETE /api/messages/%v = %v", msg.ID, code)
+	}
+	if code := getJSON(t, ts.URL+"/api/messages/"+msg.ID, nil); code != http.StatusNotFound {
+		t.Errorf("GET deleted message = %v, want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestHTTP_wait(t *testing.T) {
+	st := &store{}
+	ts := httptest.NewServer(&httpHandler{store: st})
+	defer ts.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		st.Add("root@nsa.gov", []string{"other@gchq.gov.uk"}, []byte(testMessage))
+		st.Add("root@nsa.gov", []string{"root@gchq.gov.uk"}, []byte(testMessage))
+	}()
+
+	var msg storedMessage
+	if code := getJSON(t, ts.URL+"/api/wait?to=root@gchq.gov.uk&timeout=5s", &msg); code != http.StatusOK {
+		t.Fatalf("GET /api/wait = %v", code)
+	}
+	if msg.ID != "2" {
+		t.Errorf("Invalid message: %+v", msg)
+	}
+
+	if code := getJSON(t, ts.URL+"/api/wait?to=nobody@example.org&timeout=10ms", nil); code != http.StatusRequestTimeout {
+		t.Errorf("GET /api/wait = %v, want %v", code, http.StatusRequestTimeout)
+	}
+}
+
+func TestHTTP_events(t *testing.T) {
+	st := &store{}
+	ts := httptest.NewServer(&httpHandler{store: st})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Invalid Content-Type: %v", ct)
+	}
+
+	st.Add("root@nsa.gov", []string{"root@gchq.gov.uk"}, []byte(testMessage))
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || lines[0] != "event: message" || lines[1] != "id: 1" || !strings.HasPrefix(lines[2], "data: {") {
+		t.Errorf("Invalid event: %q", lines)
+	}
+}
+
+func TestStore_limits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtp-debug-server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &store{dir: dir, maxMessages: 2}
+	for i := 0; i < 3; i++ {
+		if _, err := st.Add("root@nsa.gov", nil, []byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := st.List()
+	if len(l) != 2 || l[0].ID != "2" {
+		t.Errorf("Invalid messages: %+v", l)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Invalid number of files: %v", len(files))
+	}
+	if b, err := st.Raw(l[1]); err != nil || string(b) != testMessage {
+		t.Errorf("Raw() = %q, %v", b, err)
+	}
+
+	// Restarting with the same directory loads existing messages and doesn't
+	// overwrite them
+	st = &store{dir: dir}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+	if l := st.List(); len(l) != 2 || l[0].ID != "2" || l[1].ID != "3" {
+		t.Errorf("Invalid loaded messages: %+v", l)
+	} else if l[0].From != "root@nsa.gov" || len(l[0].To) != 1 || l[0].To[0] != "root@gchq.gov.uk" || l[0].Size != len(testMessage) {
+		t.Errorf("Invalid loaded message: %+v", l[0])
+	}
+	if msg, err := st.Add("root@nsa.gov", nil, []byte(testMessage)); err != nil || msg.ID != "4" {
+		t.Errorf("Add() after restart = %+v, %v, want ID 4", msg, err)
+	}
+
+	st = &store{maxBytes: int64(len(testMessage)) + 1}
+	st.Add("root@nsa.gov", nil, []byte(testMessage))
+	st.Add("root@nsa.gov", nil, []byte(testMessage))
+	if l := st.List(); len(l) != 1 || l[0].ID != "2" {
+		t.Errorf("Invalid messages: %+v", l)
+	}
+}
+
+func TestParseParts_quotedPrintable(t *testing.T) {
+	h := textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"Quoted-Printable"},
+	}
+	parts, err := parseParts(h, strings.NewReader("Hey =E2=9D=A4=\r\n!\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0].Text != "Hey ❤!\r\n" {
+		t.Errorf("parseParts() = %+v", parts)
+	}
+}
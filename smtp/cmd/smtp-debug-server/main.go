@@ -1,45 +1,96 @@
+// Command smtp-debug-server is a development mail catcher.
+//
+// It accepts all messages and keeps them in memory, or on disk if a
+// directory is specified, in which case messages left by a previous run are
+// loaded at startup. Messages can be inspected with an HTTP API:
+//
+//	GET    /api/messages          List messages
+//	DELETE /api/messages          Delete all messages
+//	GET    /api/messages/<id>     Get a parsed message (header and parts)
+//	GET    /api/messages/<id>/raw Get a raw message
+//	DELETE /api/messages/<id>     Delete a message
+//	GET    /api/wait              Wait for a message matching the from, to and
+//	                              subject query parameters, for at most
+//	                              timeout (defaults to 30s)
+//	GET    /api/events            Server-sent events stream of new messages
 package main
 
 import (
 	"flag"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/emersion/go-smtp"
 )
 
-var addr = "127.0.0.1:1025"
+var (
+	addr        = "127.0.0.1:1025"
+	httpAddr    = "127.0.0.1:8025"
+	dir         string
+	maxMessages = 1000
+	maxBytes    int64
+	debug       = true
+)
 
 func init() {
 	flag.StringVar(&addr, "l", addr, "Listen address")
+	flag.StringVar(&httpAddr, "http", httpAddr, "HTTP API listen address")
+	flag.StringVar(&dir, "dir", "", "Store messages in this directory instead of memory")
+	flag.IntVar(&maxMessages, "max-messages", maxMessages, "Maximum number of stored messages, 0 for no limit")
+	flag.Int64Var(&maxBytes, "max-bytes", 0, "Maximum total size of stored messages, 0 for no limit")
+	flag.BoolVar(&debug, "debug", debug, "Print SMTP transcripts")
 }
 
-type backend struct{}
+type backend struct {
+	store *store
+}
 
 func (bkd *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &session{}, nil
+	return &session{store: bkd.store}, nil
 }
 
-type session struct{}
+type session struct {
+	store *store
+
+	from string
+	to   []string
+}
 
 func (s *session) AuthPlain(username, password string) error {
 	return nil
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.to = nil
 	return nil
 }
 
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg, err := s.store.Add(s.from, s.to, b)
+	if err != nil {
+		return err
+	}
+	log.Printf("Received message %v from <%v>", msg.ID, s.from)
 	return nil
 }
 
-func (s *session) Reset() {}
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
 
 func (s *session) Logout() error {
 	return nil
@@ -48,12 +99,24 @@ func (s *session) Logout() error {
 func main() {
 	flag.Parse()
 
-	s := smtp.NewServer(&backend{})
+	st := &store{dir: dir, maxMessages: maxMessages, maxBytes: maxBytes}
+	if err := st.init(); err != nil {
+		log.Fatal(err)
+	}
+
+	s := smtp.NewServer(&backend{store: st})
 
 	s.Addr = addr
 	s.Domain = "localhost"
 	s.AllowInsecureAuth = true
-	s.Debug = os.Stdout
+	if debug {
+		s.Debug = os.Stdout
+	}
+
+	go func() {
+		log.Println("Starting HTTP server at", httpAddr)
+		log.Fatal(http.ListenAndServe(httpAddr, &httpHandler{store: st}))
+	}()
 
 	log.Println("Starting SMTP server at", addr)
 	log.Fatal(s.ListenAndServe())
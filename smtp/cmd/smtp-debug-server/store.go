@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storedMessage is a message received by the server.
+type storedMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Received time.Time `json:"received"`
+	Size     int       `json:"size"`
+
+	data []byte // nil if the message is stored on disk
+	path string
+}
+
+// store keeps received messages. When a limit is reached, the oldest
+// messages are evicted.
+type store struct {
+	// Directory where messages are written. If empty, messages are kept in
+	// memory.
+	dir string
+	// Maximum number of messages and maximum total size of messages. Zero
+	// means no limit.
+	maxMessages int
+	maxBytes    int64
+
+	mutex       sync.Mutex
+	messages    []*storedMessage
+	size        int64
+	nextID      uint64
+	subscribers map[chan *storedMessage]struct{}
+}
+
+// init prepares the store directory. Existing messages are loaded, and new
+// messages are numbered after them so that they aren't overwritten.
+//
+// The envelope of loaded messages isn't stored on disk: the sender and
+// recipients are taken from the header.
+func (st *store) init() error {
+	if st.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(st.dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return err
+	}
+
+	type storedFile struct {
+		id uint64
+		fi os.FileInfo
+	}
+	var l []storedFile
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".eml") || !fi.Mode().IsRegular() {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".eml"), 10, 64)
+		if err != nil {
+			continue
+		}
+		l = append(l, storedFile{id, fi})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].id < l[j].id
+	})
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, f := range l {
+		path := filepath.Join(st.dir, f.fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		msg := &storedMessage{
+			ID:       strconv.FormatUint(f.id, 10),
+			Received: f.fi.ModTime(),
+			Size:     len(data),
+			path:     path,
+		}
+		if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+			msg.Subject = m.Header.Get("Subject")
+			msg.From = headerSender(m.Header)
+			msg.To = headerRecipients(m.Header)
+		}
+
+		st.messages = append(st.messages, msg)
+		st.size += int64(msg.Size)
+		st.nextID = f.id
+	}
+	st.evict()
+	return nil
+}
+
+// headerSender returns the sender of a message loaded from disk.
+func headerSender(h mail.Header) string {
+	for _, k := range []string{"Return-Path", "From"} {
+		if addr, err := mail.ParseAddress(h.Get(k)); err == nil {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+// headerRecipients returns the recipients of a message loaded from disk.
+func headerRecipients(h mail.Header) []string {
+	var to []string
+	for _, k := range []string{"To", "Cc"} {
+		addrs, _ := h.AddressList(k)
+		for _, addr := range addrs {
+			to = append(to, addr.Address)
+		}
+	}
+	return to
+}
+
+func (st *store) Add(from string, to []string, data []byte) (*storedMessage, error) {
+	msg := &storedMessage{
+		From:     from,
+		To:       to,
+		Received: time.Now(),
+		Size:     len(data),
+	}
+	if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		msg.Subject = m.Header.Get("Subject")
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.nextID++
+	msg.ID = strconv.FormatUint(st.nextID, 10)
+
+	if st.dir != "" {
+		msg.path = filepath.Join(st.dir, msg.ID+".eml")
+		if err := ioutil.WriteFile(msg.path, data, 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		msg.data = data
+	}
+
+	st.messages = append(st.messages, msg)
+	st.size += int64(msg.Size)
+	st.evict()
+
+	for ch := range st.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			// Slow subscriber, drop the notification
+		}
+	}
+
+	return msg, nil
+}
+
+// evict removes the oldest messages until the limits are satisfied. The
+// newest message is always kept. The mutex must be held.
+func (st *store) evict() {
+	for len(st.messages) > 1 && ((st.maxMessages > 0 && len(st.messages) > st.maxMessages) || (st.maxBytes > 0 && st.size > st.maxBytes)) {
+		st.remove(0)
+	}
+}
+
+// remove removes the i-th message. The mutex must be held.
+func (st *store) remove(i int) {
+	msg := st.messages[i]
+	st.messages = append(st.messages[:i], st.messages[i+1:]...)
+	st.size -= int64(msg.Size)
+	if msg.path != "" {
+		os.Remove(msg.path)
+	}
+}
+
+func (st *store) List() []*storedMessage {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	l := make([]*storedMessage, len(st.messages))
+	copy(l, st.messages)
+	return l
+}
+
+func (st *store) Get(id string) *storedMessage {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, msg := range st.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (st *store) Raw(msg *storedMessage) ([]byte, error) {
+	if msg.path != "" {
+		return ioutil.ReadFile(msg.path)
+	}
+	return msg.data, nil
+}
+
+func (st *store) Delete(id string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for i, msg := range st.messages {
+		if msg.ID == id {
+			st.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (st *store) DeleteAll() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for len(st.messages) > 0 {
+		st.remove(0)
+	}
+}
+
+// Subscribe returns a channel receiving new messages. The returned function
+// must be called to unsubscribe.
+func (st *store) Subscribe() (<-chan *storedMessage, func()) {
+	ch := make(chan *storedMessage, 16)
+
+	st.mutex.Lock()
+	if st.subscribers == nil {
+		st.subscribers = make(map[chan *storedMessage]struct{})
+	}
+	st.subscribers[ch] = struct{}{}
+	st.mutex.Unlock()
+
+	return ch, func() {
+		st.mutex.Lock()
+		delete(st.subscribers, ch)
+		st.mutex.Unlock()
+	}
+}
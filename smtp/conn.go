@@ -25,6 +25,7 @@ type Conn struct {
 	text   *textproto.Conn
 	server *Server
 	helo   string
+	ehlo   bool
 
 	// Number of errors witnessed on this connection
 	errCount int
@@ -42,6 +43,8 @@ type Conn struct {
 	fromReceived bool
 	recipients   []string
 	didAuth      bool
+
+	debugIn, debugOut io.Writer
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
@@ -50,6 +53,10 @@ func newConn(c net.Conn, s *Server) *Conn {
 		conn:   c,
 	}
 
+	if s.DebugConn != nil {
+		sc.debugIn, sc.debugOut = s.DebugConn(sc)
+	}
+
 	sc.init()
 	return sc
 }
@@ -80,6 +87,12 @@ func (c *Conn) init() {
 			rwc.Closer,
 		}
 	}
+	if c.debugIn != nil {
+		rwc.Reader = io.TeeReader(rwc.Reader, c.debugIn)
+	}
+	if c.debugOut != nil {
+		rwc.Writer = io.MultiWriter(rwc.Writer, c.debugOut)
+	}
 
 	c.text = textproto.NewConn(rwc)
 }
@@ -182,6 +195,13 @@ func (c *Conn) Close() error {
 		c.session = nil
 	}
 
+	for _, w := range []io.Writer{c.debugIn, c.debugOut} {
+		if closer, ok := w.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	c.debugIn, c.debugOut = nil, nil
+
 	return c.conn.Close()
 }
 
@@ -199,6 +219,12 @@ func (c *Conn) Hostname() string {
 	return c.helo
 }
 
+// Extended reports whether the client greeted the server with EHLO (or LHLO)
+// rather than HELO.
+func (c *Conn) Extended() bool {
+	return c.ehlo
+}
+
 func (c *Conn) Conn() net.Conn {
 	return c.conn
 }
@@ -228,8 +254,13 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		return
 	}
 
+	// Make the domain available to the backend via Hostname
+	prevHelo := c.helo
+	c.helo = domain
+
 	sess, err := c.server.Backend.NewSession(c)
 	if err != nil {
+		c.helo = prevHelo
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			return
@@ -238,7 +269,7 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		return
 	}
 
-	c.helo = domain
+	c.ehlo = enhanced
 	c.setSession(sess)
 
 	if !enhanced {
@@ -271,6 +302,14 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if c.server.EnableDSN {
 		caps = append(caps, "DSN")
 	}
+	if c.server.EnableFUTURERELEASE {
+		interval := c.server.maxHoldInterval()
+		maxDate := time.Now().Add(interval).UTC().Format(time.RFC3339)
+		caps = append(caps, fmt.Sprintf("FUTURERELEASE %v %v", int64(interval/time.Second), maxDate))
+	}
+	if c.server.EnableMTPRIORITY {
+		caps = append(caps, "MT-PRIORITY")
+	}
 	if c.server.MaxMessageBytes > 0 {
 		caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
 	} else {
@@ -399,6 +438,56 @@ func (c *Conn) handleMail(arg string) {
 				}
 			}
 			opts.Auth = &value
+		case "HOLDFOR":
+			if !c.server.EnableFUTURERELEASE {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "HOLDFOR is not implemented")
+				return
+			}
+			if _, ok := args["HOLDUNTIL"]; ok {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDFOR and HOLDUNTIL are mutually exclusive")
+				return
+			}
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed HOLDFOR parameter value")
+				return
+			}
+			holdFor := time.Duration(secs) * time.Second
+			if holdFor > c.server.maxHoldInterval() {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDFOR exceeds maximum hold interval")
+				return
+			}
+			opts.HoldFor = holdFor
+		case "HOLDUNTIL":
+			if !c.server.EnableFUTURERELEASE {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "HOLDUNTIL is not implemented")
+				return
+			}
+			if _, ok := args["HOLDFOR"]; ok {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDFOR and HOLDUNTIL are mutually exclusive")
+				return
+			}
+			holdUntil, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed HOLDUNTIL parameter value")
+				return
+			}
+			if time.Until(holdUntil) > c.server.maxHoldInterval() {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDUNTIL exceeds maximum hold interval")
+				return
+			}
+			opts.HoldUntil = holdUntil
+		case "MT-PRIORITY":
+			if !c.server.EnableMTPRIORITY {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "MT-PRIORITY is not implemented")
+				return
+			}
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < MinMTPriority || priority > MaxMTPriority {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed MT-PRIORITY parameter value")
+				return
+			}
+			opts.MTPriority = &priority
 		default:
 			c.writeResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
 			return
@@ -863,6 +952,7 @@ func (c *Conn) handleStartTLS() {
 		c.setSession(nil)
 	}
 	c.helo = ""
+	c.ehlo = false
 	c.didAuth = false
 	c.reset()
 }
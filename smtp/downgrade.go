@@ -0,0 +1,427 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// ErrSMTPUTF8Unsupported is returned when a message requires SMTPUTF8 (RFC
+// 6531) but the server doesn't support it, e.g. because an address contains
+// non-ASCII characters. Such messages can't be downgraded.
+var ErrSMTPUTF8Unsupported = errors.New("smtp: server does not support SMTPUTF8")
+
+// Header fields containing addresses. Non-ASCII display names in these
+// fields are converted to RFC 2047 encoded-words, non-ASCII addresses can't
+// be downgraded.
+var addressHeaderFields = map[string]bool{
+	"from":                        true,
+	"sender":                      true,
+	"reply-to":                    true,
+	"to":                          true,
+	"cc":                          true,
+	"bcc":                         true,
+	"resent-from":                 true,
+	"resent-sender":               true,
+	"resent-to":                   true,
+	"resent-cc":                   true,
+	"resent-bcc":                  true,
+	"disposition-notification-to": true,
+}
+
+// Unstructured header fields, whose whole value can be converted to RFC 2047
+// encoded-words. Extension fields ("X-") are assumed to be unstructured.
+var unstructuredHeaderFields = map[string]bool{
+	"subject":             true,
+	"comments":            true,
+	"content-description": true,
+}
+
+// Header fields holding a media type or disposition with parameters. Non-ASCII
+// parameter values are converted to RFC 2231 extended parameters.
+var parameterHeaderFields = map[string]bool{
+	"content-type":        true,
+	"content-disposition": true,
+}
+
+// downgradeMessage converts an RFC 5322 message to 7-bit MIME as described
+// in RFC 6152 section 3. 8-bit textual parts are re-encoded with
+// quoted-printable, other 8-bit parts with base64, and 8-bit header fields
+// with RFC 2047 encoded-words or RFC 2231 parameters.
+func downgradeMessage(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(b))
+	if err := downgradeEntity(&buf, b, true); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type headerField struct {
+	key string // lower-case field name
+	raw string // the whole field, including folded lines and line ending
+}
+
+func (f *headerField) value() string {
+	v := f.raw[strings.IndexByte(f.raw, ':')+1:]
+	v = strings.ReplaceAll(v, "\r\n", "")
+	v = strings.ReplaceAll(v, "\n", "")
+	return strings.TrimSpace(v)
+}
+
+// splitEntity splits a MIME entity into its header fields and its body.
+func splitEntity(b []byte) (fields []headerField, body []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		var line []byte
+		if i < 0 {
+			line, b = b, nil
+		} else {
+			line, b = b[:i+1], b[i+1:]
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, b
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += string(line)
+			continue
+		}
+
+		key := string(line)
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key = key[:i]
+		}
+		fields = append(fields, headerField{
+			key: strings.ToLower(strings.TrimSpace(key)),
+			raw: string(line),
+		})
+	}
+	return fields, nil
+}
+
+func has8bit(b []byte) bool {
+	for _, ch := range b {
+		if ch >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// lineEnding returns the line ending used by a header field.
+func lineEnding(raw string) string {
+	if strings.HasSuffix(raw, "\r\n") {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func downgradeHeaderField(f headerField) (headerField, error) {
+	if !has8bit([]byte(f.raw)) {
+		return f, nil
+	}
+
+	name := f.raw[:strings.IndexByte(f.raw, ':')]
+	eol := lineEnding(f.raw)
+	value := f.value()
+
+	var encoded string
+	switch {
+	case addressHeaderFields[f.key]:
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return f, ErrSMTPUTF8Unsupported
+		}
+		words := make([]string, len(addrs))
+		for i, addr := range addrs {
+			if !isPrintableASCII(addr.Address) {
+				return f, ErrSMTPUTF8Unsupported
+			}
+			words[i] = addr.String()
+			if i < len(addrs)-1 {
+				words[i] += ","
+			}
+		}
+		f.raw = foldHeaderField(name, words, eol)
+		return f, nil
+	case parameterHeaderFields[f.key]:
+		t, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return f, ErrSMTPUTF8Unsupported
+		}
+		encoded = formatMediaType(t, params)
+	case unstructuredHeaderFields[f.key], strings.HasPrefix(f.key, "x-"):
+		// Long values are split into several encoded-words
+		words := strings.Fields(mime.QEncoding.Encode("utf-8", value))
+		f.raw = foldHeaderField(name, words, eol)
+		return f, nil
+	default:
+		// Encoded-words aren't allowed in structured fields
+		return f, ErrSMTPUTF8Unsupported
+	}
+
+	f.raw = name + ": " + encoded + eol
+	return f, nil
+}
+
+// foldHeaderField formats a header field from space-separated words, folding
+// lines so that they don't exceed 78 characters when possible.
+func foldHeaderField(name string, words []string, eol string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString(":")
+	n := len(name) + 1
+	for _, w := range words {
+		if n > len(name)+1 && n+1+len(w) > 78 {
+			sb.WriteString(eol)
+			n = 0
+		}
+		sb.WriteString(" ")
+		sb.WriteString(w)
+		n += 1 + len(w)
+	}
+	sb.WriteString(eol)
+	return sb.String()
+}
+
+// formatMediaType formats a media type or disposition with its parameters.
+// Non-ASCII parameter values are encoded as described in RFC 2231 section 4.
+func formatMediaType(t string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(t)
+	for _, k := range keys {
+		v := params[k]
+		sb.WriteString("; ")
+		switch {
+		case !isPrintableASCII(v):
+			sb.WriteString(k + "*=utf-8''" + percentEncode(v))
+		case v != "" && !strings.ContainsAny(v, tspecials+" "):
+			sb.WriteString(k + "=" + v)
+		default:
+			sb.WriteString(k + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`)
+		}
+	}
+	return sb.String()
+}
+
+// Characters which can't appear in MIME tokens, see RFC 2045 section 5.1.
+const tspecials = `()<>@,;:\"/[]?=`
+
+// percentEncode encodes a parameter value as described in RFC 2231 section
+// 7: bytes which aren't attribute-chars are replaced by "%" and their
+// hexadecimal value.
+func percentEncode(v string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		if ch > 0x20 && ch < 0x7F && !strings.ContainsRune(tspecials+"*'%", rune(ch)) {
+			sb.WriteByte(ch)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[ch>>4])
+			sb.WriteByte(hex[ch&0xF])
+		}
+	}
+	return sb.String()
+}
+
+func downgradeEntity(w *bytes.Buffer, b []byte, top bool) error {
+	fields, body := splitEntity(b)
+
+	eol := "\r\n"
+	mediaType, params := "text/plain", map[string]string(nil)
+	var cte string
+	hasMIMEVersion := false
+	for i, f := range fields {
+		if i == 0 {
+			eol = lineEnding(f.raw)
+		}
+		switch f.key {
+		case "content-type":
+			if t, p, err := mime.ParseMediaType(f.value()); err == nil {
+				mediaType, params = t, p
+			}
+		case "content-transfer-encoding":
+			cte = strings.ToLower(f.value())
+		case "mime-version":
+			hasMIMEVersion = true
+		}
+	}
+
+	for i, f := range fields {
+		var err error
+		if fields[i], err = downgradeHeaderField(f); err != nil {
+			return err
+		}
+	}
+
+	writeHeader := func(fields []headerField) {
+		for _, f := range fields {
+			w.WriteString(f.raw)
+		}
+		w.WriteString(eol)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		writeHeader(fields)
+		return downgradeMultipart(w, body, params["boundary"])
+	case mediaType == "message/rfc822" && has8bit(body):
+		writeHeader(fields)
+		return downgradeEntity(w, body, false)
+	case !has8bit(body):
+		writeHeader(fields)
+		w.Write(body)
+		return nil
+	}
+
+	switch cte {
+	case "", "7bit", "8bit", "binary":
+		// This space is intentionally left blank
+	default:
+		// Already encoded, but contains 8-bit data. Leave it alone, there's
+		// nothing sensible we can do.
+		writeHeader(fields)
+		w.Write(body)
+		return nil
+	}
+
+	out := fields[:0:0]
+	for _, f := range fields {
+		if f.key != "content-transfer-encoding" {
+			out = append(out, f)
+		}
+	}
+	if top && !hasMIMEVersion {
+		out = append(out, headerField{key: "mime-version", raw: "MIME-Version: 1.0" + eol})
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		out = append(out, headerField{
+			key: "content-transfer-encoding",
+			raw: "Content-Transfer-Encoding: quoted-printable" + eol,
+		})
+		writeHeader(out)
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(body); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+
+	out = append(out, headerField{
+		key: "content-transfer-encoding",
+		raw: "Content-Transfer-Encoding: base64" + eol,
+	})
+	writeHeader(out)
+
+	enc := base64.StdEncoding.EncodeToString(body)
+	for len(enc) > 76 {
+		w.WriteString(enc[:76])
+		w.WriteString(eol)
+		enc = enc[76:]
+	}
+	w.WriteString(enc)
+	w.WriteString(eol)
+	return nil
+}
+
+func downgradeMultipart(w *bytes.Buffer, body []byte, boundary string) error {
+	delim := "--" + boundary
+	var part []byte
+	inPart := false
+
+	flushPart := func() error {
+		// The line ending preceding a delimiter belongs to the delimiter.
+		eol := ""
+		if bytes.HasSuffix(part, []byte("\r\n")) {
+			eol = "\r\n"
+		} else if bytes.HasSuffix(part, []byte("\n")) {
+			eol = "\n"
+		}
+		err := downgradeEntity(w, part[:len(part)-len(eol)], false)
+		w.WriteString(eol)
+		part = nil
+		return err
+	}
+
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '\n')
+		var line []byte
+		if i < 0 {
+			line, body = body, nil
+		} else {
+			line, body = body[:i+1], body[i+1:]
+		}
+
+		trimmed := string(bytes.TrimRight(line, " \t\r\n"))
+		if trimmed == delim || trimmed == delim+"--" {
+			if inPart {
+				if err := flushPart(); err != nil {
+					return err
+				}
+			}
+			w.Write(line)
+			inPart = trimmed == delim
+			if !inPart {
+				// Epilogue
+				w.Write(body)
+				return nil
+			}
+			continue
+		}
+
+		if inPart {
+			part = append(part, line...)
+		} else {
+			// Preamble
+			w.Write(line)
+		}
+	}
+
+	if inPart {
+		return flushPart()
+	}
+	return nil
+}
+
+// downgradeWriter buffers a message and writes its 7-bit MIME version to the
+// underlying writer on Close.
+type downgradeWriter struct {
+	c   *Client
+	w   io.WriteCloser
+	buf bytes.Buffer
+}
+
+func (dw *downgradeWriter) Write(b []byte) (int, error) {
+	return dw.buf.Write(b)
+}
+
+func (dw *downgradeWriter) Close() error {
+	b, err := downgradeMessage(dw.buf.Bytes())
+	if err != nil {
+		// The DATA command has already been accepted, there is no way to
+		// abort the transaction without sending the message.
+		dw.c.Close()
+		return err
+	}
+	if _, err := dw.w.Write(b); err != nil {
+		return err
+	}
+	return dw.w.Close()
+}
@@ -0,0 +1,252 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"testing"
+)
+
+var downgradeTests = []struct {
+	name string
+	in   string
+	out  string
+	err  error
+}{
+	{
+		name: "7bit",
+		in: "From: <alice@example.org>\r\n" +
+			"Subject: Hi\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+		out: "From: <alice@example.org>\r\n" +
+			"Subject: Hi\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+	},
+	{
+		name: "8bitText",
+		in: "From: Zoé <zoe@example.org>\r\n" +
+			"Subject: Café\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Déjà vu\r\n",
+		out: "From: =?utf-8?q?Zo=C3=A9?= <zoe@example.org>\r\n" +
+			"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"D=C3=A9j=C3=A0 vu\r\n",
+	},
+	{
+		name: "multipart",
+		in: "Subject: Files\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+			"\r\n" +
+			"preamble\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"plain ascii\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Transfer-Encoding: binary\r\n" +
+			"\r\n" +
+			"\xff\xfe\r\n" +
+			"--frontier--\r\n" +
+			"epilogue\r\n",
+		out: "Subject: Files\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+			"\r\n" +
+			"preamble\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"plain ascii\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"//4=\r\n" +
+			"\r\n" +
+			"--frontier--\r\n" +
+			"epilogue\r\n",
+	},
+	{
+		name: "8bitParameters",
+		in: "Subject: Résumé\r\n" +
+			"Content-Type: application/pdf; name=\"résumé.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"résumé 2.pdf\"; size=42\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"JVBERi0=\r\n",
+		out: "Subject: =?utf-8?q?R=C3=A9sum=C3=A9?=\r\n" +
+			"Content-Type: application/pdf; name*=utf-8''r%C3%A9sum%C3%A9.pdf\r\n" +
+			"Content-Disposition: attachment; filename*=utf-8''r%C3%A9sum%C3%A9%202.pdf; size=42\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"JVBERi0=\r\n",
+	},
+	{
+		name: "8bitStructuredField",
+		in: "Message-Id: <café@example.org>\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+		err: ErrSMTPUTF8Unsupported,
+	},
+	{
+		name: "utf8Address",
+		in: "From: <zoé@example.org>\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+		err: ErrSMTPUTF8Unsupported,
+	},
+	{
+		name: "invalidAddressList",
+		in: "To: Zoé <zoe@example.org\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+		err: ErrSMTPUTF8Unsupported,
+	},
+}
+
+func TestDowngradeMessage(t *testing.T) {
+	for _, tc := range downgradeTests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := downgradeMessage([]byte(tc.in))
+			if err != tc.err {
+				t.Fatalf("downgradeMessage() = %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if string(out) != tc.out {
+				t.Errorf("downgradeMessage() = \n%q\nwant\n%q", out, tc.out)
+			}
+			if has8bit(out) {
+				t.Errorf("downgradeMessage() returned 8-bit data")
+			}
+		})
+	}
+}
+
+func TestDowngradeMessage_longSubject(t *testing.T) {
+	subject := strings.TrimSpace(strings.Repeat("Café ", 300))
+	out, err := downgradeMessage([]byte("Subject: " + subject + "\r\n\r\nHello!\r\n"))
+	if err != nil {
+		t.Fatalf("downgradeMessage() = %v", err)
+	}
+
+	header := strings.SplitN(string(out), "\r\n\r\n", 2)[0]
+	for _, l := range strings.Split(header, "\r\n") {
+		if len(l) > 90 {
+			t.Errorf("downgradeMessage() returned a %v characters long line", len(l))
+		}
+	}
+
+	value := strings.TrimPrefix(strings.Replace(header, "\r\n", "", -1), "Subject: ")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err != nil {
+		t.Errorf("DecodeHeader() = %v", err)
+	} else if decoded != subject {
+		t.Errorf("decoded subject = %q, want %q", decoded, subject)
+	}
+}
+
+func TestClientDowngrade(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.example.org\r\n" +
+		"250 SIZE\r\n" +
+		"250 ok\r\n" +
+		"250 ok\r\n" +
+		"354 go ahead\r\n" +
+		"250 ok\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.Downgrade8BitMIME = true
+
+	if err := c.Rcpt("zoé@example.org", nil); err != ErrSMTPUTF8Unsupported {
+		t.Fatalf("Rcpt() = %v, want %v", err, ErrSMTPUTF8Unsupported)
+	}
+
+	msg := "Subject: Café\r\n\r\nDéjà vu\r\n"
+	if err := c.SendMail("alice@example.org", []string{"bob@example.org"}, strings.NewReader(msg)); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<alice@example.org>\r\n" +
+		"RCPT TO:<bob@example.org>\r\n" +
+		"DATA\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"D=C3=A9j=C3=A0 vu\r\n" +
+		".\r\n"
+	if got := wrote.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+
+	wrote.Reset()
+	msg = "From: <zoé@example.org>\r\n\r\nHello!\r\n"
+	if err := c.SendMail("alice@example.org", []string{"bob@example.org"}, strings.NewReader(msg)); err != ErrSMTPUTF8Unsupported {
+		t.Fatalf("SendMail() = %v, want %v", err, ErrSMTPUTF8Unsupported)
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q; want nothing", wrote.String())
+	}
+}
+
+func TestClientNoDowngrade(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.example.org\r\n" +
+		"250 SIZE\r\n" +
+		"250 ok\r\n" +
+		"250 ok\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c, err := NewClient(fake)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	// Without Downgrade8BitMIME, it's up to the server to reject addresses
+	if err := c.Mail("zoé@example.org", nil); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("zoé@example.org", nil); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<zoé@example.org>\r\n" +
+		"RCPT TO:<zoé@example.org>\r\n"
+	if got := wrote.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,4 @@
+package smtp
+
+// Test certificate, trusted by clients in tests, for use by external tests.
+var LocalhostCert, LocalhostKey = localhostCert, localhostKey
@@ -0,0 +1,215 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// First file descriptor passed with socket activation, as defined by
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+var inherited struct {
+	once      sync.Once
+	mutex     sync.Mutex
+	listeners []net.Listener
+	err       error
+}
+
+// parseListenEnv parses the LISTEN_PID and LISTEN_FDS environment variables
+// and returns the number of passed file descriptors. LISTEN_PID is optional,
+// because a parent process passing listeners with Server.Upgrade can't know
+// the PID of its child in advance.
+func parseListenEnv(pidStr, fdsStr string, pid int) (int, error) {
+	if fdsStr == "" {
+		return 0, nil
+	}
+	if pidStr != "" {
+		if p, err := strconv.Atoi(pidStr); err != nil || p != pid {
+			// The file descriptors are meant for another process
+			return 0, nil
+		}
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("smtp: invalid LISTEN_FDS %q", fdsStr)
+	}
+	return n, nil
+}
+
+// listenersFromFDs creates listeners from n consecutive file descriptors.
+func listenersFromFDs(start, n int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := start + i
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("smtp: inherited file descriptor %v is not a listener: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func loadInheritedListeners() {
+	n, err := parseListenEnv(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	// Don't pass the variables down to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		inherited.err = err
+		return
+	}
+	inherited.listeners, inherited.err = listenersFromFDs(listenFDsStart, n)
+}
+
+// InheritedListeners returns the listeners passed to the process with
+// systemd socket activation (see sd_listen_fds(3)) or by Server.Upgrade, and
+// which haven't been used by ListenAndServe yet. The caller takes ownership
+// of the returned listeners.
+func InheritedListeners() ([]net.Listener, error) {
+	inherited.once.Do(loadInheritedListeners)
+
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	listeners := inherited.listeners
+	inherited.listeners = nil
+	return listeners, inherited.err
+}
+
+// takeInheritedListener returns the inherited listener bound to the
+// specified address, if any.
+func takeInheritedListener(network, addr string) (net.Listener, error) {
+	inherited.once.Do(loadInheritedListeners)
+
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+	for i, l := range inherited.listeners {
+		if listenerMatches(l, network, addr) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+func listenerMatches(l net.Listener, network, addr string) bool {
+	switch la := l.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && la.Name == addr
+	case *net.TCPAddr:
+		if !strings.HasPrefix(network, "tcp") {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, addr)
+		if err != nil || want.Port != la.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return la.IP == nil || la.IP.IsUnspecified()
+		}
+		return want.IP.Equal(la.IP)
+	default:
+		return false
+	}
+}
+
+// listen returns the inherited listener bound to the address, or creates a
+// new one.
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	l, err := takeInheritedListener(network, addr)
+	if err != nil {
+		return nil, err
+	} else if l != nil {
+		return l, nil
+	}
+	return net.Listen(network, addr)
+}
+
+// fileListener is a listener whose file descriptor can be passed to another
+// process, e.g. *net.TCPListener and *net.UnixListener.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// tlsListener is a TLS listener which keeps track of the underlying listener.
+type tlsListener struct {
+	net.Listener
+	raw net.Listener
+}
+
+func newTLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return &tlsListener{Listener: tls.NewListener(l, config), raw: l}
+}
+
+func (l *tlsListener) File() (*os.File, error) {
+	fl, ok := l.raw.(fileListener)
+	if !ok {
+		return nil, fmt.Errorf("smtp: listener %T can't be passed to another process", l.raw)
+	}
+	return fl.File()
+}
+
+// Upgrade starts a new process running the executable at path with args,
+// and passes it the server's listeners. The new process finds them with
+// InheritedListeners or ListenAndServe. Since both processes accept
+// connections on the same sockets, no connection is refused during the
+// upgrade: once the new process is ready, the current server should be
+// stopped with Shutdown.
+//
+// Listeners are passed in the same way as with systemd socket activation,
+// without LISTEN_PID. Standard input, output and error are passed too.
+func (s *Server) Upgrade(path string, args []string) (*os.Process, error) {
+	s.locker.Lock()
+	var files []*os.File
+	var err error
+	for _, l := range s.listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			err = fmt.Errorf("smtp: listener %T can't be passed to another process", l)
+			break
+		}
+		var f *os.File
+		if f, err = fl.File(); err != nil {
+			break
+		}
+		files = append(files, f)
+	}
+	s.locker.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "LISTEN_PID=") || strings.HasPrefix(kv, "LISTEN_FDS=") || strings.HasPrefix(kv, "LISTEN_FDNAMES=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env, "LISTEN_FDS="+strconv.Itoa(len(files)))
+
+	return os.StartProcess(path, append([]string{path}, args...), &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+}
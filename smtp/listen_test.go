@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseListenEnv(t *testing.T) {
+	tests := []struct {
+		pid, fds string
+		n        int
+		err      bool
+	}{
+		{"", "", 0, false},
+		{"42", "2", 2, false},
+		{"", "1", 1, false},
+		{"43", "2", 0, false},
+		{"42", "foo", 0, true},
+		{"42", "-1", 0, true},
+	}
+	for _, test := range tests {
+		n, err := parseListenEnv(test.pid, test.fds, 42)
+		if n != test.n || (err != nil) != test.err {
+			t.Errorf("parseListenEnv(%q, %q) = %v, %v", test.pid, test.fds, n, err)
+		}
+	}
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// listenersFromFDs takes ownership of the file descriptor
+
+	listeners, err := listenersFromFDs(int(f.Fd()), 1)
+	if err != nil {
+		t.Fatalf("listenersFromFDs() = %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("Invalid number of listeners: %v", len(listeners))
+	}
+	il := listeners[0]
+	defer il.Close()
+	if il.Addr().String() != l.Addr().String() {
+		t.Errorf("Invalid inherited listener address: %v, want %v", il.Addr(), l.Addr())
+	}
+
+	addr := l.Addr().(*net.TCPAddr)
+	if !listenerMatches(il, "tcp", addr.String()) {
+		t.Errorf("listenerMatches(%v) = false", addr)
+	}
+	if listenerMatches(il, "tcp", "127.0.0.1:1") || listenerMatches(il, "unix", addr.String()) {
+		t.Errorf("listenerMatches() = true for another address")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := il.Accept()
+		if err == nil {
+			c.Close()
+		}
+		done <- err
+	}()
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Accept() = %v", err)
+	}
+}
+
+func TestListenAndServe_inherited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited.once.Do(func() {})
+	inherited.mutex.Lock()
+	inherited.listeners = append(inherited.listeners, l)
+	inherited.mutex.Unlock()
+
+	s := NewServer(nil)
+	s.Addr = l.Addr().String()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	c.Close()
+
+	s.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe() = %v", err)
+	}
+	if ls, _ := InheritedListeners(); len(ls) != 0 {
+		t.Errorf("Inherited listener hasn't been taken: %v", ls)
+	}
+}
@@ -0,0 +1,202 @@
+package maildir
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errUnknownRcpt = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user here",
+}
+
+var errDeliveryFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Delivery failed, try again later",
+}
+
+var errTooManyRcpts = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      "Too many recipients, send the message again for this one",
+}
+
+// Envelope is the envelope of a message delivered to a recipient.
+type Envelope struct {
+	From string
+	// The recipient the message is being delivered to.
+	To string
+}
+
+// Delivery is a copy of a message to store in a Maildir.
+type Delivery struct {
+	// Folder name, as in Dir.Folder. Folders are created if they don't
+	// exist.
+	Folder string
+	// IMAP flags of the message.
+	Flags []string
+}
+
+// Filter decides how a message is delivered to a recipient. It returns the
+// copies to store, none if the message is discarded. If it returns an
+// error, delivery fails for the recipient.
+type Filter func(env *Envelope, msg []byte) ([]Delivery, error)
+
+// Backend is a backend that delivers messages to local Maildirs.
+//
+// Each recipient has a Maildir in Root, named after its lower-case address.
+// Recipients without a Maildir are rejected.
+//
+// Over LMTP, a status is reported for each recipient. Over SMTP, a single
+// reply covers all recipients, so a delivery failure for one of them can't
+// be reported without affecting the others: transactions are limited to one
+// recipient, others are deferred with a 452 reply and the client sends the
+// message again for them. Use LMTP to deliver to several recipients at once.
+type Backend struct {
+	Root string
+	// If set, called to decide where messages are delivered. By default,
+	// messages are delivered to the inbox.
+	Filter Filter
+
+	// If set, called to authenticate clients. If nil, authentication is not
+	// supported.
+	AuthPlain func(username, password string) error
+	// Logger used to report delivery errors. If nil, errors are not
+	// reported.
+	ErrorLog smtp.Logger
+}
+
+// Dir returns the Maildir of a recipient.
+func (be *Backend) Dir(rcpt string) (Dir, error) {
+	rcpt = strings.ToLower(rcpt)
+	if rcpt == "" || strings.HasPrefix(rcpt, ".") || strings.ContainsAny(rcpt, "/\\\x00") {
+		return "", errUnknownRcpt
+	}
+	d := Dir(filepath.Join(be.Root, rcpt))
+	if fi, err := os.Stat(string(d)); err != nil || !fi.IsDir() {
+		return "", errUnknownRcpt
+	}
+	return d, nil
+}
+
+func (be *Backend) logf(format string, v ...interface{}) {
+	if be.ErrorLog != nil {
+		be.ErrorLog.Printf(format, v...)
+	}
+}
+
+func (be *Backend) deliver(env *Envelope, msg []byte) error {
+	d, err := be.Dir(env.To)
+	if err != nil {
+		return err
+	}
+
+	deliveries := []Delivery{{}}
+	if be.Filter != nil {
+		if deliveries, err = be.Filter(env, msg); err != nil {
+			return err
+		}
+	}
+
+	for _, delivery := range deliveries {
+		folder, err := d.Folder(delivery.Folder)
+		if err != nil {
+			be.logf("maildir: invalid folder %q for <%v>, delivering to inbox", delivery.Folder, env.To)
+			folder = d
+		}
+		if err := folder.Init(); err != nil {
+			be.logf("maildir: failed to create folder %q for <%v>: %v", delivery.Folder, env.To, err)
+			return errDeliveryFailed
+		}
+		if _, err := folder.Deliver(bytes.NewReader(msg), delivery.Flags); err != nil {
+			be.logf("maildir: failed to deliver to <%v>: %v", env.To, err)
+			return errDeliveryFailed
+		}
+	}
+	return nil
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	lmtp := c.Server() != nil && c.Server().LMTP
+	return &session{be: be, lmtp: lmtp}, nil
+}
+
+type session struct {
+	be    *Backend
+	lmtp  bool
+	from  string
+	rcpts []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	if s.be.AuthPlain == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	return s.be.AuthPlain(username, password)
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.rcpts = nil
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if !s.lmtp && len(s.rcpts) > 0 {
+		return errTooManyRcpts
+	}
+	d, err := s.be.Dir(to)
+	if err != nil {
+		return err
+	}
+	// Fail early if the Maildir isn't usable
+	if err := d.Init(); err != nil {
+		s.be.logf("maildir: failed to initialize Maildir of <%v>: %v", to, err)
+		return errDeliveryFailed
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// SMTP transactions have a single recipient
+	for _, rcpt := range s.rcpts {
+		if err := s.be.deliver(&Envelope{From: s.from, To: rcpt}, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range s.rcpts {
+		status.SetStatus(rcpt, s.be.deliver(&Envelope{From: s.from, To: rcpt}, msg))
+	}
+	return nil
+}
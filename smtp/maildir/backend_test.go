@@ -0,0 +1,142 @@
+package maildir
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func testBackend(t *testing.T, lmtp bool) (root, addr string, cleanup func()) {
+	root, err := ioutil.TempDir("", "go-smtp-maildir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"alice@example.org", "bob@example.org"} {
+		if err := Dir(filepath.Join(root, rcpt)).Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := smtp.NewServer(&Backend{
+		Root: root,
+		Filter: func(env *Envelope, msg []byte) ([]Delivery, error) {
+			if env.To == "bob@example.org" {
+				return nil, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Rejected"}
+			}
+			return []Delivery{{}}, nil
+		},
+	})
+	s.Domain = "localhost"
+	s.LMTP = lmtp
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	return root, l.Addr().String(), func() {
+		s.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func countNew(t *testing.T, root, rcpt string) int {
+	fis, err := ioutil.ReadDir(filepath.Join(root, rcpt, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fis)
+}
+
+func TestBackend_smtp(t *testing.T) {
+	root, addr, cleanup := testBackend(t, false)
+	defer cleanup()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("eve@example.org", nil); err == nil {
+		t.Errorf("Rcpt() for an unknown user = nil, want an error")
+	}
+	if err := c.Rcpt("alice@example.org", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	// The other recipients are deferred
+	err = c.Rcpt("bob@example.org", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+		t.Errorf("Rcpt() = %v, want a 452 error", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	io.WriteString(w, "Subject: Hey\r\n\r\nHey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data().Close() = %v", err)
+	}
+	if n := countNew(t, root, "alice@example.org"); n != 1 {
+		t.Errorf("Invalid number of messages: %v", n)
+	}
+
+	err = c.SendMail("root@nsa.gov", []string{"bob@example.org"}, strings.NewReader("Subject: Hey\r\n\r\nHey <3\r\n"))
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("SendMail() = %v, want a 550 error", err)
+	}
+}
+
+func TestBackend_lmtp(t *testing.T) {
+	root, addr, cleanup := testBackend(t, true)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClientLMTP(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	for _, rcpt := range []string{"alice@example.org", "bob@example.org"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt() = %v", err)
+		}
+	}
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatalf("LMTPData() = %v", err)
+	}
+	io.WriteString(w, "Subject: Hey\r\n\r\nHey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("LMTPData().Close() = %v", err)
+	}
+
+	if len(statuses) != 2 || statuses["alice@example.org"] != nil {
+		t.Errorf("Invalid statuses: %v", statuses)
+	}
+	if st := statuses["bob@example.org"]; st == nil || st.Code != 550 {
+		t.Errorf("Invalid status for bob@example.org: %v", st)
+	}
+	if n := countNew(t, root, "alice@example.org"); n != 1 {
+		t.Errorf("Invalid number of messages: %v", n)
+	}
+}
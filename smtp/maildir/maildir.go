@@ -0,0 +1,123 @@
+// Package maildir implements delivery to Maildir mailboxes.
+//
+// Sub-folders use the Maildir++ layout: the folder "Work/Reports" of the
+// Maildir "mail" is stored in "mail/.Work.Reports".
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errInvalidFolder = errors.New("maildir: invalid folder name")
+
+// flagLetters maps IMAP system flags to the letters used in file names.
+var flagLetters = map[string]byte{
+	`\draft`:    'D',
+	`\flagged`:  'F',
+	`\answered`: 'R',
+	`\seen`:     'S',
+	`\deleted`:  'T',
+}
+
+var deliveryCounter uint32
+
+// Dir is a Maildir.
+type Dir string
+
+// Init creates the Maildir if it doesn't exist.
+func (d Dir) Init() error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(string(d), sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Folder returns a sub-folder of the Maildir. The name uses "/" as a
+// hierarchy separator. An empty name and "INBOX" refer to the Maildir
+// itself.
+func (d Dir) Folder(name string) (Dir, error) {
+	name = strings.Trim(name, "/")
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return d, nil
+	}
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, ".\\\x00") {
+			return "", errInvalidFolder
+		}
+	}
+	return Dir(filepath.Join(string(d), "."+strings.Join(parts, "."))), nil
+}
+
+// Deliver writes a message to the Maildir. IMAP system flags such as
+// "\Seen" are stored in the file name, other flags are ignored. It returns
+// the key of the message.
+func (d Dir) Deliver(r io.Reader, flags []string) (string, error) {
+	key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+
+	tmp := filepath.Join(string(d), "tmp", key)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	dst := filepath.Join(string(d), "new", key)
+	if info := flagsInfo(flags); info != "" {
+		dst = filepath.Join(string(d), "cur", key+":2,"+info)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return key, nil
+}
+
+func newKey() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	// "/" and ":" have a special meaning in Maildir file names
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	now := time.Now()
+	n := atomic.AddUint32(&deliveryCounter, 1)
+	return fmt.Sprintf("%v.M%vP%vQ%v.%v", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host), nil
+}
+
+// flagsInfo returns the sorted flag letters of IMAP flags.
+func flagsInfo(flags []string) string {
+	var letters []byte
+	for _, flag := range flags {
+		l, ok := flagLetters[strings.ToLower(flag)]
+		if ok && !strings.ContainsRune(string(letters), rune(l)) {
+			letters = append(letters, l)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters)
+}
@@ -0,0 +1,66 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDir_Folder(t *testing.T) {
+	d := Dir("mail")
+	tests := []struct {
+		name string
+		want Dir
+		ok   bool
+	}{
+		{"", "mail", true},
+		{"INBOX", "mail", true},
+		{"Work", Dir(filepath.Join("mail", ".Work")), true},
+		{"Work/Reports/", Dir(filepath.Join("mail", ".Work.Reports")), true},
+		{"../etc", "", false},
+		{"a//b", "", false},
+		{"a.b", "", false},
+	}
+	for _, tc := range tests {
+		got, err := d.Folder(tc.name)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("Folder(%q) = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestDir_Deliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-maildir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Dir(dir)
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := d.Deliver(strings.NewReader("Subject: Hi\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Deliver() = %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "new", key))
+	if err != nil || string(b) != "Subject: Hi\r\n\r\n" {
+		t.Errorf("Invalid delivered message: %q, %v", b, err)
+	}
+
+	key, err = d.Deliver(strings.NewReader("Subject: Hi\r\n\r\n"), []string{`\Seen`, `\Flagged`, "$Label1", `\seen`})
+	if err != nil {
+		t.Fatalf("Deliver() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", key+":2,FS")); err != nil {
+		t.Errorf("Message with flags hasn't been delivered to cur: %v", err)
+	}
+
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(entries) != 0 {
+		t.Errorf("Temporary files haven't been removed: %v", entries)
+	}
+}
@@ -0,0 +1,44 @@
+package mailinglist
+
+import (
+	"crypto/hmac"
+	"html/template"
+	"net/http"
+)
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<title>Unsubscribe</title>
+<form method="post">
+	<p>Unsubscribe {{.Address}} from {{.List}}?</p>
+	<input type="hidden" name="List-Unsubscribe" value="One-Click">
+	<button type="submit">Unsubscribe</button>
+</form>
+`))
+
+// ServeHTTP serves the one-click unsubscription endpoint (see
+// UnsubscribeURL). As required by RFC 8058, subscribers are only removed by
+// POST requests: GET requests show a confirmation form.
+func (be *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	list, addr, token := q.Get("list"), q.Get("address"), q.Get("token")
+	if be.Secret == nil || !hmac.Equal([]byte(token), []byte(be.unsubscribeToken(list, addr))) {
+		http.Error(w, "Invalid unsubscription link", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribeTemplate.Execute(w, struct{ List, Address string }{list, addr})
+	case http.MethodPost:
+		if err := be.Unsubscribe(list, addr); err == ErrUnknownList {
+			http.NotFound(w, r)
+		} else if err != nil {
+			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+		} else {
+			w.Write([]byte("Unsubscribed\n"))
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
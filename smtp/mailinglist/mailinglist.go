@@ -0,0 +1,1058 @@
+// Package mailinglist implements a mailing list manager.
+//
+// Messages sent to a list address (e.g. team@example.org) are distributed to
+// the subscribers of the list. Commands sent to the request address (e.g.
+// team-request@example.org) with the subject "subscribe", "unsubscribe" or
+// "help" let users manage their subscription; subscribing and unsubscribing
+// need a confirmation. Distributed messages have List-* header fields as
+// defined in RFC 2369, with one-click unsubscription as defined in RFC 8058,
+// and, if Backend.Secret is set, a signed per-subscriber envelope sender
+// (e.g. team-bounces+tag+user=example.com@example.org) so that delivery
+// failure reports can be tracked.
+//
+// Posts from non-members, and all posts to moderated lists, are held until a
+// moderator approves them with Backend.Approve.
+//
+// Accepted posts are queued in Backend.Dir before the SMTP transaction is
+// acknowledged, and distributed in the background. Deliveries which fail
+// temporarily are retried for each subscriber, with an exponential backoff.
+package mailinglist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultMaxBounces   = 5
+	defaultRetryDelay   = 5 * time.Minute
+	defaultMaxQueueTime = 5 * 24 * time.Hour
+	maxRetryDelay       = 4 * time.Hour
+	confirmTimeout      = 7 * 24 * time.Hour
+)
+
+var errLoop = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Mailing list loop detected",
+}
+
+var errUnknownRcpt = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user",
+}
+
+var errTempFail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to process message, try again later",
+}
+
+// ErrUnknownList is returned when a list doesn't exist.
+var ErrUnknownList = errors.New("mailinglist: unknown list")
+
+// ErrUnknownMessage is returned when a held message doesn't exist.
+var ErrUnknownMessage = errors.New("mailinglist: unknown held message")
+
+// List is a mailing list.
+type List struct {
+	// Address of the list, e.g. "team@example.org".
+	Address string
+	// Short description of the list, used in the List-Id header field.
+	Name string
+	// Addresses which can post without being held, and which receive
+	// notifications about held messages.
+	Moderators []string
+	// Allow non-members to post without moderation.
+	Open bool
+	// Hold all posts from non-moderators.
+	Moderated bool
+}
+
+func (l *List) split() (local, domain string) {
+	i := strings.LastIndex(l.Address, "@")
+	if i < 0 {
+		return l.Address, ""
+	}
+	return l.Address[:i], l.Address[i+1:]
+}
+
+func (l *List) requestAddress() string {
+	local, domain := l.split()
+	return local + "-request@" + domain
+}
+
+func (l *List) id() string {
+	local, domain := l.split()
+	return local + "." + domain
+}
+
+func (l *List) isModerator(addr string) bool {
+	for _, m := range l.Moderators {
+		if strings.EqualFold(m, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type addressKind int
+
+const (
+	kindPost addressKind = iota
+	kindRequest
+	kindBounce
+)
+
+// Backend is a backend which handles mailing list addresses, and passes
+// other recipients to an underlying backend.
+type Backend struct {
+	// Backend used for recipients which aren't list addresses. If nil, they
+	// are rejected.
+	Backend smtp.Backend
+	Lists   []*List
+	// Directory where subscribers and held messages are stored.
+	Dir string
+	// Opens a connection to the server used to send messages.
+	Dial func() (*smtp.Client, error)
+
+	// URL of the one-click unsubscription endpoint, served by ServeHTTP. If
+	// empty, only mailto unsubscription is advertised. Requires Secret.
+	UnsubscribeURL string
+	// Secret used to sign unsubscription links and bounce addresses. If
+	// nil, bounces aren't tracked.
+	Secret []byte
+	// Number of delivery failure reports after which a subscriber is
+	// removed. Defaults to 5.
+	MaxBounces int
+	// Delay before retrying deliveries which failed temporarily, doubled
+	// for each attempt. Defaults to 5 minutes.
+	RetryDelay time.Duration
+	// Time after which deliveries which keep failing are abandoned.
+	// Defaults to 5 days.
+	MaxQueueTime time.Duration
+
+	// Logger used to report errors while sending messages. If nil, errors
+	// are not reported.
+	ErrorLog smtp.Logger
+	// Used to get the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mutex sync.Mutex
+
+	queueOnce sync.Once
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func (be *Backend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+func (be *Backend) store() *store {
+	return &store{dir: be.Dir}
+}
+
+func (be *Backend) logf(format string, v ...interface{}) {
+	if be.ErrorLog != nil {
+		be.ErrorLog.Printf(format, v...)
+	}
+}
+
+func (be *Backend) findList(addr string) *List {
+	for _, l := range be.Lists {
+		if strings.EqualFold(l.Address, addr) {
+			return l
+		}
+	}
+	return nil
+}
+
+// lookup finds the list an address belongs to.
+func (be *Backend) lookup(addr string) (l *List, kind addressKind, subscriber string) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return nil, 0, ""
+	}
+	local, domain := strings.ToLower(addr[:i]), addr[i+1:]
+	for _, l := range be.Lists {
+		llocal, ldomain := l.split()
+		llocal = strings.ToLower(llocal)
+		if !strings.EqualFold(domain, ldomain) {
+			continue
+		}
+		switch {
+		case local == llocal:
+			return l, kindPost, ""
+		case local == llocal+"-request":
+			return l, kindRequest, ""
+		case local == llocal+"-bounces":
+			return l, kindBounce, ""
+		case strings.HasPrefix(local, llocal+"-bounces+"):
+			return l, kindBounce, be.parseBounceAddress(l, addr[len(llocal+"-bounces+"):i])
+		}
+	}
+	return nil, 0, ""
+}
+
+// Subscribe adds a subscriber to a list, without confirmation.
+func (be *Backend) Subscribe(list, addr string) error {
+	l := be.findList(list)
+	if l == nil {
+		return ErrUnknownList
+	}
+	return be.update(l, func(state *listState) error {
+		if state.Subscribers[strings.ToLower(addr)] == nil {
+			state.Subscribers[strings.ToLower(addr)] = &Subscriber{Since: be.now()}
+		}
+		return nil
+	})
+}
+
+// Unsubscribe removes a subscriber from a list, without confirmation.
+func (be *Backend) Unsubscribe(list, addr string) error {
+	l := be.findList(list)
+	if l == nil {
+		return ErrUnknownList
+	}
+	return be.update(l, func(state *listState) error {
+		delete(state.Subscribers, strings.ToLower(addr))
+		return nil
+	})
+}
+
+// Subscribers returns the sorted subscriber addresses of a list.
+func (be *Backend) Subscribers(list string) ([]string, error) {
+	l := be.findList(list)
+	if l == nil {
+		return nil, ErrUnknownList
+	}
+	state, err := be.load(l)
+	if err != nil {
+		return nil, err
+	}
+	return subscriberList(state), nil
+}
+
+func subscriberList(state *listState) []string {
+	l := make([]string, 0, len(state.Subscribers))
+	for addr := range state.Subscribers {
+		l = append(l, addr)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Held returns the messages of a list held for moderation.
+func (be *Backend) Held(list string) ([]HeldMessage, error) {
+	l := be.findList(list)
+	if l == nil {
+		return nil, ErrUnknownList
+	}
+	state, err := be.load(l)
+	if err != nil {
+		return nil, err
+	}
+	held := make([]HeldMessage, 0, len(state.Held))
+	for _, msg := range state.Held {
+		held = append(held, *msg)
+	}
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].Received.Before(held[j].Received)
+	})
+	return held, nil
+}
+
+// Approve distributes a message held for moderation.
+func (be *Backend) Approve(list, id string) error {
+	l := be.findList(list)
+	if l == nil {
+		return ErrUnknownList
+	}
+	state, err := be.load(l)
+	if err != nil {
+		return err
+	} else if state.Held[id] == nil {
+		return ErrUnknownMessage
+	}
+	b, err := be.store().readMessage(l.Address, heldDir, id)
+	if err != nil {
+		return err
+	}
+	if err := be.enqueue(l, b); err != nil {
+		return err
+	}
+	return be.Reject(list, id)
+}
+
+// Reject discards a message held for moderation.
+func (be *Backend) Reject(list, id string) error {
+	l := be.findList(list)
+	if l == nil {
+		return ErrUnknownList
+	}
+	err := be.update(l, func(state *listState) error {
+		if state.Held[id] == nil {
+			return ErrUnknownMessage
+		}
+		delete(state.Held, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return be.store().removeMessage(l.Address, heldDir, id)
+}
+
+func (be *Backend) load(l *List) (*listState, error) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	return be.store().load(l.Address)
+}
+
+// update atomically updates the state of a list. The state is saved if fn
+// succeeds.
+func (be *Backend) update(l *List, fn func(state *listState) error) error {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	state, err := be.store().load(l.Address)
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+	return be.store().save(l.Address, state)
+}
+
+// unsubscribeToken signs an unsubscription link.
+func (be *Backend) unsubscribeToken(list, addr string) string {
+	mac := hmac.New(sha256.New, be.Secret)
+	mac.Write([]byte(strings.ToLower(list) + "\x00" + strings.ToLower(addr)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bounceAddress returns the envelope sender of messages sent to a
+// subscriber. The subscriber address is encoded in it (VERP) along with a
+// tag, so that bounces can't be forged to unsubscribe someone.
+func (be *Backend) bounceAddress(l *List, subscriber string) string {
+	local, domain := l.split()
+	if subscriber == "" || be.Secret == nil {
+		return local + "-bounces@" + domain
+	}
+	verp := strings.Replace(subscriber, "@", "=", 1)
+	return local + "-bounces+" + be.bounceTag(l.Address, subscriber) + "+" + verp + "@" + domain
+}
+
+// bounceTag signs the subscriber address of a bounce address.
+func (be *Backend) bounceTag(list, addr string) string {
+	mac := hmac.New(sha256.New, be.Secret)
+	mac.Write([]byte("bounces\x00" + strings.ToLower(list) + "\x00" + strings.ToLower(addr)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// parseBounceAddress returns the subscriber encoded in the detail part of a
+// bounce address, or an empty string if the tag is invalid.
+func (be *Backend) parseBounceAddress(l *List, detail string) string {
+	if be.Secret == nil {
+		return ""
+	}
+	i := strings.IndexByte(detail, '+')
+	if i < 0 {
+		return ""
+	}
+	tag, verp := strings.ToLower(detail[:i]), detail[i+1:]
+	j := strings.LastIndex(verp, "=")
+	if j < 0 {
+		return ""
+	}
+	subscriber := verp[:j] + "@" + verp[j+1:]
+	if !hmac.Equal([]byte(tag), []byte(be.bounceTag(l.Address, subscriber))) {
+		return ""
+	}
+	return subscriber
+}
+
+func (be *Backend) unsubscribeURL(l *List, addr string) string {
+	v := url.Values{}
+	v.Set("list", l.Address)
+	v.Set("address", addr)
+	v.Set("token", be.unsubscribeToken(l.Address, addr))
+	return be.UnsubscribeURL + "?" + v.Encode()
+}
+
+// listHeader returns the header fields added to messages distributed to a
+// subscriber.
+func (be *Backend) listHeader(l *List, subscriber string) []string {
+	request := l.requestAddress()
+	id := "<" + l.id() + ">"
+	if l.Name != "" {
+		id = mime.QEncoding.Encode("utf-8", l.Name) + " " + id
+	}
+	fields := []string{
+		"List-Id: " + id,
+		"List-Post: <mailto:" + l.Address + ">",
+		"List-Help: <mailto:" + request + "?subject=help>",
+		"List-Subscribe: <mailto:" + request + "?subject=subscribe>",
+	}
+	unsubscribe := "List-Unsubscribe: <mailto:" + request + "?subject=unsubscribe>"
+	if be.UnsubscribeURL != "" && be.Secret != nil {
+		unsubscribe += ",\r\n <" + be.unsubscribeURL(l, subscriber) + ">"
+		fields = append(fields, unsubscribe, "List-Unsubscribe-Post: List-Unsubscribe=One-Click")
+	} else {
+		fields = append(fields, unsubscribe)
+	}
+	return append(fields, "Precedence: list")
+}
+
+// rewriteHeader removes the List-* and Precedence header fields of a
+// message and prepends fields.
+func rewriteHeader(b []byte, fields []string) []byte {
+	var out bytes.Buffer
+	for _, f := range fields {
+		out.WriteString(f + "\r\n")
+	}
+
+	skip := false
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		var line []byte
+		if i < 0 {
+			line, b = b, nil
+		} else {
+			line, b = b[:i+1], b[i+1:]
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header
+			out.Write(line)
+			out.Write(b)
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if j := bytes.IndexByte(line, ':'); j >= 0 {
+				name = line[:j]
+			}
+			name = bytes.ToLower(bytes.TrimSpace(name))
+			skip = bytes.HasPrefix(name, []byte("list-")) || bytes.Equal(name, []byte("precedence"))
+		}
+		if !skip {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+// enqueue queues a message for distribution to the current subscribers of a
+// list.
+func (be *Backend) enqueue(l *List, b []byte) error {
+	id, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := be.store().writeMessage(l.Address, queueDir, id, b); err != nil {
+		return err
+	}
+	queued := false
+	err = be.update(l, func(state *listState) error {
+		if len(state.Subscribers) == 0 {
+			return nil
+		}
+		state.Queue[id] = &queuedMessage{
+			Rcpts:  subscriberList(state),
+			Queued: be.now(),
+		}
+		queued = true
+		return nil
+	})
+	if err != nil || !queued {
+		be.store().removeMessage(l.Address, queueDir, id)
+		return err
+	}
+	be.wakeQueue()
+	return nil
+}
+
+func (be *Backend) retryDelay(attempts int) time.Duration {
+	d := be.RetryDelay
+	if d <= 0 {
+		d = defaultRetryDelay
+	}
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+func (be *Backend) maxQueueTime() time.Duration {
+	if be.MaxQueueTime <= 0 {
+		return defaultMaxQueueTime
+	}
+	return be.MaxQueueTime
+}
+
+// startQueue starts the goroutine distributing queued messages, if it isn't
+// running yet. Messages queued by a previous process are distributed too.
+func (be *Backend) startQueue() {
+	be.queueOnce.Do(func() {
+		be.wake = make(chan struct{}, 1)
+		be.done = make(chan struct{})
+		be.stopped = make(chan struct{})
+		go be.runQueue()
+	})
+}
+
+func (be *Backend) wakeQueue() {
+	be.startQueue()
+	select {
+	case be.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (be *Backend) runQueue() {
+	defer close(be.stopped)
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next := be.flushQueue(); !next.IsZero() {
+			timer = time.NewTimer(next.Sub(be.now()))
+			timeout = timer.C
+		}
+		select {
+		case <-be.wake:
+		case <-timeout:
+		case <-be.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-be.done:
+			return
+		default:
+		}
+	}
+}
+
+// Close stops distributing queued messages. Messages which haven't been
+// delivered to all subscribers yet are kept in the queue.
+func (be *Backend) Close() error {
+	started := true
+	be.queueOnce.Do(func() { started = false })
+	if !started {
+		return nil
+	}
+	select {
+	case <-be.done:
+	default:
+		close(be.done)
+	}
+	<-be.stopped
+	return nil
+}
+
+// flushQueue distributes the queued messages which are due. It returns the
+// time of the next delivery attempt, or the zero time if the queue is empty.
+func (be *Backend) flushQueue() time.Time {
+	var next time.Time
+	schedule := func(t time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	for _, l := range be.Lists {
+		state, err := be.load(l)
+		if err != nil {
+			be.logf("mailinglist: failed to load queue of %v: %v", l.Address, err)
+			schedule(be.now().Add(be.retryDelay(1)))
+			continue
+		}
+
+		ids := make([]string, 0, len(state.Queue))
+		for id := range state.Queue {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return state.Queue[ids[i]].Queued.Before(state.Queue[ids[j]].Queued)
+		})
+		for _, id := range ids {
+			select {
+			case <-be.done:
+				return next
+			default:
+			}
+			if qm := state.Queue[id]; be.now().Before(qm.Next) {
+				schedule(qm.Next)
+			} else {
+				schedule(be.deliver(l, id, qm))
+			}
+		}
+	}
+	return next
+}
+
+// deliver sends a queued message to the subscribers it hasn't been delivered
+// to yet. It returns the time of the next attempt, or the zero time if the
+// message has been removed from the queue.
+func (be *Backend) deliver(l *List, id string, qm *queuedMessage) time.Time {
+	b, err := be.store().readMessage(l.Address, queueDir, id)
+	if err != nil {
+		be.logf("mailinglist: failed to read queued message %v of %v: %v", id, l.Address, err)
+		qm = &queuedMessage{}
+	}
+
+	var remaining []string
+	var c *smtp.Client
+	defer func() {
+		if c != nil {
+			c.Quit()
+			c.Close()
+		}
+	}()
+loop:
+	for i, sub := range qm.Rcpts {
+		select {
+		case <-be.done:
+			remaining = append(remaining, qm.Rcpts[i:]...)
+			break loop
+		default:
+		}
+		if c == nil {
+			if c, err = be.Dial(); err != nil {
+				be.logf("mailinglist: failed to connect: %v", err)
+				remaining = append(remaining, qm.Rcpts[i:]...)
+				break loop
+			}
+		}
+		msg := rewriteHeader(b, be.listHeader(l, sub))
+		err := c.SendMail(be.bounceAddress(l, sub), []string{sub}, bytes.NewReader(msg))
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			be.logf("mailinglist: failed to deliver to <%v>: %v", sub, err)
+			c.Reset()
+			if smtpErr.Temporary() {
+				remaining = append(remaining, sub)
+			}
+		} else if err != nil {
+			be.logf("mailinglist: failed to deliver to <%v>: %v", sub, err)
+			c.Close()
+			c = nil
+			remaining = append(remaining, sub)
+		}
+	}
+
+	now := be.now()
+	if len(remaining) > 0 && now.Sub(qm.Queued) >= be.maxQueueTime() {
+		be.logf("mailinglist: giving up distributing message %v of %v to %v subscribers", id, l.Address, len(remaining))
+		remaining = nil
+	}
+
+	var next time.Time
+	err = be.update(l, func(state *listState) error {
+		if len(remaining) == 0 {
+			delete(state.Queue, id)
+			return nil
+		}
+		qm := state.Queue[id]
+		if qm == nil {
+			return nil
+		}
+		qm.Rcpts = remaining
+		qm.Attempts++
+		qm.Next = now.Add(be.retryDelay(qm.Attempts))
+		next = qm.Next
+		return nil
+	})
+	if err != nil {
+		be.logf("mailinglist: failed to update queue of %v: %v", l.Address, err)
+		return now.Add(be.retryDelay(1))
+	}
+	if len(remaining) == 0 {
+		if err := be.store().removeMessage(l.Address, queueDir, id); err != nil {
+			be.logf("mailinglist: failed to remove queued message %v of %v: %v", id, l.Address, err)
+		}
+	}
+	return next
+}
+
+// sendNotice sends a message from the request address of a list.
+func (be *Backend) sendNotice(l *List, to, subject, body string) error {
+	id, err := newToken()
+	if err != nil {
+		return err
+	}
+	_, domain := l.split()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %v\r\n", (&mail.Address{Address: l.requestAddress()}).String())
+	fmt.Fprintf(&b, "To: %v\r\n", (&mail.Address{Address: to}).String())
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", be.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%v@%v>\r\n", id, domain)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	c, err := be.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SendMail(be.bounceAddress(l, ""), []string{to}, strings.NewReader(b.String())); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// post handles a message sent to a list address.
+func (be *Backend) post(l *List, from string, b []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(msg.Header.Get("List-Id"), "<"+l.id()+">") {
+		return errLoop
+	}
+
+	state, err := be.load(l)
+	if err != nil {
+		return err
+	}
+	member := state.Subscribers[strings.ToLower(from)] != nil
+	if l.isModerator(from) || (!l.Moderated && (member || l.Open)) {
+		return be.enqueue(l, b)
+	}
+
+	id, err := newToken()
+	if err != nil {
+		return err
+	}
+	if err := be.store().writeMessage(l.Address, heldDir, id, b); err != nil {
+		return err
+	}
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	held := &HeldMessage{ID: id, From: from, Subject: subject, Received: be.now()}
+	err = be.update(l, func(state *listState) error {
+		state.Held[id] = held
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range l.Moderators {
+		body := fmt.Sprintf("A message from <%v> to %v has been held for moderation.\n\nSubject: %v\nID: %v\n", from, l.Address, subject, id)
+		if err := be.sendNotice(l, m, "Message held for moderation: "+subject, body); err != nil {
+			be.logf("mailinglist: failed to notify moderator <%v>: %v", m, err)
+		}
+	}
+	return nil
+}
+
+// parseCommand extracts a command from the subject or the first line of the
+// body of a message sent to a request address.
+func parseCommand(b []byte) (cmd, arg string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return "", ""
+	}
+	line := msg.Header.Get("Subject")
+	if strings.TrimSpace(line) == "" {
+		body, _ := ioutil.ReadAll(io.LimitReader(msg.Body, 4096))
+		for _, l := range strings.Split(string(body), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				line = l
+				break
+			}
+		}
+	}
+
+	fields := strings.Fields(strings.ToLower(line))
+	// Skip reply prefixes
+	for len(fields) > 0 && (fields[0] == "re:" || fields[0] == "aw:") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", ""
+	}
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	return fields[0], arg
+}
+
+// request handles a command sent to a request address.
+func (be *Backend) request(l *List, from string, b []byte) error {
+	if from == "" {
+		// Never reply to bounces
+		return nil
+	}
+
+	cmd, arg := parseCommand(b)
+	switch cmd {
+	case "subscribe", "unsubscribe":
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		err = be.update(l, func(state *listState) error {
+			state.Pending[token] = &pendingAction{
+				Address: strings.ToLower(from),
+				Action:  cmd,
+				Expires: be.now().Add(confirmTimeout),
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		body := fmt.Sprintf("Someone asked to %v <%v> to the list %v.\n\n"+
+			"To confirm, reply to this message, or send a message to %v with the subject \"confirm %v\".\n"+
+			"If you didn't ask for this, ignore this message.\n", cmd, from, l.Address, l.requestAddress(), token)
+		return be.sendNotice(l, from, "confirm "+token, body)
+	case "confirm":
+		var action *pendingAction
+		err := be.update(l, func(state *listState) error {
+			for token, pending := range state.Pending {
+				if !be.now().Before(pending.Expires) {
+					delete(state.Pending, token)
+				}
+			}
+			action = state.Pending[arg]
+			if action == nil {
+				return nil
+			}
+			delete(state.Pending, arg)
+			if action.Action == "subscribe" {
+				if state.Subscribers[action.Address] == nil {
+					state.Subscribers[action.Address] = &Subscriber{Since: be.now()}
+				}
+			} else {
+				delete(state.Subscribers, action.Address)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if action == nil {
+			return be.sendNotice(l, from, "Invalid confirmation", "The confirmation code is invalid or has expired.\n")
+		}
+		if action.Action == "subscribe" {
+			body := fmt.Sprintf("<%v> is now subscribed to %v.\n", action.Address, l.Address)
+			return be.sendNotice(l, action.Address, "Welcome to "+l.Address, body)
+		}
+		body := fmt.Sprintf("<%v> has been unsubscribed from %v.\n", action.Address, l.Address)
+		return be.sendNotice(l, action.Address, "Goodbye from "+l.Address, body)
+	default:
+		body := fmt.Sprintf("Send a message to %v with one of these subjects:\n\n"+
+			"  subscribe    Subscribe to the list\n"+
+			"  unsubscribe  Unsubscribe from the list\n"+
+			"  help         Get this message\n", l.requestAddress())
+		return be.sendNotice(l, from, "Help for "+l.Address, body)
+	}
+}
+
+// isDeliveryFailure checks whether a message is a delivery status
+// notification (RFC 3464) reporting a failed delivery. Other messages sent to
+// bounce addresses, e.g. auto-replies or delay notifications, are ignored.
+func isDeliveryFailure(b []byte) bool {
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	t, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || t != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return false
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return false
+		}
+		t, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if t != "message/delivery-status" && t != "message/global-delivery-status" {
+			continue
+		}
+
+		// Per-message fields, followed by per-recipient fields, separated
+		// by blank lines
+		r := textproto.NewReader(bufio.NewReader(p))
+		for {
+			h, err := r.ReadMIMEHeader()
+			if strings.EqualFold(strings.TrimSpace(h.Get("Action")), "failed") {
+				return true
+			}
+			if err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// bounce records a bounce for a subscriber.
+func (be *Backend) bounce(l *List, subscriber string, b []byte) error {
+	if subscriber == "" || !isDeliveryFailure(b) {
+		return nil
+	}
+	maxBounces := be.MaxBounces
+	if maxBounces <= 0 {
+		maxBounces = defaultMaxBounces
+	}
+	return be.update(l, func(state *listState) error {
+		sub := state.Subscribers[strings.ToLower(subscriber)]
+		if sub == nil {
+			return nil
+		}
+		sub.Bounces++
+		if sub.Bounces >= maxBounces {
+			delete(state.Subscribers, strings.ToLower(subscriber))
+		}
+		return nil
+	})
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	be.startQueue()
+	s := &session{be: be}
+	if be.Backend != nil {
+		inner, err := be.Backend.NewSession(c)
+		if err != nil {
+			return nil, err
+		}
+		s.Session = inner
+	}
+	return s, nil
+}
+
+type target struct {
+	list       *List
+	kind       addressKind
+	subscriber string
+}
+
+type session struct {
+	Session smtp.Session
+	be      *Backend
+
+	from       string
+	targets    []target
+	innerRcpts bool
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.targets = nil
+	s.innerRcpts = false
+	if s.Session != nil {
+		s.Session.Reset()
+	}
+}
+
+func (s *session) Logout() error {
+	if s.Session != nil {
+		return s.Session.Logout()
+	}
+	return nil
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	if s.Session == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.Session != nil {
+		if err := s.Session.Mail(from, opts); err != nil {
+			return err
+		}
+	}
+	s.from = from
+	s.targets = nil
+	s.innerRcpts = false
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if l, kind, subscriber := s.be.lookup(to); l != nil {
+		s.targets = append(s.targets, target{list: l, kind: kind, subscriber: subscriber})
+		return nil
+	}
+	if s.Session == nil {
+		return errUnknownRcpt
+	}
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.innerRcpts = true
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if s.innerRcpts {
+		if err := s.Session.Data(bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range s.targets {
+		var err error
+		switch t.kind {
+		case kindPost:
+			err = s.be.post(t.list, s.from, b)
+		case kindRequest:
+			err = s.be.request(t.list, s.from, b)
+		case kindBounce:
+			err = s.be.bounce(t.list, t.subscriber, b)
+		}
+		if err == errLoop {
+			return err
+		} else if err != nil {
+			s.be.logf("mailinglist: failed to process message for %v: %v", t.list.Address, err)
+			return errTempFail
+		}
+	}
+	return nil
+}
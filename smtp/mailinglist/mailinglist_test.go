@@ -0,0 +1,403 @@
+package mailinglist
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type delivery struct {
+	From string
+	To   []string
+	Data string
+}
+
+type outbox struct {
+	mutex      sync.Mutex
+	deliveries []*delivery
+	// Number of temporary failures left for each recipient.
+	tempfail map[string]int
+}
+
+func (o *outbox) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &outboxSession{outbox: o}, nil
+}
+
+func (o *outbox) take() []*delivery {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	l := o.deliveries
+	o.deliveries = nil
+	return l
+}
+
+// wait takes n deliveries, waiting for the background ones.
+func (o *outbox) wait(t *testing.T, n int) []*delivery {
+	t.Helper()
+	var l []*delivery
+	for i := 0; i < 500 && len(l) < n; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		l = append(l, o.take()...)
+	}
+	if len(l) != n {
+		t.Fatalf("Invalid number of deliveries: %v, want %v", len(l), n)
+	}
+	return l
+}
+
+type outboxSession struct {
+	outbox *outbox
+	d      *delivery
+}
+
+func (s *outboxSession) Reset()        { s.d = nil }
+func (s *outboxSession) Logout() error { return nil }
+
+func (s *outboxSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *outboxSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.d = &delivery{From: from}
+	return nil
+}
+
+func (s *outboxSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.outbox.mutex.Lock()
+	defer s.outbox.mutex.Unlock()
+	if s.outbox.tempfail[to] > 0 {
+		s.outbox.tempfail[to]--
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 2, 0}, Message: "Try again later"}
+	}
+	s.d.To = append(s.d.To, to)
+	return nil
+}
+
+func (s *outboxSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.d.Data = string(b)
+	s.outbox.mutex.Lock()
+	s.outbox.deliveries = append(s.outbox.deliveries, s.d)
+	s.outbox.mutex.Unlock()
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func testBackend(t *testing.T) (be *Backend, out *outbox, addr string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "go-smtp-mailinglist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = &outbox{}
+	obs := smtp.NewServer(out)
+	obs.Domain = "outbox"
+	outAddr := serve(t, obs)
+
+	be = &Backend{
+		Lists: []*List{{
+			Address:    "team@example.org",
+			Name:       "Team",
+			Moderators: []string{"boss@example.org"},
+		}},
+		Dir: dir,
+		Dial: func() (*smtp.Client, error) {
+			return smtp.Dial(outAddr)
+		},
+		UnsubscribeURL: "https://lists.example.org/unsubscribe",
+		Secret:         []byte("secret"),
+		MaxBounces:     2,
+		RetryDelay:     10 * time.Millisecond,
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	addr = serve(t, s)
+
+	return be, out, addr, func() {
+		s.Close()
+		be.Close()
+		obs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func sendMail(t *testing.T, addr, from, to, msg string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.SendMail(from, []string{to}, strings.NewReader(msg))
+}
+
+func TestBackend_post(t *testing.T) {
+	be, out, addr, cleanup := testBackend(t)
+	defer cleanup()
+
+	if err := be.Subscribe("team@example.org", "Alice@example.com"); err != nil {
+		t.Fatalf("Subscribe() = %v", err)
+	}
+	be.Subscribe("team@example.org", "bob@example.net")
+
+	msg := "From: alice@example.com\r\nSubject: Hey\r\nList-Id: <other.example.org>\r\n\r\nHey <3\r\n"
+	if err := sendMail(t, addr, "alice@example.com", "team@example.org", msg); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	deliveries := out.wait(t, 2)
+	d := deliveries[0]
+	if !strings.HasPrefix(d.From, "team-bounces+") || !strings.HasSuffix(d.From, "+alice=example.com@example.org") || len(d.To) != 1 || d.To[0] != "alice@example.com" {
+		t.Errorf("Invalid envelope: %v, %v", d.From, d.To)
+	}
+	bobBounces := deliveries[1].From
+	if deliveries[1].To[0] != "bob@example.net" {
+		bobBounces = d.From
+	}
+	for _, s := range []string{
+		"List-Id: Team <team.example.org>\r\n",
+		"List-Post: <mailto:team@example.org>\r\n",
+		"List-Unsubscribe: <mailto:team-request@example.org?subject=unsubscribe>,\r\n <https://lists.example.org/unsubscribe?",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+		"Precedence: list\r\n",
+		"Subject: Hey\r\n\r\nHey <3\r\n",
+	} {
+		if !strings.Contains(d.Data, s) {
+			t.Errorf("Message doesn't contain %q:\n%v", s, d.Data)
+		}
+	}
+	if strings.Contains(d.Data, "other.example.org") {
+		t.Errorf("Previous List-Id hasn't been removed:\n%v", d.Data)
+	}
+
+	// Loops are detected
+	err := sendMail(t, addr, "alice@example.com", "team@example.org", d.Data)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Errorf("SendMail() = %v, want a 554 error", err)
+	}
+
+	// Other addresses are rejected without a backend
+	err = sendMail(t, addr, "alice@example.com", "alice@example.org", msg)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("SendMail() = %v, want a 550 error", err)
+	}
+
+	// Bounces
+	dsn := func(action string) string {
+		return "Subject: Undeliverable\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/report; report-type=delivery-status; boundary=frontier\r\n" +
+			"\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Sorry.\r\n" +
+			"--frontier\r\n" +
+			"Content-Type: message/delivery-status\r\n" +
+			"\r\n" +
+			"Reporting-MTA: dns; mx.example.net\r\n" +
+			"\r\n" +
+			"Final-Recipient: rfc822; bob@example.net\r\n" +
+			"Action: " + action + "\r\n" +
+			"Status: 5.1.1\r\n" +
+			"--frontier--\r\n"
+	}
+	for _, tc := range []struct {
+		to, msg string
+	}{
+		// Forged bounce addresses
+		{"team-bounces+bob=example.net@example.org", dsn("failed")},
+		{"team-bounces+0123456789abcdef+bob=example.net@example.org", dsn("failed")},
+		// Not delivery failures
+		{bobBounces, "Subject: Out of office\r\n\r\nI'm on vacation.\r\n"},
+		{bobBounces, dsn("delayed")},
+	} {
+		if err := sendMail(t, addr, "", tc.to, tc.msg); err != nil {
+			t.Fatalf("SendMail() = %v", err)
+		}
+	}
+	if subs, _ := be.Subscribers("team@example.org"); len(subs) != 2 {
+		t.Errorf("Subscribers() = %v, want bob to be still subscribed", subs)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sendMail(t, addr, "", bobBounces, dsn("failed")); err != nil {
+			t.Fatalf("SendMail() = %v", err)
+		}
+	}
+	if subs, _ := be.Subscribers("team@example.org"); len(subs) != 1 || subs[0] != "alice@example.com" {
+		t.Errorf("Subscribers() = %v", subs)
+	}
+}
+
+func TestBackend_retry(t *testing.T) {
+	be, out, addr, cleanup := testBackend(t)
+	defer cleanup()
+
+	be.Subscribe("team@example.org", "alice@example.com")
+	be.Subscribe("team@example.org", "bob@example.net")
+	out.tempfail = map[string]int{"bob@example.net": 2}
+
+	msg := "From: alice@example.com\r\nSubject: Hey\r\n\r\nHey <3\r\n"
+	if err := sendMail(t, addr, "alice@example.com", "team@example.org", msg); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	// Only the subscriber whose delivery failed is retried
+	deliveries := out.wait(t, 2)
+	if deliveries[0].To[0] != "alice@example.com" || deliveries[1].To[0] != "bob@example.net" {
+		t.Errorf("Invalid deliveries: %+v, %+v", deliveries[0], deliveries[1])
+	}
+	time.Sleep(50 * time.Millisecond)
+	if deliveries := out.take(); len(deliveries) != 0 {
+		t.Errorf("Unexpected deliveries: %+v", deliveries)
+	}
+
+	state, err := be.load(be.Lists[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Queue) != 0 {
+		t.Errorf("Queue isn't empty: %+v", state.Queue)
+	}
+	if fis, err := ioutil.ReadDir(filepath.Join(be.Dir, "team@example.org", "queue")); err != nil || len(fis) != 0 {
+		t.Errorf("Queued messages haven't been removed: %v, %v", len(fis), err)
+	}
+}
+
+func TestBackend_moderation(t *testing.T) {
+	be, out, addr, cleanup := testBackend(t)
+	defer cleanup()
+
+	be.Subscribe("team@example.org", "alice@example.com")
+
+	msg := "From: mallory@example.com\r\nSubject: Buy now\r\n\r\nCheap stuff\r\n"
+	if err := sendMail(t, addr, "mallory@example.com", "team@example.org", msg); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	deliveries := out.take()
+	if len(deliveries) != 1 || deliveries[0].To[0] != "boss@example.org" || !strings.Contains(deliveries[0].Data, "held for moderation") {
+		t.Fatalf("Moderators haven't been notified: %+v", deliveries)
+	}
+
+	held, err := be.Held("team@example.org")
+	if err != nil || len(held) != 1 || held[0].From != "mallory@example.com" || held[0].Subject != "Buy now" {
+		t.Fatalf("Held() = %+v, %v", held, err)
+	}
+	if err := be.Approve("team@example.org", held[0].ID); err != nil {
+		t.Fatalf("Approve() = %v", err)
+	}
+	deliveries = out.wait(t, 1)
+	if deliveries[0].To[0] != "alice@example.com" || !strings.Contains(deliveries[0].Data, "Cheap stuff") {
+		t.Errorf("Approved message hasn't been distributed: %+v", deliveries)
+	}
+	if held, _ := be.Held("team@example.org"); len(held) != 0 {
+		t.Errorf("Held() = %+v after approval", held)
+	}
+	if err := be.Reject("team@example.org", "unknown"); err != ErrUnknownMessage {
+		t.Errorf("Reject() = %v, want %v", err, ErrUnknownMessage)
+	}
+}
+
+func TestBackend_request(t *testing.T) {
+	be, out, addr, cleanup := testBackend(t)
+	defer cleanup()
+
+	if err := sendMail(t, addr, "carol@example.com", "team-request@example.org", "Subject: subscribe\r\n\r\n"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	deliveries := out.take()
+	if len(deliveries) != 1 || deliveries[0].To[0] != "carol@example.com" || deliveries[0].From != "team-bounces@example.org" {
+		t.Fatalf("Invalid confirmation request: %+v", deliveries)
+	}
+	var subject string
+	for _, line := range strings.Split(deliveries[0].Data, "\r\n") {
+		if strings.HasPrefix(line, "Subject: ") {
+			subject = strings.TrimPrefix(line, "Subject: ")
+		}
+	}
+	if !strings.HasPrefix(subject, "confirm ") {
+		t.Fatalf("Invalid confirmation subject: %q", subject)
+	}
+	if subs, _ := be.Subscribers("team@example.org"); len(subs) != 0 {
+		t.Fatalf("Subscribed before confirmation: %v", subs)
+	}
+
+	if err := sendMail(t, addr, "carol@example.com", "team-request@example.org", "Subject: Re: "+subject+"\r\n\r\n"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if subs, _ := be.Subscribers("team@example.org"); len(subs) != 1 || subs[0] != "carol@example.com" {
+		t.Errorf("Subscribers() = %v after confirmation", subs)
+	}
+	if deliveries := out.take(); len(deliveries) != 1 || !strings.Contains(deliveries[0].Data, "Welcome") {
+		t.Errorf("Invalid welcome message: %+v", deliveries)
+	}
+
+	// Commands in the body
+	if err := sendMail(t, addr, "carol@example.com", "team-request@example.org", "\r\nhelp\r\n"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if deliveries := out.take(); len(deliveries) != 1 || !strings.Contains(deliveries[0].Data, "Subject: Help for team@example.org") {
+		t.Errorf("Invalid help message: %+v", deliveries)
+	}
+}
+
+func TestBackend_ServeHTTP(t *testing.T) {
+	be, _, _, cleanup := testBackend(t)
+	defer cleanup()
+
+	be.Subscribe("team@example.org", "alice@example.com")
+
+	ts := httptest.NewServer(be)
+	defer ts.Close()
+
+	u := ts.URL + "?" + strings.SplitN(be.unsubscribeURL(be.Lists[0], "alice@example.com"), "?", 2)[1]
+	resp, err := http.PostForm(ts.URL+"?list=team@example.org&address=alice@example.com&token=invalid", url.Values{"List-Unsubscribe": {"One-Click"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST with an invalid token = %v", resp.StatusCode)
+	}
+
+	resp, err = http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if subs, _ := be.Subscribers("team@example.org"); resp.StatusCode != http.StatusOK || len(subs) != 1 {
+		t.Errorf("GET = %v, subscribers = %v", resp.StatusCode, subs)
+	}
+
+	resp, err = http.PostForm(u, url.Values{"List-Unsubscribe": {"One-Click"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if subs, _ := be.Subscribers("team@example.org"); resp.StatusCode != http.StatusOK || len(subs) != 0 {
+		t.Errorf("POST = %v, subscribers = %v", resp.StatusCode, subs)
+	}
+}
@@ -0,0 +1,154 @@
+package mailinglist
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Subscriber is a member of a list.
+type Subscriber struct {
+	Since time.Time `json:"since"`
+	// Number of bounces received since the subscription. The subscriber is
+	// removed once it reaches Backend.MaxBounces.
+	Bounces int `json:"bounces,omitempty"`
+}
+
+// pendingAction is an action waiting for a confirmation.
+type pendingAction struct {
+	Address string    `json:"address"`
+	Action  string    `json:"action"`
+	Expires time.Time `json:"expires"`
+}
+
+// HeldMessage is a message held for moderation.
+type HeldMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// queuedMessage is a message waiting to be distributed.
+type queuedMessage struct {
+	// Subscribers the message hasn't been delivered to yet.
+	Rcpts    []string  `json:"rcpts"`
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts,omitempty"`
+	// Time of the next delivery attempt.
+	Next time.Time `json:"next,omitempty"`
+}
+
+// listState is the state of a list, stored as JSON.
+type listState struct {
+	Subscribers map[string]*Subscriber    `json:"subscribers"`
+	Pending     map[string]*pendingAction `json:"pending,omitempty"`
+	Held        map[string]*HeldMessage   `json:"held,omitempty"`
+	Queue       map[string]*queuedMessage `json:"queue,omitempty"`
+}
+
+// store keeps the state of lists in a directory. Each list has its own
+// sub-directory, containing a state.json file, a held directory with
+// messages held for moderation and a queue directory with messages waiting
+// to be distributed. Callers must serialize accesses.
+type store struct {
+	dir string
+}
+
+func (st *store) listDir(list string) string {
+	return filepath.Join(st.dir, strings.ToLower(list))
+}
+
+func (st *store) load(list string) (*listState, error) {
+	state := &listState{}
+	b, err := ioutil.ReadFile(filepath.Join(st.listDir(list), "state.json"))
+	if os.IsNotExist(err) {
+		// Empty list
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.Subscribers == nil {
+		state.Subscribers = make(map[string]*Subscriber)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string]*pendingAction)
+	}
+	if state.Held == nil {
+		state.Held = make(map[string]*HeldMessage)
+	}
+	if state.Queue == nil {
+		state.Queue = make(map[string]*queuedMessage)
+	}
+	return state, nil
+}
+
+// save atomically replaces the state of a list.
+func (st *store) save(list string, state *listState) error {
+	dir := st.listDir(list)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "state-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, "state.json"))
+}
+
+// Directories of messages.
+const (
+	heldDir  = "held"
+	queueDir = "queue"
+)
+
+func (st *store) messagePath(list, dir, id string) string {
+	return filepath.Join(st.listDir(list), dir, id+".eml")
+}
+
+func (st *store) writeMessage(list, dir, id string, b []byte) error {
+	path := st.messagePath(list, dir, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func (st *store) readMessage(list, dir, id string) ([]byte, error) {
+	return ioutil.ReadFile(st.messagePath(list, dir, id))
+}
+
+func (st *store) removeMessage(list, dir, id string) error {
+	err := os.Remove(st.messagePath(list, dir, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func newToken() (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
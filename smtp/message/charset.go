@@ -0,0 +1,90 @@
+package message
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetReader, if non-nil, is used to convert text in charsets which
+// aren't supported by this package to UTF-8. It can be set to the
+// charset.NewReaderLabel function of golang.org/x/net/html/charset to
+// support most charsets.
+var CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252 to runes. The other
+// bytes are the same as in ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+// iso885915 maps the bytes of ISO-8859-15 which differ from ISO-8859-1.
+var iso885915 = map[byte]rune{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+}
+
+// singleByteReader converts a single-byte charset to UTF-8.
+type singleByteReader struct {
+	r      *bufio.Reader
+	decode func(b byte) rune
+	buf    []byte
+}
+
+func (r *singleByteReader) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			if len(r.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+		if b < utf8.RuneSelf {
+			r.buf = append(r.buf, b)
+		} else {
+			var enc [utf8.UTFMax]byte
+			n := utf8.EncodeRune(enc[:], r.decode(b))
+			r.buf = append(r.buf, enc[:n]...)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func newSingleByteReader(r io.Reader, decode func(b byte) rune) io.Reader {
+	return &singleByteReader{r: bufio.NewReader(r), decode: decode}
+}
+
+// charsetReader returns a reader converting input from charset to UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return newSingleByteReader(input, func(b byte) rune {
+			return rune(b)
+		}), nil
+	case "windows-1252", "cp1252":
+		return newSingleByteReader(input, func(b byte) rune {
+			if b >= 0x80 && b < 0xA0 {
+				return windows1252[b-0x80]
+			}
+			return rune(b)
+		}), nil
+	case "iso-8859-15", "iso8859-15", "latin9":
+		return newSingleByteReader(input, func(b byte) rune {
+			if r, ok := iso885915[b]; ok {
+				return r
+			}
+			return rune(b)
+		}), nil
+	}
+	if CharsetReader != nil {
+		return CharsetReader(charset, input)
+	}
+	return nil, fmt.Errorf("message: unsupported charset %q", charset)
+}
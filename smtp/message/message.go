@@ -0,0 +1,313 @@
+// Package message parses messages into a structured model.
+//
+// Read turns a message, e.g. the reader passed to smtp.Session.Data, into a
+// Message: RFC 5322 header fields are decoded (including RFC 2047 encoded
+// words), the MIME tree is walked, transfer encodings are removed and text
+// is converted to UTF-8. A Message can be serialized as JSON, e.g. to be
+// published to other nodes.
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Maximum depth of nested multipart entities.
+const maxDepth = 20
+
+var errTooDeep = errors.New("message: too many nested multipart entities")
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Address is a mailbox, as found in the From, To or Cc header fields.
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+func (a *Address) String() string {
+	addr := mail.Address{Name: a.Name, Address: a.Address}
+	return addr.String()
+}
+
+// Part is a MIME entity.
+type Part struct {
+	// Header fields, with encoded words decoded.
+	Header map[string][]string `json:"header"`
+	// Media type, e.g. "text/plain" or "multipart/alternative".
+	ContentType string `json:"contentType"`
+	// Content-Type parameters.
+	Params map[string]string `json:"params,omitempty"`
+	// Content-Disposition, e.g. "inline" or "attachment".
+	Disposition string `json:"disposition,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"contentId,omitempty"`
+	// Charset of the original text, before conversion to UTF-8.
+	Charset string `json:"charset,omitempty"`
+	// Size of the decoded content.
+	Size int `json:"size"`
+
+	// Content of textual parts, converted to UTF-8.
+	Text string `json:"text,omitempty"`
+	// Content of non-textual parts.
+	Data []byte `json:"data,omitempty"`
+	// Children of multipart entities.
+	Parts []*Part `json:"parts,omitempty"`
+}
+
+// IsMultipart reports whether the part is a multipart entity.
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsAttachment reports whether the part is an attachment, i.e. a leaf part
+// which isn't part of the message text.
+func (p *Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	if p.Disposition == "attachment" {
+		return true
+	}
+	return p.ContentType != "text/plain" && p.ContentType != "text/html"
+}
+
+// Walk calls fn for the part and its descendants, depth-first.
+func (p *Part) Walk(fn func(p *Part)) {
+	fn(p)
+	for _, child := range p.Parts {
+		child.Walk(fn)
+	}
+}
+
+// Message is a parsed message.
+type Message struct {
+	// Header fields of the message, with encoded words decoded.
+	Header map[string][]string `json:"header"`
+
+	From      []Address `json:"from,omitempty"`
+	Sender    *Address  `json:"sender,omitempty"`
+	ReplyTo   []Address `json:"replyTo,omitempty"`
+	To        []Address `json:"to,omitempty"`
+	Cc        []Address `json:"cc,omitempty"`
+	Bcc       []Address `json:"bcc,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Date      time.Time `json:"date"`
+	MessageID string    `json:"messageId,omitempty"`
+	InReplyTo []string  `json:"inReplyTo,omitempty"`
+	// Message IDs of the References header field.
+	References []string `json:"references,omitempty"`
+
+	// First plain text and HTML bodies which aren't attachments. For
+	// multipart/alternative messages, both are set.
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+
+	// Root MIME entity.
+	Body *Part `json:"body"`
+}
+
+// Recipients returns the addresses of the To, Cc and Bcc header fields.
+func (m *Message) Recipients() []Address {
+	var l []Address
+	l = append(l, m.To...)
+	l = append(l, m.Cc...)
+	l = append(l, m.Bcc...)
+	return l
+}
+
+// Attachments returns the attachments of the message.
+func (m *Message) Attachments() []*Part {
+	var l []*Part
+	if m.Body != nil {
+		m.Body.Walk(func(p *Part) {
+			if p.IsAttachment() {
+				l = append(l, p)
+			}
+		})
+	}
+	return l
+}
+
+// Read parses a message.
+//
+// Malformed header fields, e.g. invalid addresses or dates, are kept in
+// Header but are otherwise ignored. Text in unsupported charsets is kept
+// as-is, with invalid UTF-8 sequences replaced, unless CharsetReader is set.
+func Read(r io.Reader) (*Message, error) {
+	mr, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Header:  decodeHeader(mr.Header),
+		Subject: decodeWords(mr.Header.Get("Subject")),
+	}
+	m.From = parseAddressList(mr.Header.Get("From"))
+	if l := parseAddressList(mr.Header.Get("Sender")); len(l) > 0 {
+		m.Sender = &l[0]
+	}
+	m.ReplyTo = parseAddressList(mr.Header.Get("Reply-To"))
+	m.To = parseAddressList(mr.Header.Get("To"))
+	m.Cc = parseAddressList(mr.Header.Get("Cc"))
+	m.Bcc = parseAddressList(mr.Header.Get("Bcc"))
+	if date, err := mr.Header.Date(); err == nil {
+		m.Date = date
+	}
+	if ids := parseMsgIDs(mr.Header.Get("Message-Id")); len(ids) > 0 {
+		m.MessageID = ids[0]
+	}
+	m.InReplyTo = parseMsgIDs(mr.Header.Get("In-Reply-To"))
+	m.References = parseMsgIDs(mr.Header.Get("References"))
+
+	m.Body, err = readPart(textproto.MIMEHeader(mr.Header), mr.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Body.Walk(func(p *Part) {
+		if p.IsMultipart() || p.IsAttachment() {
+			return
+		}
+		switch p.ContentType {
+		case "text/plain":
+			if m.Text == "" {
+				m.Text = p.Text
+			}
+		case "text/html":
+			if m.HTML == "" {
+				m.HTML = p.Text
+			}
+		}
+	})
+
+	return m, nil
+}
+
+func decodeWords(s string) string {
+	if dec, err := wordDecoder.DecodeHeader(s); err == nil {
+		return dec
+	}
+	return s
+}
+
+func decodeHeader(h map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(h))
+	for k, values := range h {
+		for _, v := range values {
+			out[k] = append(out[k], decodeWords(v))
+		}
+	}
+	return out
+}
+
+func parseAddressList(s string) []Address {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	list, err := parser.ParseList(s)
+	if err != nil {
+		return nil
+	}
+	l := make([]Address, len(list))
+	for i, addr := range list {
+		l[i] = Address{Name: addr.Name, Address: addr.Address}
+	}
+	return l
+}
+
+// parseMsgIDs parses a list of message IDs, and strips their angle brackets.
+func parseMsgIDs(s string) []string {
+	var ids []string
+	for _, f := range strings.Fields(s) {
+		f = strings.TrimSuffix(strings.TrimPrefix(f, "<"), ">")
+		if f != "" {
+			ids = append(ids, f)
+		}
+	}
+	return ids
+}
+
+func readPart(h textproto.MIMEHeader, body io.Reader, depth int) (*Part, error) {
+	p := &Part{Header: decodeHeader(h)}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	p.ContentType = mediaType
+	if len(params) > 0 {
+		p.Params = params
+	}
+
+	if disp, dispParams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		p.Disposition = disp
+		p.Filename = dispParams["filename"]
+	}
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	p.Filename = decodeWords(p.Filename)
+	p.ContentID = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(h.Get("Content-Id")), "<"), ">")
+
+	if p.IsMultipart() && params["boundary"] != "" {
+		if depth >= maxDepth {
+			return nil, errTooDeep
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			child, err := readPart(part.Header, part, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, child)
+		}
+		return p, nil
+	}
+
+	// multipart.Reader already decodes quoted-printable and removes the
+	// Content-Transfer-Encoding header field in that case
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	p.Size = len(b)
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		p.Data = b
+		return p, nil
+	}
+
+	p.Charset = strings.ToLower(params["charset"])
+	if r, err := charsetReader(p.Charset, bytes.NewReader(b)); err == nil {
+		if converted, err := ioutil.ReadAll(r); err == nil {
+			b = converted
+		}
+	}
+	p.Text = strings.ToValidUTF8(string(b), "�")
+	return p, nil
+}
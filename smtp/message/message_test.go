@@ -0,0 +1,133 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: =?utf-8?q?J=C3=A9r=C3=B4me?= <root@nsa.gov>\r\n" +
+	"To: root@gchq.gov.uk, \"Other\" <other@gchq.gov.uk>\r\n" +
+	"Cc: =?iso-8859-1?q?Fran=E7ois?= <francois@dgse.fr>\r\n" +
+	"Subject: =?utf-8?b?Q2Fmw6k=?= time\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-Id: <42@nsa.gov>\r\n" +
+	"References: <1@nsa.gov> <2@nsa.gov>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9 at 10?\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Café at 10?</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"=?utf-8?q?r=C3=A9sum=C3=A9.bin?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--outer--\r\n"
+
+func TestRead(t *testing.T) {
+	m, err := Read(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+
+	if want := []Address{{Name: "Jérôme", Address: "root@nsa.gov"}}; !reflect.DeepEqual(m.From, want) {
+		t.Errorf("From = %v, want %v", m.From, want)
+	}
+	wantRcpts := []Address{
+		{Address: "root@gchq.gov.uk"},
+		{Name: "Other", Address: "other@gchq.gov.uk"},
+		{Name: "François", Address: "francois@dgse.fr"},
+	}
+	if rcpts := m.Recipients(); !reflect.DeepEqual(rcpts, wantRcpts) {
+		t.Errorf("Recipients() = %v, want %v", rcpts, wantRcpts)
+	}
+	if m.Subject != "Café time" {
+		t.Errorf("Subject = %q", m.Subject)
+	}
+	if m.Date.Year() != 2006 || m.MessageID != "42@nsa.gov" || len(m.References) != 2 || m.References[1] != "2@nsa.gov" {
+		t.Errorf("Invalid Date, Message-Id or References: %v, %v, %v", m.Date, m.MessageID, m.References)
+	}
+	if m.Text != "Café at 10?" {
+		t.Errorf("Text = %q", m.Text)
+	}
+	if m.HTML != "<p>Café at 10?</p>" {
+		t.Errorf("HTML = %q", m.HTML)
+	}
+
+	if len(m.Body.Parts) != 2 || len(m.Body.Parts[0].Parts) != 2 {
+		t.Fatalf("Invalid MIME tree: %+v", m.Body)
+	}
+	if p := m.Body.Parts[0].Parts[0]; p.Charset != "iso-8859-1" {
+		t.Errorf("Charset = %q", p.Charset)
+	}
+	attachments := m.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("Attachments() = %v", attachments)
+	}
+	if a := attachments[0]; a.Filename != "résumé.bin" || string(a.Data) != "\x00\x01\x02" || a.Size != 3 {
+		t.Errorf("Invalid attachment: %+v", a)
+	}
+}
+
+func TestRead_json(t *testing.T) {
+	m, err := Read(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	var decoded Message
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+	b2, err := json.Marshal(&decoded)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	if string(b2) != string(b) {
+		t.Errorf("Decoded message differs:\n%s\nwant:\n%s", b2, b)
+	}
+	if decoded.Attachments()[0].Filename != "résumé.bin" || !decoded.Date.Equal(m.Date) {
+		t.Errorf("Invalid decoded message: %+v", &decoded)
+	}
+}
+
+func TestRead_plain(t *testing.T) {
+	m, err := Read(strings.NewReader("From: root@nsa.gov\r\n" +
+		"Content-Type: text/plain; charset=windows-1252\r\n" +
+		"\r\n" +
+		"\x93Hey\x94 \x80\r\n"))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if m.Text != "“Hey” €\r\n" {
+		t.Errorf("Text = %q", m.Text)
+	}
+	if len(m.Attachments()) != 0 {
+		t.Errorf("Attachments() = %v", m.Attachments())
+	}
+
+	m, err = Read(strings.NewReader("Content-Type: text/plain; charset=x-unknown\r\n\r\nHey \xff\r\n"))
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if m.Text != "Hey �\r\n" {
+		t.Errorf("Text = %q", m.Text)
+	}
+}
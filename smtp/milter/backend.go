@@ -0,0 +1,493 @@
+package milter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errMilterTempFail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Service unavailable, try again later",
+}
+
+var errMilterReject = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Command rejected",
+}
+
+// Backend is a backend that consults a milter before passing commands to
+// the underlying backend.
+//
+// The milter is consulted when the session is created (connect and HELO
+// stages), for each MAIL and RCPT command, and for the message header and
+// body. Header modifications, body replacements and quarantine requests are
+// applied before the message is passed to the underlying backend.
+//
+// A single milter connection is kept per SMTP connection: when a client
+// greets again, the milter connection of the previous session is closed.
+type Backend struct {
+	Backend smtp.Backend
+	Client  *Client
+
+	// If true, milter failures are ignored and messages are accepted.
+	// Otherwise, commands are rejected with a temporary error.
+	FailOpen bool
+
+	// Called with messages quarantined by the milter instead of passing them
+	// to the underlying backend. If nil, quarantined messages are rejected.
+	Quarantine func(from string, to []string, r io.Reader, reason string) error
+
+	mutex    sync.Mutex
+	sessions map[*smtp.Conn]*session
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{Session: sess, be: be, conn: c}
+	if err := s.connect(c); err != nil {
+		s.Logout()
+		return nil, err
+	}
+
+	be.mutex.Lock()
+	prev := be.sessions[c]
+	if be.sessions == nil {
+		be.sessions = make(map[*smtp.Conn]*session)
+	}
+	be.sessions[c] = s
+	be.mutex.Unlock()
+
+	// The previous session is replaced without being logged out
+	if prev != nil {
+		prev.closeMilter()
+	}
+	return s, nil
+}
+
+type session struct {
+	Session smtp.Session
+
+	be   *Backend
+	conn *smtp.Conn
+	// nil if the milter doesn't need to be consulted for this connection
+	m *Session
+
+	inTx bool
+	// The milter accepted or discarded the message
+	accepted, discard bool
+	// The milter discarded all messages of the connection
+	discardAll bool
+	// The milter failed and FailOpen is false
+	failed bool
+
+	from  string
+	rcpts []string
+}
+
+// fail handles a milter failure. The milter connection is closed.
+func (s *session) fail(err error) error {
+	if s.m != nil {
+		s.m.conn.Close()
+		s.m = nil
+	}
+	if s.be.FailOpen {
+		return nil
+	}
+	s.failed = true
+	return errMilterTempFail
+}
+
+// apply converts a milter action to an SMTP reply.
+func (s *session) apply(act *Action, err error) error {
+	if err != nil {
+		return s.fail(err)
+	}
+
+	switch act.Type {
+	case ActContinue, ActSkip:
+		return nil
+	case ActAccept:
+		s.accepted = true
+		return nil
+	case ActDiscard:
+		s.discard = true
+		return nil
+	case ActReject:
+		return errMilterReject
+	case ActTempFail:
+		return errMilterTempFail
+	case ActReplyCode:
+		return act.SMTPError
+	default:
+		return s.fail(fmt.Errorf("milter: unexpected action %q", byte(act.Type)))
+	}
+}
+
+func (s *session) connect(c *smtp.Conn) error {
+	m, err := s.be.Client.Session()
+	if err != nil {
+		return s.fail(err)
+	}
+	s.m = m
+
+	var addr net.Addr
+	hostname := "localhost"
+	if c.Conn() != nil {
+		addr = c.Conn().RemoteAddr()
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+			hostname = "[" + tcpAddr.IP.String() + "]"
+		}
+	}
+
+	macros := []string{"j", c.Server().Domain}
+	if addr != nil {
+		macros = append(macros, "{client_addr}", addr.String())
+	}
+	if err := m.Macros(cmdConnect, macros...); err != nil {
+		return s.fail(err)
+	}
+	if err := s.apply(m.Conn(hostname, addr)); err != nil || s.stop() {
+		return err
+	}
+
+	if err := s.apply(m.Helo(c.Hostname())); err != nil || s.stop() {
+		return err
+	}
+	return nil
+}
+
+// stop checks whether the milter needs to be consulted for the rest of the
+// connection. At the connection level, accept and discard apply to all
+// messages.
+func (s *session) stop() bool {
+	if s.m != nil && (s.accepted || s.discard) && !s.inTx {
+		s.discardAll = s.discard
+		s.closeMilter()
+	}
+	return s.m == nil
+}
+
+func (s *session) skip() bool {
+	return s.m == nil || s.accepted || s.discard
+}
+
+func (s *session) abort() {
+	if s.m != nil && s.inTx {
+		if err := s.m.Abort(); err != nil {
+			s.fail(err)
+		}
+	}
+	s.inTx = false
+	s.accepted = false
+	s.discard = s.discardAll
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) Reset() {
+	s.abort()
+	s.Session.Reset()
+}
+
+func (s *session) closeMilter() {
+	if s.m != nil {
+		s.m.Close()
+		s.m = nil
+	}
+}
+
+func (s *session) Logout() error {
+	s.be.mutex.Lock()
+	if s.be.sessions[s.conn] == s {
+		delete(s.be.sessions, s.conn)
+	}
+	s.be.mutex.Unlock()
+
+	s.closeMilter()
+	return s.Session.Logout()
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func mailParams(opts *smtp.MailOptions) []string {
+	if opts == nil {
+		return nil
+	}
+	var params []string
+	if opts.Size > 0 {
+		params = append(params, fmt.Sprintf("SIZE=%v", opts.Size))
+	}
+	if opts.Body != "" {
+		params = append(params, fmt.Sprintf("BODY=%v", opts.Body))
+	}
+	if opts.UTF8 {
+		params = append(params, "SMTPUTF8")
+	}
+	if opts.RequireTLS {
+		params = append(params, "REQUIRETLS")
+	}
+	return params
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.abort()
+	if s.failed {
+		return errMilterTempFail
+	}
+	s.inTx = true
+	s.from = from
+
+	if !s.skip() {
+		if err := s.m.Macros(cmdMail, "{mail_addr}", from); err != nil {
+			return s.fail(err)
+		}
+		if err := s.apply(s.m.Mail(from, mailParams(opts)...)); err != nil {
+			return err
+		}
+	}
+
+	return s.Session.Mail(from, opts)
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.failed {
+		return errMilterTempFail
+	}
+	if !s.skip() {
+		if err := s.m.Macros(cmdRcpt, "{rcpt_addr}", to); err != nil {
+			return s.fail(err)
+		}
+		if err := s.apply(s.m.Rcpt(to)); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	if s.failed {
+		return errMilterTempFail
+	}
+	if s.skip() {
+		if s.discard {
+			io.Copy(ioutil.Discard, r)
+			return nil
+		}
+		return s.Session.Data(r)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg := parseMessage(b)
+
+	mods, err := s.filter(msg)
+	if err != nil {
+		return err
+	}
+	if s.discard {
+		return nil
+	}
+	if len(mods) == 0 {
+		return s.Session.Data(bytes.NewReader(b))
+	}
+
+	var quarantine *Modification
+	for i := range mods {
+		if mods[i].Type == ActQuarantine {
+			quarantine = &mods[i]
+		}
+	}
+	msg.apply(mods)
+
+	var buf bytes.Buffer
+	msg.WriteTo(&buf)
+
+	if quarantine != nil {
+		if s.be.Quarantine == nil {
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Message quarantined: " + quarantine.Reason,
+			}
+		}
+		return s.be.Quarantine(s.from, s.rcpts, &buf, quarantine.Reason)
+	}
+
+	return s.Session.Data(&buf)
+}
+
+// filter sends the message to the milter and returns the requested
+// modifications.
+func (s *session) filter(msg *message) ([]Modification, error) {
+	if err := s.apply(s.m.Data()); err != nil || s.skip() {
+		return nil, err
+	}
+
+	for _, f := range msg.header {
+		if err := s.apply(s.m.Header(f.name, f.milterValue())); err != nil || s.skip() {
+			return nil, err
+		}
+	}
+	if err := s.apply(s.m.EndOfHeaders()); err != nil || s.skip() {
+		return nil, err
+	}
+
+	// ActSkip means the milter doesn't need the rest of the body
+	if err := s.apply(s.m.Body(msg.body)); err != nil || s.skip() {
+		return nil, err
+	}
+
+	// Modifications are applied even if the message is accepted
+	act, mods, err := s.m.End()
+	if err := s.apply(act, err); err != nil || s.m == nil || s.discard {
+		return nil, err
+	}
+	return mods, nil
+}
+
+type headerField struct {
+	name  string
+	value string // value without the leading space
+	raw   string // the whole field, including the line ending, empty if modified
+}
+
+// milterValue returns the value as sent to milters, with LF line endings.
+func (f *headerField) milterValue() string {
+	return strings.ReplaceAll(f.value, "\r\n", "\n")
+}
+
+type message struct {
+	header []headerField
+	body   []byte
+}
+
+func parseMessage(b []byte) *message {
+	msg := &message{}
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		var line []byte
+		if i < 0 {
+			line, b = b, nil
+		} else {
+			line, b = b[:i+1], b[i+1:]
+		}
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			msg.body = b
+			return msg
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.header) > 0 {
+			f := &msg.header[len(msg.header)-1]
+			f.raw += string(line)
+			f.value += "\r\n" + string(trimmed)
+			continue
+		}
+
+		name, value := string(trimmed), ""
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name, value = name[:i], strings.TrimLeft(name[i+1:], " \t")
+		}
+		msg.header = append(msg.header, headerField{
+			name:  strings.TrimSpace(name),
+			value: value,
+			raw:   string(line),
+		})
+	}
+	return msg
+}
+
+func newHeaderField(name, value string) headerField {
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.ReplaceAll(value, "\n", "\r\n")
+	return headerField{name: name, value: value}
+}
+
+// apply applies header and body modifications.
+func (msg *message) apply(mods []Modification) {
+	var body []byte
+	replaceBody := false
+	for _, mod := range mods {
+		switch mod.Type {
+		case ActAddHeader:
+			msg.header = append(msg.header, newHeaderField(mod.HeaderName, mod.HeaderValue))
+		case ActInsertHeader:
+			i := int(mod.HeaderIndex)
+			if i > len(msg.header) {
+				i = len(msg.header)
+			}
+			msg.header = append(msg.header, headerField{})
+			copy(msg.header[i+1:], msg.header[i:])
+			msg.header[i] = newHeaderField(mod.HeaderName, mod.HeaderValue)
+		case ActChangeHeader:
+			msg.changeHeader(mod.HeaderIndex, mod.HeaderName, mod.HeaderValue)
+		case ActReplBody:
+			body = append(body, mod.Body...)
+			replaceBody = true
+		}
+	}
+	if replaceBody {
+		msg.body = body
+	}
+}
+
+// changeHeader changes the index-th occurrence (starting at 1) of a header
+// field. If the value is empty, the field is removed. If there is no such
+// occurrence, the field is added.
+func (msg *message) changeHeader(index uint32, name, value string) {
+	n := uint32(0)
+	for i, f := range msg.header {
+		if !strings.EqualFold(f.name, name) {
+			continue
+		}
+		n++
+		if n != index && index != 0 {
+			continue
+		}
+		if value == "" {
+			msg.header = append(msg.header[:i], msg.header[i+1:]...)
+		} else {
+			msg.header[i] = newHeaderField(f.name, value)
+		}
+		return
+	}
+	if value != "" {
+		msg.header = append(msg.header, newHeaderField(name, value))
+	}
+}
+
+func (msg *message) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range msg.header {
+		if f.raw != "" {
+			buf.WriteString(f.raw)
+		} else {
+			buf.WriteString(f.name + ": " + f.value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(msg.body)
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,548 @@
+// Package milter implements a client for the Sendmail mail filter protocol
+// (milter), version 6.
+//
+// Milters such as rspamd or opendkim can inspect and modify messages
+// received by a smtp.Server. A Backend wraps another backend and consults a
+// milter at each stage of the SMTP transaction.
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Protocol version implemented by this package.
+const protocolVersion = 6
+
+// Maximum size of a body chunk.
+const maxBodyChunk = 65535
+
+// Maximum size of a packet sent by a milter.
+const maxPacketSize = 1024 * 1024
+
+const defaultTimeout = 10 * time.Second
+
+// OptAction is a set of message modifications a milter may perform.
+type OptAction uint32
+
+const (
+	OptAddHeader     OptAction = 0x01
+	OptChangeBody    OptAction = 0x02
+	OptAddRcpt       OptAction = 0x04
+	OptRemoveRcpt    OptAction = 0x08
+	OptChangeHeader  OptAction = 0x10
+	OptQuarantine    OptAction = 0x20
+	OptChangeFrom    OptAction = 0x40
+	OptAddRcptParams OptAction = 0x80
+	OptSetSymList    OptAction = 0x100
+)
+
+// OptProtocol is a set of protocol steps. The milter uses it to skip stages
+// it isn't interested in, and stages it doesn't reply to.
+type OptProtocol uint32
+
+const (
+	OptNoConnect      OptProtocol = 0x01
+	OptNoHelo         OptProtocol = 0x02
+	OptNoMailFrom     OptProtocol = 0x04
+	OptNoRcptTo       OptProtocol = 0x08
+	OptNoBody         OptProtocol = 0x10
+	OptNoHeaders      OptProtocol = 0x20
+	OptNoEOH          OptProtocol = 0x40
+	OptNoHeaderReply  OptProtocol = 0x80
+	OptNoUnknown      OptProtocol = 0x100
+	OptNoData         OptProtocol = 0x200
+	OptSkip           OptProtocol = 0x400
+	OptRcptRej        OptProtocol = 0x800
+	OptNoConnReply    OptProtocol = 0x1000
+	OptNoHeloReply    OptProtocol = 0x2000
+	OptNoMailReply    OptProtocol = 0x4000
+	OptNoRcptReply    OptProtocol = 0x8000
+	OptNoDataReply    OptProtocol = 0x10000
+	OptNoUnknownReply OptProtocol = 0x20000
+	OptNoEOHReply     OptProtocol = 0x40000
+	OptNoBodyReply    OptProtocol = 0x80000
+)
+
+// Protocol steps offered to milters by default. OptRcptRej and the
+// header leading space option aren't supported.
+const defaultProtocol = OptNoConnect | OptNoHelo | OptNoMailFrom | OptNoRcptTo |
+	OptNoBody | OptNoHeaders | OptNoEOH | OptNoHeaderReply | OptNoUnknown |
+	OptNoData | OptSkip | OptNoConnReply | OptNoHeloReply | OptNoMailReply |
+	OptNoRcptReply | OptNoDataReply | OptNoUnknownReply | OptNoEOHReply |
+	OptNoBodyReply
+
+// Message modifications supported by Backend.
+const defaultActions = OptAddHeader | OptChangeHeader | OptChangeBody | OptQuarantine
+
+// Commands sent to milters.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// ActionType is the type of a milter reply ending a stage.
+type ActionType byte
+
+const (
+	ActAccept    ActionType = 'a'
+	ActContinue  ActionType = 'c'
+	ActDiscard   ActionType = 'd'
+	ActReject    ActionType = 'r'
+	ActTempFail  ActionType = 't'
+	ActReplyCode ActionType = 'y'
+	ActSkip      ActionType = 's'
+)
+
+// Action is a milter reply ending a stage.
+type Action struct {
+	Type ActionType
+	// SMTP reply sent by the milter, for ActReplyCode
+	SMTPError *smtp.SMTPError
+}
+
+// ModifyActType is the type of a message modification.
+type ModifyActType byte
+
+const (
+	ActAddRcpt      ModifyActType = '+'
+	ActDelRcpt      ModifyActType = '-'
+	ActReplBody     ModifyActType = 'b'
+	ActChangeFrom   ModifyActType = 'e'
+	ActAddHeader    ModifyActType = 'h'
+	ActInsertHeader ModifyActType = 'i'
+	ActChangeHeader ModifyActType = 'm'
+	ActQuarantine   ModifyActType = 'q'
+)
+
+// Modification is a message modification requested by a milter at the end
+// of the message.
+type Modification struct {
+	Type ModifyActType
+	// Header index, for ActInsertHeader and ActChangeHeader
+	HeaderIndex uint32
+	HeaderName  string
+	HeaderValue string
+	// Body chunk, for ActReplBody
+	Body []byte
+	// Address, for ActAddRcpt, ActDelRcpt and ActChangeFrom
+	Addr string
+	// Reason, for ActQuarantine
+	Reason string
+}
+
+// Replies sent by milters which aren't actions or modifications.
+const (
+	respOptNeg   = 'O'
+	respProgress = 'p'
+)
+
+// Client holds the configuration needed to connect to a milter.
+type Client struct {
+	// The type of network, "tcp" or "unix".
+	Network string
+	// Address of the milter.
+	Addr string
+	// Timeout for milter I/O operations. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// Message modifications the milter is allowed to perform. Defaults to
+	// adding and changing headers, replacing the body and quarantining.
+	Actions OptAction
+	// Protocol steps the milter is allowed to skip. Defaults to all steps
+	// supported by this package.
+	Protocol OptProtocol
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return c.Timeout
+}
+
+// Session opens a connection to the milter and negotiates options.
+func (c *Client) Session() (*Session, error) {
+	conn, err := net.DialTimeout(c.Network, c.Addr, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: c.timeout(),
+	}
+	if err := s.negotiate(c.actions(), c.protocol()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *Client) actions() OptAction {
+	if c.Actions == 0 {
+		return defaultActions
+	}
+	return c.Actions
+}
+
+func (c *Client) protocol() OptProtocol {
+	if c.Protocol == 0 {
+		return defaultProtocol
+	}
+	return c.Protocol
+}
+
+// Session is a connection to a milter.
+type Session struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	actions  OptAction
+	protocol OptProtocol
+}
+
+func (s *Session) writePacket(cmd byte, data []byte) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *Session) readPacket() (byte, []byte, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return 0, nil, err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size == 0 || size > maxPacketSize {
+		return 0, nil, fmt.Errorf("milter: invalid packet size %v", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+func (s *Session) negotiate(actions OptAction, protocol OptProtocol) error {
+	var data [12]byte
+	binary.BigEndian.PutUint32(data[0:], protocolVersion)
+	binary.BigEndian.PutUint32(data[4:], uint32(actions))
+	binary.BigEndian.PutUint32(data[8:], uint32(protocol))
+	if err := s.writePacket(cmdOptNeg, data[:]); err != nil {
+		return err
+	}
+
+	cmd, resp, err := s.readPacket()
+	if err != nil {
+		return err
+	}
+	if cmd != respOptNeg || len(resp) < 12 {
+		return fmt.Errorf("milter: unexpected option negotiation reply %q", cmd)
+	}
+	version := binary.BigEndian.Uint32(resp[0:])
+	if version < 2 || version > protocolVersion {
+		return fmt.Errorf("milter: unsupported protocol version %v", version)
+	}
+	s.actions = OptAction(binary.BigEndian.Uint32(resp[4:]))
+	s.protocol = OptProtocol(binary.BigEndian.Uint32(resp[8:]))
+	if s.actions&^actions != 0 {
+		return fmt.Errorf("milter: requested unsupported actions 0x%x", uint32(s.actions&^actions))
+	}
+	if s.protocol&^protocol != 0 {
+		return fmt.Errorf("milter: requested unsupported protocol steps 0x%x", uint32(s.protocol&^protocol))
+	}
+	return nil
+}
+
+// Actions returns the message modifications negotiated with the milter.
+func (s *Session) Actions() OptAction {
+	return s.actions
+}
+
+// Protocol returns the protocol steps negotiated with the milter.
+func (s *Session) Protocol() OptProtocol {
+	return s.protocol
+}
+
+func parseReplyCode(b []byte) (*smtp.SMTPError, error) {
+	text := strings.TrimRight(string(b), "\x00")
+	parts := strings.SplitN(text, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("milter: malformed reply code %q", text)
+	}
+	code, err := strconv.Atoi(parts[0])
+	if err != nil || code < 400 || code > 599 {
+		return nil, fmt.Errorf("milter: invalid reply code %q", text)
+	}
+
+	smtpErr := &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode}
+	msg := strings.Join(parts[1:], " ")
+	if ec, err := parseEnhancedCode(parts[1]); err == nil && len(parts) == 3 {
+		smtpErr.EnhancedCode = ec
+		msg = parts[2]
+	}
+	smtpErr.Message = msg
+	return smtpErr, nil
+}
+
+func parseEnhancedCode(s string) (smtp.EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, errors.New("milter: malformed enhanced code")
+	}
+	var ec smtp.EnhancedCode
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return smtp.EnhancedCode{}, err
+		}
+		ec[i] = n
+	}
+	return ec, nil
+}
+
+// readAction reads replies until an action is received. Modifications are
+// only allowed at the end of the message.
+func (s *Session) readAction(allowModify bool) (*Action, []Modification, error) {
+	var mods []Modification
+	for {
+		cmd, data, err := s.readPacket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch act := ActionType(cmd); act {
+		case ActAccept, ActContinue, ActDiscard, ActReject, ActTempFail, ActSkip:
+			return &Action{Type: act}, mods, nil
+		case ActReplyCode:
+			smtpErr, err := parseReplyCode(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &Action{Type: act, SMTPError: smtpErr}, mods, nil
+		}
+
+		if cmd == respProgress {
+			continue
+		}
+		if !allowModify {
+			return nil, nil, fmt.Errorf("milter: unexpected reply %q", cmd)
+		}
+
+		mod, err := parseModification(ModifyActType(cmd), data)
+		if err != nil {
+			return nil, nil, err
+		}
+		mods = append(mods, *mod)
+	}
+}
+
+func splitCStrings(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\x00")
+	return strings.Split(s, "\x00")
+}
+
+func parseModification(typ ModifyActType, data []byte) (*Modification, error) {
+	mod := &Modification{Type: typ}
+	switch typ {
+	case ActAddHeader:
+		l := splitCStrings(data)
+		if len(l) != 2 {
+			return nil, errors.New("milter: malformed add header modification")
+		}
+		mod.HeaderName, mod.HeaderValue = l[0], l[1]
+	case ActInsertHeader, ActChangeHeader:
+		if len(data) < 4 {
+			return nil, errors.New("milter: malformed header modification")
+		}
+		mod.HeaderIndex = binary.BigEndian.Uint32(data)
+		l := splitCStrings(data[4:])
+		if len(l) != 2 {
+			return nil, errors.New("milter: malformed header modification")
+		}
+		mod.HeaderName, mod.HeaderValue = l[0], l[1]
+	case ActReplBody:
+		mod.Body = data
+	case ActAddRcpt, ActDelRcpt, ActChangeFrom:
+		mod.Addr = splitCStrings(data)[0]
+	case ActQuarantine:
+		mod.Reason = splitCStrings(data)[0]
+	default:
+		return nil, fmt.Errorf("milter: unknown reply %q", byte(typ))
+	}
+	return mod, nil
+}
+
+// send sends a command and reads the milter reply. If noSend is part of
+// the negotiated protocol, the command isn't sent. If noReply is part of the
+// negotiated protocol, the milter doesn't reply. In both cases, ActContinue
+// is returned.
+func (s *Session) send(cmd byte, data []byte, noSend, noReply OptProtocol) (*Action, error) {
+	if noSend != 0 && s.protocol&noSend != 0 {
+		return &Action{Type: ActContinue}, nil
+	}
+	if err := s.writePacket(cmd, data); err != nil {
+		return nil, err
+	}
+	if noReply != 0 && s.protocol&noReply != 0 {
+		return &Action{Type: ActContinue}, nil
+	}
+	act, _, err := s.readAction(false)
+	return act, err
+}
+
+func appendCString(b []byte, s string) []byte {
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+// Macros sends macros for the next command. kv is a list of macro names
+// and values.
+func (s *Session) Macros(cmd byte, kv ...string) error {
+	data := []byte{cmd}
+	for _, v := range kv {
+		data = appendCString(data, v)
+	}
+	return s.writePacket(cmdMacro, data)
+}
+
+// Conn sends the connection information: the host name of the client and
+// its address. addr may be nil if the address is unknown.
+func (s *Session) Conn(hostname string, addr net.Addr) (*Action, error) {
+	data := appendCString(nil, hostname)
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		family := byte('4')
+		if addr.IP.To4() == nil {
+			family = '6'
+		}
+		data = append(data, family)
+		data = append(data, byte(addr.Port>>8), byte(addr.Port))
+		data = appendCString(data, addr.IP.String())
+	case *net.UnixAddr:
+		data = append(data, 'L', 0, 0)
+		data = appendCString(data, addr.Name)
+	default:
+		data = append(data, 'U')
+	}
+	return s.send(cmdConnect, data, OptNoConnect, OptNoConnReply)
+}
+
+// Helo sends the HELO/EHLO domain.
+func (s *Session) Helo(domain string) (*Action, error) {
+	return s.send(cmdHelo, appendCString(nil, domain), OptNoHelo, OptNoHeloReply)
+}
+
+// Mail sends the reverse-path and its ESMTP parameters.
+func (s *Session) Mail(from string, params ...string) (*Action, error) {
+	data := appendCString(nil, "<"+from+">")
+	for _, p := range params {
+		data = appendCString(data, p)
+	}
+	return s.send(cmdMail, data, OptNoMailFrom, OptNoMailReply)
+}
+
+// Rcpt sends a recipient and its ESMTP parameters.
+func (s *Session) Rcpt(to string, params ...string) (*Action, error) {
+	data := appendCString(nil, "<"+to+">")
+	for _, p := range params {
+		data = appendCString(data, p)
+	}
+	return s.send(cmdRcpt, data, OptNoRcptTo, OptNoRcptReply)
+}
+
+// Data notifies the milter that the message is about to be sent.
+func (s *Session) Data() (*Action, error) {
+	return s.send(cmdData, nil, OptNoData, OptNoDataReply)
+}
+
+// Header sends a header field.
+func (s *Session) Header(name, value string) (*Action, error) {
+	data := appendCString(nil, name)
+	data = appendCString(data, value)
+	return s.send(cmdHeader, data, OptNoHeaders, OptNoHeaderReply)
+}
+
+// EndOfHeaders notifies the milter that all header fields have been sent.
+func (s *Session) EndOfHeaders() (*Action, error) {
+	return s.send(cmdEOH, nil, OptNoEOH, OptNoEOHReply)
+}
+
+// BodyChunk sends a chunk of the message body, at most 65535 bytes long.
+//
+// ActSkip is returned if the milter doesn't need the rest of the body.
+func (s *Session) BodyChunk(chunk []byte) (*Action, error) {
+	return s.send(cmdBody, chunk, OptNoBody, OptNoBodyReply)
+}
+
+// Body sends the message body, split in chunks.
+func (s *Session) Body(body []byte) (*Action, error) {
+	for len(body) > 0 {
+		n := len(body)
+		if n > maxBodyChunk {
+			n = maxBodyChunk
+		}
+		act, err := s.BodyChunk(body[:n])
+		if err != nil || act.Type != ActContinue {
+			return act, err
+		}
+		body = body[n:]
+	}
+	return &Action{Type: ActContinue}, nil
+}
+
+// End notifies the milter that the message is complete, and returns the
+// final action and the requested message modifications.
+func (s *Session) End() (*Action, []Modification, error) {
+	if err := s.writePacket(cmdEOB, nil); err != nil {
+		return nil, nil, err
+	}
+	return s.readAction(true)
+}
+
+// Abort aborts the current message. The session can be used for another
+// message.
+func (s *Session) Abort() error {
+	return s.writePacket(cmdAbort, nil)
+}
+
+// Close closes the connection to the milter.
+func (s *Session) Close() error {
+	s.writePacket(cmdQuit, nil)
+	return s.conn.Close()
+}
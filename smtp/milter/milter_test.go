@@ -0,0 +1,476 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type packet struct {
+	cmd  byte
+	data []byte
+}
+
+// fakeMilter is an in-process milter. It replies to each command with the
+// packets returned by handle, or with a continue action if handle is nil or
+// returns nil.
+type fakeMilter struct {
+	l        net.Listener
+	actions  OptAction
+	protocol OptProtocol
+	handle   func(cmd byte, data []byte) []packet
+
+	mutex  sync.Mutex
+	conns  int // open connections
+	cmds   []byte
+	macros []string
+	header []string
+	body   []byte
+}
+
+func newFakeMilter(t *testing.T, handle func(cmd byte, data []byte) []packet) *fakeMilter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMilter{l: l, actions: defaultActions, handle: handle}
+	go m.serve()
+	return m
+}
+
+func (m *fakeMilter) client() *Client {
+	return &Client{Network: "tcp", Addr: m.l.Addr().String()}
+}
+
+func (m *fakeMilter) serve() {
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		go m.serveConn(conn)
+	}
+}
+
+func writeTestPacket(w io.Writer, p packet) error {
+	buf := make([]byte, 5+len(p.data))
+	binary.BigEndian.PutUint32(buf, uint32(len(p.data)+1))
+	buf[4] = p.cmd
+	copy(buf[5:], p.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (m *fakeMilter) openConns() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.conns
+}
+
+func (m *fakeMilter) serveConn(conn net.Conn) {
+	m.mutex.Lock()
+	m.conns++
+	m.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		m.mutex.Lock()
+		m.conns--
+		m.mutex.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		cmd, data := buf[0], buf[1:]
+
+		m.mutex.Lock()
+		m.cmds = append(m.cmds, cmd)
+		switch cmd {
+		case cmdMacro:
+			m.macros = append(m.macros, splitCStrings(data[1:])...)
+		case cmdHeader:
+			m.header = append(m.header, strings.Join(splitCStrings(data), ": "))
+		case cmdBody:
+			m.body = append(m.body, data...)
+		}
+		m.mutex.Unlock()
+
+		var replies []packet
+		switch cmd {
+		case cmdOptNeg:
+			resp := make([]byte, 12)
+			binary.BigEndian.PutUint32(resp[0:], protocolVersion)
+			binary.BigEndian.PutUint32(resp[4:], uint32(m.actions))
+			binary.BigEndian.PutUint32(resp[8:], uint32(m.protocol))
+			replies = []packet{{respOptNeg, resp}}
+		case cmdMacro, cmdAbort:
+			continue
+		case cmdQuit:
+			return
+		default:
+			if m.handle != nil {
+				replies = m.handle(cmd, data)
+			}
+			if replies == nil {
+				replies = []packet{{byte(ActContinue), nil}}
+			}
+		}
+
+		for _, p := range replies {
+			if err := writeTestPacket(conn, p); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *fakeMilter) Close() error {
+	return m.l.Close()
+}
+
+type delivery struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+type testBackend struct {
+	messages []*delivery
+}
+
+func (be *testBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &testSession{be: be}, nil
+}
+
+type testSession struct {
+	be  *testBackend
+	msg *delivery
+}
+
+func (s *testSession) Reset()        { s.msg = nil }
+func (s *testSession) Logout() error { return nil }
+
+func (s *testSession) AuthPlain(username, password string) error {
+	return errors.New("Invalid username or password")
+}
+
+func (s *testSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &delivery{From: from}
+	return nil
+}
+
+func (s *testSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = b
+	s.be.messages = append(s.be.messages, s.msg)
+	return nil
+}
+
+func testServer(t *testing.T, mbe *Backend) (be *testBackend, s *smtp.Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = &testBackend{}
+	mbe.Backend = be
+	s = smtp.NewServer(mbe)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	return be, s, l.Addr().String()
+}
+
+const testMessage = "From: root@nsa.gov\r\n" +
+	"Subject: Hello\r\n" +
+	"X-Folded: a\r\n" +
+	" b\r\n" +
+	"\r\n" +
+	"Hey <3\r\n"
+
+func sendTestMail(t *testing.T, addr string, to ...string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("root@nsa.gov", to, strings.NewReader(testMessage)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestBackend_modify(t *testing.T) {
+	m := newFakeMilter(t, func(cmd byte, data []byte) []packet {
+		if cmd != cmdEOB {
+			return nil
+		}
+		chg := make([]byte, 4)
+		binary.BigEndian.PutUint32(chg, 1)
+		ins := make([]byte, 4)
+		return []packet{
+			{byte(ActAddHeader), []byte("X-Spam\x00yes\x00")},
+			{byte(ActChangeHeader), append(chg, "Subject\x00[SPAM] Hello\x00"...)},
+			{byte(ActChangeHeader), append(chg, "X-Folded\x00\x00"...)},
+			{byte(ActInsertHeader), append(ins, "Received\x00by milter\x00"...)},
+			{byte(ActReplBody), []byte("Replaced ")},
+			{byte(ActReplBody), []byte("body\r\n")},
+			{byte(ActContinue), nil},
+		}
+	})
+	defer m.Close()
+
+	be, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	want := "Received: by milter\r\n" +
+		"From: root@nsa.gov\r\n" +
+		"Subject: [SPAM] Hello\r\n" +
+		"X-Spam: yes\r\n" +
+		"\r\n" +
+		"Replaced body\r\n"
+	if got := string(be.messages[0].Data); got != want {
+		t.Errorf("Invalid message:\n%v\nwant:\n%v", got, want)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if want := "OCHMRTLLLNBE"; !strings.HasPrefix(strings.ReplaceAll(string(m.cmds), "D", ""), want) {
+		t.Errorf("Invalid milter commands: %q, want %q", m.cmds, want)
+	}
+	if want := []string{"From: root@nsa.gov", "Subject: Hello", "X-Folded: a\n b"}; strings.Join(m.header, "|") != strings.Join(want, "|") {
+		t.Errorf("Invalid milter header: %q, want %q", m.header, want)
+	}
+	if string(m.body) != "Hey <3\r\n" {
+		t.Errorf("Invalid milter body: %q", m.body)
+	}
+	if !strings.Contains(strings.Join(m.macros, "|"), "{mail_addr}|root@nsa.gov") {
+		t.Errorf("Missing {mail_addr} macro: %q", m.macros)
+	}
+}
+
+func TestBackend_reject(t *testing.T) {
+	m := newFakeMilter(t, func(cmd byte, data []byte) []packet {
+		if cmd == cmdRcpt && strings.HasPrefix(string(data), "<unknown@") {
+			return []packet{{byte(ActReplyCode), []byte("550 5.1.1 No such user\x00")}}
+		}
+		if cmd == cmdMail && strings.HasPrefix(string(data), "<spammer@") {
+			return []packet{{byte(ActTempFail), nil}}
+		}
+		return nil
+	})
+	defer m.Close()
+
+	_, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Mail("spammer@example.org", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatalf("Mail() = %v, want a 451 error", err)
+	}
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	err = c.Rcpt("unknown@gchq.gov.uk", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) || smtpErr.Message != "No such user" {
+		t.Fatalf("Rcpt() = %v, want the milter reply", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+}
+
+func TestBackend_discard(t *testing.T) {
+	m := newFakeMilter(t, func(cmd byte, data []byte) []packet {
+		if cmd == cmdEOB {
+			return []packet{{byte(ActDiscard), nil}}
+		}
+		return nil
+	})
+	defer m.Close()
+
+	be, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 0 {
+		t.Error("Discarded message was delivered:", be.messages)
+	}
+}
+
+func TestBackend_quarantine(t *testing.T) {
+	m := newFakeMilter(t, func(cmd byte, data []byte) []packet {
+		if cmd == cmdEOB {
+			return []packet{
+				{byte(ActQuarantine), []byte("Virus found\x00")},
+				{byte(ActAccept), nil},
+			}
+		}
+		return nil
+	})
+	defer m.Close()
+
+	var quarantined []string
+	be, s, addr := testServer(t, &Backend{
+		Client: m.client(),
+		Quarantine: func(from string, to []string, r io.Reader, reason string) error {
+			quarantined = append(quarantined, from+" "+strings.Join(to, ",")+" "+reason)
+			return nil
+		},
+	})
+	defer s.Close()
+
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 0 {
+		t.Error("Quarantined message was delivered:", be.messages)
+	}
+	if want := "root@nsa.gov root@gchq.gov.uk Virus found"; len(quarantined) != 1 || quarantined[0] != want {
+		t.Errorf("Invalid quarantined messages: %q, want %q", quarantined, want)
+	}
+}
+
+func TestBackend_acceptConnection(t *testing.T) {
+	m := newFakeMilter(t, func(cmd byte, data []byte) []packet {
+		switch cmd {
+		case cmdConnect:
+			return nil
+		case cmdHelo:
+			return []packet{{byte(ActAccept), nil}}
+		}
+		return []packet{{byte(ActReject), nil}}
+	})
+	defer m.Close()
+
+	be, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 1 || string(be.messages[0].Data) != testMessage {
+		t.Error("Invalid delivered messages:", be.messages)
+	}
+}
+
+func TestBackend_helloTwice(t *testing.T) {
+	m := newFakeMilter(t, nil)
+	defer m.Close()
+
+	_, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id, err := c.Cmd("HELO localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.StartResponse(id)
+		_, _, err = c.ReadResponse(250)
+		c.EndResponse(id)
+		if err != nil {
+			t.Fatalf("HELO: %v", err)
+		}
+	}
+
+	// Previous milter connections are closed asynchronously
+	deadline := time.Now().Add(time.Second)
+	for m.openConns() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.openConns(); n != 1 {
+		t.Errorf("%v open milter connections, want 1", n)
+	}
+}
+
+func TestBackend_unavailable(t *testing.T) {
+	m := newFakeMilter(t, nil)
+	m.Close()
+
+	be, s, addr := testServer(t, &Backend{Client: m.client()})
+	err := sendTestMail(t, addr, "root@gchq.gov.uk")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("SendMail() = %v, want a 451 error", err)
+	}
+	s.Close()
+
+	be, s, addr = testServer(t, &Backend{Client: m.client(), FailOpen: true})
+	defer s.Close()
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 1 {
+		t.Error("Invalid number of delivered messages:", be.messages)
+	}
+}
+
+func TestSession_noReply(t *testing.T) {
+	m := newFakeMilter(t, nil)
+	m.protocol = OptNoConnect | OptNoHelo | OptNoRcptReply | OptNoHeaders | OptNoBody
+	defer m.Close()
+
+	be, s, addr := testServer(t, &Backend{Client: m.client()})
+	defer s.Close()
+
+	if err := sendTestMail(t, addr, "root@gchq.gov.uk"); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 1 {
+		t.Error("Invalid number of delivered messages:", be.messages)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if got := strings.ReplaceAll(string(m.cmds), "D", ""); !strings.HasPrefix(got, "OMRTNE") {
+		t.Errorf("Invalid milter commands: %q", got)
+	}
+}
@@ -0,0 +1,196 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fetcher retrieves the policy body of a domain.
+type Fetcher interface {
+	FetchPolicy(ctx context.Context, domain string) (io.ReadCloser, error)
+}
+
+// FetcherFunc is an adapter to allow the use of ordinary functions as
+// fetchers.
+type FetcherFunc func(ctx context.Context, domain string) (io.ReadCloser, error)
+
+func (f FetcherFunc) FetchPolicy(ctx context.Context, domain string) (io.ReadCloser, error) {
+	return f(ctx, domain)
+}
+
+// HTTPFetcher fetches policies over HTTPS from the domain's policy host, as
+// defined in RFC 8461 section 3.3.
+type HTTPFetcher struct {
+	// HTTP client used to fetch policies. If nil, a client with a 1 minute
+	// timeout is used. Redirects must not be followed.
+	Client *http.Client
+}
+
+var defaultHTTPClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (f *HTTPFetcher) FetchPolicy(ctx context.Context, domain string) (io.ReadCloser, error) {
+	client := f.Client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("mtasts: failed to fetch policy for %q: HTTP %v", domain, resp.Status)
+	}
+	if t := resp.Header.Get("Content-Type"); !strings.HasPrefix(t, "text/plain") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("mtasts: unexpected policy media type for %q: %q", domain, t)
+	}
+	return resp.Body, nil
+}
+
+// ErrNoPolicy is returned by Cache.Get when a domain doesn't publish a
+// policy.
+var ErrNoPolicy = errors.New("mtasts: no policy")
+
+type cacheEntry struct {
+	id      string
+	policy  *Policy
+	expires time.Time
+}
+
+// Cache fetches and caches policies. It is safe for concurrent use.
+type Cache struct {
+	// Fetcher used to retrieve policies. If nil, a HTTPFetcher is used.
+	Fetcher Fetcher
+	// Function used to lookup the _mta-sts TXT records. If nil,
+	// net.DefaultResolver.LookupTXT is used.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	now func() time.Time // for tests
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func (c *Cache) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	if c.LookupTXT != nil {
+		return c.LookupTXT(ctx, name)
+	}
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+func (c *Cache) fetch(ctx context.Context, domain string) (*Policy, error) {
+	f := c.Fetcher
+	if f == nil {
+		f = &HTTPFetcher{}
+	}
+	rc, err := f.FetchPolicy(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ParsePolicy(rc)
+}
+
+func (c *Cache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// lookupID returns the policy ID published in the _mta-sts TXT record of a
+// domain, as defined in RFC 8461 section 3.1.
+func (c *Cache) lookupID(ctx context.Context, domain string) (string, error) {
+	records, err := c.lookupTXT(ctx, "_mta-sts."+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return "", ErrNoPolicy
+	} else if err != nil {
+		return "", err
+	}
+
+	var id string
+	n := 0
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		n++
+		for _, field := range strings.Split(record, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	// Multiple records must be treated as if no record was published
+	if n != 1 || id == "" {
+		return "", ErrNoPolicy
+	}
+	return id, nil
+}
+
+// Get returns the policy of a domain. ErrNoPolicy is returned if the domain
+// doesn't publish a policy.
+//
+// Cached policies are used until they expire, or until the domain publishes
+// a new policy ID. If the policy can't be refreshed, the cached policy is
+// used, as required by RFC 8461 section 5.1.
+func (c *Cache) Get(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	c.mutex.Lock()
+	entry := c.entries[domain]
+	c.mutex.Unlock()
+
+	id, err := c.lookupID(ctx, domain)
+	if err != nil {
+		if entry != nil && c.timeNow().Before(entry.expires) {
+			return entry.policy, nil
+		}
+		return nil, err
+	}
+
+	if entry != nil && entry.id == id && c.timeNow().Before(entry.expires) {
+		return entry.policy, nil
+	}
+
+	policy, err := c.fetch(ctx, domain)
+	if err != nil {
+		if entry != nil && c.timeNow().Before(entry.expires) {
+			return entry.policy, nil
+		}
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	c.entries[domain] = &cacheEntry{
+		id:      id,
+		policy:  policy,
+		expires: c.timeNow().Add(policy.MaxAge),
+	}
+	c.mutex.Unlock()
+
+	return policy, nil
+}
@@ -0,0 +1,130 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDNS map[string][]string
+
+func (dns testDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := dns[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestCache(t *testing.T) {
+	dns := testDNS{"_mta-sts.example.com": {"v=STSv1; id=20160831085700Z;"}}
+	fetches := 0
+	policy := testPolicy
+	now := time.Now()
+
+	c := &Cache{
+		Fetcher: FetcherFunc(func(ctx context.Context, domain string) (io.ReadCloser, error) {
+			if domain != "example.com" {
+				t.Errorf("FetchPolicy(%q) called, want example.com", domain)
+			}
+			fetches++
+			return ioutil.NopCloser(strings.NewReader(policy)), nil
+		}),
+		LookupTXT: dns.LookupTXT,
+		now:       func() time.Time { return now },
+	}
+
+	ctx := context.Background()
+	p, err := c.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if p.Mode != ModeEnforce || fetches != 1 {
+		t.Fatalf("Get() = %+v after %v fetches", p, fetches)
+	}
+
+	if _, err := c.Get(ctx, "EXAMPLE.com."); err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("cached policy was fetched again")
+	}
+
+	// A new policy ID invalidates the cache
+	dns["_mta-sts.example.com"] = []string{"v=STSv1; id=20160901000000Z;"}
+	policy = strings.Replace(testPolicy, "enforce", "testing", 1)
+	if p, err = c.Get(ctx, "example.com"); err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if p.Mode != ModeTesting || fetches != 2 {
+		t.Errorf("Get() = %+v after %v fetches, want a refreshed policy", p, fetches)
+	}
+
+	// A cached policy is used if DNS fails
+	delete(dns, "_mta-sts.example.com")
+	if p, err = c.Get(ctx, "example.com"); err != nil || p.Mode != ModeTesting {
+		t.Errorf("Get() = %+v, %v, want the cached policy", p, err)
+	}
+
+	// Until it expires
+	now = now.Add(8 * 24 * time.Hour)
+	if _, err = c.Get(ctx, "example.com"); err != ErrNoPolicy {
+		t.Errorf("Get() = %v, want %v", err, ErrNoPolicy)
+	}
+}
+
+func TestCache_fetchError(t *testing.T) {
+	dns := testDNS{"_mta-sts.example.com": {"v=STSv1; id=1"}}
+	fetchErr := errors.New("connection refused")
+	c := &Cache{
+		Fetcher: FetcherFunc(func(ctx context.Context, domain string) (io.ReadCloser, error) {
+			return nil, fetchErr
+		}),
+		LookupTXT: dns.LookupTXT,
+	}
+	if _, err := c.Get(context.Background(), "example.com"); err != fetchErr {
+		t.Errorf("Get() = %v, want %v", err, fetchErr)
+	}
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, testPolicy)
+	}))
+	defer ts.Close()
+
+	client := ts.Client()
+	tsURL, _ := url.Parse(ts.URL)
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, tsURL.Host)
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+
+	f := &HTTPFetcher{Client: client}
+	rc, err := f.FetchPolicy(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("FetchPolicy() = %v", err)
+	}
+	defer rc.Close()
+
+	p, err := ParsePolicy(rc)
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+	if !p.Match("mail.example.com") {
+		t.Errorf("fetched policy doesn't match mail.example.com")
+	}
+}
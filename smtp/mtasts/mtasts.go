@@ -0,0 +1,174 @@
+// Package mtasts implements SMTP MTA Strict Transport Security (MTA-STS), as
+// defined in RFC 8461.
+//
+// A Policy can be used as a smtp.TLSPolicy to refuse delivery over
+// connections which don't satisfy the recipient domain's policy.
+package mtasts
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Mode is the policy mode.
+type Mode string
+
+const (
+	ModeEnforce Mode = "enforce"
+	ModeTesting Mode = "testing"
+	ModeNone    Mode = "none"
+)
+
+// Maximum max_age value allowed by RFC 8461 section 3.2.
+const maxMaxAge = 31557600 * time.Second
+
+// Maximum policy size. RFC 8461 section 3.3 recommends limiting the policy
+// body to 64 KiB.
+const maxPolicySize = 64 * 1024
+
+// Policy is a MTA-STS policy.
+type Policy struct {
+	Mode   Mode
+	MX     []string
+	MaxAge time.Duration
+}
+
+var _ smtp.TLSPolicy = (*Policy)(nil)
+
+// ParsePolicy parses a policy body, as served by policy hosts at
+// https://mta-sts.<domain>/.well-known/mta-sts.txt.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	hasVersion, hasMaxAge := false, false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxPolicySize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("mtasts: malformed policy line: %q", line)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "version":
+			if value != "STSv1" {
+				return nil, fmt.Errorf("mtasts: unsupported policy version: %q", value)
+			}
+			hasVersion = true
+		case "mode":
+			switch Mode(value) {
+			case ModeEnforce, ModeTesting, ModeNone:
+				p.Mode = Mode(value)
+			default:
+				return nil, fmt.Errorf("mtasts: unknown policy mode: %q", value)
+			}
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mtasts: malformed max_age: %v", err)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+			if p.MaxAge > maxMaxAge {
+				p.MaxAge = maxMaxAge
+			}
+			hasMaxAge = true
+		default:
+			// Unknown fields must be ignored
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !hasVersion {
+		return nil, errors.New("mtasts: missing policy version")
+	}
+	if p.Mode == "" {
+		return nil, errors.New("mtasts: missing policy mode")
+	}
+	if !hasMaxAge {
+		return nil, errors.New("mtasts: missing policy max_age")
+	}
+	if len(p.MX) == 0 && p.Mode != ModeNone {
+		return nil, errors.New("mtasts: missing policy mx")
+	}
+	return p, nil
+}
+
+// Match checks whether a MX host name is allowed by the policy.
+//
+// A pattern starting with "*." matches exactly one leftmost label, as defined
+// in RFC 8461 section 4.1.
+func (p *Policy) Match(mx string) bool {
+	mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.IndexByte(mx, '.')
+			if i > 0 && mx[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if mx == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyError is returned when a connection doesn't satisfy a policy.
+type PolicyError struct {
+	MX     string
+	Reason string
+}
+
+func (err *PolicyError) Error() string {
+	return fmt.Sprintf("mtasts: MX %q violates policy: %v", err.MX, err.Reason)
+}
+
+// Check checks a connection to the MX host mx against the policy, as
+// described in RFC 8461 section 4. state is nil if the connection doesn't
+// use TLS.
+//
+// Violations are reported for all policy modes, use CheckTLS to only
+// enforce policies in enforce mode.
+func (p *Policy) Check(state *tls.ConnectionState, mx string) error {
+	if p.Mode == ModeNone {
+		return nil
+	}
+	if !p.Match(mx) {
+		return &PolicyError{MX: mx, Reason: "MX not listed in policy"}
+	}
+	if state == nil {
+		return &PolicyError{MX: mx, Reason: "TLS not used"}
+	}
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return &PolicyError{MX: mx, Reason: "certificate not verified"}
+	}
+	if err := state.PeerCertificates[0].VerifyHostname(strings.TrimSuffix(mx, ".")); err != nil {
+		return &PolicyError{MX: mx, Reason: err.Error()}
+	}
+	return nil
+}
+
+// CheckTLS implements smtp.TLSPolicy. Policy violations are only reported if
+// the policy is in enforce mode.
+func (p *Policy) CheckTLS(state *tls.ConnectionState, serverName string) error {
+	if p.Mode != ModeEnforce {
+		return nil
+	}
+	return p.Check(state, serverName)
+}
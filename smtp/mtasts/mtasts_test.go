@@ -0,0 +1,137 @@
+package mtasts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `version: STSv1
+mode: enforce
+mx: mail.example.com
+mx: *.example.net
+mx: backupmx.example.com
+max_age: 604800
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(strings.ReplaceAll(testPolicy, "\n", "\r\n")))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+	if p.Mode != ModeEnforce {
+		t.Errorf("Mode = %q, want %q", p.Mode, ModeEnforce)
+	}
+	if len(p.MX) != 3 {
+		t.Errorf("MX = %v, want 3 entries", p.MX)
+	}
+	if p.MaxAge != 7*24*time.Hour {
+		t.Errorf("MaxAge = %v, want %v", p.MaxAge, 7*24*time.Hour)
+	}
+}
+
+func TestParsePolicy_invalid(t *testing.T) {
+	for _, s := range []string{
+		"mode: enforce\nmx: a.example.com\nmax_age: 1\n",
+		"version: STSv2\nmode: enforce\nmx: a.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: strict\nmx: a.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmx: a.example.com\n",
+		"version: STSv1\nmode: enforce\nmx: a.example.com\nmax_age: forever\n",
+	} {
+		if _, err := ParsePolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("ParsePolicy(%q) = nil, want an error", s)
+		}
+	}
+}
+
+func TestPolicy_Match(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+
+	for mx, want := range map[string]bool{
+		"mail.example.com":     true,
+		"MAIL.example.com.":    true,
+		"mx1.example.net":      true,
+		"example.net":          false,
+		"a.mx1.example.net":    false,
+		"mail.example.org":     false,
+		"backupmx.example.com": true,
+	} {
+		if got := p.Match(mx); got != want {
+			t.Errorf("Match(%q) = %v, want %v", mx, got, want)
+		}
+	}
+}
+
+func testCertificate(t *testing.T, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Acme Co"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPolicy_CheckTLS(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+
+	cert := testCertificate(t, "mail.example.com")
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	unverified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	if err := p.CheckTLS(verified, "mail.example.com"); err != nil {
+		t.Errorf("CheckTLS(verified) = %v", err)
+	}
+	if err := p.CheckTLS(unverified, "mail.example.com"); err == nil {
+		t.Errorf("CheckTLS(unverified) = nil, want an error")
+	}
+	if err := p.CheckTLS(nil, "mail.example.com"); err == nil {
+		t.Errorf("CheckTLS(plaintext) = nil, want an error")
+	}
+	if err := p.CheckTLS(verified, "backupmx.example.com"); err == nil {
+		t.Errorf("CheckTLS(hostname mismatch) = nil, want an error")
+	}
+	if err := p.CheckTLS(verified, "mail.example.org"); err == nil {
+		t.Errorf("CheckTLS(unlisted MX) = nil, want an error")
+	}
+
+	p.Mode = ModeTesting
+	if err := p.CheckTLS(nil, "mail.example.com"); err != nil {
+		t.Errorf("CheckTLS(plaintext) in testing mode = %v", err)
+	}
+	if err := p.Check(nil, "mail.example.com"); err == nil {
+		t.Errorf("Check(plaintext) in testing mode = nil, want an error")
+	}
+}
@@ -0,0 +1,277 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// ErrPoolClosed is returned by Pool.Get when the pool has been closed.
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// Default maximum number of idle connections per key.
+const defaultPoolMaxIdle = 2
+
+// PoolKey identifies a destination and the credentials used to authenticate
+// with it. Connections are only shared between users of the same key.
+type PoolKey struct {
+	// Address of the server, as passed to Dial.
+	Addr string
+
+	// Credentials used to authenticate with SASL PLAIN. If Username is empty,
+	// connections are not authenticated.
+	Username string
+	Password string
+}
+
+type poolConn struct {
+	key       PoolKey
+	created   time.Time
+	idleSince time.Time
+}
+
+// Pool is a pool of reusable client connections. Idle connections are
+// health-checked with NOOP before being handed out, and reset with RSET
+// before being put back into the pool.
+//
+// A Pool is safe for concurrent use by multiple goroutines.
+type Pool struct {
+	// Dial opens a new connection for key. The connection must be ready to
+	// start a mail transaction, i.e. greeted and authenticated if necessary.
+	//
+	// If nil, the connection is opened with Dial, STARTTLS is started if the
+	// server supports it and the client authenticates with SASL PLAIN if the
+	// key contains a username. Credentials are only sent over TLS.
+	Dial func(key PoolKey) (*Client, error)
+
+	// TLS configuration used for STARTTLS by the default Dial function.
+	TLSConfig *tls.Config
+
+	// Maximum number of idle connections kept per key. If zero, 2 is used.
+	// If negative, no idle connections are kept.
+	MaxIdle int
+	// Maximum amount of time a connection may be reused. If zero,
+	// connections are reused forever.
+	MaxLifetime time.Duration
+	// Maximum amount of time a connection may remain idle before being
+	// closed. If zero, idle connections are not closed.
+	IdleTimeout time.Duration
+
+	mutex  sync.Mutex
+	idle   map[PoolKey][]*Client
+	conns  map[*Client]*poolConn
+	closed bool
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle == 0 {
+		return defaultPoolMaxIdle
+	}
+	return p.MaxIdle
+}
+
+func (p *Pool) expired(pc *poolConn, now time.Time) bool {
+	if p.MaxLifetime > 0 && now.Sub(pc.created) > p.MaxLifetime {
+		return true
+	}
+	if p.IdleTimeout > 0 && !pc.idleSince.IsZero() && now.Sub(pc.idleSince) > p.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+func (p *Pool) dial(key PoolKey) (*Client, error) {
+	if p.Dial != nil {
+		return p.Dial(key)
+	}
+
+	c, err := Dial(key.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(p.TLSConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if key.Username != "" {
+		// Don't send credentials in cleartext, e.g. if STARTTLS has been
+		// stripped from the server's capabilities
+		if _, isTLS := c.TLSConnectionState(); !isTLS {
+			c.Close()
+			return nil, errors.New("smtp: refusing to authenticate without TLS")
+		}
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(sasl.NewPlainClient("", key.Username, key.Password)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// discard removes a connection from the pool and closes it.
+func (p *Pool) discard(c *Client) {
+	p.mutex.Lock()
+	delete(p.conns, c)
+	p.mutex.Unlock()
+
+	if err := c.Quit(); err != nil {
+		c.Close()
+	}
+}
+
+// Get returns a connection for key, either an idle one or a new one. The
+// connection must be returned to the pool with Put once the mail transaction
+// is complete, or with Discard if it is no longer usable. It must not be
+// closed directly, otherwise the pool keeps track of it forever.
+func (p *Pool) Get(key PoolKey) (*Client, error) {
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return nil, ErrPoolClosed
+		}
+		l := p.idle[key]
+		if len(l) == 0 {
+			p.mutex.Unlock()
+			break
+		}
+		c := l[len(l)-1]
+		p.idle[key] = l[:len(l)-1]
+		pc := p.conns[c]
+		p.mutex.Unlock()
+
+		if p.expired(pc, time.Now()) {
+			p.discard(c)
+			continue
+		}
+		if err := c.Noop(); err != nil {
+			p.Discard(c)
+			continue
+		}
+
+		p.mutex.Lock()
+		pc.idleSince = time.Time{}
+		p.mutex.Unlock()
+		return c, nil
+	}
+
+	c, err := p.dial(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		c.Close()
+		return nil, ErrPoolClosed
+	}
+	if p.conns == nil {
+		p.conns = make(map[*Client]*poolConn)
+	}
+	p.conns[c] = &poolConn{key: key, created: time.Now()}
+	return c, nil
+}
+
+// Put returns a connection obtained with Get to the pool. The current mail
+// transaction, if any, is aborted with RSET.
+//
+// If the connection can't be reset, or if the pool already has enough idle
+// connections, the connection is closed.
+func (p *Pool) Put(c *Client) error {
+	p.mutex.Lock()
+	pc, ok := p.conns[c]
+	p.mutex.Unlock()
+	if !ok {
+		return errors.New("smtp: connection doesn't belong to pool")
+	}
+
+	if err := c.Reset(); err != nil {
+		p.Discard(c)
+		return err
+	}
+
+	now := time.Now()
+
+	p.mutex.Lock()
+	if p.closed || len(p.idle[pc.key]) >= p.maxIdle() || p.expired(pc, now) {
+		p.mutex.Unlock()
+		p.discard(c)
+		return nil
+	}
+	if p.idle == nil {
+		p.idle = make(map[PoolKey][]*Client)
+	}
+	pc.idleSince = now
+	p.idle[pc.key] = append(p.idle[pc.key], c)
+	p.mutex.Unlock()
+	return nil
+}
+
+// Discard closes a connection obtained with Get which is no longer usable,
+// e.g. after an I/O error, and forgets about it.
+func (p *Pool) Discard(c *Client) error {
+	p.mutex.Lock()
+	delete(p.conns, c)
+	p.mutex.Unlock()
+
+	return c.Close()
+}
+
+// SendMail sends an email with a pooled connection for key. See
+// Client.SendMail.
+//
+// The connection is returned to the pool, unless an I/O error occurred.
+func (p *Pool) SendMail(key PoolKey, from string, to []string, r io.Reader) error {
+	c, err := p.Get(key)
+	if err != nil {
+		return err
+	}
+
+	err = c.SendMail(from, to, r)
+	if err != nil {
+		if _, ok := err.(*SMTPError); !ok {
+			// The state of the connection is unknown, don't reuse it
+			p.Discard(c)
+			return err
+		}
+	}
+
+	p.Put(c)
+	return err
+}
+
+// Close closes all idle connections. Connections currently in use are closed
+// when they are returned to the pool.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	for _, l := range idle {
+		for _, c := range l {
+			p.discard(c)
+		}
+	}
+	return nil
+}
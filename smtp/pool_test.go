@@ -0,0 +1,239 @@
+package smtp_test
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func testPoolServer(t *testing.T) (be *backend, s *smtp.Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = new(backend)
+	s = smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+
+	go s.Serve(l)
+
+	return be, s, l.Addr().String()
+}
+
+// testPoolServerTLS starts a server supporting STARTTLS, and returns a pool
+// for it. Clients trust the server's certificate in tests.
+func testPoolServerTLS(t *testing.T) (be *backend, s *smtp.Server, addr string, p *smtp.Pool) {
+	cert, err := tls.X509KeyPair(smtp.LocalhostCert, smtp.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be, s, addr = testPoolServer(t)
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return be, s, addr, &smtp.Pool{}
+}
+
+func TestPool(t *testing.T) {
+	be, s, addr, p := testPoolServerTLS(t)
+	defer s.Close()
+	defer p.Close()
+
+	key := smtp.PoolKey{Addr: addr, Username: "username", Password: "password"}
+
+	c1, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if err := c1.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if err := p.Put(c1); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+
+	c2, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c2 != c1 {
+		t.Errorf("Get() returned a new connection, want the idle one")
+	}
+	p.Put(c2)
+
+	// A different key must not share connections
+	c3, err := p.Get(smtp.PoolKey{Addr: addr})
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c3 == c1 {
+		t.Errorf("Get() returned a connection of another key")
+	}
+	p.Put(c3)
+
+	if err := p.SendMail(key, "root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey again\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	if len(be.messages) != 2 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestPool_insecureAuth(t *testing.T) {
+	_, s, addr := testPoolServer(t)
+	defer s.Close()
+
+	p := &smtp.Pool{}
+	defer p.Close()
+
+	// The server doesn't support STARTTLS
+	key := smtp.PoolKey{Addr: addr, Username: "username", Password: "password"}
+	if c, err := p.Get(key); err == nil {
+		p.Put(c)
+		t.Fatal("Get() succeeded, want credentials to be refused without TLS")
+	}
+}
+
+func TestPool_brokenConnection(t *testing.T) {
+	_, s, addr := testPoolServer(t)
+	defer s.Close()
+
+	p := &smtp.Pool{}
+	defer p.Close()
+
+	key := smtp.PoolKey{Addr: addr}
+	c1, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	p.Put(c1)
+
+	// Break the idle connection, the health check must detect it
+	c1.Close()
+
+	c2, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c2 == c1 {
+		t.Errorf("Get() returned a broken connection")
+	}
+	if err := c2.Noop(); err != nil {
+		t.Errorf("Noop() = %v", err)
+	}
+	p.Put(c2)
+}
+
+func TestPool_discard(t *testing.T) {
+	_, s, addr := testPoolServer(t)
+	defer s.Close()
+
+	p := &smtp.Pool{}
+	defer p.Close()
+
+	key := smtp.PoolKey{Addr: addr}
+	c1, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if err := p.Discard(c1); err != nil {
+		t.Fatalf("Discard() = %v", err)
+	}
+	if err := p.Put(c1); err == nil {
+		t.Errorf("Put() succeeded, want the discarded connection to be forgotten")
+	}
+
+	c2, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c2 == c1 {
+		t.Errorf("Get() returned a discarded connection")
+	}
+	p.Put(c2)
+}
+
+func TestPool_maxLifetime(t *testing.T) {
+	_, s, addr := testPoolServer(t)
+	defer s.Close()
+
+	p := &smtp.Pool{MaxLifetime: time.Nanosecond}
+	defer p.Close()
+
+	key := smtp.PoolKey{Addr: addr}
+	c1, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	p.Put(c1)
+
+	c2, err := p.Get(key)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if c2 == c1 {
+		t.Errorf("Get() returned an expired connection")
+	}
+	p.Put(c2)
+}
+
+func TestPool_concurrent(t *testing.T) {
+	be, s, addr, p := testPoolServerTLS(t)
+	defer s.Close()
+
+	// The test backend isn't safe for concurrent use
+	var mutex sync.Mutex
+	p.MaxIdle = 4
+	defer p.Close()
+
+	key := smtp.PoolKey{Addr: addr, Username: "username", Password: "password"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.Get(key)
+			if err != nil {
+				errs <- err
+				return
+			}
+			mutex.Lock()
+			err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+			mutex.Unlock()
+			if err != nil {
+				errs <- err
+				p.Discard(c)
+				return
+			}
+			errs <- p.Put(c)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(be.messages) != 16 {
+		t.Fatal("Invalid number of sent messages:", len(be.messages))
+	}
+}
+
+func TestPool_closed(t *testing.T) {
+	p := &smtp.Pool{}
+	p.Close()
+	if _, err := p.Get(smtp.PoolKey{Addr: "127.0.0.1:0"}); err != smtp.ErrPoolClosed {
+		t.Errorf("Get() = %v, want %v", err, smtp.ErrPoolClosed)
+	}
+}
@@ -0,0 +1,575 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum length of a command line, including CRLF. RFC 2449 limits commands
+// to 255 octets, but SASL responses may be longer.
+const maxLineLength = 4096
+
+var errTooLongLine = errors.New("pop3: too long line")
+
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	text   *textproto.Writer
+	server *Server
+
+	// Name given with USER, waiting for PASS
+	username string
+
+	locker   sync.Mutex
+	mailbox  Mailbox
+	messages []MessageInfo
+	deleted  []bool
+}
+
+func newConn(c net.Conn, s *Server) *Conn {
+	sc := &Conn{
+		server: s,
+		conn:   c,
+	}
+
+	sc.init()
+	return sc
+}
+
+func (c *Conn) init() {
+	var r io.Reader = c.conn
+	var w io.Writer = c.conn
+	if c.server.Debug != nil {
+		r = io.TeeReader(r, c.server.Debug)
+		w = io.MultiWriter(w, c.server.Debug)
+	}
+
+	c.r = bufio.NewReaderSize(r, maxLineLength)
+	c.text = textproto.NewWriter(bufio.NewWriter(w))
+}
+
+// Close closes the connection. The mailbox is released, messages marked as
+// deleted are kept.
+func (c *Conn) Close() error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.mailbox != nil {
+		c.mailbox.Close()
+		c.mailbox = nil
+	}
+
+	return c.conn.Close()
+}
+
+// TLSConnectionState returns the connection's TLS connection state.
+// Zero values are returned if the connection doesn't use TLS.
+func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tc.ConnectionState(), true
+}
+
+func (c *Conn) Conn() net.Conn {
+	return c.conn
+}
+
+// SetMailbox opens the mailbox of an authenticated client and enters the
+// TRANSACTION state. If listing the messages fails, the mailbox is closed.
+func (c *Conn) SetMailbox(mbox Mailbox) error {
+	msgs, err := mbox.List()
+	if err != nil {
+		mbox.Close()
+		return err
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.mailbox = mbox
+	c.messages = msgs
+	c.deleted = make([]bool, len(msgs))
+	return nil
+}
+
+func (c *Conn) login(username, password string) error {
+	mbox, err := c.server.Backend.Login(c, username, password)
+	if err != nil {
+		return err
+	}
+	return c.SetMailbox(mbox)
+}
+
+func (c *Conn) authAllowed() bool {
+	_, isTLS := c.TLSConnectionState()
+	return isTLS || c.server.AllowInsecureAuth
+}
+
+// handle dispatches a command line to the appropriate handler function. It
+// returns true if the connection must be closed.
+func (c *Conn) handle(line string) (quit bool) {
+	// If panic happens during command handling - send an error response
+	// and close connection.
+	defer func() {
+		if err := recover(); err != nil {
+			c.writeErr("", "Internal server error")
+			quit = true
+
+			stack := debug.Stack()
+			c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
+		}
+	}()
+
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], line[i+1:]
+	}
+	cmd = strings.ToUpper(cmd)
+
+	if cmd == "CAPA" {
+		c.handleCapa()
+		return false
+	}
+
+	if c.mailbox == nil {
+		// AUTHORIZATION state
+		switch cmd {
+		case "USER":
+			c.handleUser(arg)
+		case "PASS":
+			c.handlePass(arg)
+		case "AUTH":
+			c.handleAuth(arg)
+		case "STLS":
+			return c.handleStartTLS()
+		case "QUIT":
+			c.writeOK("Bye")
+			return true
+		case "STAT", "LIST", "RETR", "DELE", "NOOP", "RSET", "TOP", "UIDL":
+			c.writeErr("", "Please authenticate first")
+		default:
+			c.writeErr("", fmt.Sprintf("Unknown command %v", cmd))
+		}
+		return false
+	}
+
+	// TRANSACTION state
+	switch cmd {
+	case "STAT":
+		c.handleStat()
+	case "LIST":
+		c.handleList(arg)
+	case "UIDL":
+		c.handleUidl(arg)
+	case "RETR":
+		c.handleRetr(arg)
+	case "TOP":
+		c.handleTop(arg)
+	case "DELE":
+		c.handleDele(arg)
+	case "NOOP":
+		c.writeOK("")
+	case "RSET":
+		for i := range c.deleted {
+			c.deleted[i] = false
+		}
+		c.writeOK(fmt.Sprintf("Maildrop has %v messages", len(c.messages)))
+	case "QUIT":
+		c.handleQuit()
+		return true
+	case "USER", "PASS", "AUTH", "STLS":
+		c.writeErr("", "Already authenticated")
+	default:
+		c.writeErr("", fmt.Sprintf("Unknown command %v", cmd))
+	}
+	return false
+}
+
+func (c *Conn) handleCapa() {
+	caps := []string{"TOP", "UIDL", "PIPELINING", "RESP-CODES", "AUTH-RESP-CODE"}
+	if c.mailbox == nil {
+		if _, isTLS := c.TLSConnectionState(); !isTLS && c.server.TLSConfig != nil {
+			caps = append(caps, "STLS")
+		}
+		if c.authAllowed() {
+			caps = append(caps, "USER")
+			if mechs := c.server.authMechanisms(); len(mechs) > 0 {
+				caps = append(caps, "SASL "+strings.Join(mechs, " "))
+			}
+		}
+	}
+
+	c.writeOK("Capability list follows")
+	c.writeLines(caps)
+}
+
+func (c *Conn) handleUser(arg string) {
+	if !c.authAllowed() {
+		c.writeErr("", "TLS is required")
+		return
+	}
+	if arg == "" {
+		c.writeErr("", "Missing user name")
+		return
+	}
+
+	c.username = arg
+	c.writeOK("Send password")
+}
+
+func (c *Conn) handlePass(arg string) {
+	username := c.username
+	c.username = ""
+	if username == "" {
+		c.writeErr("", "Please send USER first")
+		return
+	}
+
+	if err := c.login(username, arg); err != nil {
+		c.writeAuthError(err)
+		return
+	}
+	c.writeOK("Logged in")
+}
+
+// AUTH, as defined in RFC 5034.
+func (c *Conn) handleAuth(arg string) {
+	parts := strings.Fields(arg)
+	if len(parts) == 0 {
+		c.writeErr("", "Missing parameter")
+		return
+	}
+
+	if !c.authAllowed() {
+		c.writeErr("", "TLS is required")
+		return
+	}
+
+	mechanism := strings.ToUpper(parts[0])
+
+	// Parse client initial response if there is one
+	var ir []byte
+	if len(parts) > 1 && parts[1] != "=" {
+		var err error
+		ir, err = base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			c.writeErr("", "Invalid base64 data")
+			return
+		}
+	}
+
+	newSasl, ok := c.server.auths[mechanism]
+	if !ok {
+		c.writeErr("", "Unsupported authentication mechanism")
+		return
+	}
+
+	sasl := newSasl(c)
+
+	response := ir
+	for {
+		challenge, done, err := sasl.Next(response)
+		if err != nil {
+			c.writeAuthError(err)
+			return
+		}
+
+		if done {
+			break
+		}
+
+		c.text.PrintfLine("+ %v", base64.StdEncoding.EncodeToString(challenge))
+
+		encoded, err := c.readLine()
+		if err != nil {
+			return // the error is reported by the next read
+		}
+
+		if encoded == "*" {
+			c.writeErr("", "Negotiation cancelled")
+			return
+		}
+
+		response, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			c.writeErr("", "Invalid base64 data")
+			return
+		}
+	}
+
+	if c.mailbox == nil {
+		c.writeErr("SYS/PERM", "Authentication mechanism didn't open a mailbox")
+		return
+	}
+	c.writeOK("Logged in")
+}
+
+// STLS, as defined in RFC 2595 section 4.
+func (c *Conn) handleStartTLS() (quit bool) {
+	if _, isTLS := c.TLSConnectionState(); isTLS {
+		c.writeErr("", "Already running in TLS")
+		return false
+	}
+	if c.server.TLSConfig == nil {
+		c.writeErr("", "TLS not supported")
+		return false
+	}
+
+	c.writeOK("Begin TLS negotiation")
+
+	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.server.ErrorLog.Printf("TLS handshake error for %v: %v", c.conn.RemoteAddr(), err)
+		return true
+	}
+
+	// Data buffered before the handshake is discarded
+	c.conn = tlsConn
+	c.init()
+	c.username = ""
+	return false
+}
+
+// message parses a message number and returns its index. It writes an error
+// response and returns false if there is no such message.
+func (c *Conn) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		c.writeErr("", "Invalid message number")
+		return 0, false
+	}
+	if n < 1 || n > len(c.messages) || c.deleted[n-1] {
+		c.writeErr("", "No such message")
+		return 0, false
+	}
+	return n - 1, true
+}
+
+func (c *Conn) handleStat() {
+	var count int
+	var size int64
+	for i, msg := range c.messages {
+		if !c.deleted[i] {
+			count++
+			size += msg.Size
+		}
+	}
+	c.writeOK(fmt.Sprintf("%v %v", count, size))
+}
+
+func (c *Conn) handleList(arg string) {
+	if arg != "" {
+		if i, ok := c.message(arg); ok {
+			c.writeOK(fmt.Sprintf("%v %v", i+1, c.messages[i].Size))
+		}
+		return
+	}
+
+	var lines []string
+	for i, msg := range c.messages {
+		if !c.deleted[i] {
+			lines = append(lines, fmt.Sprintf("%v %v", i+1, msg.Size))
+		}
+	}
+	c.writeOK(fmt.Sprintf("%v messages", len(lines)))
+	c.writeLines(lines)
+}
+
+func (c *Conn) handleUidl(arg string) {
+	if arg != "" {
+		if i, ok := c.message(arg); ok {
+			c.writeOK(fmt.Sprintf("%v %v", i+1, c.messages[i].UID))
+		}
+		return
+	}
+
+	var lines []string
+	for i, msg := range c.messages {
+		if !c.deleted[i] {
+			lines = append(lines, fmt.Sprintf("%v %v", i+1, msg.UID))
+		}
+	}
+	c.writeOK("Unique-ID listing follows")
+	c.writeLines(lines)
+}
+
+func (c *Conn) handleRetr(arg string) {
+	i, ok := c.message(arg)
+	if !ok {
+		return
+	}
+
+	rc, err := c.mailbox.Open(c.messages[i].UID)
+	if err != nil {
+		c.writeErr("SYS/TEMP", "Failed to open message")
+		c.server.ErrorLog.Printf("pop3: failed to open message %v: %v", c.messages[i].UID, err)
+		return
+	}
+	defer rc.Close()
+
+	c.writeOK(fmt.Sprintf("%v octets", c.messages[i].Size))
+	c.setWriteDeadline()
+	w := c.text.DotWriter()
+	if _, err := io.Copy(w, rc); err != nil {
+		c.server.ErrorLog.Printf("pop3: failed to read message %v: %v", c.messages[i].UID, err)
+	}
+	w.Close()
+}
+
+func (c *Conn) handleTop(arg string) {
+	args := strings.Fields(arg)
+	if len(args) != 2 {
+		c.writeErr("", "Usage: TOP <message> <lines>")
+		return
+	}
+	i, ok := c.message(args[0])
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		c.writeErr("", "Invalid number of lines")
+		return
+	}
+
+	rc, err := c.mailbox.Open(c.messages[i].UID)
+	if err != nil {
+		c.writeErr("SYS/TEMP", "Failed to open message")
+		c.server.ErrorLog.Printf("pop3: failed to open message %v: %v", c.messages[i].UID, err)
+		return
+	}
+	defer rc.Close()
+
+	c.writeOK("Top of message follows")
+	c.setWriteDeadline()
+	w := c.text.DotWriter()
+	defer w.Close()
+
+	br := bufio.NewReader(rc)
+	inHeader := true
+	for inHeader || n > 0 {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			w.Write(line)
+			if inHeader {
+				inHeader = strings.TrimRight(string(line), "\r\n") != ""
+			} else {
+				n--
+			}
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			c.server.ErrorLog.Printf("pop3: failed to read message %v: %v", c.messages[i].UID, err)
+			return
+		}
+	}
+}
+
+func (c *Conn) handleDele(arg string) {
+	i, ok := c.message(arg)
+	if !ok {
+		return
+	}
+	c.deleted[i] = true
+	c.writeOK(fmt.Sprintf("Message %v deleted", i+1))
+}
+
+// QUIT in the TRANSACTION state enters the UPDATE state: messages marked as
+// deleted are removed.
+func (c *Conn) handleQuit() {
+	var uids []string
+	for i, msg := range c.messages {
+		if c.deleted[i] {
+			uids = append(uids, msg.UID)
+		}
+	}
+
+	if len(uids) > 0 {
+		if err := c.mailbox.Delete(uids); err != nil {
+			c.writeErr("SYS/TEMP", "Some deleted messages not removed")
+			c.server.ErrorLog.Printf("pop3: failed to delete messages: %v", err)
+			return
+		}
+	}
+
+	// Release the mailbox before replying, so that the client can open it
+	// again right away
+	c.locker.Lock()
+	c.mailbox.Close()
+	c.mailbox = nil
+	c.locker.Unlock()
+
+	c.writeOK("Bye")
+}
+
+func (c *Conn) writeAuthError(err error) {
+	if popErr, ok := err.(*Error); ok {
+		c.writeErr(popErr.Code, popErr.Message)
+		return
+	}
+	c.writeErr(ErrAuthFailed.Code, "Authentication failed")
+}
+
+func (c *Conn) setWriteDeadline() {
+	if c.server.WriteTimeout != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+}
+
+func (c *Conn) writeOK(text string) {
+	c.setWriteDeadline()
+	if text == "" {
+		c.text.PrintfLine("+OK")
+	} else {
+		c.text.PrintfLine("+OK %v", text)
+	}
+}
+
+// writeErr writes a negative response, with an optional extended response
+// code.
+func (c *Conn) writeErr(code, text string) {
+	c.setWriteDeadline()
+	if code != "" {
+		text = "[" + code + "] " + text
+	}
+	c.text.PrintfLine("-ERR %v", text)
+}
+
+// writeLines writes the body of a multi-line response.
+func (c *Conn) writeLines(lines []string) {
+	w := c.text.DotWriter()
+	for _, l := range lines {
+		io.WriteString(w, l+"\r\n")
+	}
+	w.Close()
+}
+
+func (c *Conn) readLine() (string, error) {
+	if c.server.ReadTimeout != 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout)); err != nil {
+			return "", err
+		}
+	}
+
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errTooLongLine
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
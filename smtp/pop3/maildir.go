@@ -0,0 +1,169 @@
+package pop3
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp/maildir"
+)
+
+// MaildirBackend serves the Maildirs written by maildir.Backend: each user
+// has a Maildir in Root, named after their lower-case address. Only the inbox
+// is served.
+//
+// A mailbox can only be opened by one session at a time, other sessions
+// are refused with an IN-USE response code.
+type MaildirBackend struct {
+	Root string
+	// Called to authenticate users. If nil, all logins fail.
+	Authenticate func(username, password string) error
+
+	mutex  sync.Mutex
+	locked map[string]bool
+}
+
+// Dir returns the Maildir of a user.
+func (be *MaildirBackend) Dir(username string) (maildir.Dir, error) {
+	username = strings.ToLower(username)
+	if username == "" || strings.HasPrefix(username, ".") || strings.ContainsAny(username, "/\\\x00") {
+		return "", ErrAuthFailed
+	}
+	d := filepath.Join(be.Root, username)
+	if fi, err := os.Stat(d); err != nil || !fi.IsDir() {
+		return "", ErrAuthFailed
+	}
+	return maildir.Dir(d), nil
+}
+
+// Login implements Backend.
+func (be *MaildirBackend) Login(conn *Conn, username, password string) (Mailbox, error) {
+	if be.Authenticate == nil {
+		return nil, ErrAuthFailed
+	}
+	if err := be.Authenticate(username, password); err != nil {
+		return nil, err
+	}
+	d, err := be.Dir(username)
+	if err != nil {
+		return nil, err
+	}
+
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	if be.locked[string(d)] {
+		return nil, ErrInUse
+	}
+	if be.locked == nil {
+		be.locked = make(map[string]bool)
+	}
+	be.locked[string(d)] = true
+
+	return &maildirMailbox{be: be, dir: d}, nil
+}
+
+type maildirMailbox struct {
+	be    *MaildirBackend
+	dir   maildir.Dir
+	paths map[string]string // UID -> file path
+}
+
+// maildirUID returns the UID of a message from its Maildir key. Keys which
+// can't be used as UIDs are hashed.
+func maildirUID(key string) string {
+	valid := len(key) > 0 && len(key) <= 70
+	for i := 0; i < len(key) && valid; i++ {
+		valid = key[i] >= 0x21 && key[i] <= 0x7E
+	}
+	if valid {
+		return key
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (mbox *maildirMailbox) List() ([]MessageInfo, error) {
+	type entry struct {
+		info MessageInfo
+		fi   os.FileInfo
+	}
+
+	var entries []entry
+	mbox.paths = make(map[string]string)
+	for _, sub := range []string{"new", "cur"} {
+		dir := filepath.Join(string(mbox.dir), sub)
+		fis, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			if !fi.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			key := name
+			if i := strings.IndexByte(key, ':'); i >= 0 {
+				key = key[:i]
+			}
+			uid := maildirUID(key)
+			if _, ok := mbox.paths[uid]; ok {
+				continue
+			}
+			mbox.paths[uid] = filepath.Join(dir, name)
+			entries = append(entries, entry{MessageInfo{UID: uid, Size: fi.Size()}, fi})
+		}
+	}
+
+	// Oldest messages first
+	sort.Slice(entries, func(i, j int) bool {
+		ti, tj := entries[i].fi.ModTime(), entries[j].fi.ModTime()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return entries[i].fi.Name() < entries[j].fi.Name()
+	})
+
+	msgs := make([]MessageInfo, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.info
+	}
+	return msgs, nil
+}
+
+func (mbox *maildirMailbox) Open(uid string) (io.ReadCloser, error) {
+	path, ok := mbox.paths[uid]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(path)
+}
+
+func (mbox *maildirMailbox) Delete(uids []string) error {
+	var err error
+	for _, uid := range uids {
+		path, ok := mbox.paths[uid]
+		if !ok {
+			continue
+		}
+		if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+		delete(mbox.paths, uid)
+	}
+	return err
+}
+
+func (mbox *maildirMailbox) Close() error {
+	mbox.be.mutex.Lock()
+	delete(mbox.be.locked, string(mbox.dir))
+	mbox.be.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,283 @@
+package pop3
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp/maildir"
+)
+
+const testMessage = "From: root@nsa.gov\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Line 1\r\n" +
+	".Line 2\r\n" +
+	"Line 3\r\n"
+
+func serve(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func testServer(t *testing.T) (s *Server, root, addr string, cleanup func()) {
+	root, err := ioutil.TempDir("", "go-smtp-pop3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := maildir.Dir(filepath.Join(root, "alice@example.org"))
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"Hello", "Again"} {
+		msg := strings.Replace(testMessage, "Hello", subject, 1)
+		if _, err := d.Deliver(strings.NewReader(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = NewServer(&MaildirBackend{
+		Root: root,
+		Authenticate: func(username, password string) error {
+			if strings.ToLower(username) != "alice@example.org" || password != "secret password" {
+				return errors.New("invalid credentials")
+			}
+			return nil
+		},
+	})
+	s.AllowInsecureAuth = true
+	addr = serve(t, s)
+	return s, root, addr, func() {
+		s.Close()
+		os.RemoveAll(root)
+	}
+}
+
+type testClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, text: textproto.NewConn(conn)}
+	c.expect("+OK")
+	return c
+}
+
+// cmd sends a command and returns the response line.
+func (c *testClient) cmd(line string) string {
+	c.t.Helper()
+	if err := c.text.PrintfLine("%v", line); err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := c.text.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+func (c *testClient) expect(prefix string) string {
+	c.t.Helper()
+	resp, err := c.text.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp, prefix) {
+		c.t.Fatalf("Invalid response: got %q, want prefix %q", resp, prefix)
+	}
+	return resp
+}
+
+// multiline sends a command and returns the body of the multi-line response.
+func (c *testClient) multiline(line string) string {
+	c.t.Helper()
+	if resp := c.cmd(line); !strings.HasPrefix(resp, "+OK") {
+		c.t.Fatalf("%v: invalid response: %q", line, resp)
+	}
+	b, err := ioutil.ReadAll(c.text.DotReader())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return string(b)
+}
+
+func (c *testClient) login() {
+	c.t.Helper()
+	if resp := c.cmd("USER alice@example.org"); !strings.HasPrefix(resp, "+OK") {
+		c.t.Fatalf("USER: invalid response: %q", resp)
+	}
+	if resp := c.cmd("PASS secret password"); !strings.HasPrefix(resp, "+OK") {
+		c.t.Fatalf("PASS: invalid response: %q", resp)
+	}
+}
+
+func TestServer_transaction(t *testing.T) {
+	_, root, addr, cleanup := testServer(t)
+	defer cleanup()
+
+	c := dial(t, addr)
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("STAT before login: got %q", resp)
+	}
+	c.cmd("USER alice@example.org")
+	if resp := c.cmd("PASS wrong"); resp != "-ERR [AUTH] Authentication failed" {
+		t.Errorf("PASS with invalid password: got %q", resp)
+	}
+	c.login()
+
+	size := len(testMessage)
+	if resp := c.cmd("STAT"); resp != "+OK 2 "+strconv.Itoa(2*size) {
+		t.Errorf("STAT: got %q", resp)
+	}
+
+	list := c.multiline("LIST")
+	if list != "1 "+strconv.Itoa(size)+"\n2 "+strconv.Itoa(size)+"\n" {
+		t.Errorf("LIST: got %q", list)
+	}
+
+	uidl := c.multiline("UIDL")
+	lines := strings.Split(strings.TrimSuffix(uidl, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "1 ") || !strings.HasPrefix(lines[1], "2 ") {
+		t.Fatalf("UIDL: got %q", uidl)
+	}
+	if resp := c.cmd("UIDL 2"); resp != "+OK "+lines[1] {
+		t.Errorf("UIDL 2: got %q, want %q", resp, "+OK "+lines[1])
+	}
+
+	// The DotReader removes the dot-stuffing and converts CRLF to LF
+	want := strings.Replace(testMessage, "\r\n", "\n", -1)
+	if msg := c.multiline("RETR 1"); msg != want {
+		t.Errorf("RETR 1: got %q, want %q", msg, want)
+	}
+	top := c.multiline("TOP 2 1")
+	if top != "From: root@nsa.gov\nSubject: Again\n\nLine 1\n" {
+		t.Errorf("TOP 2 1: got %q", top)
+	}
+	if resp := c.cmd("RETR 3"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("RETR 3: got %q", resp)
+	}
+
+	// Another session can't open the mailbox
+	c2 := dial(t, addr)
+	c2.cmd("USER alice@example.org")
+	if resp := c2.cmd("PASS secret password"); resp != "-ERR [IN-USE] Mailbox already locked" {
+		t.Errorf("PASS for a locked mailbox: got %q", resp)
+	}
+
+	if resp := c.cmd("DELE 1"); !strings.HasPrefix(resp, "+OK") {
+		t.Errorf("DELE 1: got %q", resp)
+	}
+	if resp := c.cmd("RETR 1"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("RETR of a deleted message: got %q", resp)
+	}
+	if resp := c.cmd("STAT"); resp != "+OK 1 "+strconv.Itoa(size) {
+		t.Errorf("STAT after DELE: got %q", resp)
+	}
+	if resp := c.cmd("QUIT"); !strings.HasPrefix(resp, "+OK") {
+		t.Errorf("QUIT: got %q", resp)
+	}
+
+	fis, err := ioutil.ReadDir(filepath.Join(root, "alice@example.org", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("Got %v messages after QUIT, want 1", len(fis))
+	}
+
+	// The mailbox has been released
+	c2.login()
+	if uidl2 := c2.multiline("UIDL"); uidl2 != "1"+strings.TrimPrefix(lines[1], "2")+"\n" {
+		t.Errorf("UIDL after QUIT: got %q", uidl2)
+	}
+	c2.cmd("DELE 1")
+	if resp := c2.cmd("RSET"); !strings.HasPrefix(resp, "+OK") {
+		t.Errorf("RSET: got %q", resp)
+	}
+	if resp := c2.cmd("STAT"); resp != "+OK 1 "+strconv.Itoa(size) {
+		t.Errorf("STAT after RSET: got %q", resp)
+	}
+	c2.cmd("QUIT")
+}
+
+func TestServer_auth(t *testing.T) {
+	s, _, addr, cleanup := testServer(t)
+	defer cleanup()
+
+	c := dial(t, addr)
+	capa := c.multiline("CAPA")
+	for _, want := range []string{"UIDL\n", "TOP\n", "USER\n", "SASL PLAIN\n", "RESP-CODES\n"} {
+		if !strings.Contains(capa, want) {
+			t.Errorf("CAPA doesn't advertise %q: %q", want, capa)
+		}
+	}
+	if strings.Contains(capa, "STLS") {
+		t.Errorf("CAPA advertises STLS without TLSConfig: %q", capa)
+	}
+
+	if resp := c.cmd("AUTH PLAIN"); resp != "+ " {
+		t.Fatalf("AUTH PLAIN: got %q", resp)
+	}
+	if resp := c.cmd("*"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("Cancelled AUTH: got %q", resp)
+	}
+
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00alice@example.org\x00wrong"))
+	if resp := c.cmd("AUTH PLAIN " + ir); resp != "-ERR [AUTH] Authentication failed" {
+		t.Errorf("AUTH PLAIN with invalid password: got %q", resp)
+	}
+
+	if resp := c.cmd("AUTH PLAIN"); resp != "+ " {
+		t.Fatalf("AUTH PLAIN: got %q", resp)
+	}
+	ir = base64.StdEncoding.EncodeToString([]byte("\x00alice@example.org\x00secret password"))
+	if resp := c.cmd(ir); !strings.HasPrefix(resp, "+OK") {
+		t.Fatalf("AUTH PLAIN: got %q", resp)
+	}
+	if resp := c.cmd("STAT"); !strings.HasPrefix(resp, "+OK 2 ") {
+		t.Errorf("STAT: got %q", resp)
+	}
+	c.cmd("QUIT")
+
+	s.AllowInsecureAuth = false
+	c = dial(t, addr)
+	if capa := c.multiline("CAPA"); strings.Contains(capa, "USER") || strings.Contains(capa, "SASL") {
+		t.Errorf("CAPA advertises authentication without TLS: %q", capa)
+	}
+	if resp := c.cmd("USER alice@example.org"); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("USER without TLS: got %q", resp)
+	}
+	if resp := c.cmd("AUTH PLAIN " + ir); !strings.HasPrefix(resp, "-ERR") {
+		t.Errorf("AUTH without TLS: got %q", resp)
+	}
+}
+
+func TestMaildirUID(t *testing.T) {
+	if uid := maildirUID("1600000000.M1P2Q3.host"); uid != "1600000000.M1P2Q3.host" {
+		t.Errorf("maildirUID() = %q", uid)
+	}
+	long := strings.Repeat("a", 71)
+	if uid := maildirUID(long); len(uid) != 40 || uid == maildirUID(long+"b") {
+		t.Errorf("maildirUID(%q) = %q", long, uid)
+	}
+	if uid := maildirUID("a b"); strings.Contains(uid, " ") {
+		t.Errorf("maildirUID(%q) = %q", "a b", uid)
+	}
+}
@@ -0,0 +1,314 @@
+// Package pop3 implements a POP3 server, as defined in RFC 1939.
+//
+// The server supports the CAPA (RFC 2449), STLS (RFC 2595) and AUTH
+// (RFC 5034) extensions, as well as the optional UIDL, TOP and USER
+// commands.
+package pop3
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+var ErrServerClosed = errors.New("pop3: server already closed")
+
+// Error is an error returned by a backend. Code is an optional extended
+// response code, as defined in RFC 2449 section 8, such as "IN-USE".
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+var (
+	// ErrAuthFailed is returned by Backend.Login when the credentials are
+	// invalid.
+	ErrAuthFailed = &Error{Code: "AUTH", Message: "Invalid credentials"}
+	// ErrInUse is returned by Backend.Login when the mailbox is already
+	// opened by another session.
+	ErrInUse = &Error{Code: "IN-USE", Message: "Mailbox already locked"}
+)
+
+// MessageInfo describes a message of a mailbox.
+type MessageInfo struct {
+	// Unique identifier of the message, which must persist across sessions.
+	// It must be made of 1 to 70 characters in the range 0x21 to 0x7E.
+	UID string
+	// Size of the message in octets, with CRLF line endings.
+	Size int64
+}
+
+// Mailbox is a mailbox opened by a client. It's locked until Close is
+// called.
+type Mailbox interface {
+	// List returns the messages of the mailbox.
+	List() ([]MessageInfo, error)
+	// Open returns the contents of a message.
+	Open(uid string) (io.ReadCloser, error)
+	// Delete removes messages from the mailbox. It's called when the client
+	// quits, with the messages it marked as deleted.
+	Delete(uids []string) error
+	// Close releases the mailbox.
+	Close() error
+}
+
+// Backend opens mailboxes for authenticated users.
+type Backend interface {
+	// Login authenticates a user and opens their mailbox.
+	Login(conn *Conn, username, password string) (Mailbox, error)
+}
+
+// A function that creates SASL servers.
+type SaslServerFactory func(conn *Conn) sasl.Server
+
+// A POP3 server.
+type Server struct {
+	// The type of network, "tcp" or "unix".
+	Network string
+	// TCP or Unix address to listen on.
+	Addr string
+	// The server TLS configuration. If set, STLS is advertised.
+	TLSConfig *tls.Config
+
+	AllowInsecureAuth bool
+	Debug             io.Writer
+	ErrorLog          smtp.Logger
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+
+	// The server backend.
+	Backend Backend
+
+	wg sync.WaitGroup
+
+	auths map[string]SaslServerFactory
+	done  chan struct{}
+
+	locker    sync.Mutex
+	listeners []net.Listener
+	conns     map[*Conn]struct{}
+}
+
+// NewServer creates a new POP3 server.
+func NewServer(be Backend) *Server {
+	return &Server{
+		Backend:  be,
+		done:     make(chan struct{}, 1),
+		ErrorLog: log.New(os.Stderr, "pop3/server ", log.LstdFlags),
+		auths: map[string]SaslServerFactory{
+			sasl.Plain: func(conn *Conn) sasl.Server {
+				return sasl.NewPlainServer(func(identity, username, password string) error {
+					if identity != "" && identity != username {
+						return errors.New("identities not supported")
+					}
+					return conn.login(username, password)
+				})
+			},
+		},
+		conns: make(map[*Conn]struct{}),
+	}
+}
+
+// EnableAuth enables an authentication mechanism on this server.
+//
+// Custom mechanisms must call Conn.SetMailbox once the client has been
+// authenticated.
+//
+// This function should not be called directly, it must only be used by
+// libraries implementing extensions of the POP3 protocol.
+func (s *Server) EnableAuth(name string, f SaslServerFactory) {
+	s.auths[name] = f
+}
+
+func (s *Server) authMechanisms() []string {
+	mechs := make([]string, 0, len(s.auths))
+	for name := range s.auths {
+		mechs = append(mechs, name)
+	}
+	sort.Strings(mechs)
+	return mechs
+}
+
+// Serve accepts incoming connections on the Listener l.
+func (s *Server) Serve(l net.Listener) error {
+	s.locker.Lock()
+	s.listeners = append(s.listeners, l)
+	s.locker.Unlock()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				// we called Close()
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.ErrorLog.Printf("accept error: %s; retrying in %s", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			err := s.handleConn(newConn(c, s))
+			if err != nil {
+				s.ErrorLog.Printf("handler error: %s", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleConn(c *Conn) error {
+	s.locker.Lock()
+	s.conns[c] = struct{}{}
+	s.locker.Unlock()
+
+	defer func() {
+		c.Close()
+
+		s.locker.Lock()
+		delete(s.conns, c)
+		s.locker.Unlock()
+	}()
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if d := s.ReadTimeout; d != 0 {
+			c.conn.SetReadDeadline(time.Now().Add(d))
+		}
+		if d := s.WriteTimeout; d != 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(d))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+
+	c.writeOK("POP3 server ready")
+
+	for {
+		line, err := c.readLine()
+		if err == nil {
+			if quit := c.handle(line); quit {
+				return nil
+			}
+		} else {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if err == errTooLongLine {
+				c.writeErr("", "Too long line, closing connection")
+				return nil
+			}
+
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				c.writeErr("", "Idle timeout, bye bye")
+				return nil
+			}
+
+			c.writeErr("", "Connection error, sorry")
+			return err
+		}
+	}
+}
+
+func (s *Server) network() string {
+	if s.Network != "" {
+		return s.Network
+	}
+	return "tcp"
+}
+
+// ListenAndServe listens on the network address s.Addr and then calls Serve
+// to handle requests on incoming connections.
+//
+// If s.Addr is blank, ":pop3" is used.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":pop3"
+	}
+
+	l, err := net.Listen(s.network(), addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on the TCP network address s.Addr and then calls
+// Serve to handle requests on incoming TLS connections.
+//
+// If s.Addr is blank, ":pop3s" is used.
+func (s *Server) ListenAndServeTLS() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":pop3s"
+	}
+
+	if s.TLSConfig == nil || (len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil && s.TLSConfig.GetConfigForClient == nil) {
+		return errors.New("pop3: neither Certificates, GetCertificate, nor GetConfigForClient set in TLSConfig")
+	}
+
+	l, err := tls.Listen(s.network(), addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Close immediately closes all active listeners and connections. Messages
+// marked as deleted are kept.
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+		return ErrServerClosed
+	default:
+		close(s.done)
+	}
+
+	var err error
+	s.locker.Lock()
+	for _, l := range s.listeners {
+		if lerr := l.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.locker.Unlock()
+
+	return err
+}
@@ -0,0 +1,132 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/message"
+)
+
+// maxPreviewText is the maximum length of the text in previews.
+const maxPreviewText = 4096
+
+// Preview is a quarantined message with a summary of its contents.
+type Preview struct {
+	*Item
+	Header      map[string][]string `json:"header,omitempty"`
+	Text        string              `json:"text,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+}
+
+// Attachment describes an attachment of a quarantined message.
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// Preview returns a quarantined message with a summary of its contents.
+// Malformed messages don't have a summary.
+func (st *Store) Preview(id string) (*Preview, error) {
+	item, err := st.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := st.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	p := &Preview{Item: item}
+	msg, err := message.Read(rc)
+	if err != nil {
+		return p, nil
+	}
+	p.Header = msg.Header
+	p.Text = msg.Text
+	if len(p.Text) > maxPreviewText {
+		p.Text = strings.ToValidUTF8(p.Text[:maxPreviewText], "")
+	}
+	for _, part := range msg.Attachments() {
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			Size:        part.Size,
+		})
+	}
+	return p, nil
+}
+
+// ServeHTTP serves the review API:
+//
+//	GET    /               List quarantined messages
+//	GET    /<id>           Preview a message
+//	GET    /<id>/raw       Download the raw message
+//	POST   /<id>/release   Deliver a message to its recipients
+//	DELETE /<id>           Delete a message
+func (st *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		items, err := st.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, items)
+		return
+	}
+
+	id, action := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		var p *Preview
+		if p, err = st.Preview(id); err == nil {
+			writeJSON(w, p)
+		}
+	case action == "" && r.Method == http.MethodDelete:
+		if err = st.Delete(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case action == "raw" && r.Method == http.MethodGet:
+		var rc io.ReadCloser
+		if rc, err = st.Open(id); err == nil {
+			defer rc.Close()
+			w.Header().Set("Content-Type", "message/rfc822")
+			io.Copy(w, rc)
+		}
+	case action == "release" && r.Method == http.MethodPost:
+		if err = st.Release(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case action == "" || action == "raw" || action == "release":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+	} else if _, ok := err.(*smtp.SMTPError); ok {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
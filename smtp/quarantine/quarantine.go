@@ -0,0 +1,429 @@
+// Package quarantine implements a store for messages set aside by filters.
+//
+// Instead of rejecting a message, a filter can quarantine it by returning an
+// *Error from its Data method. Backend catches these errors and saves the
+// message along with the reason in a Store, and the message is accepted. An
+// administrator can later review quarantined messages with the HTTP API
+// served by Store.ServeHTTP, and release or delete them.
+package quarantine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultMaxAge  = 30 * 24 * time.Hour
+	expiryInterval = time.Hour
+	itemSuffix     = ".json"
+	messageSuffix  = ".eml"
+)
+
+// ErrNotFound is returned when a quarantined message doesn't exist.
+var ErrNotFound = errors.New("quarantine: message not found")
+
+var errTempFail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to process message, try again later",
+}
+
+// Error is returned by filters to quarantine a message instead of rejecting
+// it.
+type Error struct {
+	Reason string
+}
+
+func (err *Error) Error() string {
+	return "quarantine: " + err.Reason
+}
+
+// Item describes a quarantined message.
+type Item struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Reason   string    `json:"reason"`
+	Received time.Time `json:"received"`
+	// Size of the message, in bytes.
+	Size    int64  `json:"size"`
+	Subject string `json:"subject,omitempty"`
+	// Additional information about the message, e.g. the address of the
+	// client.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Store keeps quarantined messages in a directory. Each message is stored in
+// a <id>.eml file, and is described by a <id>.json file.
+//
+// Messages older than MaxAge are removed by Expire. Expire is called
+// automatically at most once per hour when messages are added.
+type Store struct {
+	Dir string
+	// Maximum age of quarantined messages. Defaults to 30 days, a negative
+	// value disables expiry.
+	MaxAge time.Duration
+
+	// Opens a connection to the server used to release messages. If nil,
+	// messages can't be released.
+	Dial func() (*smtp.Client, error)
+	// Used to get the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mutex      sync.Mutex
+	lastExpiry time.Time
+}
+
+func (st *Store) now() time.Time {
+	if st.Now != nil {
+		return st.Now()
+	}
+	return time.Now()
+}
+
+func (st *Store) maxAge() time.Duration {
+	if st.MaxAge == 0 {
+		return defaultMaxAge
+	}
+	return st.MaxAge
+}
+
+func (st *Store) path(id, suffix string) string {
+	return filepath.Join(st.Dir, id+suffix)
+}
+
+// validID checks that an ID has been generated by newID, so that it can't be
+// used to access files outside of the store.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, ch := range id {
+		if !(ch >= '0' && ch <= '9') && !(ch >= 'a' && ch <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Add quarantines a message. The ID, Received, Size and Subject fields of
+// item are filled in.
+func (st *Store) Add(item *Item, r io.Reader) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(st.Dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(st.path(id, messageSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	item.ID = id
+	item.Received = st.now()
+	item.Size = size
+	item.Subject = st.subject(id)
+
+	// The description is written last, so that incomplete items are never
+	// listed
+	b, err := json.MarshalIndent(item, "", "\t")
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := ioutil.WriteFile(st.path(id, itemSuffix), b, 0600); err != nil {
+		os.Remove(st.path(id, itemSuffix))
+		os.Remove(f.Name())
+		return err
+	}
+
+	st.mutex.Lock()
+	expire := st.now().Sub(st.lastExpiry) >= expiryInterval
+	if expire {
+		st.lastExpiry = st.now()
+	}
+	st.mutex.Unlock()
+	if expire {
+		st.Expire()
+	}
+
+	return nil
+}
+
+// subject returns the decoded subject of a stored message, if any.
+func (st *Store) subject(id string) string {
+	f, err := os.Open(st.path(id, messageSuffix))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return ""
+	}
+	s := msg.Header.Get("Subject")
+	if dec, err := new(mime.WordDecoder).DecodeHeader(s); err == nil {
+		s = dec
+	}
+	return s
+}
+
+// Quarantine quarantines a message. It can be used as the Quarantine
+// callback of milter.Backend.
+func (st *Store) Quarantine(from string, to []string, r io.Reader, reason string) error {
+	return st.Add(&Item{From: from, To: to, Reason: reason}, r)
+}
+
+// Get returns the description of a quarantined message.
+func (st *Store) Get(id string) (*Item, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(st.path(id, itemSuffix))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	item := &Item{}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Open opens a quarantined message.
+func (st *Store) Open(id string) (io.ReadCloser, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(st.path(id, messageSuffix))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// List returns the quarantined messages, oldest first.
+func (st *Store) List() ([]*Item, error) {
+	names, err := filepath.Glob(filepath.Join(st.Dir, "*"+itemSuffix))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(names))
+	for _, name := range names {
+		item, err := st.Get(strings.TrimSuffix(filepath.Base(name), itemSuffix))
+		if err == ErrNotFound {
+			// Removed in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Received.Before(items[j].Received)
+	})
+	return items, nil
+}
+
+// Delete removes a quarantined message.
+func (st *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(st.path(id, itemSuffix))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(st.path(id, messageSuffix))
+}
+
+// Release delivers a quarantined message to its original recipients via the
+// server opened by Dial, then removes it from the store.
+func (st *Store) Release(id string) error {
+	if st.Dial == nil {
+		return errors.New("quarantine: releasing messages is not supported")
+	}
+	item, err := st.Get(id)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(st.path(id, messageSuffix))
+	if err != nil {
+		return err
+	}
+
+	c, err := st.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SendMail(item.From, item.To, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	c.Quit()
+
+	return st.Delete(id)
+}
+
+// Expire removes the messages older than MaxAge. It returns the number of
+// removed messages.
+func (st *Store) Expire() (int, error) {
+	if st.maxAge() < 0 {
+		return 0, nil
+	}
+	items, err := st.List()
+	if err != nil {
+		return 0, err
+	}
+	deadline := st.now().Add(-st.maxAge())
+	n := 0
+	for _, item := range items {
+		if !item.Received.Before(deadline) {
+			break
+		}
+		if err := st.Delete(item.ID); err != nil && err != ErrNotFound {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Backend is a backend that quarantines messages in Store when the
+// underlying backend returns an *Error from Data.
+//
+// The HELO host name, the client address and whether TLS was used are saved
+// in the metadata of quarantined messages.
+type Backend struct {
+	Backend smtp.Backend
+	Store   *Store
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{"helo": c.Hostname()}
+	if conn := c.Conn(); conn != nil {
+		meta["remote-addr"] = conn.RemoteAddr().String()
+	}
+	if _, ok := c.TLSConnectionState(); ok {
+		meta["tls"] = "yes"
+	}
+	return &session{Session: sess, be: be, meta: meta}, nil
+}
+
+type session struct {
+	Session smtp.Session
+
+	be   *Backend
+	meta map[string]string
+
+	from  string
+	rcpts []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	if err := s.Session.AuthPlain(username, password); err != nil {
+		return err
+	}
+	s.meta["username"] = username
+	return nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.from = from
+	s.rcpts = nil
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	err = s.Session.Data(bytes.NewReader(b))
+	qerr, ok := err.(*Error)
+	if !ok {
+		return err
+	}
+
+	meta := make(map[string]string, len(s.meta))
+	for k, v := range s.meta {
+		meta[k] = v
+	}
+	item := &Item{
+		From:     s.from,
+		To:       append([]string(nil), s.rcpts...),
+		Reason:   qerr.Reason,
+		Metadata: meta,
+	}
+	if err := s.be.Store.Add(item, bytes.NewReader(b)); err != nil {
+		return errTempFail
+	}
+	return nil
+}
+
+func (s *session) Logout() error {
+	return s.Session.Logout()
+}
@@ -0,0 +1,260 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type delivery struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+type filterBackend struct {
+	messages []*delivery
+}
+
+func (be *filterBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &filterSession{be: be}, nil
+}
+
+// filterSession quarantines messages containing "virus".
+type filterSession struct {
+	be  *filterBackend
+	msg *delivery
+}
+
+func (s *filterSession) Reset()        { s.msg = &delivery{} }
+func (s *filterSession) Logout() error { return nil }
+
+func (s *filterSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *filterSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &delivery{From: from}
+	return nil
+}
+
+func (s *filterSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *filterSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(b), "virus") {
+		return &Error{Reason: "Virus found"}
+	}
+	s.msg.Data = b
+	s.be.messages = append(s.be.messages, s.msg)
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func testStore(t *testing.T) (st *Store, be *filterBackend, addr string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "go-smtp-quarantine-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be = &filterBackend{}
+	st = &Store{Dir: dir}
+	s := smtp.NewServer(&Backend{Backend: be, Store: st})
+	s.Domain = "localhost"
+	addr = serve(t, s)
+	st.Dial = func() (*smtp.Client, error) {
+		return smtp.Dial(addr)
+	}
+
+	return st, be, addr, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func sendMail(t *testing.T, addr, msg string) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	st, be, addr, cleanup := testStore(t)
+	defer cleanup()
+
+	sendMail(t, addr, "Subject: Hello\r\n\r\nHey <3\r\n")
+	sendMail(t, addr, "Subject: =?utf-8?q?Caf=C3=A9?=\r\n\r\nThis is a virus\r\n")
+
+	if len(be.messages) != 1 {
+		t.Fatalf("Invalid number of delivered messages: %v", len(be.messages))
+	}
+
+	items, err := st.List()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Invalid number of quarantined messages: %v", len(items))
+	}
+	item := items[0]
+	if item.From != "root@nsa.gov" || len(item.To) != 1 || item.To[0] != "root@gchq.gov.uk" {
+		t.Errorf("Invalid envelope: %v, %v", item.From, item.To)
+	}
+	if item.Reason != "Virus found" || item.Subject != "Café" {
+		t.Errorf("Invalid reason or subject: %q, %q", item.Reason, item.Subject)
+	}
+	if item.Metadata["helo"] != "client.example.org" || item.Metadata["remote-addr"] == "" {
+		t.Errorf("Invalid metadata: %v", item.Metadata)
+	}
+
+	// Releasing the message re-injects it, so it's quarantined again
+	if err := st.Release(item.ID); err != nil {
+		t.Fatalf("Release() = %v", err)
+	}
+	if _, err := st.Get(item.ID); err != ErrNotFound {
+		t.Errorf("Get() = %v after release, want %v", err, ErrNotFound)
+	}
+	if items, _ := st.List(); len(items) != 1 || items[0].ID == item.ID {
+		t.Errorf("Released message hasn't been re-injected: %v", items)
+	}
+}
+
+func TestStore_ServeHTTP(t *testing.T) {
+	st, _, _, cleanup := testStore(t)
+	defer cleanup()
+
+	msg := "Subject: Hello\r\nContent-Type: text/plain\r\n\r\nThis is a virus\r\n"
+	if err := st.Quarantine("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg), "Virus found"); err != nil {
+		t.Fatalf("Quarantine() = %v", err)
+	}
+
+	ts := httptest.NewServer(st)
+	defer ts.Close()
+
+	var items []*Item
+	getJSON(t, ts.URL+"/", &items)
+	if len(items) != 1 {
+		t.Fatalf("Invalid number of items: %v", len(items))
+	}
+	id := items[0].ID
+
+	var p Preview
+	getJSON(t, ts.URL+"/"+id, &p)
+	if p.Reason != "Virus found" || p.Text != "This is a virus\r\n" {
+		t.Errorf("Invalid preview: %+v", p)
+	}
+
+	resp, err := http.Get(ts.URL + "/" + id + "/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != msg {
+		t.Errorf("Invalid raw message: %q", b)
+	}
+
+	resp, err = http.Get(ts.URL + "/../../etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET with an invalid ID = %v", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/"+id, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE = %v", resp.StatusCode)
+	}
+	if items, _ := st.List(); len(items) != 0 {
+		t.Errorf("Message hasn't been deleted: %v", items)
+	}
+
+	resp, err = http.Post(ts.URL+"/"+id+"/release", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST release of a deleted message = %v", resp.StatusCode)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %v = %v", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_Expire(t *testing.T) {
+	st, _, _, cleanup := testStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	st.Now = func() time.Time { return now }
+	st.MaxAge = 24 * time.Hour
+
+	st.Quarantine("a@example.org", []string{"b@example.org"}, strings.NewReader("\r\n"), "Old")
+	now = now.Add(12 * time.Hour)
+	st.Quarantine("a@example.org", []string{"b@example.org"}, strings.NewReader("\r\n"), "Recent")
+	now = now.Add(13 * time.Hour)
+
+	if n, err := st.Expire(); err != nil || n != 1 {
+		t.Fatalf("Expire() = %v, %v", n, err)
+	}
+	if items, _ := st.List(); len(items) != 1 || items[0].Reason != "Recent" {
+		t.Errorf("Invalid items after expiry: %v", items)
+	}
+
+	// Expiry runs automatically when messages are added
+	now = now.Add(12 * time.Hour)
+	st.Quarantine("a@example.org", []string{"b@example.org"}, strings.NewReader("\r\n"), "New")
+	if items, _ := st.List(); len(items) != 1 || items[0].Reason != "New" {
+		t.Errorf("Invalid items after automatic expiry: %v", items)
+	}
+}
@@ -0,0 +1,248 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Mode is the evaluation mode of rules.
+type Mode string
+
+const (
+	// Rules are evaluated in order and the action of the first matching rule
+	// is applied.
+	ModeFirstMatch Mode = "first-match"
+	// The scores of all matching rules are added, and the action of the
+	// highest threshold reached by the total is applied.
+	ModeScore Mode = "score"
+)
+
+// ActionType is the type of an action.
+type ActionType string
+
+const (
+	// Accept the message and stop evaluating rules.
+	ActionAccept ActionType = "accept"
+	// Reject the message with a permanent error.
+	ActionReject ActionType = "reject"
+	// Reject the message with a temporary error.
+	ActionTempFail ActionType = "tempfail"
+	// Accept the message but drop it silently.
+	ActionDiscard ActionType = "discard"
+	// Add a header field to the message. Evaluation continues.
+	ActionAddHeader ActionType = "add-header"
+	// Deliver the message to another recipient instead of the original ones.
+	ActionRedirect ActionType = "redirect"
+	// Quarantine the message, see the quarantine package.
+	ActionQuarantine ActionType = "quarantine"
+)
+
+// Action is an action applied to a message.
+type Action struct {
+	Type ActionType `json:"type"`
+	// Error message for reject and tempfail, reason for quarantine.
+	Message string `json:"message,omitempty"`
+	// Header field name and value for add-header.
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Recipient for redirect.
+	To string `json:"to,omitempty"`
+}
+
+func (a *Action) validate() error {
+	switch a.Type {
+	case ActionAccept, ActionReject, ActionTempFail, ActionDiscard, ActionQuarantine:
+		return nil
+	case ActionAddHeader:
+		if a.Header == "" || strings.ContainsAny(a.Header, ": \t\r\n") || strings.ContainsAny(a.Value, "\r\n") {
+			return fmt.Errorf("invalid header field %q: %q", a.Header, a.Value)
+		}
+		return nil
+	case ActionRedirect:
+		if !strings.Contains(a.To, "@") {
+			return fmt.Errorf("invalid redirect recipient %q", a.To)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+}
+
+// terminal returns true if the action stops the evaluation of rules.
+func (a *Action) terminal() bool {
+	return a.Type != ActionAddHeader
+}
+
+// Regexp is a regular expression, encoded as a string in JSON.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (re *Regexp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	compiled, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	re.Regexp = compiled
+	return nil
+}
+
+func (re *Regexp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(re.String())
+}
+
+// Rule is a set of conditions and an action applied to messages matching
+// all of them. Empty conditions match all messages.
+type Rule struct {
+	Name string `json:"name,omitempty"`
+
+	// Matches the envelope sender.
+	From *Regexp `json:"from,omitempty"`
+	// Matches if any envelope recipient matches.
+	To *Regexp `json:"to,omitempty"`
+	// Client IP addresses or CIDR ranges.
+	IP []string `json:"ip,omitempty"`
+	// Matches the HELO host name.
+	Helo *Regexp `json:"helo,omitempty"`
+	// Header field names and regexps matching their decoded value. Matches
+	// if, for each field, any value matches.
+	Header map[string]*Regexp `json:"header,omitempty"`
+	// Matches the decoded text of the message, or the raw body if the
+	// message can't be parsed.
+	Body *Regexp `json:"body,omitempty"`
+	// Bounds of the message size in bytes. Zero means no bound.
+	MinSize int64 `json:"minSize,omitempty"`
+	MaxSize int64 `json:"maxSize,omitempty"`
+
+	// Action applied in first-match mode. In score mode, only add-header
+	// actions are applied.
+	Action *Action `json:"action,omitempty"`
+	// Score added to the total in score mode.
+	Score float64 `json:"score,omitempty"`
+
+	nets []*net.IPNet
+}
+
+func (r *Rule) init() error {
+	for _, s := range r.IP {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid IP address or range %q", s)
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	for k, re := range r.Header {
+		if re == nil || re.Regexp == nil {
+			return fmt.Errorf("missing regexp for header field %q", k)
+		}
+	}
+	if r.Action != nil {
+		return r.Action.validate()
+	}
+	return nil
+}
+
+// Threshold is an action applied in score mode when the total score is
+// greater than or equal to Score.
+type Threshold struct {
+	Score  float64 `json:"score"`
+	Action *Action `json:"action"`
+}
+
+// Config is a set of rules.
+//
+// It's read from a JSON file:
+//
+//	{
+//		"mode": "first-match",
+//		"rules": [
+//			{"ip": ["192.0.2.0/24"], "action": {"type": "accept"}},
+//			{"from": "@spam\\.example$", "action": {"type": "reject", "message": "Go away"}},
+//			{"header": {"Subject": "(?i)viagra"}, "action": {"type": "quarantine", "message": "Spam"}},
+//			{"minSize": 10485760, "action": {"type": "redirect", "to": "large@example.org"}}
+//		]
+//	}
+type Config struct {
+	// Defaults to first-match.
+	Mode  Mode    `json:"mode,omitempty"`
+	Rules []*Rule `json:"rules"`
+
+	// Thresholds used in score mode. The highest threshold reached applies.
+	Thresholds []*Threshold `json:"thresholds,omitempty"`
+	// If set, the name of a header field added with the total score in
+	// score mode.
+	ScoreHeader string `json:"scoreHeader,omitempty"`
+}
+
+// ParseConfig parses a configuration.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("rules: %v", err)
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeFirstMatch
+	case ModeFirstMatch, ModeScore:
+	default:
+		return nil, fmt.Errorf("rules: unknown mode %q", cfg.Mode)
+	}
+
+	for i, rule := range cfg.Rules {
+		if err := rule.init(); err != nil {
+			return nil, fmt.Errorf("rules: rule %v: %v", ruleName(i, rule), err)
+		}
+		if cfg.Mode == ModeFirstMatch && rule.Action == nil {
+			return nil, fmt.Errorf("rules: rule %v: missing action", ruleName(i, rule))
+		}
+	}
+	for i, t := range cfg.Thresholds {
+		if t.Action == nil {
+			return nil, fmt.Errorf("rules: threshold %v: missing action", i)
+		}
+		if err := t.Action.validate(); err != nil {
+			return nil, fmt.Errorf("rules: threshold %v: %v", i, err)
+		}
+	}
+	if strings.ContainsAny(cfg.ScoreHeader, ": \t\r\n") {
+		return nil, fmt.Errorf("rules: invalid score header field %q", cfg.ScoreHeader)
+	}
+
+	return &cfg, nil
+}
+
+// LoadConfig reads a configuration from a file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseConfig(f)
+}
+
+func ruleName(i int, r *Rule) string {
+	if r.Name != "" {
+		return fmt.Sprintf("%q", r.Name)
+	}
+	return fmt.Sprintf("%v", i)
+}
@@ -0,0 +1,358 @@
+// Package rules implements a backend applying policies described in a
+// configuration file.
+//
+// Rules match messages on their envelope, the client IP address, the HELO
+// host name, header fields, body and size. Matching messages can be
+// rejected, deferred, discarded, tagged with a header field, redirected or
+// quarantined. See Config for the file format.
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/message"
+	"github.com/emersion/go-smtp/quarantine"
+)
+
+// envelope contains the information known about a message before DATA.
+type envelope struct {
+	helo  string
+	ip    net.IP
+	from  string
+	rcpts []string
+}
+
+// parsedMessage is a message being evaluated. Its contents are decoded
+// lazily, only if needed by rules.
+type parsedMessage struct {
+	raw []byte
+
+	header     textproto.MIMEHeader
+	body       []byte
+	text       string
+	textParsed bool
+}
+
+func newParsedMessage(raw []byte) *parsedMessage {
+	msg := &parsedMessage{raw: raw, body: raw}
+	r := bytes.NewReader(raw)
+	br := bufio.NewReader(r)
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err == nil {
+		// The body is what hasn't been consumed by the header reader
+		msg.body = raw[len(raw)-r.Len()-br.Buffered():]
+	}
+	msg.header = h
+	return msg
+}
+
+func (msg *parsedMessage) headerMatches(k string, re *Regexp) bool {
+	dec := new(mime.WordDecoder)
+	for _, v := range msg.header[textproto.CanonicalMIMEHeaderKey(k)] {
+		if s, err := dec.DecodeHeader(v); err == nil {
+			v = s
+		}
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (msg *parsedMessage) bodyMatches(re *Regexp) bool {
+	if !msg.textParsed {
+		msg.textParsed = true
+		if m, err := message.Read(bytes.NewReader(msg.raw)); err == nil {
+			msg.text = m.Text + "\n" + m.HTML
+		} else {
+			msg.text = string(msg.body)
+		}
+	}
+	return re.MatchString(msg.text)
+}
+
+func (r *Rule) matches(env *envelope, msg *parsedMessage) bool {
+	if r.From != nil && !r.From.MatchString(env.from) {
+		return false
+	}
+	if r.To != nil {
+		ok := false
+		for _, rcpt := range env.rcpts {
+			if r.To.MatchString(rcpt) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.nets) > 0 {
+		ok := false
+		for _, ipNet := range r.nets {
+			if env.ip != nil && ipNet.Contains(env.ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.Helo != nil && !r.Helo.MatchString(env.helo) {
+		return false
+	}
+	size := int64(len(msg.raw))
+	if r.MinSize > 0 && size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return false
+	}
+	for k, re := range r.Header {
+		if !msg.headerMatches(k, re) {
+			return false
+		}
+	}
+	if r.Body != nil && !msg.bodyMatches(r.Body) {
+		return false
+	}
+	return true
+}
+
+// result is the outcome of the evaluation of rules.
+type result struct {
+	// Header fields to add, in order
+	addHeader []*Action
+	// Final action, nil if the message should be delivered
+	action *Action
+}
+
+func (cfg *Config) evaluate(env *envelope, msg *parsedMessage) *result {
+	res := &result{}
+
+	if cfg.Mode == ModeFirstMatch {
+		for _, rule := range cfg.Rules {
+			if !rule.matches(env, msg) {
+				continue
+			}
+			if !rule.Action.terminal() {
+				res.addHeader = append(res.addHeader, rule.Action)
+				continue
+			}
+			res.action = rule.Action
+			break
+		}
+		return res
+	}
+
+	var score float64
+	var names []string
+	for _, rule := range cfg.Rules {
+		if !rule.matches(env, msg) {
+			continue
+		}
+		score += rule.Score
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		if rule.Action != nil && !rule.Action.terminal() {
+			res.addHeader = append(res.addHeader, rule.Action)
+		}
+	}
+
+	if cfg.ScoreHeader != "" {
+		v := strconv.FormatFloat(score, 'f', -1, 64)
+		if len(names) > 0 {
+			v += " (" + strings.Join(names, ", ") + ")"
+		}
+		res.addHeader = append(res.addHeader, &Action{
+			Type:   ActionAddHeader,
+			Header: cfg.ScoreHeader,
+			Value:  v,
+		})
+	}
+
+	var reached *Threshold
+	for _, t := range cfg.Thresholds {
+		if score >= t.Score && (reached == nil || t.Score > reached.Score) {
+			reached = t
+		}
+	}
+	if reached != nil && reached.Action.terminal() {
+		res.action = reached.Action
+	} else if reached != nil {
+		res.addHeader = append(res.addHeader, reached.Action)
+	}
+	return res
+}
+
+// Backend is a backend that applies rules to messages before passing them
+// to the underlying backend.
+//
+// Rules are evaluated once the message has been received, and are applied to
+// all of its recipients. Redirected messages are delivered to the underlying
+// backend with the new recipient only. Quarantined messages are reported
+// with a *quarantine.Error, so the backend needs to be wrapped in a
+// quarantine.Backend.
+type Backend struct {
+	Backend smtp.Backend
+
+	// Path of the configuration file. The file is reloaded when it changes.
+	// If the new file can't be loaded, the previous configuration is kept.
+	Path string
+	// Logger used to report errors while reloading the configuration. If
+	// nil, errors are not reported.
+	ErrorLog smtp.Logger
+
+	file backendutil.ReloadableFile
+}
+
+func loadConfig(path string) (interface{}, error) {
+	return LoadConfig(path)
+}
+
+// Load loads the configuration file, replacing the current configuration.
+func (be *Backend) Load() error {
+	_, err := be.file.Load(be.Path, loadConfig)
+	return err
+}
+
+// config returns the current configuration, reloading the file if it has
+// changed.
+func (be *Backend) config() (*Config, error) {
+	v, err := be.file.Get(be.Path, loadConfig)
+	if v == nil {
+		return nil, err
+	} else if err != nil && be.ErrorLog != nil {
+		be.ErrorLog.Printf("failed to reload rules: %v", err)
+	}
+	return v.(*Config), nil
+}
+
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	cfg, err := be.config()
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{helo: c.Hostname()}
+	if conn := c.Conn(); conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			env.ip = addr.IP
+		}
+	}
+	return &session{Session: sess, cfg: cfg, env: env}, nil
+}
+
+type session struct {
+	Session smtp.Session
+
+	cfg      *Config
+	env      envelope
+	mailOpts *smtp.MailOptions
+}
+
+func (s *session) Reset() {
+	s.env.from = ""
+	s.env.rcpts = nil
+	s.mailOpts = nil
+	s.Session.Reset()
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	return s.Session.AuthPlain(username, password)
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.env.from = from
+	s.env.rcpts = nil
+	s.mailOpts = opts
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.env.rcpts = append(s.env.rcpts, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	res := s.cfg.evaluate(&s.env, newParsedMessage(b))
+
+	if len(res.addHeader) > 0 {
+		var buf bytes.Buffer
+		for _, a := range res.addHeader {
+			buf.WriteString(textproto.CanonicalMIMEHeaderKey(a.Header) + ": " + a.Value + "\r\n")
+		}
+		buf.Write(b)
+		b = buf.Bytes()
+	}
+
+	if a := res.action; a != nil {
+		switch a.Type {
+		case ActionReject:
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      actionMessage(a, "Message rejected"),
+			}
+		case ActionTempFail:
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+				Message:      actionMessage(a, "Message deferred, try again later"),
+			}
+		case ActionDiscard:
+			return nil
+		case ActionQuarantine:
+			return &quarantine.Error{Reason: actionMessage(a, "Matched rules")}
+		case ActionRedirect:
+			s.Session.Reset()
+			if err := s.Session.Mail(s.env.from, s.mailOpts); err != nil {
+				return err
+			}
+			if err := s.Session.Rcpt(a.To, &smtp.RcptOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.Session.Data(bytes.NewReader(b))
+}
+
+func (s *session) Logout() error {
+	return s.Session.Logout()
+}
+
+func actionMessage(a *Action, def string) string {
+	if a.Message != "" {
+		return a.Message
+	}
+	return def
+}
@@ -0,0 +1,266 @@
+package rules
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/quarantine"
+)
+
+func mustParseConfig(t *testing.T, s string) *Config {
+	cfg, err := ParseConfig(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+	return cfg
+}
+
+func TestParseConfig_invalid(t *testing.T) {
+	for _, s := range []string{
+		`{"mode": "random"}`,
+		`{"rules": [{"from": "("}]}`,
+		`{"rules": [{"ip": ["not-an-ip"], "action": {"type": "reject"}}]}`,
+		`{"rules": [{"from": "a"}]}`,
+		`{"rules": [{"action": {"type": "explode"}}]}`,
+		`{"rules": [{"action": {"type": "add-header", "header": "X-Spam: yes"}}]}`,
+		`{"rules": [{"action": {"type": "redirect"}}]}`,
+		`{"rules": [], "unknown": true}`,
+	} {
+		if _, err := ParseConfig(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseConfig(%q) = nil, want an error", s)
+		}
+	}
+}
+
+const firstMatchConfig = `{
+	"rules": [
+		{"name": "trusted", "ip": ["192.0.2.0/24", "2001:db8::1"], "action": {"type": "accept"}},
+		{"name": "tag", "to": "^list@", "action": {"type": "add-header", "header": "X-List", "value": "yes"}},
+		{"name": "spammer", "from": "@spam\\.example$", "action": {"type": "reject", "message": "Go away"}},
+		{"name": "helo", "helo": "^localhost$", "action": {"type": "tempfail"}},
+		{"name": "viagra", "header": {"Subject": "(?i)viagra"}, "action": {"type": "quarantine", "message": "Spam"}},
+		{"name": "body", "body": "unsubscribe now", "action": {"type": "discard"}},
+		{"name": "large", "minSize": 100, "action": {"type": "redirect", "to": "large@example.org"}}
+	]
+}`
+
+func TestConfig_firstMatch(t *testing.T) {
+	cfg := mustParseConfig(t, firstMatchConfig)
+
+	tests := []struct {
+		name   string
+		env    envelope
+		msg    string
+		action ActionType
+		tags   int
+	}{
+		{"clean", envelope{helo: "mx.example.org", from: "a@example.org", rcpts: []string{"b@example.org"}}, "Subject: Hi\r\n\r\nHi\r\n", "", 0},
+		{"trusted", envelope{ip: net.ParseIP("192.0.2.42"), from: "a@spam.example"}, "\r\n", ActionAccept, 0},
+		{"trusted-v6", envelope{ip: net.ParseIP("2001:db8::1"), from: "a@spam.example"}, "\r\n", ActionAccept, 0},
+		{"spammer", envelope{ip: net.ParseIP("198.51.100.1"), from: "a@spam.example"}, "\r\n", ActionReject, 0},
+		{"tag", envelope{from: "a@spam.example", rcpts: []string{"b@example.org", "list@example.org"}}, "\r\n", ActionReject, 1},
+		{"helo", envelope{helo: "localhost"}, "\r\n", ActionTempFail, 0},
+		{"header", envelope{}, "Subject: =?utf-8?q?Cheap_VIAGRA?=\r\n\r\n", ActionQuarantine, 0},
+		{"body", envelope{}, "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\ndW5zdWJzY3JpYmUgbm93\r\n", ActionDiscard, 0},
+		{"size", envelope{}, "Subject: Hi\r\n\r\n" + strings.Repeat("a", 100), ActionRedirect, 0},
+	}
+	for _, tc := range tests {
+		res := cfg.evaluate(&tc.env, newParsedMessage([]byte(tc.msg)))
+		var action ActionType
+		if res.action != nil {
+			action = res.action.Type
+		}
+		if action != tc.action {
+			t.Errorf("%v: action = %q, want %q", tc.name, action, tc.action)
+		}
+		if len(res.addHeader) != tc.tags {
+			t.Errorf("%v: %v header fields added, want %v", tc.name, len(res.addHeader), tc.tags)
+		}
+	}
+}
+
+func TestConfig_score(t *testing.T) {
+	cfg := mustParseConfig(t, `{
+		"mode": "score",
+		"rules": [
+			{"name": "subject", "header": {"Subject": "(?i)money"}, "score": 3},
+			{"name": "body", "body": "(?i)money", "score": 2.5},
+			{"name": "helo", "helo": "^\\[", "score": 1}
+		],
+		"thresholds": [
+			{"score": 3, "action": {"type": "add-header", "header": "X-Spam", "value": "yes"}},
+			{"score": 6, "action": {"type": "reject"}}
+		],
+		"scoreHeader": "X-Spam-Score"
+	}`)
+
+	res := cfg.evaluate(&envelope{}, newParsedMessage([]byte("Subject: Money\r\n\r\nMoney!\r\n")))
+	if res.action != nil {
+		t.Errorf("action = %+v, want none", res.action)
+	}
+	if len(res.addHeader) != 2 || res.addHeader[0].Value != "5.5 (subject, body)" || res.addHeader[1].Header != "X-Spam" {
+		t.Errorf("Invalid header fields: %+v", res.addHeader)
+	}
+
+	res = cfg.evaluate(&envelope{helo: "[192.0.2.1]"}, newParsedMessage([]byte("Subject: Money\r\n\r\nMoney!\r\n")))
+	if res.action == nil || res.action.Type != ActionReject {
+		t.Errorf("action = %+v, want reject", res.action)
+	}
+}
+
+func TestNewParsedMessage_large(t *testing.T) {
+	body := strings.Repeat("Hey <3\r\n", 1000)
+	msg := newParsedMessage([]byte("Subject: Hey\r\n\r\n" + body))
+	if msg.header.Get("Subject") != "Hey" {
+		t.Errorf("Invalid header: %v", msg.header)
+	}
+	if string(msg.body) != body {
+		t.Errorf("Invalid body: %v bytes, want %v", len(msg.body), len(body))
+	}
+}
+
+type delivery struct {
+	to   []string
+	data string
+}
+
+type backend struct {
+	deliveries []*delivery
+}
+
+func (be *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &backendSession{be: be}, nil
+}
+
+type backendSession struct {
+	be *backend
+	d  *delivery
+}
+
+func (s *backendSession) Reset()        { s.d = &delivery{} }
+func (s *backendSession) Logout() error { return nil }
+
+func (s *backendSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *backendSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.d = &delivery{}
+	return nil
+}
+
+func (s *backendSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.d.to = append(s.d.to, to)
+	return nil
+}
+
+func (s *backendSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.d.data = string(b)
+	s.be.deliveries = append(s.be.deliveries, s.d)
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func sendMail(t *testing.T, addr, to, msg string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.SendMail("root@nsa.gov", []string{to}, strings.NewReader(msg))
+}
+
+func TestBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-rules-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(path, []byte(`{"rules": [
+		{"to": "^tagged@", "action": {"type": "add-header", "header": "x-tag", "value": "1"}},
+		{"to": "^rejected@", "action": {"type": "reject", "message": "No thanks"}},
+		{"to": "^redirected@", "action": {"type": "redirect", "to": "postmaster@example.org"}},
+		{"to": "^quarantined@", "action": {"type": "quarantine"}}
+	]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	be := &backend{}
+	qdir := filepath.Join(dir, "quarantine")
+	st := &quarantine.Store{Dir: qdir}
+	s := smtp.NewServer(&quarantine.Backend{
+		Backend: &Backend{Backend: be, Path: path},
+		Store:   st,
+	})
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	if err := sendMail(t, addr, "tagged@example.org", "Subject: Hi\r\n\r\nHi\r\n"); err != nil {
+		t.Fatalf("SendMail(tagged) = %v", err)
+	}
+	err = sendMail(t, addr, "rejected@example.org", "Subject: Hi\r\n\r\nHi\r\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.Message != "No thanks" {
+		t.Errorf("SendMail(rejected) = %v", err)
+	}
+	if err := sendMail(t, addr, "redirected@example.org", "Subject: Hi\r\n\r\nHi\r\n"); err != nil {
+		t.Fatalf("SendMail(redirected) = %v", err)
+	}
+	if err := sendMail(t, addr, "quarantined@example.org", "Subject: Hi\r\n\r\nHi\r\n"); err != nil {
+		t.Fatalf("SendMail(quarantined) = %v", err)
+	}
+
+	if len(be.deliveries) != 2 {
+		t.Fatalf("Invalid number of deliveries: %v", len(be.deliveries))
+	}
+	if d := be.deliveries[0]; d.data != "X-Tag: 1\r\nSubject: Hi\r\n\r\nHi\r\n" {
+		t.Errorf("Invalid tagged message: %q", d.data)
+	}
+	if d := be.deliveries[1]; len(d.to) != 1 || d.to[0] != "postmaster@example.org" {
+		t.Errorf("Invalid redirected recipients: %v", d.to)
+	}
+	if items, _ := st.List(); len(items) != 1 || items[0].To[0] != "quarantined@example.org" {
+		t.Errorf("Invalid quarantined messages: %v", items)
+	}
+
+	// Hot reload
+	if err := ioutil.WriteFile(path, []byte(`{"rules": [{"action": {"type": "tempfail"}}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	err = sendMail(t, addr, "tagged@example.org", "Subject: Hi\r\n\r\nHi\r\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("SendMail() = %v after reload, want a 451 error", err)
+	}
+
+	// Invalid configurations are ignored
+	if err := ioutil.WriteFile(path, []byte(`{"rules": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = sendMail(t, addr, "tagged@example.org", "Subject: Hi\r\n\r\nHi\r\n")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("SendMail() = %v after invalid reload, want a 451 error", err)
+	}
+}
@@ -48,6 +48,12 @@ type Server struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 
+	// If set, called for each new connection. The returned writers receive a
+	// copy of the data read from and written to the client, like Debug. If
+	// they implement io.Closer, they are closed when the connection is
+	// closed. Either writer may be nil.
+	DebugConn func(c *Conn) (in, out io.Writer)
+
 	// Advertise SMTPUTF8 (RFC 6531) capability.
 	// Should be used only if backend supports it.
 	EnableSMTPUTF8 bool
@@ -64,6 +70,18 @@ type Server struct {
 	// Should be used only if backend supports it.
 	EnableDSN bool
 
+	// Advertise FUTURERELEASE (RFC 4865) capability.
+	// Should be used only if backend supports it.
+	EnableFUTURERELEASE bool
+
+	// Maximum hold interval advertised with FUTURERELEASE. Defaults to
+	// 7 days.
+	MaxHoldInterval time.Duration
+
+	// Advertise MT-PRIORITY (RFC 6710) capability.
+	// Should be used only if backend supports it.
+	EnableMTPRIORITY bool
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
@@ -82,6 +100,9 @@ type Server struct {
 	conns     map[*Conn]struct{}
 }
 
+// Default maximum hold interval for FUTURERELEASE.
+const defaultMaxHoldInterval = 7 * 24 * time.Hour
+
 // New creates a new SMTP server.
 func NewServer(be Backend) *Server {
 	return &Server{
@@ -214,6 +235,13 @@ func (s *Server) handleConn(c *Conn) error {
 	}
 }
 
+func (s *Server) maxHoldInterval() time.Duration {
+	if s.MaxHoldInterval > 0 {
+		return s.MaxHoldInterval
+	}
+	return defaultMaxHoldInterval
+}
+
 func (s *Server) network() string {
 	if s.Network != "" {
 		return s.Network
@@ -227,6 +255,10 @@ func (s *Server) network() string {
 // ListenAndServe listens on the network address s.Addr and then calls Serve
 // to handle requests on incoming connections.
 //
+// If a listener bound to s.Addr has been inherited from systemd socket
+// activation or from a previous process (see Upgrade), it's used instead of
+// creating a new one.
+//
 // If s.Addr is blank and LMTP is disabled, ":smtp" is used.
 func (s *Server) ListenAndServe() error {
 	network := s.network()
@@ -236,7 +268,7 @@ func (s *Server) ListenAndServe() error {
 		addr = ":smtp"
 	}
 
-	l, err := net.Listen(network, addr)
+	l, err := s.listen(network, addr)
 	if err != nil {
 		return err
 	}
@@ -247,6 +279,8 @@ func (s *Server) ListenAndServe() error {
 // ListenAndServeTLS listens on the TCP network address s.Addr and then calls
 // Serve to handle requests on incoming TLS connections.
 //
+// Inherited listeners are used as in ListenAndServe.
+//
 // If s.Addr is blank and LMTP is disabled, ":smtps" is used.
 func (s *Server) ListenAndServeTLS() error {
 	network := s.network()
@@ -256,12 +290,16 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen(network, addr, s.TLSConfig)
+	if s.TLSConfig == nil || (len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil && s.TLSConfig.GetConfigForClient == nil) {
+		return errors.New("smtp: neither Certificates, GetCertificate, nor GetConfigForClient set in TLSConfig")
+	}
+
+	l, err := s.listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.Serve(newTLSListener(l, s.TLSConfig))
 }
 
 // Close immediately closes all active listeners and connections.
@@ -11,6 +11,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
@@ -1385,3 +1386,135 @@ func TestServerDSNwithSMTPUTF8(t *testing.T) {
 		t.Fatal("Invalid ORCPT address:", val)
 	}
 }
+
+func TestServerFUTURERELEASE(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t,
+		func(s *smtp.Server) {
+			s.EnableFUTURERELEASE = true
+			s.MaxHoldInterval = 24 * time.Hour
+		})
+	defer s.Close()
+	defer c.Close()
+
+	found := false
+	for cap := range caps {
+		if strings.HasPrefix(cap, "FUTURERELEASE 86400 ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Missing capability: FUTURERELEASE")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=3600 HOLDUNTIL=2030-01-01T00:00:00Z\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=172800\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=3600\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	holdUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDUNTIL="+holdUntil.Format(time.RFC3339)+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 2 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	if val := be.anonmsgs[0].Opts.HoldFor; val != time.Hour {
+		t.Fatal("Invalid HOLDFOR parameter value:", val)
+	}
+	if val := be.anonmsgs[1].Opts.HoldUntil; !val.Equal(holdUntil) {
+		t.Fatal("Invalid HOLDUNTIL parameter value:", val)
+	}
+}
+
+func TestServerFUTURERELEASE_Disabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> HOLDFOR=3600\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServerMTPRIORITY(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t,
+		func(s *smtp.Server) {
+			s.EnableMTPRIORITY = true
+		})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["MT-PRIORITY"]; !ok {
+		t.Fatal("Missing capability: MT-PRIORITY")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=10\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=-3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	if val := be.anonmsgs[0].Opts.MTPriority; val == nil || *val != -3 {
+		t.Fatal("Invalid MT-PRIORITY parameter value:", val)
+	}
+}
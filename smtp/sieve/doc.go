@@ -0,0 +1,8 @@
+// Package sieve implements the Sieve mail filtering language, as defined in
+// RFC 5228.
+//
+// The following extensions are supported: fileinto, reject (RFC 5429),
+// envelope, vacation (RFC 5230), imap4flags (RFC 5232) and variables
+// (RFC 5229). Scripts of users are kept in a Store, and Filter runs them when
+// messages are delivered by a maildir.Backend.
+package sieve
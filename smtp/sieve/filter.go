@@ -0,0 +1,206 @@
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+	"github.com/emersion/go-smtp/maildir"
+)
+
+// Filter runs the scripts of recipients when messages are delivered to
+// Maildirs. Its Filter method can be used as maildir.Backend.Filter.
+//
+// Recipients without a script, and messages for which the script fails, are
+// delivered to the inbox. Messages which can't be redirected are kept in the
+// inbox too, as required by RFC 5228 section 2.10.6. Rejected messages are
+// refused with a 550 error. Vacation responses are not sent to automated
+// senders (RFC 3834), nor to messages which aren't addressed to the
+// recipient in the To, Cc or Bcc header fields.
+type Filter struct {
+	Scripts *Store
+
+	// Opens a connection to the server used to send redirected messages and
+	// vacation responses. If nil, redirected messages are kept and vacation
+	// actions are ignored.
+	Dial func() (*smtp.Client, error)
+	// Logger used to report script and sending errors. If nil, errors are
+	// not reported.
+	ErrorLog smtp.Logger
+	// Used to get the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	vacations map[string]time.Time // response key -> time after which to respond again
+}
+
+func (f *Filter) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+func (f *Filter) logf(format string, v ...interface{}) {
+	if f.ErrorLog != nil {
+		f.ErrorLog.Printf(format, v...)
+	}
+}
+
+// Filter implements maildir.Filter.
+func (f *Filter) Filter(env *maildir.Envelope, msg []byte) ([]maildir.Delivery, error) {
+	inbox := []maildir.Delivery{{}}
+
+	script, err := f.Scripts.Script(env.To)
+	if err == ErrNoScript {
+		return inbox, nil
+	} else if err != nil {
+		f.logf("sieve: failed to load script of <%v>: %v", env.To, err)
+		return inbox, nil
+	}
+
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg))).ReadMIMEHeader()
+	if err != nil {
+		h = make(textproto.MIMEHeader)
+	}
+	res, err := script.Run(&Envelope{From: env.From, To: env.To}, h, int64(len(msg)))
+	if err != nil {
+		f.logf("sieve: script of <%v> failed: %v", env.To, err)
+		return inbox, nil
+	}
+
+	if res.Reject {
+		reason := strings.Join(strings.Fields(res.RejectReason), " ")
+		if reason == "" {
+			reason = "Message rejected by recipient"
+		}
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      reason,
+		}
+	}
+
+	var deliveries []maildir.Delivery
+	if res.Keep {
+		deliveries = append(deliveries, maildir.Delivery{Flags: res.KeepFlags})
+	}
+	for _, fi := range res.FileInto {
+		deliveries = append(deliveries, maildir.Delivery{Folder: fi.Mailbox, Flags: fi.Flags})
+	}
+
+	redirected := true
+	for _, to := range res.Redirect {
+		if f.Dial == nil {
+			redirected = false
+			break
+		}
+		if err := f.send(env.From, to, msg); err != nil {
+			f.logf("sieve: failed to redirect message for <%v> to <%v>: %v", env.To, to, err)
+			redirected = false
+		}
+	}
+	if !redirected && !res.Keep {
+		// The redirect cancelled the implicit keep
+		deliveries = append(deliveries, maildir.Delivery{})
+	}
+
+	if f.Dial != nil && res.Vacation != nil && f.shouldRespond(env, h, res.Vacation) {
+		if err := f.respond(env, h, res.Vacation); err != nil {
+			f.forgetResponse(env, res.Vacation)
+			f.logf("sieve: failed to send vacation response from <%v>: %v", env.To, err)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (f *Filter) send(from, to string, msg []byte) error {
+	c, err := f.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SendMail(from, []string{to}, bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// shouldRespond checks whether a vacation response should be sent, and
+// records the response if so. The response must be forgotten if it can't be
+// sent.
+func (f *Filter) shouldRespond(env *maildir.Envelope, h textproto.MIMEHeader, v *Vacation) bool {
+	if !backendutil.CanAutoReply(env.From, h) {
+		return false
+	}
+	own := append([]string{env.To}, v.Addresses...)
+	if containsFold(own, env.From) || !backendutil.IsAddressedTo(h, own) {
+		return false
+	}
+
+	key := vacationKey(env, v)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := f.now()
+	if until, ok := f.vacations[key]; ok && now.Before(until) {
+		return false
+	}
+	if f.vacations == nil {
+		f.vacations = make(map[string]time.Time)
+	}
+	for k, until := range f.vacations {
+		if !now.Before(until) {
+			delete(f.vacations, k)
+		}
+	}
+	f.vacations[key] = now.Add(time.Duration(v.Days) * 24 * time.Hour)
+	return true
+}
+
+// forgetResponse removes a response recorded by shouldRespond.
+func (f *Filter) forgetResponse(env *maildir.Envelope, v *Vacation) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.vacations, vacationKey(env, v))
+}
+
+func vacationKey(env *maildir.Envelope, v *Vacation) string {
+	handle := v.Handle
+	if handle == "" {
+		handle = v.Subject + "\x00" + v.Reason
+	}
+	return strings.ToLower(env.To) + "\x00" + strings.ToLower(env.From) + "\x00" + handle
+}
+
+func (f *Filter) respond(env *maildir.Envelope, h textproto.MIMEHeader, v *Vacation) error {
+	from := v.From
+	if from == "" {
+		from = (&mail.Address{Address: env.To}).String()
+	}
+	m := &backendutil.AutoReplyMessage{
+		From:    from,
+		To:      env.From,
+		Subject: v.Subject,
+		Date:    f.now(),
+		Body:    v.Reason,
+		MIME:    v.MIME,
+	}
+	msg, err := m.Format(h)
+	if err != nil {
+		return err
+	}
+
+	c, err := f.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return m.Send(c, msg)
+}
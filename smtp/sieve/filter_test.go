@@ -0,0 +1,300 @@
+package sieve
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/maildir"
+)
+
+type delivery struct {
+	from string
+	to   []string
+	data string
+}
+
+type outbox struct {
+	mutex      sync.Mutex
+	deliveries []*delivery
+}
+
+func (o *outbox) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &outboxSession{outbox: o}, nil
+}
+
+type outboxSession struct {
+	outbox *outbox
+	d      *delivery
+}
+
+func (s *outboxSession) Reset()        {}
+func (s *outboxSession) Logout() error { return nil }
+
+func (s *outboxSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *outboxSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.d = &delivery{from: from}
+	return nil
+}
+
+func (s *outboxSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.d.to = append(s.d.to, to)
+	return nil
+}
+
+func (s *outboxSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.d.data = string(b)
+	s.outbox.mutex.Lock()
+	s.outbox.deliveries = append(s.outbox.deliveries, s.d)
+	s.outbox.mutex.Unlock()
+	return nil
+}
+
+func serve(t *testing.T, s *smtp.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// countMessages returns the number of messages in a Maildir folder.
+func countMessages(t *testing.T, dir string) int {
+	n := 0
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		n += len(entries)
+	}
+	return n
+}
+
+const testScript = `require ["fileinto", "reject", "vacation", "imap4flags"];
+if header :contains "Subject" "[list]" {
+	fileinto :flags "\\Seen" "Lists/Go";
+	stop;
+}
+if address :is "from" "spammer@example.com" {
+	reject "I don't want your mail";
+	stop;
+}
+vacation :days 1 "I'm away";
+`
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-sieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := &outbox{}
+	obs := smtp.NewServer(out)
+	obs.Domain = "outbox"
+	outAddr := serve(t, obs)
+	defer obs.Close()
+
+	root := filepath.Join(dir, "mail")
+	bob := filepath.Join(root, "bob@example.org")
+	if err := maildir.Dir(bob).Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &Store{Dir: filepath.Join(dir, "sieve")}
+	ts := httptest.NewServer(st)
+	defer ts.Close()
+
+	put := func(src string) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/bob@example.org", strings.NewReader(src))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put(`fileinto "Junk";`); code != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid script = %v", code)
+	}
+	if code := put(testScript); code != http.StatusNoContent {
+		t.Fatalf("PUT = %v", code)
+	}
+
+	f := &Filter{
+		Scripts: st,
+		Dial: func() (*smtp.Client, error) {
+			return smtp.Dial(outAddr)
+		},
+	}
+	s := smtp.NewServer(&maildir.Backend{Root: root, Filter: f.Filter})
+	s.Domain = "localhost"
+	addr := serve(t, s)
+	defer s.Close()
+
+	send := func(from, to, msg string) error {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.SendMail(from, []string{to}, strings.NewReader(msg))
+	}
+
+	if err := send("alice@example.com", "eve@example.org", "Subject: Hi\r\n\r\n"); err == nil {
+		t.Errorf("SendMail() to an unknown user = nil, want an error")
+	}
+
+	msg := "From: alice@example.com\r\nTo: bob@example.org\r\nSubject: [list] Hello\r\n\r\nHi\r\n"
+	if err := send("alice@example.com", "bob@example.org", msg); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(bob, ".Lists.Go", "cur"))
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ":2,S") {
+		t.Errorf("Message hasn't been filed into Lists/Go: %v", entries)
+	}
+
+	msg = "From: spammer@example.com\r\nTo: bob@example.org\r\nSubject: Buy now\r\n\r\nHi\r\n"
+	err = send("spammer@example.com", "bob@example.org", msg)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.Message != "I don't want your mail" {
+		t.Errorf("SendMail() = %v, want a rejection", err)
+	}
+
+	msg = "From: carol@example.com\r\nTo: bob@example.org\r\nSubject: Lunch\r\nMessage-Id: <1@example.com>\r\n\r\nHi\r\n"
+	for i := 0; i < 2; i++ {
+		if err := send("carol@example.com", "bob@example.org", msg); err != nil {
+			t.Fatalf("SendMail() = %v", err)
+		}
+	}
+	if n := countMessages(t, bob); n != 2 {
+		t.Errorf("Invalid number of messages in the inbox: %v", n)
+	}
+	if len(out.deliveries) != 1 {
+		t.Fatalf("Invalid number of vacation responses: %v", len(out.deliveries))
+	}
+	d := out.deliveries[0]
+	if d.from != "" || d.to[0] != "carol@example.com" {
+		t.Errorf("Invalid vacation envelope: %q, %v", d.from, d.to)
+	}
+	for _, s := range []string{"Subject: Auto: Lunch\r\n", "In-Reply-To: <1@example.com>\r\n", "Auto-Submitted: auto-replied\r\n", "\r\n\r\nI'm away\r\n"} {
+		if !strings.Contains(d.data, s) {
+			t.Errorf("Vacation response doesn't contain %q:\n%v", s, d.data)
+		}
+	}
+
+	// Users without a script get all messages in their inbox
+	if code := func() int {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/bob@example.org", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}(); code != http.StatusNoContent {
+		t.Fatalf("DELETE = %v", code)
+	}
+	msg = "From: spammer@example.com\r\nTo: bob@example.org\r\nSubject: Buy now\r\n\r\nHi\r\n"
+	if err := send("spammer@example.com", "bob@example.org", msg); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if n := countMessages(t, bob); n != 3 {
+		t.Errorf("Invalid number of messages in the inbox: %v", n)
+	}
+}
+
+func TestFilter_redirectFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-sieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &Store{Dir: dir}
+	if err := st.Put("bob@example.org", `redirect "bob@example.net";`); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &maildir.Envelope{From: "alice@example.com", To: "bob@example.org"}
+	msg := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: Hi\r\n\r\nHi\r\n")
+	for _, f := range []*Filter{
+		{Scripts: st},
+		{Scripts: st, Dial: func() (*smtp.Client, error) {
+			return nil, errors.New("outbox down")
+		}},
+	} {
+		deliveries, err := f.Filter(env, msg)
+		if err != nil {
+			t.Fatalf("Filter() = %v", err)
+		}
+		if len(deliveries) != 1 || deliveries[0].Folder != "" {
+			t.Errorf("Filter() = %+v, want the message to be kept in the inbox", deliveries)
+		}
+	}
+}
+
+func TestFilter_vacationFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-sieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := &outbox{}
+	obs := smtp.NewServer(out)
+	obs.Domain = "outbox"
+	outAddr := serve(t, obs)
+	defer obs.Close()
+
+	st := &Store{Dir: dir}
+	f := &Filter{
+		Scripts: st,
+		Dial: func() (*smtp.Client, error) {
+			return smtp.Dial(outAddr)
+		},
+	}
+
+	env := &maildir.Envelope{From: "alice@example.com", To: "bob@example.org"}
+	msg := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: Hi\r\n\r\nHi\r\n")
+	for _, from := range []string{"\"Bob\r\nBcc: eve@example.net\" <bob@example.org>", "Bob <bob@example.org>"} {
+		script := "require \"vacation\";\nvacation :from \"" + strings.Replace(from, `"`, `\"`, -1) + "\" \"Caf\u00e9 ferm\u00e9\";\n"
+		if err := st.Put("bob@example.org", script); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Filter(env, msg); err != nil {
+			t.Fatalf("Filter() = %v", err)
+		}
+	}
+
+	// The response with an invalid From address isn't sent
+	if len(out.deliveries) != 1 {
+		t.Fatalf("Invalid number of vacation responses: %v", len(out.deliveries))
+	}
+	data := out.deliveries[0].data
+	for _, s := range []string{"From: \"Bob\" <bob@example.org>\r\n", "Content-Transfer-Encoding: quoted-printable\r\n", "Caf=C3=A9 ferm=C3=A9\r\n"} {
+		if !strings.Contains(data, s) {
+			t.Errorf("Vacation response doesn't contain %q:\n%v", s, data)
+		}
+	}
+	if strings.Contains(data, "eve@example.net") {
+		t.Errorf("Vacation response contains an injected header field:\n%v", data)
+	}
+}
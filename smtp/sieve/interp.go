@@ -0,0 +1,562 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum number of redirect actions in a script.
+const maxRedirects = 10
+
+// Envelope is the envelope of a message being filtered.
+type Envelope struct {
+	From string
+	To   string
+}
+
+// FileInto is a request to store the message in a folder.
+type FileInto struct {
+	Mailbox string
+	Flags   []string
+}
+
+// Vacation is a request to send a vacation response, see RFC 5230.
+type Vacation struct {
+	// Minimum number of days between two responses to the same sender.
+	Days int
+	// Subject of the response. If empty, the subject of the message
+	// prefixed with "Auto:" is used.
+	Subject string
+	// From field of the response. If empty, the recipient is used.
+	From string
+	// Additional addresses of the recipient.
+	Addresses []string
+	// The reason is a MIME entity, including its header.
+	MIME bool
+	// Identifies the response when computing whether it has been sent
+	// recently. If empty, the response itself is used.
+	Handle string
+	// Body of the response.
+	Reason string
+}
+
+// Result is the outcome of a script.
+type Result struct {
+	// Store the message in the inbox. Set by keep, or if no action cancels
+	// the implicit keep.
+	Keep bool
+	// Flags of the message stored in the inbox.
+	KeepFlags []string
+	FileInto  []FileInto
+	Redirect  []string
+	// Reject the message with RejectReason.
+	Reject       bool
+	RejectReason string
+	Vacation     *Vacation
+}
+
+// Run executes a script for a message. The header fields are used by tests
+// such as header and address, size is the size of the message in bytes.
+//
+// If Run returns an error, the message should be kept in the inbox, as
+// required by RFC 5228.
+func (s *Script) Run(env *Envelope, header textproto.MIMEHeader, size int64) (*Result, error) {
+	r := &runtime{
+		script:       s,
+		env:          env,
+		header:       header,
+		size:         size,
+		vars:         make(map[string]string),
+		implicitKeep: true,
+		res:          &Result{},
+	}
+	if err := r.exec(s.commands); err != nil {
+		return nil, err
+	}
+
+	res := r.res
+	if r.implicitKeep && !res.Keep {
+		res.Keep = true
+		res.KeepFlags = splitFlags(r.flags)
+	}
+	if res.Reject && (res.Keep || len(res.FileInto) > 0 || len(res.Redirect) > 0 || res.Vacation != nil) {
+		return nil, errors.New("sieve: reject can't be combined with keep, fileinto, redirect or vacation")
+	}
+	return res, nil
+}
+
+type runtime struct {
+	script *Script
+	env    *Envelope
+	header textproto.MIMEHeader
+	size   int64
+
+	vars      map[string]string
+	matchVars []string
+	// Internal variable of the imap4flags extension
+	flags string
+
+	res          *Result
+	implicitKeep bool
+	stopped      bool
+}
+
+func (r *runtime) errorf(cmd *command, format string, v ...interface{}) error {
+	return fmt.Errorf("sieve: line %v: %v", cmd.line, fmt.Sprintf(format, v...))
+}
+
+func (r *runtime) exec(cmds []*command) error {
+	// Whether a branch of the current if/elsif/else chain has been taken
+	taken := false
+	for _, cmd := range cmds {
+		if r.stopped {
+			return nil
+		}
+
+		args := cmd.args
+		switch cmd.name {
+		case "require":
+			// Handled by the parser
+		case "if", "elsif", "else":
+			if cmd.name == "if" {
+				taken = false
+			}
+			if taken {
+				continue
+			}
+			if cmd.name != "else" && !r.test(cmd.tests[0]) {
+				continue
+			}
+			taken = true
+			if err := r.exec(cmd.block); err != nil {
+				return err
+			}
+		case "stop":
+			r.stopped = true
+		case "keep":
+			r.res.Keep = true
+			r.res.KeepFlags = r.actionFlags(args)
+		case "discard":
+			r.implicitKeep = false
+		case "redirect":
+			if len(r.res.Redirect) >= maxRedirects {
+				return r.errorf(cmd, "too many redirects")
+			}
+			addr := r.expand(args.pos[0].str())
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return r.errorf(cmd, "invalid redirect address %q", addr)
+			}
+			r.res.Redirect = append(r.res.Redirect, addr)
+			r.implicitKeep = false
+		case "fileinto":
+			r.res.FileInto = append(r.res.FileInto, FileInto{
+				Mailbox: r.expand(args.pos[0].str()),
+				Flags:   r.actionFlags(args),
+			})
+			r.implicitKeep = false
+		case "reject":
+			r.res.Reject = true
+			r.res.RejectReason = r.expand(args.pos[0].str())
+			r.implicitKeep = false
+		case "vacation":
+			if r.res.Vacation != nil {
+				return r.errorf(cmd, "vacation can only be used once")
+			}
+			days := 7
+			if arg, ok := args.tags["days"]; ok {
+				days = int(arg.num)
+			}
+			r.res.Vacation = &Vacation{
+				Days:      days,
+				Subject:   r.expand(args.tagString("subject", "")),
+				From:      r.expand(args.tagString("from", "")),
+				Addresses: r.expandList(args.tags["addresses"]),
+				MIME:      args.has("mime"),
+				Handle:    r.expand(args.tagString("handle", "")),
+				Reason:    r.expand(args.pos[0].str()),
+			}
+		case "setflag", "addflag", "removeflag":
+			r.updateFlags(cmd.name, args.pos[0], r.expandList(args.pos[1]))
+		case "set":
+			r.vars[strings.ToLower(args.pos[0].str())] = applyModifiers(args, r.expand(args.pos[1].str()))
+		default:
+			return r.errorf(cmd, "unknown command %q", cmd.name)
+		}
+	}
+	return nil
+}
+
+// actionFlags returns the flags of a keep or fileinto action.
+func (r *runtime) actionFlags(args *arguments) []string {
+	if arg, ok := args.tags["flags"]; ok {
+		return splitFlags(strings.Join(r.expandList(arg), " "))
+	}
+	return splitFlags(r.flags)
+}
+
+func (r *runtime) getFlags(name *argument) string {
+	if name == nil {
+		return r.flags
+	}
+	return r.vars[strings.ToLower(name.str())]
+}
+
+func (r *runtime) updateFlags(op string, name *argument, list []string) {
+	cur := splitFlags(r.getFlags(name))
+	l := splitFlags(strings.Join(list, " "))
+
+	var out []string
+	switch op {
+	case "setflag":
+		out = l
+	case "addflag":
+		out = splitFlags(strings.Join(append(cur, l...), " "))
+	case "removeflag":
+		for _, f := range cur {
+			if !containsFold(l, f) {
+				out = append(out, f)
+			}
+		}
+	}
+
+	v := strings.Join(out, " ")
+	if name == nil {
+		r.flags = v
+	} else {
+		r.vars[strings.ToLower(name.str())] = v
+	}
+}
+
+// splitFlags splits a space-separated list of flags and removes duplicates.
+func splitFlags(s string) []string {
+	var l []string
+	for _, f := range strings.Fields(s) {
+		if !containsFold(l, f) {
+			l = append(l, f)
+		}
+	}
+	return l
+}
+
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyModifiers(args *arguments, v string) string {
+	switch {
+	case args.has("lower"):
+		v = strings.ToLower(v)
+	case args.has("upper"):
+		v = strings.ToUpper(v)
+	}
+	if v != "" {
+		_, n := utf8.DecodeRuneInString(v)
+		switch {
+		case args.has("lowerfirst"):
+			v = strings.ToLower(v[:n]) + v[n:]
+		case args.has("upperfirst"):
+			v = strings.ToUpper(v[:n]) + v[n:]
+		}
+	}
+	if args.has("quotewildcard") {
+		v = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(v)
+	}
+	if args.has("length") {
+		v = strconv.Itoa(utf8.RuneCountInString(v))
+	}
+	return v
+}
+
+// expand replaces variable references such as "${name}" or "${1}" in s, if
+// the variables extension is enabled.
+func (r *runtime) expand(s string) string {
+	if !r.script.extensions["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i+2:], '}')
+		if j < 0 {
+			break
+		}
+		name := s[i+2 : i+2+j]
+		sb.WriteString(s[:i])
+		if v, ok := r.variable(name); ok {
+			sb.WriteString(v)
+		} else {
+			// Not a variable reference, left as is
+			sb.WriteString(s[i : i+3+j])
+		}
+		s = s[i+3+j:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+func (r *runtime) variable(name string) (string, bool) {
+	if n, err := strconv.Atoi(name); err == nil && name[0] >= '0' && name[0] <= '9' {
+		if n < len(r.matchVars) {
+			return r.matchVars[n], true
+		}
+		return "", true
+	}
+	if isVariableName(name) {
+		return r.vars[strings.ToLower(name)], true
+	}
+	return "", false
+}
+
+func (r *runtime) expandList(arg *argument) []string {
+	if arg == nil {
+		return nil
+	}
+	l := make([]string, len(arg.strs))
+	for i, s := range arg.strs {
+		l[i] = r.expand(s)
+	}
+	return l
+}
+
+func (r *runtime) test(t *test) bool {
+	args := t.args
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !r.test(t.tests[0])
+	case "allof":
+		for _, sub := range t.tests {
+			if !r.test(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.tests {
+			if r.test(sub) {
+				return true
+			}
+		}
+		return false
+	case "size":
+		if arg, ok := args.tags["over"]; ok {
+			return r.size > arg.num
+		}
+		return r.size < args.tags["under"].num
+	case "exists":
+		for _, name := range r.expandList(args.pos[0]) {
+			if len(r.header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+				return false
+			}
+		}
+		return true
+	case "header":
+		var values []string
+		for _, name := range r.expandList(args.pos[0]) {
+			values = append(values, r.headerValues(name)...)
+		}
+		return r.match(args, values, r.expandList(args.pos[1]))
+	case "address":
+		var values []string
+		for _, name := range r.expandList(args.pos[0]) {
+			for _, v := range r.headerValues(name) {
+				for _, addr := range parseAddresses(v) {
+					values = append(values, addressPart(args, addr))
+				}
+			}
+		}
+		return r.match(args, values, r.expandList(args.pos[1]))
+	case "envelope":
+		var values []string
+		for _, part := range args.pos[0].strs {
+			addr := r.env.From
+			if strings.EqualFold(part, "to") {
+				addr = r.env.To
+			}
+			values = append(values, addressPart(args, addr))
+		}
+		return r.match(args, values, r.expandList(args.pos[1]))
+	case "hasflag":
+		var flags []string
+		if arg := args.pos[0]; arg != nil {
+			for _, name := range arg.strs {
+				flags = append(flags, splitFlags(r.vars[strings.ToLower(name)])...)
+			}
+		} else {
+			flags = splitFlags(r.flags)
+		}
+		return r.match(args, flags, r.expandList(args.pos[1]))
+	case "string":
+		return r.match(args, r.expandList(args.pos[0]), r.expandList(args.pos[1]))
+	default:
+		return false
+	}
+}
+
+// headerValues returns the decoded values of a header field.
+func (r *runtime) headerValues(name string) []string {
+	raw := r.header[textproto.CanonicalMIMEHeaderKey(name)]
+	values := make([]string, len(raw))
+	dec := new(mime.WordDecoder)
+	for i, v := range raw {
+		if s, err := dec.DecodeHeader(v); err == nil {
+			v = s
+		}
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// parseAddresses returns the addresses of a header field value. Values
+// which can't be parsed are returned as is.
+func parseAddresses(v string) []string {
+	l, err := mail.ParseAddressList(v)
+	if err != nil {
+		return []string{v}
+	}
+	addrs := make([]string, len(l))
+	for i, addr := range l {
+		addrs[i] = addr.Address
+	}
+	return addrs
+}
+
+func addressPart(args *arguments, addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	switch args.oneOf(addrPartTags, "all") {
+	case "localpart":
+		if i < 0 {
+			return addr
+		}
+		return addr[:i]
+	case "domain":
+		if i < 0 {
+			return ""
+		}
+		return addr[i+1:]
+	default:
+		return addr
+	}
+}
+
+// match checks whether any value matches any key, with the comparator and
+// match type of a test.
+func (r *runtime) match(args *arguments, values, keys []string) bool {
+	fold := args.tagString("comparator", "i;ascii-casemap") == "i;ascii-casemap"
+	matchType := args.oneOf(matchTags, "is")
+
+	for _, v := range values {
+		for _, key := range keys {
+			switch matchType {
+			case "is":
+				if v == key || fold && asciiLower(v) == asciiLower(key) {
+					return true
+				}
+			case "contains":
+				if strings.Contains(v, key) || fold && strings.Contains(asciiLower(v), asciiLower(key)) {
+					return true
+				}
+			case "matches":
+				if captures, ok := globMatch(key, v, fold); ok {
+					r.matchVars = append([]string{v}, captures...)
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, ch := range b {
+		if ch >= 'A' && ch <= 'Z' {
+			b[i] = ch + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// globMatch matches s against a pattern containing "*" and "?" wildcards.
+// Wildcards can be escaped with a backslash. It returns the strings matched
+// by each wildcard. Wildcards match as few characters as possible.
+//
+// Only the last "*" is backtracked, so matching takes at most
+// len(pattern)*len(s) steps: a "*" is never extended if the pattern up to
+// the next "*" matches, since the next "*" can absorb the difference.
+func globMatch(pattern, s string, fold bool) ([]string, bool) {
+	var captures []string
+	// The last "*": its position in the pattern, the start and end of the
+	// string it matches, and its index in captures
+	star, starStart, starEnd, starCapture := -1, 0, 0, 0
+	p, i := 0, 0
+	for p < len(pattern) || i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starStart, starEnd, starCapture = p, i, i, len(captures)
+				captures = append(captures, "")
+				p++
+				continue
+			case '?':
+				if i < len(s) {
+					_, n := utf8.DecodeRuneInString(s[i:])
+					captures = append(captures, s[i:i+n])
+					i += n
+					p++
+					continue
+				}
+			default:
+				ch, next := pattern[p], p+1
+				if ch == '\\' && next < len(pattern) {
+					ch, next = pattern[next], next+1
+				}
+				if i < len(s) && equalByte(s[i], ch, fold) {
+					i++
+					p = next
+					continue
+				}
+			}
+		}
+
+		// Mismatch, let the last "*" match one more character
+		if star < 0 || starEnd == len(s) {
+			return nil, false
+		}
+		_, n := utf8.DecodeRuneInString(s[starEnd:])
+		starEnd += n
+		captures = append(captures[:starCapture], s[starStart:starEnd])
+		p, i = star+1, starEnd
+	}
+	return captures, true
+}
+
+func equalByte(a, b byte, fold bool) bool {
+	if fold {
+		if a >= 'A' && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+	}
+	return a == b
+}
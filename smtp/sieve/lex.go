@@ -0,0 +1,240 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	line int
+	// Identifier or tag name, punctuation character, or string value
+	value string
+	num   int64
+}
+
+func (tok *token) String() string {
+	switch tok.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + tok.value
+	case tokenNumber:
+		return strconv.FormatInt(tok.num, 10)
+	case tokenString:
+		return strconv.Quote(tok.value)
+	default:
+		return tok.value
+	}
+}
+
+// SyntaxError is returned when a script is malformed.
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("sieve: line %v: %v", err.Line, err.Message)
+}
+
+type lexer struct {
+	s    string
+	line int
+}
+
+func (l *lexer) errorf(format string, v ...interface{}) error {
+	return &SyntaxError{Line: l.line, Message: fmt.Sprintf(format, v...)}
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || (ch >= '0' && ch <= '9')
+}
+
+// skipSpace skips white space and comments.
+func (l *lexer) skipSpace() error {
+	for len(l.s) > 0 {
+		switch {
+		case l.s[0] == '\n':
+			l.line++
+			l.s = l.s[1:]
+		case l.s[0] == ' ' || l.s[0] == '\t' || l.s[0] == '\r':
+			l.s = l.s[1:]
+		case l.s[0] == '#':
+			i := strings.IndexByte(l.s, '\n')
+			if i < 0 {
+				i = len(l.s)
+			}
+			l.s = l.s[i:]
+		case strings.HasPrefix(l.s, "/*"):
+			i := strings.Index(l.s[2:], "*/")
+			if i < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.s[:i+2], "\n")
+			l.s = l.s[i+4:]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (*token, error) {
+	if err := l.skipSpace(); err != nil {
+		return nil, err
+	}
+	tok := &token{line: l.line}
+	if len(l.s) == 0 {
+		return tok, nil
+	}
+
+	ch := l.s[0]
+	switch {
+	case strings.IndexByte("[](){},;", ch) >= 0:
+		tok.kind = tokenPunct
+		tok.value = l.s[:1]
+		l.s = l.s[1:]
+	case ch == ':':
+		i := 1
+		for i < len(l.s) && isIdentChar(l.s[i]) {
+			i++
+		}
+		if i == 1 || !isIdentStart(l.s[1]) {
+			return nil, l.errorf("invalid tag")
+		}
+		tok.kind = tokenTag
+		tok.value = strings.ToLower(l.s[1:i])
+		l.s = l.s[i:]
+	case ch >= '0' && ch <= '9':
+		return l.number(tok)
+	case ch == '"':
+		return l.quoted(tok)
+	case isIdentStart(ch):
+		i := 1
+		for i < len(l.s) && isIdentChar(l.s[i]) {
+			i++
+		}
+		ident := strings.ToLower(l.s[:i])
+		if ident == "text" && strings.HasPrefix(l.s[i:], ":") {
+			l.s = l.s[i+1:]
+			return l.multiline(tok)
+		}
+		tok.kind = tokenIdentifier
+		tok.value = ident
+		l.s = l.s[i:]
+	default:
+		return nil, l.errorf("unexpected character %q", ch)
+	}
+	return tok, nil
+}
+
+func (l *lexer) number(tok *token) (*token, error) {
+	i := 0
+	for i < len(l.s) && l.s[i] >= '0' && l.s[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(l.s[:i], 10, 64)
+	if err != nil {
+		return nil, l.errorf("invalid number %q", l.s[:i])
+	}
+	if i < len(l.s) {
+		var mult int64 = 1
+		switch l.s[i] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			n *= mult
+			i++
+		}
+	}
+	tok.kind = tokenNumber
+	tok.num = n
+	l.s = l.s[i:]
+	return tok, nil
+}
+
+func (l *lexer) quoted(tok *token) (*token, error) {
+	var sb strings.Builder
+	i := 1
+	for {
+		if i >= len(l.s) {
+			return nil, l.errorf("unterminated string")
+		}
+		ch := l.s[i]
+		if ch == '"' {
+			break
+		}
+		if ch == '\\' && i+1 < len(l.s) {
+			i++
+			ch = l.s[i]
+		}
+		if ch == '\n' {
+			l.line++
+		}
+		sb.WriteByte(ch)
+		i++
+	}
+	tok.kind = tokenString
+	tok.value = sb.String()
+	l.s = l.s[i+1:]
+	return tok, nil
+}
+
+// multiline reads a multi-line string, after "text:".
+func (l *lexer) multiline(tok *token) (*token, error) {
+	// The rest of the line may only contain white space or a comment
+	i := strings.IndexByte(l.s, '\n')
+	if i < 0 {
+		return nil, l.errorf("unterminated multi-line string")
+	}
+	rest := strings.TrimSpace(l.s[:i])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, l.errorf("unexpected characters after text:")
+	}
+	l.s = l.s[i+1:]
+	l.line++
+
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(l.s, '\n')
+		if i < 0 {
+			return nil, l.errorf("unterminated multi-line string")
+		}
+		line := strings.TrimSuffix(l.s[:i], "\r")
+		l.s = l.s[i+1:]
+		l.line++
+		if line == "." {
+			break
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		sb.WriteString(line)
+		sb.WriteString("\r\n")
+	}
+	tok.kind = tokenString
+	tok.value = sb.String()
+	return tok, nil
+}
@@ -0,0 +1,611 @@
+package sieve
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Extensions lists the supported extensions.
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+	"variables",
+}
+
+type argType int
+
+const (
+	typeFlag argType = iota
+	typeNumber
+	typeString
+	typeStringList
+)
+
+func (t argType) String() string {
+	switch t {
+	case typeFlag:
+		return "no value"
+	case typeNumber:
+		return "a number"
+	case typeString:
+		return "a string"
+	default:
+		return "a string list"
+	}
+}
+
+// spec describes the arguments of a command or test.
+type spec struct {
+	// Required extension, if any
+	ext  string
+	tags map[string]argType
+	// Groups of mutually exclusive tags
+	exclusive [][]string
+	pos       []argType
+	// Number of leading positional arguments which can be omitted
+	optPos int
+	// Number of tests: 0, 1, or -1 for a list
+	tests int
+	block bool
+}
+
+var (
+	comparatorTags = map[string]argType{"comparator": typeString}
+	matchTags      = []string{"is", "contains", "matches"}
+	addrPartTags   = []string{"all", "localpart", "domain"}
+)
+
+func tagSet(groups ...interface{}) map[string]argType {
+	m := make(map[string]argType)
+	for _, g := range groups {
+		switch g := g.(type) {
+		case map[string]argType:
+			for k, v := range g {
+				m[k] = v
+			}
+		case []string:
+			for _, k := range g {
+				m[k] = typeFlag
+			}
+		}
+	}
+	return m
+}
+
+var commandSpecs = map[string]*spec{
+	"require":  {pos: []argType{typeStringList}},
+	"if":       {tests: 1, block: true},
+	"elsif":    {tests: 1, block: true},
+	"else":     {block: true},
+	"stop":     {},
+	"keep":     {tags: map[string]argType{"flags": typeStringList}},
+	"discard":  {},
+	"redirect": {pos: []argType{typeString}},
+	"fileinto": {
+		ext:  "fileinto",
+		tags: map[string]argType{"flags": typeStringList},
+		pos:  []argType{typeString},
+	},
+	"reject": {ext: "reject", pos: []argType{typeString}},
+	"vacation": {
+		ext: "vacation",
+		tags: map[string]argType{
+			"days":      typeNumber,
+			"subject":   typeString,
+			"from":      typeString,
+			"addresses": typeStringList,
+			"mime":      typeFlag,
+			"handle":    typeString,
+		},
+		pos: []argType{typeString},
+	},
+	"setflag":    {ext: "imap4flags", pos: []argType{typeString, typeStringList}, optPos: 1},
+	"addflag":    {ext: "imap4flags", pos: []argType{typeString, typeStringList}, optPos: 1},
+	"removeflag": {ext: "imap4flags", pos: []argType{typeString, typeStringList}, optPos: 1},
+	"set": {
+		ext:  "variables",
+		tags: tagSet([]string{"lower", "upper", "lowerfirst", "upperfirst", "quotewildcard", "length"}),
+		exclusive: [][]string{
+			{"lower", "upper"},
+			{"lowerfirst", "upperfirst"},
+		},
+		pos: []argType{typeString, typeString},
+	},
+}
+
+var testSpecs = map[string]*spec{
+	"address": {
+		tags:      tagSet(comparatorTags, matchTags, addrPartTags),
+		exclusive: [][]string{matchTags, addrPartTags},
+		pos:       []argType{typeStringList, typeStringList},
+	},
+	"header": {
+		tags:      tagSet(comparatorTags, matchTags),
+		exclusive: [][]string{matchTags},
+		pos:       []argType{typeStringList, typeStringList},
+	},
+	"envelope": {
+		ext:       "envelope",
+		tags:      tagSet(comparatorTags, matchTags, addrPartTags),
+		exclusive: [][]string{matchTags, addrPartTags},
+		pos:       []argType{typeStringList, typeStringList},
+	},
+	"exists": {pos: []argType{typeStringList}},
+	"size": {
+		tags:      map[string]argType{"over": typeNumber, "under": typeNumber},
+		exclusive: [][]string{{"over", "under"}},
+	},
+	"allof": {tests: -1},
+	"anyof": {tests: -1},
+	"not":   {tests: 1},
+	"true":  {},
+	"false": {},
+	"hasflag": {
+		ext:       "imap4flags",
+		tags:      tagSet(comparatorTags, matchTags),
+		exclusive: [][]string{matchTags},
+		pos:       []argType{typeStringList, typeStringList},
+		optPos:    1,
+	},
+	"string": {
+		ext:       "variables",
+		tags:      tagSet(comparatorTags, matchTags),
+		exclusive: [][]string{matchTags},
+		pos:       []argType{typeStringList, typeStringList},
+	},
+}
+
+type argument struct {
+	typ  argType
+	line int
+	num  int64
+	strs []string
+}
+
+func (arg *argument) str() string {
+	return arg.strs[0]
+}
+
+// arguments are the validated arguments of a command or test.
+type arguments struct {
+	tags map[string]*argument
+	pos  []*argument
+}
+
+func (args *arguments) has(tag string) bool {
+	_, ok := args.tags[tag]
+	return ok
+}
+
+func (args *arguments) tagString(tag, def string) string {
+	if arg, ok := args.tags[tag]; ok {
+		return arg.str()
+	}
+	return def
+}
+
+// oneOf returns the tag set among tags, or def.
+func (args *arguments) oneOf(tags []string, def string) string {
+	for _, tag := range tags {
+		if args.has(tag) {
+			return tag
+		}
+	}
+	return def
+}
+
+type test struct {
+	name  string
+	line  int
+	args  *arguments
+	tests []*test
+}
+
+type command struct {
+	name  string
+	line  int
+	args  *arguments
+	tests []*test
+	block []*command
+}
+
+// Script is a parsed Sieve script.
+type Script struct {
+	extensions map[string]bool
+	commands   []*command
+}
+
+// Parse parses and validates a script.
+func Parse(r io.Reader) (*Script, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{lexer: lexer{s: string(b), line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	s := &Script{extensions: make(map[string]bool)}
+	p.script = s
+	if s.commands, err = p.commands(true); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.errorf("unexpected %v", p.tok)
+	}
+	return s, nil
+}
+
+type parser struct {
+	lexer
+	tok    *token
+	script *Script
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, v ...interface{}) error {
+	return &SyntaxError{Line: p.tok.line, Message: fmt.Sprintf(format, v...)}
+}
+
+func (p *parser) isPunct(ch string) bool {
+	return p.tok.kind == tokenPunct && p.tok.value == ch
+}
+
+func (p *parser) expectPunct(ch string) error {
+	if !p.isPunct(ch) {
+		return p.errorf("expected %q, got %v", ch, p.tok)
+	}
+	return p.advance()
+}
+
+// commands parses commands until the end of the script or of a block.
+func (p *parser) commands(topLevel bool) ([]*command, error) {
+	var cmds []*command
+	requireAllowed := topLevel
+	for p.tok.kind == tokenIdentifier {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+
+		switch cmd.name {
+		case "require":
+			if !requireAllowed {
+				return nil, &SyntaxError{Line: cmd.line, Message: "require must be at the beginning of the script"}
+			}
+			for _, ext := range cmd.args.pos[0].strs {
+				if !isSupportedExtension(ext) {
+					return nil, &SyntaxError{Line: cmd.line, Message: fmt.Sprintf("unsupported extension %q", ext)}
+				}
+				p.script.extensions[ext] = true
+			}
+		case "elsif", "else":
+			if len(cmds) == 0 || (cmds[len(cmds)-1].name != "if" && cmds[len(cmds)-1].name != "elsif") {
+				return nil, &SyntaxError{Line: cmd.line, Message: cmd.name + " without if"}
+			}
+		}
+		if cmd.name != "require" {
+			requireAllowed = false
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func isSupportedExtension(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) command() (*command, error) {
+	cmd := &command{name: p.tok.value, line: p.tok.line}
+	sp, ok := commandSpecs[cmd.name]
+	if !ok {
+		return nil, p.errorf("unknown command %q", cmd.name)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if cmd.args, cmd.tests, err = p.arguments(cmd.name, sp); err != nil {
+		return nil, err
+	}
+
+	if sp.block {
+		if err := p.expectPunct("{"); err != nil {
+			return nil, err
+		}
+		if cmd.block, err = p.commands(false); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("}"); err != nil {
+			return nil, err
+		}
+	} else if err := p.expectPunct(";"); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkCommand(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (p *parser) test() (*test, error) {
+	if p.tok.kind != tokenIdentifier {
+		return nil, p.errorf("expected a test, got %v", p.tok)
+	}
+	t := &test{name: p.tok.value, line: p.tok.line}
+	sp, ok := testSpecs[t.name]
+	if !ok {
+		return nil, p.errorf("unknown test %q", t.name)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.args, t.tests, err = p.arguments(t.name, sp); err != nil {
+		return nil, err
+	}
+	if err := p.checkTest(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// arguments parses and validates the arguments and tests of a command or
+// test.
+func (p *parser) arguments(name string, sp *spec) (*arguments, []*test, error) {
+	line := p.tok.line
+	if sp.ext != "" && !p.script.extensions[sp.ext] {
+		return nil, nil, &SyntaxError{Line: line, Message: fmt.Sprintf("%v requires the %q extension", name, sp.ext)}
+	}
+
+	args := &arguments{tags: make(map[string]*argument)}
+	var pos []*argument
+	for {
+		switch {
+		case p.tok.kind == tokenTag:
+			tag := p.tok.value
+			if len(pos) > 0 {
+				return nil, nil, p.errorf("tag :%v after positional arguments", tag)
+			}
+			typ, ok := sp.tags[tag]
+			if !ok {
+				return nil, nil, p.errorf("unknown tag :%v for %v", tag, name)
+			}
+			if tag == "flags" && !p.script.extensions["imap4flags"] {
+				return nil, nil, p.errorf(":flags requires the \"imap4flags\" extension")
+			}
+			if args.has(tag) {
+				return nil, nil, p.errorf("duplicate tag :%v", tag)
+			}
+			if err := p.advance(); err != nil {
+				return nil, nil, err
+			}
+			arg := &argument{typ: typeFlag, line: p.tok.line}
+			if typ != typeFlag {
+				var err error
+				if arg, err = p.value(); err != nil {
+					return nil, nil, err
+				}
+				if err := checkType(arg, typ); err != nil {
+					return nil, nil, &SyntaxError{Line: arg.line, Message: fmt.Sprintf(":%v expects %v", tag, typ)}
+				}
+			}
+			args.tags[tag] = arg
+			continue
+		case p.tok.kind == tokenNumber, p.tok.kind == tokenString, p.isPunct("["):
+			arg, err := p.value()
+			if err != nil {
+				return nil, nil, err
+			}
+			pos = append(pos, arg)
+			continue
+		}
+		break
+	}
+
+	for _, group := range sp.exclusive {
+		n := 0
+		for _, tag := range group {
+			if args.has(tag) {
+				n++
+			}
+		}
+		if n > 1 {
+			return nil, nil, &SyntaxError{Line: line, Message: fmt.Sprintf("%v: conflicting tags :%v", name, strings.Join(group, ", :"))}
+		}
+	}
+
+	want := sp.pos
+	if len(pos) < len(want) && len(want)-len(pos) <= sp.optPos {
+		want = want[len(want)-len(pos):]
+		// Omitted optional arguments are represented by nil
+		for i := 0; i < len(sp.pos)-len(want); i++ {
+			args.pos = append(args.pos, nil)
+		}
+	}
+	if len(pos) != len(want) {
+		return nil, nil, &SyntaxError{Line: line, Message: fmt.Sprintf("%v expects %v positional arguments, got %v", name, len(sp.pos), len(pos))}
+	}
+	for i, arg := range pos {
+		if err := checkType(arg, want[i]); err != nil {
+			return nil, nil, &SyntaxError{Line: arg.line, Message: fmt.Sprintf("%v: argument %v must be %v", name, i+1, want[i])}
+		}
+	}
+	args.pos = append(args.pos, pos...)
+
+	var tests []*test
+	switch {
+	case sp.tests == 1:
+		t, err := p.test()
+		if err != nil {
+			return nil, nil, err
+		}
+		tests = []*test{t}
+	case sp.tests < 0:
+		if err := p.expectPunct("("); err != nil {
+			return nil, nil, err
+		}
+		for {
+			t, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			tests = append(tests, t)
+			if !p.isPunct(",") {
+				break
+			}
+			if err := p.advance(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return args, tests, nil
+}
+
+// value parses a number, a string or a string list.
+func (p *parser) value() (*argument, error) {
+	arg := &argument{line: p.tok.line}
+	switch {
+	case p.tok.kind == tokenNumber:
+		arg.typ = typeNumber
+		arg.num = p.tok.num
+	case p.tok.kind == tokenString:
+		arg.typ = typeString
+		arg.strs = []string{p.tok.value}
+	case p.isPunct("["):
+		arg.typ = typeStringList
+		for {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokenString {
+				return nil, p.errorf("expected a string, got %v", p.tok)
+			}
+			arg.strs = append(arg.strs, p.tok.value)
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if !p.isPunct(",") {
+				break
+			}
+		}
+		if !p.isPunct("]") {
+			return nil, p.errorf("expected \"]\", got %v", p.tok)
+		}
+	default:
+		return nil, p.errorf("expected a value, got %v", p.tok)
+	}
+	return arg, p.advance()
+}
+
+func checkType(arg *argument, typ argType) error {
+	switch {
+	case arg.typ == typ:
+		return nil
+	case arg.typ == typeString && typ == typeStringList:
+		// A string is a string list with a single element
+		arg.typ = typeStringList
+		return nil
+	default:
+		return fmt.Errorf("expected %v", typ)
+	}
+}
+
+func (p *parser) checkComparator(args *arguments) error {
+	if arg, ok := args.tags["comparator"]; ok {
+		switch c := arg.str(); c {
+		case "i;ascii-casemap", "i;octet":
+		default:
+			return &SyntaxError{Line: arg.line, Message: fmt.Sprintf("unsupported comparator %q", c)}
+		}
+	}
+	return nil
+}
+
+func (p *parser) checkCommand(cmd *command) error {
+	switch cmd.name {
+	case "set":
+		if name := cmd.args.pos[0].str(); !isVariableName(name) {
+			return &SyntaxError{Line: cmd.line, Message: fmt.Sprintf("invalid variable name %q", name)}
+		}
+	case "setflag", "addflag", "removeflag":
+		if arg := cmd.args.pos[0]; arg != nil && !isVariableName(arg.str()) {
+			return &SyntaxError{Line: cmd.line, Message: fmt.Sprintf("invalid variable name %q", arg.str())}
+		}
+	case "vacation":
+		if arg, ok := cmd.args.tags["days"]; ok && arg.num < 1 {
+			return &SyntaxError{Line: cmd.line, Message: ":days must be at least 1"}
+		}
+	}
+	return nil
+}
+
+func (p *parser) checkTest(t *test) error {
+	if err := p.checkComparator(t.args); err != nil {
+		return err
+	}
+	switch t.name {
+	case "size":
+		if !t.args.has("over") && !t.args.has("under") {
+			return &SyntaxError{Line: t.line, Message: "size requires :over or :under"}
+		}
+	case "envelope":
+		for _, part := range t.args.pos[0].strs {
+			switch strings.ToLower(part) {
+			case "from", "to":
+			default:
+				return &SyntaxError{Line: t.line, Message: fmt.Sprintf("unsupported envelope part %q", part)}
+			}
+		}
+	case "hasflag":
+		if arg := t.args.pos[0]; arg != nil {
+			for _, name := range arg.strs {
+				if !isVariableName(name) {
+					return &SyntaxError{Line: t.line, Message: fmt.Sprintf("invalid variable name %q", name)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isVariableName(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isIdentChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
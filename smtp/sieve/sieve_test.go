@@ -0,0 +1,245 @@
+package sieve
+
+import (
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse_invalid(t *testing.T) {
+	for _, src := range []string{
+		`keep`,
+		`fileinto "Junk";`,
+		`require "fileinto"; fileinto;`,
+		`require "foobar";`,
+		`keep; require "fileinto";`,
+		`if true { keep; } require "fileinto";`,
+		`elsif true { keep; }`,
+		`if header :is :contains "Subject" "x" { keep; }`,
+		`if header :comparator "i;unknown" "Subject" "x" { keep; }`,
+		`if size 100 { keep; }`,
+		`if envelope "from" "x" { keep; }`,
+		`require "envelope"; if envelope "cc" "x" { keep; }`,
+		`if header "Subject" { keep; }`,
+		`if anyof(true, ) { keep; }`,
+		`redirect "a@example.org" :copy;`,
+		`require "variables"; set "1a" "b";`,
+		`require "vacation"; vacation :days 0 "Away";`,
+		`keep :flags "\\Seen";`,
+		`/* unterminated`,
+		`"unterminated`,
+		"require \"vacation\"; vacation text:\r\nHello\r\n",
+		`if true { keep;`,
+		`unknown;`,
+	} {
+		if _, err := Parse(strings.NewReader(src)); err == nil {
+			t.Errorf("Parse(%q) = nil, want an error", src)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Parse(%q) = %v, want a *SyntaxError", src, err)
+		}
+	}
+
+	_, err := Parse(strings.NewReader("keep;\n\n  discard\n"))
+	if err, ok := err.(*SyntaxError); !ok || err.Line != 4 {
+		t.Errorf("Parse() = %v, want an error on line 4", err)
+	}
+}
+
+var testHeader = textproto.MIMEHeader{
+	"From":    {`"Alice" <Alice@Example.org>`},
+	"To":      {"bob@example.com, carol@example.net"},
+	"Subject": {"=?utf-8?q?[Project]_Caf=C3=A9_meeting?="},
+	"X-Spam":  {"YES"},
+}
+
+var runTests = []struct {
+	name string
+	src  string
+	want Result
+}{
+	{
+		name: "empty",
+		src:  "",
+		want: Result{Keep: true},
+	},
+	{
+		name: "discard",
+		src:  `if header :contains "x-spam" "yes" { discard; stop; } keep;`,
+		want: Result{},
+	},
+	{
+		name: "octet",
+		src:  `if header :comparator "i;octet" :is "X-Spam" "yes" { discard; }`,
+		want: Result{Keep: true},
+	},
+	{
+		name: "fileinto",
+		src: `require ["fileinto"];
+			# Mailing list
+			if address :domain :is "from" "example.org" {
+				fileinto "Work";
+			} elsif true {
+				fileinto "Other";
+			} else {
+				fileinto "Never";
+			}
+			fileinto "Work";`,
+		want: Result{FileInto: []FileInto{{Mailbox: "Work"}, {Mailbox: "Work"}}},
+	},
+	{
+		name: "elsif",
+		src: `require "fileinto";
+			if false { fileinto "A"; } elsif anyof(false, not true) { fileinto "B"; } else { fileinto "C"; }`,
+		want: Result{FileInto: []FileInto{{Mailbox: "C"}}},
+	},
+	{
+		name: "envelope",
+		src: `require ["envelope", "fileinto"];
+			if allof(envelope :localpart :is "to" "bob", envelope :all :is "from" "") { fileinto "Bounces"; }`,
+		want: Result{FileInto: []FileInto{{Mailbox: "Bounces"}}},
+	},
+	{
+		name: "size",
+		src:  `if size :over 1K { discard; } if size :under 1k { redirect "archive@example.org"; }`,
+		want: Result{Redirect: []string{"archive@example.org"}},
+	},
+	{
+		name: "exists",
+		src:  `if exists ["From", "X-Spam"] { keep; } if exists "X-Nope" { discard; }`,
+		want: Result{Keep: true},
+	},
+	{
+		name: "reject",
+		src: `require "reject";
+			if address :matches "from" "*@example.org" { reject text:
+Go away.
+..
+.
+; }`,
+		want: Result{Reject: true, RejectReason: "Go away.\r\n.\r\n"},
+	},
+	{
+		name: "variables",
+		src: `require ["fileinto", "variables"];
+			if header :matches "Subject" "[*] *" {
+				set :lower "list" "${1}";
+				set :upperfirst "topic" "${2}";
+				set :length "len" "${2}";
+				fileinto "Lists/${list}/${len}";
+			}
+			if string :is "${topic}" "Café meeting" { keep; }`,
+		want: Result{Keep: true, FileInto: []FileInto{{Mailbox: "Lists/project/12"}}},
+	},
+	{
+		name: "quotewildcard",
+		src: `require ["variables"];
+			set :quotewildcard "pattern" "a*b";
+			if string :matches "axxb" "${pattern}" { discard; }
+			if string :matches "a*b" "${pattern}" { keep; }`,
+		want: Result{Keep: true},
+	},
+	{
+		name: "imap4flags",
+		src: `require ["imap4flags", "fileinto", "variables"];
+			setflag "\\Seen";
+			addflag ["\\Flagged \\seen", "Work"];
+			removeflag "work";
+			fileinto "Archive";
+			addflag "myflags" "$Label1";
+			if hasflag "\\flagged" { fileinto :flags "${myflags}" "Labels"; }
+			if hasflag "myflags" "$label1" { keep :flags ""; }`,
+		want: Result{
+			Keep: true,
+			FileInto: []FileInto{
+				{Mailbox: "Archive", Flags: []string{`\Seen`, `\Flagged`}},
+				{Mailbox: "Labels", Flags: []string{"$Label1"}},
+			},
+		},
+	},
+	{
+		name: "implicit-keep-flags",
+		src:  `require "imap4flags"; setflag "\\Seen";`,
+		want: Result{Keep: true, KeepFlags: []string{`\Seen`}},
+	},
+	{
+		name: "vacation",
+		src: `require ["vacation", "variables"];
+			set "name" "Bob";
+			vacation :days 3 :subject "Away" :addresses ["bob@example.org"] :handle "h" "${name} is away";`,
+		want: Result{
+			Keep: true,
+			Vacation: &Vacation{
+				Days:      3,
+				Subject:   "Away",
+				Addresses: []string{"bob@example.org"},
+				Handle:    "h",
+				Reason:    "Bob is away",
+			},
+		},
+	},
+}
+
+func TestScript_Run(t *testing.T) {
+	env := &Envelope{From: "", To: "bob@example.com"}
+	for _, tc := range runTests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Parse(strings.NewReader(tc.src))
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			res, err := s.Run(env, testHeader, 42)
+			if err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if !reflect.DeepEqual(res, &tc.want) {
+				t.Errorf("Run() = \n%+v\nbut want\n%+v", res, &tc.want)
+			}
+		})
+	}
+}
+
+func TestScript_Run_error(t *testing.T) {
+	for _, src := range []string{
+		`require "reject"; reject "No"; keep;`,
+		`redirect "not an address";`,
+		`require "vacation"; vacation "a"; vacation "b";`,
+	} {
+		s, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatalf("Parse(%q) = %v", src, err)
+		}
+		if _, err := s.Run(&Envelope{}, testHeader, 42); err == nil {
+			t.Errorf("Run(%q) = nil, want an error", src)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		fold       bool
+		captures   []string
+		ok         bool
+	}{
+		{"*", "", false, []string{""}, true},
+		{"a*c", "abbc", false, []string{"bb"}, true},
+		{"* *", "a b c", false, []string{"a", "b c"}, true},
+		{"?é*", "xéyz", false, []string{"x", "yz"}, true},
+		{"A?", "ab", true, []string{"b"}, true},
+		{"A?", "ab", false, nil, false},
+		{`a\*`, "a*", false, nil, true},
+		{`a\*`, "ab", false, nil, false},
+		{"a*b", "acbd", false, nil, false},
+		{"*.txt", "a.b.txt", false, []string{"a.b"}, true},
+		{"a*b*c", "axbybzc", false, []string{"x", "ybz"}, true},
+		{"*?", "é", false, []string{"", "é"}, true},
+		{"*a*a*a*a*a*b", strings.Repeat("a", 10000), false, nil, false},
+	}
+	for _, tc := range tests {
+		captures, ok := globMatch(tc.pattern, tc.s, tc.fold)
+		if ok != tc.ok || (ok && !reflect.DeepEqual(captures, tc.captures)) {
+			t.Errorf("globMatch(%q, %q) = %q, %v, want %q, %v", tc.pattern, tc.s, captures, ok, tc.captures, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package sieve
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum size of a script, in bytes.
+const maxScriptSize = 64 * 1024
+
+// ErrNoScript is returned when a user has no script.
+var ErrNoScript = errors.New("sieve: no script")
+
+var errInvalidUser = errors.New("sieve: invalid user name")
+
+var errScriptTooLarge = errors.New("sieve: script too large")
+
+// Store keeps the scripts of users in a directory, as <user>.sieve files.
+// Scripts are validated before being stored.
+//
+// HTTP API served by ServeHTTP:
+//
+//	GET    /<user>   Get the script of a user
+//	PUT    /<user>   Validate and set the script of a user
+//	DELETE /<user>   Remove the script of a user
+type Store struct {
+	Dir string
+}
+
+func (st *Store) path(user string) (string, error) {
+	user = strings.ToLower(user)
+	if user == "" || strings.HasPrefix(user, ".") || strings.ContainsAny(user, "/\\\x00") {
+		return "", errInvalidUser
+	}
+	return filepath.Join(st.Dir, user+".sieve"), nil
+}
+
+// Source returns the source of the script of a user.
+func (st *Store) Source(user string) (string, error) {
+	path, err := st.path(user)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", ErrNoScript
+	}
+	return string(b), err
+}
+
+// Script returns the parsed script of a user.
+func (st *Store) Script(user string) (*Script, error) {
+	src, err := st.Source(user)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(strings.NewReader(src))
+}
+
+// Put validates and sets the script of a user. Invalid scripts are rejected
+// with a *SyntaxError.
+func (st *Store) Put(user, src string) error {
+	path, err := st.path(user)
+	if err != nil {
+		return err
+	}
+	if len(src) > maxScriptSize {
+		return errScriptTooLarge
+	}
+	if _, err := Parse(strings.NewReader(src)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(st.Dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(st.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Delete removes the script of a user.
+func (st *Store) Delete(user string) error {
+	path, err := st.path(user)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNoScript
+	}
+	return err
+}
+
+// ServeHTTP serves the script management API.
+func (st *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := strings.Trim(r.URL.Path, "/")
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var src string
+		if src, err = st.Source(user); err == nil {
+			w.Header().Set("Content-Type", "application/sieve; charset=utf-8")
+			w.Write([]byte(src))
+		}
+	case http.MethodPut:
+		var b []byte
+		b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxScriptSize))
+		if err != nil {
+			err = errScriptTooLarge
+		} else {
+			err = st.Put(user, string(b))
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		if err = st.Delete(user); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := err.(*SyntaxError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err == ErrNoScript {
+		http.NotFound(w, r)
+	} else if err == errInvalidUser {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err == errScriptTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -11,12 +11,18 @@
 //   - CHUNKING (RFC 3030)
 //   - BINARYMIME (RFC 3030)
 //   - DSN (RFC 3461, RFC 6533)
+//   - FUTURERELEASE (RFC 4865)
+//   - MT-PRIORITY (RFC 6710)
 //
 // LMTP (RFC 2033) is also supported.
 //
 // Additional extensions may be handled by other packages.
 package smtp
 
+import (
+	"time"
+)
+
 type BodyType string
 
 const (
@@ -64,8 +70,35 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// Amount of time the message should be held before being released for
+	// delivery (HOLDFOR= argument). Zero if not specified. The client rounds
+	// it up to whole seconds.
+	//
+	// Defined in RFC 4865.
+	HoldFor time.Duration
+
+	// Time until which the message should be held before being released for
+	// delivery (HOLDUNTIL= argument). Zero if not specified.
+	//
+	// Defined in RFC 4865.
+	HoldUntil time.Time
+
+	// Priority of the message (MT-PRIORITY= argument), between
+	// MinMTPriority and MaxMTPriority.
+	//
+	// nil value indicates missing MT-PRIORITY, which should be handled as
+	// the default priority 0.
+	//
+	// Defined in RFC 6710.
+	MTPriority *int
 }
 
+const (
+	MinMTPriority = -9
+	MaxMTPriority = 9
+)
+
 type DSNNotify string
 
 const (
@@ -0,0 +1,294 @@
+// Package srs implements the Sender Rewriting Scheme.
+//
+// SRS rewrites the reverse-path of forwarded messages so that they pass SPF
+// checks at the final destination, while still allowing bounces to be routed
+// back to the original sender. See
+// https://www.libsrs2.org/srs/srs.pdf for the specification.
+//
+// A Rewriter can be plugged into backendutil.TransformBackend: TransformMail
+// rewrites the reverse-path of outgoing messages and TransformRcpt decodes
+// bounces sent back to the SRS domain.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	prefix0   = "SRS0"
+	prefix1   = "SRS1"
+	separator = "="
+)
+
+// Alphabet used to encode timestamps, as defined by RFC 4648 section 6.
+const timestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// Timestamps are days, modulo 2 base32 characters.
+const (
+	timestampPrecision = 24 * time.Hour
+	timestampSlots     = 32 * 32
+)
+
+const (
+	defaultHashLength = 4
+	defaultMaxAge     = 21 * 24 * time.Hour
+)
+
+var (
+	// ErrNotSRS is returned by Rewriter.Reverse when an address hasn't been
+	// rewritten with SRS.
+	ErrNotSRS = errors.New("srs: not a SRS address")
+	// ErrMalformed is returned when a SRS address can't be parsed.
+	ErrMalformed = errors.New("srs: malformed address")
+	// ErrInvalidHash is returned when the hash of a SRS address doesn't
+	// match.
+	ErrInvalidHash = errors.New("srs: invalid hash")
+	// ErrExpired is returned when the timestamp of a SRS address is too old.
+	ErrExpired = errors.New("srs: address expired")
+)
+
+var errInvalidRcpt = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Invalid SRS address",
+}
+
+// Rewriter rewrites addresses with SRS.
+type Rewriter struct {
+	// Domain used in rewritten addresses. Bounces are sent to this domain.
+	Domain string
+	// Secrets used to compute hashes. The first secret is used to rewrite
+	// addresses, all secrets are accepted when decoding addresses. This
+	// allows secrets to be rotated.
+	Secrets [][]byte
+	// Number of base64 characters of the hash to keep. Defaults to 4.
+	HashLength int
+	// Maximum age of a rewritten address. Defaults to 21 days.
+	MaxAge time.Duration
+
+	now func() time.Time // for tests
+}
+
+func (rw *Rewriter) hashLength() int {
+	if rw.HashLength <= 0 {
+		return defaultHashLength
+	}
+	return rw.HashLength
+}
+
+func (rw *Rewriter) maxAge() time.Duration {
+	if rw.MaxAge <= 0 {
+		return defaultMaxAge
+	}
+	return rw.MaxAge
+}
+
+func (rw *Rewriter) timeNow() time.Time {
+	if rw.now != nil {
+		return rw.now()
+	}
+	return time.Now()
+}
+
+func computeHash(secret []byte, n int, fields ...string) string {
+	mac := hmac.New(sha1.New, secret)
+	for _, f := range fields {
+		mac.Write([]byte(strings.ToLower(f)))
+	}
+	h := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return h[:n]
+}
+
+func (rw *Rewriter) hash(fields ...string) (string, error) {
+	if len(rw.Secrets) == 0 {
+		return "", errors.New("srs: no secret configured")
+	}
+	return computeHash(rw.Secrets[0], rw.hashLength(), fields...), nil
+}
+
+func (rw *Rewriter) checkHash(hash string, fields ...string) error {
+	if len(hash) != rw.hashLength() {
+		return ErrInvalidHash
+	}
+	for _, secret := range rw.Secrets {
+		// Some MTAs don't preserve the case of local parts
+		want := computeHash(secret, len(hash), fields...)
+		if hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(want))) {
+			return nil
+		}
+	}
+	return ErrInvalidHash
+}
+
+func (rw *Rewriter) timestamp() string {
+	t := rw.timeNow().Unix() / int64(timestampPrecision/time.Second)
+	t %= timestampSlots
+	return string([]byte{timestampAlphabet[t>>5], timestampAlphabet[t&31]})
+}
+
+func (rw *Rewriter) checkTimestamp(ts string) error {
+	if len(ts) != 2 {
+		return ErrMalformed
+	}
+	var t int64
+	for _, ch := range strings.ToUpper(ts) {
+		i := strings.IndexRune(timestampAlphabet, ch)
+		if i < 0 {
+			return ErrMalformed
+		}
+		t = t<<5 | int64(i)
+	}
+
+	now := rw.timeNow().Unix() / int64(timestampPrecision/time.Second)
+	age := (now%timestampSlots - t + timestampSlots) % timestampSlots
+	if time.Duration(age)*timestampPrecision > rw.maxAge() {
+		return ErrExpired
+	}
+	return nil
+}
+
+func splitAddress(addr string) (local, domain string, err error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", ErrMalformed
+	}
+	return addr[:i], addr[i+1:], nil
+}
+
+// hasPrefix checks whether a local part starts with a SRS prefix followed by
+// a separator.
+func hasPrefix(local, prefix string) bool {
+	return len(local) > len(prefix) &&
+		strings.EqualFold(local[:len(prefix)], prefix) &&
+		local[len(prefix):len(prefix)+1] == separator
+}
+
+// IsSRS checks whether an address has been rewritten with SRS.
+func IsSRS(addr string) bool {
+	local, _, err := splitAddress(addr)
+	if err != nil {
+		return false
+	}
+	return hasPrefix(local, prefix0) || hasPrefix(local, prefix1)
+}
+
+// Forward rewrites an address with SRS.
+//
+// Regular addresses are rewritten to SRS0 addresses. Addresses already
+// rewritten by another forwarder are rewritten to SRS1 addresses, so that
+// bounces are routed to the first forwarder directly. Addresses at the
+// rewriter's domain are left untouched.
+func (rw *Rewriter) Forward(addr string) (string, error) {
+	local, domain, err := splitAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(domain, rw.Domain) {
+		return addr, nil
+	}
+
+	switch {
+	case hasPrefix(local, prefix0):
+		// SRS0=HHH=TT=domain=local@first -> SRS1=HHH=first==HHH=TT=domain=local
+		user := local[len(prefix0):]
+		hash, err := rw.hash(domain, user)
+		if err != nil {
+			return "", err
+		}
+		local = prefix1 + separator + hash + separator + domain + separator + user
+	case hasPrefix(local, prefix1):
+		// SRS1 addresses keep pointing to the first forwarder
+		parts := strings.SplitN(local[len(prefix1)+1:], separator, 3)
+		if len(parts) != 3 || parts[1] == "" {
+			return "", ErrMalformed
+		}
+		first, user := parts[1], parts[2]
+		hash, err := rw.hash(first, user)
+		if err != nil {
+			return "", err
+		}
+		local = prefix1 + separator + hash + separator + first + separator + user
+	default:
+		ts := rw.timestamp()
+		hash, err := rw.hash(ts, domain, local)
+		if err != nil {
+			return "", err
+		}
+		local = prefix0 + separator + hash + separator + ts + separator + domain + separator + local
+	}
+
+	return local + "@" + rw.Domain, nil
+}
+
+// Reverse decodes an address rewritten with Forward. ErrNotSRS is returned if
+// the address isn't a SRS address.
+//
+// SRS0 addresses are decoded to the original sender address. SRS1 addresses
+// are decoded to the SRS0 address at the first forwarder.
+func (rw *Rewriter) Reverse(addr string) (string, error) {
+	local, _, err := splitAddress(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case hasPrefix(local, prefix0):
+		parts := strings.SplitN(local[len(prefix0)+1:], separator, 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", ErrMalformed
+		}
+		hash, ts, domain, user := parts[0], parts[1], parts[2], parts[3]
+		if err := rw.checkHash(hash, ts, domain, user); err != nil {
+			return "", err
+		}
+		if err := rw.checkTimestamp(ts); err != nil {
+			return "", err
+		}
+		return user + "@" + domain, nil
+	case hasPrefix(local, prefix1):
+		parts := strings.SplitN(local[len(prefix1)+1:], separator, 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", ErrMalformed
+		}
+		hash, first, user := parts[0], parts[1], parts[2]
+		if err := rw.checkHash(hash, first, user); err != nil {
+			return "", err
+		}
+		return prefix0 + user + "@" + first, nil
+	default:
+		return "", ErrNotSRS
+	}
+}
+
+// TransformMail rewrites the reverse-path of a message. The null
+// reverse-path is left untouched. It can be used as
+// backendutil.TransformBackend.TransformMail.
+func (rw *Rewriter) TransformMail(from string) (string, error) {
+	if from == "" {
+		return from, nil
+	}
+	return rw.Forward(from)
+}
+
+// TransformRcpt decodes SRS recipients at the rewriter's domain, so that
+// bounces are delivered to the original sender. Other recipients are left
+// untouched. It can be used as backendutil.TransformBackend.TransformRcpt.
+func (rw *Rewriter) TransformRcpt(to string) (string, error) {
+	_, domain, err := splitAddress(to)
+	if err != nil || !strings.EqualFold(domain, rw.Domain) || !IsSRS(to) {
+		return to, nil
+	}
+
+	addr, err := rw.Reverse(to)
+	if err != nil {
+		return "", errInvalidRcpt
+	}
+	return addr, nil
+}
@@ -0,0 +1,186 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func testRewriter(domain string, now time.Time) *Rewriter {
+	return &Rewriter{
+		Domain:  domain,
+		Secrets: [][]byte{[]byte("secret")},
+		now:     func() time.Time { return now },
+	}
+}
+
+func TestRewriter_SRS0(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw := testRewriter("fwd.example", now)
+
+	addr, err := rw.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward() = %v", err)
+	}
+	if !strings.HasPrefix(addr, "SRS0=") || !strings.HasSuffix(addr, "=example.org=alice@fwd.example") {
+		t.Fatalf("Forward() = %q, want a SRS0 address", addr)
+	}
+	if !IsSRS(addr) {
+		t.Errorf("IsSRS(%q) = false", addr)
+	}
+
+	orig, err := rw.Reverse(addr)
+	if err != nil {
+		t.Fatalf("Reverse() = %v", err)
+	}
+	if orig != "alice@example.org" {
+		t.Errorf("Reverse() = %q, want %q", orig, "alice@example.org")
+	}
+
+	// Some MTAs lower-case local parts
+	if orig, err := rw.Reverse(strings.ToLower(addr)); err != nil || orig != "alice@example.org" {
+		t.Errorf("Reverse(lower-case) = %q, %v", orig, err)
+	}
+}
+
+func TestRewriter_SRS1(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw1 := testRewriter("fwd1.example", now)
+	rw2 := testRewriter("fwd2.example", now)
+	rw2.Secrets = [][]byte{[]byte("other secret")}
+	rw3 := testRewriter("fwd3.example", now)
+
+	srs0, err := rw1.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward() = %v", err)
+	}
+	srs1, err := rw2.Forward(srs0)
+	if err != nil {
+		t.Fatalf("Forward(SRS0) = %v", err)
+	}
+	user := strings.TrimPrefix(srs0[:strings.IndexByte(srs0, '@')], "SRS0")
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.HasSuffix(srs1, "=fwd1.example="+user+"@fwd2.example") {
+		t.Fatalf("Forward(SRS0) = %q, want a SRS1 address", srs1)
+	}
+
+	// A third forwarder keeps pointing to the first one
+	srs1bis, err := rw3.Forward(srs1)
+	if err != nil {
+		t.Fatalf("Forward(SRS1) = %v", err)
+	}
+	if !strings.HasSuffix(srs1bis, "=fwd1.example="+user+"@fwd3.example") {
+		t.Fatalf("Forward(SRS1) = %q", srs1bis)
+	}
+
+	back, err := rw2.Reverse(srs1)
+	if err != nil {
+		t.Fatalf("Reverse(SRS1) = %v", err)
+	}
+	if back != srs0 {
+		t.Errorf("Reverse(SRS1) = %q, want %q", back, srs0)
+	}
+	if _, err := rw1.Reverse(srs1); err != ErrInvalidHash {
+		t.Errorf("Reverse(SRS1) with wrong secret = %v, want %v", err, ErrInvalidHash)
+	}
+
+	orig, err := rw1.Reverse(back)
+	if err != nil {
+		t.Fatalf("Reverse(SRS0) = %v", err)
+	}
+	if orig != "alice@example.org" {
+		t.Errorf("Reverse(SRS0) = %q, want %q", orig, "alice@example.org")
+	}
+}
+
+func TestRewriter_Reverse_invalid(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw := testRewriter("fwd.example", now)
+
+	addr, err := rw.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward() = %v", err)
+	}
+
+	tests := []struct {
+		addr string
+		err  error
+	}{
+		{"alice@example.org", ErrNotSRS},
+		{"SRS0=abc@fwd.example", ErrMalformed},
+		{strings.Replace(addr, "=alice@", "=bob@", 1), ErrInvalidHash},
+		{"no-at-sign", ErrMalformed},
+	}
+	for _, tc := range tests {
+		if _, err := rw.Reverse(tc.addr); err != tc.err {
+			t.Errorf("Reverse(%q) = %v, want %v", tc.addr, err, tc.err)
+		}
+	}
+}
+
+func TestRewriter_Reverse_expired(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw := testRewriter("fwd.example", now)
+
+	addr, err := rw.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward() = %v", err)
+	}
+
+	now = now.Add(20 * 24 * time.Hour)
+	rw.now = func() time.Time { return now }
+	if _, err := rw.Reverse(addr); err != nil {
+		t.Errorf("Reverse() after 20 days = %v", err)
+	}
+
+	now = now.Add(2 * 24 * time.Hour)
+	if _, err := rw.Reverse(addr); err != ErrExpired {
+		t.Errorf("Reverse() after 22 days = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestRewriter_secretRotation(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw := testRewriter("fwd.example", now)
+
+	addr, err := rw.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward() = %v", err)
+	}
+
+	rw.Secrets = [][]byte{[]byte("new secret"), []byte("secret")}
+	if _, err := rw.Reverse(addr); err != nil {
+		t.Errorf("Reverse() with rotated secret = %v", err)
+	}
+}
+
+func TestRewriter_Transform(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	rw := testRewriter("fwd.example", now)
+
+	if from, err := rw.TransformMail(""); err != nil || from != "" {
+		t.Errorf("TransformMail(\"\") = %q, %v", from, err)
+	}
+	if from, err := rw.TransformMail("postmaster@FWD.example"); err != nil || from != "postmaster@FWD.example" {
+		t.Errorf("TransformMail(local) = %q, %v", from, err)
+	}
+
+	from, err := rw.TransformMail("alice@example.org")
+	if err != nil {
+		t.Fatalf("TransformMail() = %v", err)
+	}
+
+	to, err := rw.TransformRcpt(from)
+	if err != nil || to != "alice@example.org" {
+		t.Errorf("TransformRcpt(%q) = %q, %v", from, to, err)
+	}
+	if to, err := rw.TransformRcpt("bob@example.org"); err != nil || to != "bob@example.org" {
+		t.Errorf("TransformRcpt(non-SRS) = %q, %v", to, err)
+	}
+
+	_, err = rw.TransformRcpt("SRS0=xxxx=AA=example.org=alice@fwd.example")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("TransformRcpt(invalid) = %v, want a 550 error", err)
+	}
+}
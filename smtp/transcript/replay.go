@@ -0,0 +1,146 @@
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const defaultReplayTimeout = 5 * time.Second
+
+// Mismatch is a difference between a transcript and a replayed session.
+type Mismatch struct {
+	// Index of the entry in the transcript.
+	Index int
+	From  Direction
+	Want  string
+	Got   string
+}
+
+func (m *Mismatch) String() string {
+	return fmt.Sprintf("entry %v (%v): want %q, got %q", m.Index, m.From, m.Want, m.Got)
+}
+
+// Replayer replays transcripts.
+type Replayer struct {
+	// Maximum amount of time to wait for a line. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Compares a recorded line with a replayed line. If nil, lines must be
+	// equal. This can be used to ignore variable parts, e.g. dates or queue
+	// IDs.
+	Match func(want, got string) bool
+}
+
+func (r *Replayer) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultReplayTimeout
+	}
+	return r.Timeout
+}
+
+func (r *Replayer) match(want, got string) bool {
+	if r.Match != nil {
+		return r.Match(want, got)
+	}
+	return want == got
+}
+
+// replay plays the side of the transcript which isn't peer: lines sent by
+// the other side are written to conn, lines sent by peer are read from conn
+// and compared with the transcript.
+func (r *Replayer) replay(conn net.Conn, t *Transcript, peer Direction) ([]Mismatch, error) {
+	br := bufio.NewReader(conn)
+	var mismatches []Mismatch
+	for i, e := range t.Entries {
+		if e.From != peer {
+			if err := conn.SetWriteDeadline(time.Now().Add(r.timeout())); err != nil {
+				return mismatches, err
+			}
+			if _, err := io.WriteString(conn, e.Line+"\r\n"); err != nil {
+				return mismatches, fmt.Errorf("transcript: failed to write entry %v: %v", i, err)
+			}
+			continue
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(r.timeout())); err != nil {
+			return mismatches, err
+		}
+		line, err := br.ReadString('\n')
+		if err != nil {
+			mismatches = append(mismatches, Mismatch{Index: i, From: e.From, Want: e.Line})
+			return mismatches, fmt.Errorf("transcript: failed to read entry %v: %v", i, err)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if !r.match(e.Line, line) {
+			mismatches = append(mismatches, Mismatch{Index: i, From: e.From, Want: e.Line, Got: line})
+		}
+	}
+	return mismatches, nil
+}
+
+// ReplayServer plays the client side of a transcript against a server, and
+// returns the differences between the recorded and the actual server
+// replies. The server must not use implicit TLS, and sessions using STARTTLS
+// can't be replayed.
+func (r *Replayer) ReplayServer(s *smtp.Server, t *Transcript) ([]Mismatch, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return r.replay(conn, t, FromServer)
+}
+
+// ReplayClient plays the server side of a transcript against a client, and
+// returns the differences between the recorded and the actual client lines.
+// The client is connected to the fake server and passed to fn, which must
+// run the session.
+func (r *Replayer) ReplayClient(t *Transcript, fn func(c *smtp.Client) error) ([]Mismatch, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	type result struct {
+		mismatches []Mismatch
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		mismatches, err := r.replay(conn, t, FromClient)
+		done <- result{mismatches, err}
+	}()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	fnErr := fn(c)
+	c.Close()
+
+	res := <-done
+	if res.err != nil {
+		return res.mismatches, res.err
+	}
+	return res.mismatches, fnErr
+}
@@ -0,0 +1,203 @@
+// Package transcript records and replays SMTP session transcripts.
+//
+// A Recorder captures the lines exchanged on each connection of a
+// smtp.Server and saves them as JSON files. A Replayer feeds a transcript to
+// a smtp.Server or a smtp.Client and reports the differences between the
+// recorded and the actual responses. This allows sessions seen in the wild
+// to be turned into regression tests.
+package transcript
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Direction is the sender of a line.
+type Direction string
+
+const (
+	FromClient Direction = "client"
+	FromServer Direction = "server"
+)
+
+// Entry is a line of a transcript.
+type Entry struct {
+	// Time elapsed since the start of the session.
+	Elapsed time.Duration `json:"elapsed"`
+	From    Direction     `json:"from"`
+	// The line, without the line ending.
+	Line string `json:"line"`
+}
+
+// Transcript is the list of lines exchanged during a session.
+type Transcript struct {
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Start      time.Time `json:"start"`
+	Entries    []Entry   `json:"entries"`
+}
+
+// Read reads a JSON transcript.
+func Read(r io.Reader) (*Transcript, error) {
+	var t Transcript
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, fmt.Errorf("transcript: failed to decode transcript: %v", err)
+	}
+	return &t, nil
+}
+
+// ReadFile reads a JSON transcript from a file.
+func ReadFile(path string) (*Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// WriteTo writes the transcript as JSON.
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// Recorder records the transcripts of the sessions of a server.
+//
+// Its DebugConn method must be set as the server's DebugConn field:
+//
+//	rec := &transcript.Recorder{Dir: "transcripts"}
+//	s.DebugConn = rec.DebugConn
+type Recorder struct {
+	// Directory where transcripts are written, one JSON file per session.
+	Dir string
+	// If set, called with each transcript instead of writing it to Dir.
+	Save func(t *Transcript) error
+	// Logger used to report errors while saving transcripts. If nil, errors
+	// are not reported.
+	ErrorLog smtp.Logger
+
+	mutex sync.Mutex
+	n     uint64
+}
+
+func (rec *Recorder) save(t *Transcript) error {
+	if rec.Save != nil {
+		return rec.Save(t)
+	}
+
+	rec.mutex.Lock()
+	rec.n++
+	name := fmt.Sprintf("%v-%v.json", t.Start.UTC().Format("20060102T150405.000000000Z"), rec.n)
+	rec.mutex.Unlock()
+
+	f, err := os.Create(filepath.Join(rec.Dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := t.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DebugConn starts recording a session. It can be used as
+// smtp.Server.DebugConn.
+func (rec *Recorder) DebugConn(c *smtp.Conn) (in, out io.Writer) {
+	sr := &sessionRecorder{
+		rec: rec,
+		t:   &Transcript{Start: time.Now()},
+	}
+	if c.Conn() != nil {
+		sr.t.RemoteAddr = c.Conn().RemoteAddr().String()
+	}
+	sr.in = &lineWriter{sr: sr, from: FromClient}
+	sr.out = &lineWriter{sr: sr, from: FromServer}
+	return sr.in, sr.out
+}
+
+type sessionRecorder struct {
+	rec     *Recorder
+	in, out *lineWriter
+
+	mutex  sync.Mutex
+	t      *Transcript
+	closed int
+}
+
+func (sr *sessionRecorder) append(from Direction, line string) {
+	sr.t.Entries = append(sr.t.Entries, Entry{
+		Elapsed: time.Since(sr.t.Start),
+		From:    from,
+		Line:    line,
+	})
+}
+
+// lineWriter splits data into lines and appends them to the transcript.
+type lineWriter struct {
+	sr   *sessionRecorder
+	from Direction
+	buf  []byte
+	done bool
+}
+
+func (lw *lineWriter) Write(b []byte) (int, error) {
+	lw.sr.mutex.Lock()
+	defer lw.sr.mutex.Unlock()
+
+	if lw.done {
+		return len(b), nil
+	}
+
+	lw.buf = append(lw.buf, b...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(lw.buf[:i], []byte("\r"))
+		lw.sr.append(lw.from, string(line))
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Close flushes the last incomplete line. The transcript is saved once both
+// writers are closed.
+func (lw *lineWriter) Close() error {
+	lw.sr.mutex.Lock()
+	if lw.done {
+		lw.sr.mutex.Unlock()
+		return nil
+	}
+	lw.done = true
+	if len(lw.buf) > 0 {
+		lw.sr.append(lw.from, string(lw.buf))
+		lw.buf = nil
+	}
+	lw.sr.closed++
+	complete := lw.sr.closed == 2
+	lw.sr.mutex.Unlock()
+
+	if !complete {
+		return nil
+	}
+	err := lw.sr.rec.save(lw.sr.t)
+	if err != nil && lw.sr.rec.ErrorLog != nil {
+		lw.sr.rec.ErrorLog.Printf("failed to save transcript: %v", err)
+	}
+	return err
+}
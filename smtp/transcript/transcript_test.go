@@ -0,0 +1,210 @@
+package transcript
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+type backend struct {
+	rejectRcpt bool
+}
+
+func (be *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{be: be}, nil
+}
+
+type session struct {
+	be *backend
+}
+
+func (s *session) Reset()        {}
+func (s *session) Logout() error { return nil }
+
+func (s *session) AuthPlain(username, password string) error {
+	return errors.New("Invalid username or password")
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.be.rejectRcpt {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		}
+	}
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func newServer(be *backend) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	return s
+}
+
+func sendMail(c *smtp.Client) error {
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func record(t *testing.T) *Transcript {
+	var mutex sync.Mutex
+	var transcripts []*Transcript
+	rec := &Recorder{Save: func(t *Transcript) error {
+		mutex.Lock()
+		transcripts = append(transcripts, t)
+		mutex.Unlock()
+		return nil
+	}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(&backend{})
+	s.DebugConn = rec.DebugConn
+	go s.Serve(l)
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMail(c); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	c.Close()
+	s.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(transcripts) != 1 {
+		t.Fatalf("Invalid number of transcripts: %v", len(transcripts))
+	}
+	return transcripts[0]
+}
+
+func TestRecorder(t *testing.T) {
+	tr := record(t)
+
+	var lines []string
+	for _, e := range tr.Entries {
+		lines = append(lines, string(e.From)+": "+e.Line)
+	}
+	want := []string{
+		"server: 220 localhost ESMTP Service Ready",
+		"client: EHLO localhost",
+	}
+	if len(lines) < len(want) || lines[0] != want[0] || lines[1] != want[1] {
+		t.Fatalf("Invalid transcript:\n%v", strings.Join(lines, "\n"))
+	}
+	joined := strings.Join(lines, "\n")
+	for _, s := range []string{
+		"client: MAIL FROM:<root@nsa.gov>",
+		"client: Hey <3",
+		"client: .",
+		"client: QUIT",
+		"server: 221 2.0.0 Bye",
+	} {
+		if !strings.Contains(joined, s) {
+			t.Errorf("Transcript doesn't contain %q:\n%v", s, joined)
+		}
+	}
+	for i := 1; i < len(tr.Entries); i++ {
+		if tr.Entries[i].Elapsed < tr.Entries[i-1].Elapsed {
+			t.Errorf("Entry %v has a decreasing timestamp", i)
+		}
+	}
+}
+
+func TestRecorder_dir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp-transcript-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := &Recorder{Dir: dir}
+	tr := record(t)
+	if err := rec.save(tr); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Invalid transcript files: %v, %v", files, err)
+	}
+	loaded, err := ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	if len(loaded.Entries) != len(tr.Entries) || loaded.Entries[1] != tr.Entries[1] {
+		t.Errorf("Invalid loaded transcript: %+v", loaded)
+	}
+}
+
+func TestReplayer_ReplayServer(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := record(t).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+
+	var r Replayer
+
+	s := newServer(&backend{})
+	mismatches, err := r.ReplayServer(s, tr)
+	s.Close()
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("ReplayServer() = %v, %v", mismatches, err)
+	}
+
+	s = newServer(&backend{rejectRcpt: true})
+	mismatches, err = r.ReplayServer(s, tr)
+	s.Close()
+	if len(mismatches) == 0 {
+		t.Fatalf("ReplayServer() = %v, %v, want mismatches", mismatches, err)
+	}
+	if m := mismatches[0]; m.From != FromServer || m.Want != "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this" || !strings.HasPrefix(m.Got, "550 5.1.1") {
+		t.Errorf("Invalid mismatch: %v", m.String())
+	}
+}
+
+func TestReplayer_ReplayClient(t *testing.T) {
+	tr := record(t)
+
+	var r Replayer
+	mismatches, err := r.ReplayClient(tr, sendMail)
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("ReplayClient() = %v, %v", mismatches, err)
+	}
+
+	mismatches, _ = r.ReplayClient(tr, func(c *smtp.Client) error {
+		return c.SendMail("other@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n"))
+	})
+	if len(mismatches) == 0 || mismatches[0].Got != "MAIL FROM:<other@nsa.gov> BODY=8BITMIME" {
+		t.Errorf("ReplayClient() = %v, want a MAIL mismatch", mismatches)
+	}
+}